@@ -0,0 +1,201 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jaliph/auto-dm/database"
+	"github.com/jaliph/auto-dm/models"
+	"github.com/jaliph/auto-dm/utils"
+)
+
+// defaultAuditLimit caps JSON listings that don't ask for a limit. Exports return everything.
+const defaultAuditLimit = 100
+
+// proxyUserHeaders carry the user authenticated by a reverse proxy in front of the API
+var proxyUserHeaders = []string{"X-Forwarded-User", "X-Auth-Request-User", "X-Remote-User"}
+
+// auditActor identifies who made a request. The API has no authentication of
+// its own, so this is the user named by an authenticating proxy, or else a
+// fingerprint of the API key the client sent, or "anonymous".
+func auditActor(r *http.Request) string {
+	for _, header := range proxyUserHeaders {
+		if user := r.Header.Get(header); user != "" {
+			return "user:" + user
+		}
+	}
+
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	if key != "" {
+		// Only a fingerprint is kept so the audit log never holds usable keys
+		sum := sha256.Sum256([]byte(key))
+		return "key:" + hex.EncodeToString(sum[:4])
+	}
+	return "anonymous"
+}
+
+// sourceIP returns the client address, preferring the one reported by a proxy
+func sourceIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		client, _, _ := strings.Cut(forwarded, ",")
+		return strings.TrimSpace(client)
+	}
+	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		return realIP
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// audit appends an action taken through the API to the audit log. A nil err
+// records a success. Failing to write the entry is logged but never fails the request.
+func (h *Handler) audit(r *http.Request, entry models.AuditEntry, err error) {
+	entry.Timestamp = time.Now()
+	entry.Actor = auditActor(r)
+	entry.RequestID = utils.RequestIDFromContext(r.Context())
+	entry.SourceIP = sourceIP(r)
+	entry.Outcome = "success"
+	if err != nil {
+		entry.Outcome = "failure"
+		entry.Error = err.Error()
+	}
+
+	if err := h.gormDB.StoreAuditEntry(&entry); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to write audit entry", "action", entry.Action, "sender", entry.SenderPhone, "error", err)
+	}
+}
+
+// HandleGetAudit handles the /audit API endpoint. Entries can be filtered by
+// actor, action, sender, target, message_id, request_id, outcome, from and to,
+// and exported with format=csv or format=jsonl.
+func (h *Handler) HandleGetAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseAuditFilter(r)
+	if err != nil {
+		response := models.APIResponse{
+			Status: "error",
+			Error:  fmt.Sprintf("Invalid audit request: %v", err),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	entries, err := h.gormDB.GetAuditEntries(filter)
+	if err != nil {
+		response := models.APIResponse{
+			Status: "error",
+			Error:  fmt.Sprintf("Failed to get audit log: %v", err),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "csv":
+		writeAuditCSV(w, entries)
+	case "jsonl":
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+		encoder := json.NewEncoder(w)
+		for _, entry := range entries {
+			encoder.Encode(entry)
+		}
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	}
+}
+
+// parseAuditFilter reads the /audit query parameters
+func parseAuditFilter(r *http.Request) (database.AuditFilter, error) {
+	query := r.URL.Query()
+	filter := database.AuditFilter{
+		Actor:       query.Get("actor"),
+		Action:      query.Get("action"),
+		SenderPhone: query.Get("sender"),
+		Target:      query.Get("target"),
+		MessageID:   query.Get("message_id"),
+		RequestID:   query.Get("request_id"),
+		Outcome:     query.Get("outcome"),
+	}
+
+	if from := query.Get("from"); from != "" {
+		t, _, err := parseStatsTime(from, time.UTC)
+		if err != nil {
+			return filter, fmt.Errorf("invalid from: %s", from)
+		}
+		filter.From = t
+	}
+	if to := query.Get("to"); to != "" {
+		t, dateOnly, err := parseStatsTime(to, time.UTC)
+		if err != nil {
+			return filter, fmt.Errorf("invalid to: %s", to)
+		}
+		if dateOnly {
+			t = t.AddDate(0, 0, 1)
+		}
+		filter.To = t
+	}
+
+	format := query.Get("format")
+	if format == "" || format == "json" {
+		filter.Limit = defaultAuditLimit
+	}
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return filter, fmt.Errorf("invalid limit: %s", limit)
+		}
+		filter.Limit = n
+	}
+	return filter, nil
+}
+
+// writeAuditCSV writes audit entries as a CSV download
+func writeAuditCSV(w http.ResponseWriter, entries []models.AuditEntry) {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"id", "timestamp", "actor", "action", "sender_phone", "target", "message_type", "message_id", "request_id", "source_ip", "outcome", "error"})
+	for _, entry := range entries {
+		writer.Write([]string{
+			strconv.FormatUint(uint64(entry.ID), 10),
+			entry.Timestamp.Format(time.RFC3339),
+			entry.Actor,
+			entry.Action,
+			entry.SenderPhone,
+			entry.Target,
+			entry.MessageType,
+			entry.MessageID,
+			entry.RequestID,
+			entry.SourceIP,
+			entry.Outcome,
+			entry.Error,
+		})
+	}
+	writer.Flush()
+}
@@ -0,0 +1,152 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jaliph/auto-dm/backup"
+	"github.com/jaliph/auto-dm/models"
+)
+
+// restoreResponse reports a staged restore or a dry run
+type restoreResponse struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	*backup.RestoreResult
+}
+
+// authorizeBackup checks the caller of a backup endpoint against the backup
+// token, or requires a local caller when none is configured, and writes the
+// error response if the caller is refused
+func (h *Handler) authorizeBackup(w http.ResponseWriter, r *http.Request) bool {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	err := h.backupManager.Authorize(token, isLocalRequest(r))
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, backup.ErrNotLocal):
+		writeError(w, http.StatusForbidden, "The backup API is only available from the same host unless BACKUP_TOKEN or [backup] token is set")
+	default:
+		writeError(w, http.StatusUnauthorized, "Invalid or missing backup token")
+	}
+	slog.WarnContext(r.Context(), "Refused backup API caller", "remote_addr", r.RemoteAddr, "path", r.URL.Path, "error", err)
+	return false
+}
+
+// isLocalRequest reports whether a request comes from a loopback address
+func isLocalRequest(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	addr, err := netip.ParseAddr(host)
+	return err == nil && addr.Unmap().IsLoopback()
+}
+
+// bodyTooLarge reports whether reading a body wrapped in http.MaxBytesReader
+// stopped at its limit. The reader keeps returning its error once it is hit.
+func bodyTooLarge(body io.Reader) bool {
+	_, err := body.Read(make([]byte, 1))
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// HandleBackup handles POST /admin/backup, streaming an encrypted archive of
+// the session stores, store.db and config.ini. A backup that fails halfway
+// ends the stream early, and the cut off archive fails to decrypt.
+func (h *Handler) HandleBackup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorizeBackup(w, r) {
+		return
+	}
+	if !h.backupManager.Enabled() {
+		writeError(w, http.StatusServiceUnavailable, "Backups through the API are encrypted, set BACKUP_PASSPHRASE or [backup] passphrase first")
+		return
+	}
+
+	name := fmt.Sprintf("auto-dm-backup-%s.tar.gz.enc", time.Now().UTC().Format("20060102-150405"))
+	auditEntry := models.AuditEntry{Action: models.AuditBackup, Target: name}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+
+	manifest, err := h.backupManager.Create(w)
+	h.audit(r, auditEntry, err)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Backup failed", "error", err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Backup downloaded", "archive", name, "files", len(manifest.Files))
+}
+
+// HandleRestore handles POST /admin/restore with an encrypted archive as the
+// body. The archive is verified and staged, then restored when the server
+// next starts, since the stores it replaces are open. With ?dry_run=true it is
+// only verified and the files it would restore are listed.
+func (h *Handler) HandleRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !h.authorizeBackup(w, r) {
+		return
+	}
+	if !h.backupManager.Enabled() {
+		writeError(w, http.StatusServiceUnavailable, "Restores through the API need encrypted archives, set BACKUP_PASSPHRASE or [backup] passphrase first")
+		return
+	}
+	maxSize := h.backupManager.MaxRestoreSize()
+	if r.ContentLength > maxSize {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Archive is larger than the %d MiB limit", maxSize>>20))
+		return
+	}
+	body := http.MaxBytesReader(w, r.Body, maxSize)
+	dryRun := false
+	if value := r.URL.Query().Get("dry_run"); value != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(value); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid dry_run, expected true or false")
+			return
+		}
+	}
+
+	target := "staged"
+	if dryRun {
+		target = "dry_run"
+	}
+	result, err := h.backupManager.Stage(body, dryRun)
+	h.audit(r, models.AuditEntry{Action: models.AuditRestore, Target: target}, err)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Rejected backup archive", "dry_run", dryRun, "error", err)
+		if bodyTooLarge(body) {
+			writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("Archive is larger than the %d MiB limit", maxSize>>20))
+			return
+		}
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid backup archive: %v", err))
+		return
+	}
+
+	response := restoreResponse{Status: "success", RestoreResult: result}
+	status := http.StatusOK
+	if dryRun {
+		response.Message = fmt.Sprintf("Archive verified, %d file(s) would be restored", len(result.Files))
+	} else {
+		response.Message = "Archive verified and staged, restart the server to restore it"
+		status = http.StatusAccepted
+		slog.InfoContext(r.Context(), "Backup staged for restore on the next start", "archive", backup.PendingRestorePath, "created_at", result.Manifest.CreatedAt)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
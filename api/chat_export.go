@@ -0,0 +1,432 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jaliph/auto-dm/models"
+	"github.com/jaliph/auto-dm/whatsapp"
+)
+
+var chatExportTemplate = template.Must(template.ParseFS(webAssets, "web/chat_export.html"))
+
+// txtTimeLayout is the timestamp layout of WhatsApp's "Export chat" text files
+const txtTimeLayout = "02/01/2006, 15:04"
+
+// mediaMessageTypes are shown as "<Media omitted>" in text exports, the way
+// WhatsApp exports a chat without media
+var mediaMessageTypes = map[string]bool{
+	"image":    true,
+	"video":    true,
+	"audio":    true,
+	"document": true,
+	"sticker":  true,
+	"contact":  true,
+	"contacts": true,
+}
+
+// chatExport describes one conversation export
+type chatExport struct {
+	ChatID     string
+	Sender     string // sender account the export is limited to, if any
+	From       time.Time
+	To         time.Time
+	Location   *time.Location
+	ExportedAt time.Time
+	names      map[string]string // display names by sender account and phone
+	h          *Handler
+}
+
+// chatExporter writes a conversation in one format
+type chatExporter interface {
+	begin(w io.Writer, export *chatExport) error
+	message(w io.Writer, export *chatExport, message *models.Message) error
+	end(w io.Writer, export *chatExport, count int) error
+}
+
+// chatExportFormats maps the format parameter to its content type, file
+// extension and exporter
+var chatExportFormats = map[string]struct {
+	contentType string
+	extension   string
+	newExporter func() chatExporter
+}{
+	"txt":  {"text/plain; charset=utf-8", "txt", func() chatExporter { return &txtChatExporter{} }},
+	"json": {"application/json", "json", func() chatExporter { return &jsonChatExporter{} }},
+	"csv":  {"text/csv", "csv", func() chatExporter { return &csvChatExporter{} }},
+	"html": {"text/html; charset=utf-8", "html", func() chatExporter { return &htmlChatExporter{} }},
+}
+
+// HandleExportChat handles the /chats/{chat_id}/export API endpoint. The chat
+// is streamed oldest first in the requested format, optionally limited to a
+// date range and one sender account.
+func (h *Handler) HandleExportChat(w http.ResponseWriter, r *http.Request) {
+	chatID, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/chats/"), "/")
+	if action != "export" || chatID == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	export, err := h.parseChatExport(r, chatID)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid export request: %v", err))
+		return
+	}
+
+	formatName := r.URL.Query().Get("format")
+	if formatName == "" {
+		formatName = "txt"
+	}
+	format, exists := chatExportFormats[formatName]
+	if !exists {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid format: %s (use txt, json, csv or html)", formatName))
+		return
+	}
+	exporter := format.newExporter()
+
+	// Headers are only sent with the first message, so a failing query can
+	// still be answered with an error
+	count := 0
+	begin := func() error {
+		fileName := strings.NewReplacer("@", "_", ".", "_").Replace(export.ChatID)
+		w.Header().Set("Content-Type", format.contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chat_%s.%s"`, fileName, format.extension))
+		return exporter.begin(w, export)
+	}
+
+	err = h.gormDB.EachChatMessage(export.ChatID, export.Sender, export.From, export.To, func(message *models.Message) error {
+		if count == 0 {
+			if err := begin(); err != nil {
+				return err
+			}
+		}
+		count++
+		return exporter.message(w, export, message)
+	})
+	if err != nil && count == 0 {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to export chat: %v", err))
+		return
+	}
+	if err != nil {
+		// The response has started, so the export can only be cut short
+		slog.ErrorContext(r.Context(), "Chat export failed", "chat", export.ChatID, "exported", count, "error", err)
+		return
+	}
+
+	if count == 0 {
+		if err := begin(); err != nil {
+			return
+		}
+	}
+	if err := exporter.end(w, export, count); err != nil {
+		slog.WarnContext(r.Context(), "Failed to finish chat export", "chat", export.ChatID, "error", err)
+		return
+	}
+	slog.InfoContext(r.Context(), "Exported chat", "chat", export.ChatID, "format", formatName, "messages", count)
+}
+
+// parseChatExport reads the chat, sender, range and timezone of an export.
+// Dates without a time are whole days in the chosen timezone.
+func (h *Handler) parseChatExport(r *http.Request, chatID string) (*chatExport, error) {
+	query := r.URL.Query()
+	jid, err := whatsapp.RecipientJID(chatID)
+	if err != nil {
+		return nil, err
+	}
+	export := &chatExport{
+		ChatID:     jid.String(),
+		Sender:     query.Get("sender"),
+		Location:   time.Local,
+		ExportedAt: time.Now(),
+		names:      make(map[string]string),
+		h:          h,
+	}
+
+	if tz := query.Get("tz"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone: %s", tz)
+		}
+		export.Location = loc
+	}
+	if from := query.Get("from"); from != "" {
+		t, _, err := parseStatsTime(from, export.Location)
+		if err != nil {
+			return nil, fmt.Errorf("invalid from: %s", from)
+		}
+		export.From = t
+	}
+	if to := query.Get("to"); to != "" {
+		t, dateOnly, err := parseStatsTime(to, export.Location)
+		if err != nil {
+			return nil, fmt.Errorf("invalid to: %s", to)
+		}
+		if dateOnly {
+			t = t.AddDate(0, 0, 1)
+		}
+		export.To = t
+	}
+	if !export.From.IsZero() && !export.To.IsZero() && !export.From.Before(export.To) {
+		return nil, fmt.Errorf("from must be before to")
+	}
+	return export, nil
+}
+
+// rangeText describes the date range of an export
+func (e *chatExport) rangeText() string {
+	const layout = "2006-01-02 15:04"
+	switch {
+	case e.From.IsZero() && e.To.IsZero():
+		return "all messages"
+	case e.From.IsZero():
+		return "messages before " + e.To.In(e.Location).Format(layout)
+	case e.To.IsZero():
+		return "messages since " + e.From.In(e.Location).Format(layout)
+	default:
+		return fmt.Sprintf("messages from %s to %s", e.From.In(e.Location).Format(layout), e.To.In(e.Location).Format(layout))
+	}
+}
+
+// authorName returns the name a message is shown under: the contact's name as
+// the sender account's session store knows it, or else their phone number
+func (e *chatExport) authorName(message *models.Message) string {
+	if message.IsFromMe {
+		return "+" + message.SenderPhone
+	}
+
+	key := message.RecipientPhone + "/" + message.SenderPhone
+	if name, cached := e.names[key]; cached {
+		return name
+	}
+
+	name := "+" + message.SenderPhone
+	contacts, err := e.h.userStoreManager.GetContactAttributes(message.RecipientPhone, message.SenderPhone)
+	if err == nil {
+		for _, contact := range contacts {
+			if candidate := firstNonEmpty(contact.FullName, contact.PushName, contact.BusinessName); candidate != "" {
+				name = candidate
+				break
+			}
+		}
+	}
+	e.names[key] = name
+	return name
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// transcriptText renders a message the way WhatsApp's chat export shows it
+func transcriptText(message *models.Message) string {
+	if message.RevokedAt != nil {
+		if message.IsFromMe {
+			return "You deleted this message"
+		}
+		return "This message was deleted"
+	}
+
+	var text string
+	switch {
+	case mediaMessageTypes[message.MessageType]:
+		text = "<Media omitted>"
+		if message.Payload != nil && message.Payload.Caption != "" {
+			text += "\n" + message.Payload.Caption
+		}
+	case message.MessageType == "location" && message.Payload != nil && message.Payload.Latitude != nil && message.Payload.Longitude != nil:
+		text = fmt.Sprintf("location: https://maps.google.com/?q=%f,%f", *message.Payload.Latitude, *message.Payload.Longitude)
+	case message.MessageType == "poll":
+		text = "POLL:\n" + message.Content
+		if message.Payload != nil {
+			for _, option := range message.Payload.PollOptions {
+				text += "\nOPTION: " + option
+			}
+		}
+	default:
+		text = message.Content
+	}
+
+	if message.EditedAt != nil {
+		text += " <This message was edited>"
+	}
+	return text
+}
+
+// reactionsText lists the reactions on a message, e.g. "👍 +919876543210"
+func reactionsText(message *models.Message) string {
+	reactions := make([]string, 0, len(message.Reactions))
+	for _, reaction := range message.Reactions {
+		reactions = append(reactions, reaction.Emoji+" +"+reaction.SenderPhone)
+	}
+	return strings.Join(reactions, "; ")
+}
+
+// txtChatExporter writes the layout of WhatsApp's "Export chat" without media
+type txtChatExporter struct{}
+
+func (x *txtChatExporter) begin(w io.Writer, export *chatExport) error {
+	return nil
+}
+
+func (x *txtChatExporter) message(w io.Writer, export *chatExport, message *models.Message) error {
+	_, err := fmt.Fprintf(w, "%s - %s: %s\n", message.Timestamp.In(export.Location).Format(txtTimeLayout), export.authorName(message), transcriptText(message))
+	return err
+}
+
+func (x *txtChatExporter) end(w io.Writer, export *chatExport, count int) error {
+	return nil
+}
+
+// jsonChatExporter writes a JSON array of the messages as the API returns them
+type jsonChatExporter struct {
+	encoder *json.Encoder
+	started bool
+}
+
+func (x *jsonChatExporter) begin(w io.Writer, export *chatExport) error {
+	x.encoder = json.NewEncoder(w)
+	_, err := io.WriteString(w, "[\n")
+	return err
+}
+
+func (x *jsonChatExporter) message(w io.Writer, export *chatExport, message *models.Message) error {
+	if x.started {
+		if _, err := io.WriteString(w, ","); err != nil {
+			return err
+		}
+	}
+	x.started = true
+	return x.encoder.Encode(message)
+}
+
+func (x *jsonChatExporter) end(w io.Writer, export *chatExport, count int) error {
+	_, err := io.WriteString(w, "]\n")
+	return err
+}
+
+// csvChatExporter writes one row per message
+type csvChatExporter struct {
+	writer *csv.Writer
+}
+
+func (x *csvChatExporter) begin(w io.Writer, export *chatExport) error {
+	x.writer = csv.NewWriter(w)
+	return x.writer.Write([]string{"timestamp", "author", "sender_phone", "recipient_phone", "direction", "message_type", "content", "media_url", "message_id", "parent_message_id", "edited_at", "revoked_at", "reactions"})
+}
+
+func (x *csvChatExporter) message(w io.Writer, export *chatExport, message *models.Message) error {
+	direction := "inbound"
+	if message.IsFromMe {
+		direction = "outbound"
+	}
+	formatOptional := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.In(export.Location).Format(time.RFC3339)
+	}
+
+	err := x.writer.Write([]string{
+		message.Timestamp.In(export.Location).Format(time.RFC3339),
+		export.authorName(message),
+		message.SenderPhone,
+		message.RecipientPhone,
+		direction,
+		message.MessageType,
+		message.Content,
+		message.MediaURL,
+		message.MessageID,
+		message.ParentMessageID,
+		formatOptional(message.EditedAt),
+		formatOptional(message.RevokedAt),
+		reactionsText(message),
+	})
+	if err != nil {
+		return err
+	}
+	// Flush every row so the download streams instead of building up in the writer
+	x.writer.Flush()
+	return x.writer.Error()
+}
+
+func (x *csvChatExporter) end(w io.Writer, export *chatExport, count int) error {
+	x.writer.Flush()
+	return x.writer.Error()
+}
+
+// htmlChatExporter writes a readable transcript with links to media
+type htmlChatExporter struct{}
+
+func (x *htmlChatExporter) begin(w io.Writer, export *chatExport) error {
+	return chatExportTemplate.ExecuteTemplate(w, "header", map[string]string{
+		"ChatID":     export.ChatID,
+		"Sender":     export.Sender,
+		"Range":      export.rangeText(),
+		"ExportedAt": export.ExportedAt.In(export.Location).Format("2006-01-02 15:04 MST"),
+	})
+}
+
+func (x *htmlChatExporter) message(w io.Writer, export *chatExport, message *models.Message) error {
+	data := struct {
+		MessageID string
+		Name      string
+		Outbound  bool
+		Deleted   bool
+		MediaType string
+		FileName  string
+		MediaURL  template.URL
+		Text      string
+		Reactions string
+		Time      string
+		Edited    bool
+	}{
+		MessageID: message.MessageID,
+		Name:      export.authorName(message),
+		Outbound:  message.IsFromMe,
+		Deleted:   message.RevokedAt != nil,
+		Text:      message.Content,
+		Reactions: reactionsText(message),
+		Time:      message.Timestamp.In(export.Location).Format("2006-01-02 15:04"),
+		Edited:    message.EditedAt != nil,
+	}
+
+	switch {
+	case data.Deleted:
+		data.Text = transcriptText(message)
+	case mediaMessageTypes[message.MessageType]:
+		data.MediaType, data.Text = message.MessageType, ""
+		if message.Payload != nil {
+			data.FileName = message.Payload.FileName
+			data.Text = message.Payload.Caption
+		}
+		// Only web links are linked, sent files are stored with their local path
+		if strings.HasPrefix(message.MediaURL, "https://") {
+			data.MediaURL = template.URL(message.MediaURL)
+		} else if data.FileName == "" && message.MediaURL != "" {
+			data.FileName = message.Content
+		}
+	case message.MessageType == "location" || message.MessageType == "poll":
+		data.Text = transcriptText(message)
+	}
+	return chatExportTemplate.ExecuteTemplate(w, "message", data)
+}
+
+func (x *htmlChatExporter) end(w io.Writer, export *chatExport, count int) error {
+	return chatExportTemplate.ExecuteTemplate(w, "footer", map[string]int{"Count": count})
+}
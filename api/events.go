@@ -0,0 +1,285 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/jaliph/auto-dm/eventbus"
+	"github.com/jaliph/auto-dm/models"
+)
+
+// eventKeepAliveInterval keeps idle streams open through proxies
+const eventKeepAliveInterval = 15 * time.Second
+
+var eventUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// HandleEvents handles the /events API endpoint. It streams live events as
+// Server-Sent Events, or over a WebSocket when the request asks for an upgrade.
+func (h *Handler) HandleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter := eventbus.Filter{
+		Senders: splitQueryList(r.URL.Query().Get("sender")),
+		Types:   splitQueryList(r.URL.Query().Get("types")),
+	}
+
+	// EventSource sends Last-Event-ID on reconnect, other clients can pass it as a parameter
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+
+	var resumeFrom uint64
+	resume := lastEventID != ""
+	if resume {
+		id, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			response := models.APIResponse{
+				Status: "error",
+				Error:  fmt.Sprintf("Invalid last event ID: %s", lastEventID),
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		resumeFrom = id
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		h.streamEventsWebSocket(w, r, filter, resumeFrom, resume)
+		return
+	}
+	h.streamEventsSSE(w, r, filter, resumeFrom, resume)
+}
+
+// streamEventsSSE writes events as a text/event-stream until the client goes away
+func (h *Handler) streamEventsSSE(w http.ResponseWriter, r *http.Request, filter eventbus.Filter, lastEventID uint64, resume bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	sub, backlog := h.eventBus.Subscribe(filter, lastEventID, resume)
+	defer h.eventBus.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	for _, event := range backlog {
+		writeSSEEvent(r.Context(), w, event)
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event, ok := <-sub.Events:
+			if !ok {
+				// Dropped for falling behind, the client reconnects with Last-Event-ID
+				return
+			}
+			writeSSEEvent(r.Context(), w, event)
+			flusher.Flush()
+
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeSSEEvent writes one event in the Server-Sent Events format
+func writeSSEEvent(ctx context.Context, w http.ResponseWriter, event models.Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to encode event", "event_id", event.ID, "sender", event.Sender, "error", err)
+		return
+	}
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+}
+
+// streamEventsWebSocket writes events as JSON messages over a WebSocket until either side closes it
+func (h *Handler) streamEventsWebSocket(w http.ResponseWriter, r *http.Request, filter eventbus.Filter, lastEventID uint64, resume bool) {
+	conn, err := eventUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Failed to upgrade event stream to WebSocket", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	sub, backlog := h.eventBus.Subscribe(filter, lastEventID, resume)
+	defer h.eventBus.Unsubscribe(sub)
+
+	// The stream is one-way, reading only notices when the client closes it
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, event := range backlog {
+		if err := conn.WriteJSON(event); err != nil {
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event, ok := <-sub.Events:
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "subscriber fell behind"))
+				return
+			}
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+
+		case <-keepAlive.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(eventKeepAliveInterval)); err != nil {
+				return
+			}
+
+		case <-closed:
+			return
+		}
+	}
+}
+
+// HandleQRCodeEvents handles the /qr/{token}/events API endpoint. It streams the
+// rotating codes and status changes of one QR session as Server-Sent Events,
+// with each code rendered as a PNG, and ends once the session is linked or expired.
+func (h *Handler) HandleQRCodeEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/qr/"), "/events")
+	session, exists := h.qrManager.GetSession(token)
+	if !exists {
+		response := models.QRCodeResponse{
+			Status: "error",
+			Error:  "QR code not found: session not found",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// Subscribe before reading the current state so no change is missed in between
+	sub, _ := h.eventBus.Subscribe(eventbus.Filter{
+		Senders: []string{session.Phone},
+		Types:   []string{models.EventQR},
+	}, 0, false)
+	defer h.eventBus.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	state := session.State()
+	h.writeQRState(r.Context(), w, state)
+	flusher.Flush()
+	if state.Status != "pending" {
+		return
+	}
+
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event, ok := <-sub.Events:
+			if !ok {
+				return
+			}
+
+			var state models.QREvent
+			if err := json.Unmarshal(event.Data, &state); err != nil || state.Token != token {
+				continue
+			}
+			h.writeQRState(r.Context(), w, &state)
+			flusher.Flush()
+			if state.Status != "pending" {
+				return
+			}
+
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeQRState writes the state of a QR session as a "qr" event, replacing the code with its PNG
+func (h *Handler) writeQRState(ctx context.Context, w http.ResponseWriter, state *models.QREvent) {
+	if state.QRCode != "" {
+		png, err := h.qrManager.GetQRCodePNGBase64(state.QRCode)
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to generate PNG for QR code", "error", err)
+		}
+		state.QRCodePNG = png
+		state.QRCode = ""
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to encode QR state", "error", err)
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", models.EventQR, data)
+}
+
+// splitQueryList splits a comma-separated query parameter, ignoring empty entries
+func splitQueryList(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
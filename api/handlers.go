@@ -2,11 +2,11 @@ package api
 
 import (
 	"context"
-	"crypto/rand"
-	"encoding/hex"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -14,7 +14,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/jaliph/auto-dm/backup"
 	"github.com/jaliph/auto-dm/database"
+	"github.com/jaliph/auto-dm/eventbus"
 	"github.com/jaliph/auto-dm/models"
 	"github.com/jaliph/auto-dm/store"
 	"github.com/jaliph/auto-dm/whatsapp"
@@ -27,22 +29,26 @@ type Handler struct {
 	db               *database.Database
 	clientManager    *whatsapp.ClientManager
 	qrManager        *whatsapp.QRManager
+	eventBus         *eventbus.Bus
 	baseURL          string
 	qrExpiryMinutes  int
 	fileShareFolder  string
+	backupManager    *backup.Manager
 }
 
 // NewHandler creates a new API handler
-func NewHandler(userStoreManager *store.UserStoreManager, gormDB *database.GormDB, db *database.Database, clientManager *whatsapp.ClientManager, qrManager *whatsapp.QRManager, baseURL string, qrExpiryMinutes int, fileShareFolder string) *Handler {
+func NewHandler(userStoreManager *store.UserStoreManager, gormDB *database.GormDB, db *database.Database, clientManager *whatsapp.ClientManager, qrManager *whatsapp.QRManager, eventBus *eventbus.Bus, baseURL string, qrExpiryMinutes int, fileShareFolder string, backupManager *backup.Manager) *Handler {
 	return &Handler{
 		userStoreManager: userStoreManager,
 		gormDB:           gormDB,
 		db:               db,
 		clientManager:    clientManager,
 		qrManager:        qrManager,
+		eventBus:         eventBus,
 		baseURL:          baseURL,
 		qrExpiryMinutes:  qrExpiryMinutes,
 		fileShareFolder:  fileShareFolder,
+		backupManager:    backupManager,
 	}
 }
 
@@ -88,6 +94,7 @@ func (h *Handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 
 	// Create QR code session with context
 	session, err := h.qrManager.CreateQRCodeSessionWithContext(r.Context(), request.Phone, h.baseURL, h.qrExpiryMinutes)
+	h.audit(r, models.AuditEntry{Action: models.AuditRegister, SenderPhone: request.Phone, Target: request.Phone}, err)
 	if err != nil {
 		// Check if context was cancelled
 		if r.Context().Err() != nil {
@@ -105,6 +112,15 @@ func (h *Handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 			json.NewEncoder(w).Encode(response)
 			return
 		}
+		if strings.Contains(err.Error(), "is paused") {
+			response := models.APIResponse{
+				Status: "error",
+				Error:  fmt.Sprintf("Sender %s is paused, resume it with POST /senders/%s/resume", request.Phone, request.Phone),
+			}
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
 
 		response := models.APIResponse{
 			Status: "error",
@@ -131,10 +147,8 @@ func (h *Handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 
 // HandleGetQRCode handles the /qr/{token} API endpoint
 func (h *Handler) HandleGetQRCode(w http.ResponseWriter, r *http.Request) {
-	log.Printf("DEBUG: HandleGetQRCode called with path: %s", r.URL.Path)
 
 	if r.Method != "GET" {
-		log.Printf("DEBUG: Invalid method: %s", r.Method)
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
@@ -142,25 +156,22 @@ func (h *Handler) HandleGetQRCode(w http.ResponseWriter, r *http.Request) {
 	// Extract token from URL path
 	// Assuming URL pattern is /qr/{token}
 	path := r.URL.Path
-	log.Printf("DEBUG: Path length: %d", len(path))
 	if len(path) < 5 { // /qr/ is 4 characters
-		log.Printf("DEBUG: Path too short: %s", path)
 		http.Error(w, "Invalid QR code URL", http.StatusBadRequest)
 		return
 	}
 	token := path[4:] // Remove /qr/ prefix
-	log.Printf("DEBUG: Extracted token: %s", token)
 
 	// Check if HTML response is requested
 	format := r.URL.Query().Get("format")
-	log.Printf("DEBUG: Format parameter: %s", format)
+	if format == "html" {
+		h.serveQRPage(w, r, token)
+		return
+	}
 
 	// Get QR code session with context
-	log.Printf("DEBUG: Calling qrManager.GetQRCodeWithContext with token: %s", token)
 	session, err := h.qrManager.GetQRCodeWithContext(r.Context(), token)
-	log.Printf("DEBUG: GetQRCodeWithContext returned err: %v", err)
 	if err != nil {
-		log.Printf("DEBUG: Error type: %T, Error message: %s", err, err.Error())
 
 		// Check if context was cancelled
 		if r.Context().Err() != nil {
@@ -170,7 +181,6 @@ func (h *Handler) HandleGetQRCode(w http.ResponseWriter, r *http.Request) {
 
 		// Check if the error is due to expired session
 		if strings.Contains(err.Error(), "QR code session expired") {
-			log.Printf("DEBUG: Detected expired session error")
 			response := models.QRCodeResponse{
 				Status:  "error",
 				Error:   "QR code session expired",
@@ -179,12 +189,10 @@ func (h *Handler) HandleGetQRCode(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusGone)
 			json.NewEncoder(w).Encode(response)
-			log.Printf("DEBUG: Sent expired response")
 			return
 		}
 
 		// Handle other errors (session not found, etc.)
-		log.Printf("DEBUG: Handling other error type")
 		response := models.QRCodeResponse{
 			Status:  "error",
 			Error:   fmt.Sprintf("QR code not found: %v", err),
@@ -193,16 +201,11 @@ func (h *Handler) HandleGetQRCode(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode(response)
-		log.Printf("DEBUG: Sent not found response")
 		return
 	}
 
 	// Check if authenticated
 	if session.Status == "authenticated" {
-		if format == "html" {
-			h.sendHTMLResponse(w, "Already Authenticated", "This phone number is already authenticated.", "", false)
-			return
-		}
 		response := models.QRCodeResponse{
 			Status:  "success",
 			Error:   "Phone number already authenticated",
@@ -217,11 +220,7 @@ func (h *Handler) HandleGetQRCode(w http.ResponseWriter, r *http.Request) {
 	// Generate PNG image for QR code
 	qrCodePNG, err := h.qrManager.GetQRCodePNGBase64(session.QRCode)
 	if err != nil {
-		log.Printf("DEBUG: Failed to generate PNG for QR code: %v", err)
-		if format == "html" {
-			h.sendHTMLResponse(w, "QR Code Error", "Failed to generate QR code image. Please try again.", "", true)
-			return
-		}
+		slog.WarnContext(r.Context(), "Failed to generate PNG for QR code", "error", err)
 		// Fallback to text QR code
 		response := models.QRCodeResponse{
 			Status:  "success",
@@ -234,12 +233,6 @@ func (h *Handler) HandleGetQRCode(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check if HTML response is requested
-	if format == "html" {
-		h.sendHTMLResponse(w, "QR Code Ready", "Scan the QR code below with your WhatsApp app to authenticate.", qrCodePNG, false)
-		return
-	}
-
 	// Return QR code with PNG image
 	response := models.QRCodeResponse{
 		Status:    "success",
@@ -273,11 +266,25 @@ func (h *Handler) HandleGetSenders(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Add the live connection and lifecycle state of each sender's client
+	for i := range senders {
+		if client, exists := h.userStoreManager.GetUserClient(senders[i].Phone); exists {
+			senders[i].Connected = client.IsConnected()
+		}
+		if state, exists := h.userStoreManager.SenderState(senders[i].Phone); exists {
+			senders[i].ClientState = string(state)
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(senders)
 }
 
-// HandleDeleteSender handles the /senders/{phone} DELETE API endpoint
+// HandleDeleteSender handles the /senders/{phone} DELETE API endpoint. By
+// default the sender's device is unlinked from their phone and their session
+// store deleted along with the sender; with ?purge_messages=true their
+// messages are deleted too. A sender whose device cannot be unlinked is kept
+// unless ?force=true is set. With ?mode=soft the sender is only paused.
 func (h *Handler) HandleDeleteSender(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "DELETE" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -304,9 +311,52 @@ func (h *Handler) HandleDeleteSender(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = models.DeleteSenderHard
+	}
+	if mode != models.DeleteSenderHard && mode != models.DeleteSenderSoft {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid mode %q, expected %s or %s", mode, models.DeleteSenderHard, models.DeleteSenderSoft))
+		return
+	}
+	purge := false
+	if value := r.URL.Query().Get("purge_messages"); value != "" {
+		var err error
+		if purge, err = strconv.ParseBool(value); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid purge_messages, expected true or false")
+			return
+		}
+	}
+	if purge && mode == models.DeleteSenderSoft {
+		writeError(w, http.StatusBadRequest, "purge_messages needs mode=hard, a paused sender keeps its messages")
+		return
+	}
+	force := false
+	if value := r.URL.Query().Get("force"); value != "" {
+		var err error
+		if force, err = strconv.ParseBool(value); err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid force, expected true or false")
+			return
+		}
+	}
+	if force && mode == models.DeleteSenderSoft {
+		writeError(w, http.StatusBadRequest, "force needs mode=hard, a paused sender stays linked")
+		return
+	}
+	if purge && !h.gormDB.Available() {
+		writeError(w, http.StatusServiceUnavailable, "MSSQL is unavailable, try again later")
+		return
+	}
+
+	auditEntry := models.AuditEntry{Action: models.AuditDeleteSender, SenderPhone: phone, Target: phone}
+	if mode == models.DeleteSenderSoft {
+		auditEntry.Action = models.AuditPauseSender
+	}
+
 	// Check if sender exists
-	_, err := h.db.GetSender(phone)
+	sender, err := h.db.GetSender(phone)
 	if err != nil {
+		h.audit(r, auditEntry, err)
 		response := models.APIResponse{
 			Status: "error",
 			Error:  fmt.Sprintf("Sender not found: %v", err),
@@ -317,11 +367,53 @@ func (h *Handler) HandleDeleteSender(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Disconnect the sender if they're connected
-	h.userStoreManager.DisconnectUser(phone)
+	response := models.DeleteSenderResponse{Status: "success", Mode: mode}
+	if mode == models.DeleteSenderSoft {
+		// A pending QR code would link the sender again
+		h.qrManager.RemoveSessionsForPhone(phone)
+		err := h.clientManager.PauseSender(phone)
+		h.audit(r, auditEntry, err)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to pause sender: %v", err))
+			return
+		}
+		response.Message = fmt.Sprintf("Sender %s paused, its device stays linked", phone)
+		if sender.DeviceID == "" {
+			response.Message = fmt.Sprintf("Sender %s paused, it has no linked device", phone)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Unlink the device from the phone and delete the session store
+	logout, err := h.userStoreManager.LogoutUser(r.Context(), phone, sender.DeviceID, force)
+	response.Unlinked, response.UnlinkError, response.Forced = logout.Unlinked, logout.UnlinkError, logout.Forced
+	if errors.Is(err, store.ErrUnlinkFailed) {
+		h.audit(r, auditEntry, err)
+		response.Status = "error"
+		response.Error = fmt.Sprintf("Failed to unlink the device, the sender was kept: %s. Remove the device on the phone under Linked devices, then delete again with force=true", logout.UnlinkError)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+	if err != nil {
+		h.audit(r, auditEntry, err)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to delete session store: %v", err))
+		return
+	}
+	if logout.Forced {
+		// Recorded on the successful entry, the device is still listed on the phone
+		auditEntry.Error = "deleted with force=true, the device was not unlinked: " + logout.UnlinkError
+	}
+
+	// Only once the sender is going away, a kept sender keeps its pending QR codes
+	h.qrManager.RemoveSessionsForPhone(phone)
 
 	// Delete sender from SQLite database
 	if err := h.db.DeleteSender(phone); err != nil {
+		h.audit(r, auditEntry, err)
 		response := models.APIResponse{
 			Status: "error",
 			Error:  fmt.Sprintf("Failed to delete sender: %v", err),
@@ -332,21 +424,72 @@ func (h *Handler) HandleDeleteSender(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Sync deletion to MSSQL
-	if err := h.gormDB.DeleteSender(phone); err != nil {
-		log.Printf("Warning: Failed to delete sender from MSSQL: %v", err)
-		// Don't return error as the main deletion succeeded
+	status := http.StatusOK
+	if purge {
+		purged, purgeErr := h.gormDB.PurgeSenderMessages(phone)
+		response.MessagesPurged = &purged
+		if _, err := h.eventBus.Remove(func(event models.Event) bool { return event.Sender == phone }); err != nil {
+			slog.WarnContext(r.Context(), "Failed to remove buffered events of deleted sender", "sender", phone, "error", err)
+		}
+		if purgeErr != nil {
+			err = purgeErr
+			response.Status = "error"
+			response.Error = purgeErr.Error()
+			status = http.StatusInternalServerError
+		}
 	}
+	h.audit(r, auditEntry, err)
 
-	response := models.APIResponse{
-		Status:  "success",
-		Message: fmt.Sprintf("Sender %s deleted successfully", phone),
+	switch {
+	case !logout.Linked:
+		response.Message = fmt.Sprintf("Sender %s deleted successfully, it had no linked device", phone)
+	case logout.Unlinked:
+		response.Message = fmt.Sprintf("Sender %s deleted successfully and unlinked from the phone", phone)
+	default:
+		response.Message = fmt.Sprintf("Sender %s deleted with force, but its device could not be unlinked, remove it on the phone under Linked devices", phone)
 	}
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(response)
 }
 
+// HandleResumeSender handles POST /senders/{phone}/resume, connecting a
+// sender paused with DELETE /senders/{phone}?mode=soft again
+func (h *Handler) HandleResumeSender(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	phone := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/senders/"), "/resume")
+
+	sender, err := h.db.GetSender(phone)
+	if err != nil {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("Sender not found: %v", err))
+		return
+	}
+	if sender.Status != "paused" {
+		writeError(w, http.StatusConflict, fmt.Sprintf("Sender %s is not paused", phone))
+		return
+	}
+	if sender.DeviceID == "" {
+		writeError(w, http.StatusConflict, fmt.Sprintf("Sender %s was never linked, register it again", phone))
+		return
+	}
+
+	err = h.clientManager.ResumeSender(phone)
+	h.audit(r, models.AuditEntry{Action: models.AuditResumeSender, SenderPhone: phone, Target: phone}, err)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to resume sender: %v", err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(models.APIResponse{
+		Status:  "success",
+		Message: fmt.Sprintf("Sender %s resumed", phone),
+	})
+}
+
 // HandleSendMessage handles the /send API endpoint
 func (h *Handler) HandleSendMessage(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
@@ -367,11 +510,19 @@ func (h *Handler) HandleSendMessage(w http.ResponseWriter, r *http.Request) {
 
 	// Parse JSON request body
 	var request struct {
-		Sender    string `json:"sender"`
-		Recipient string `json:"recipient"`
-		Message   string `json:"message"`
-		Type      string `json:"type"`      // "text" or "file"
-		FileName  string `json:"file_name"` // filename when type is "file"
+		Sender          string              `json:"sender"`
+		Recipient       string              `json:"recipient"`
+		Message         string              `json:"message"`
+		Type            string              `json:"type"`              // "text", "file", "location", "contact", "poll", "reaction", "edit" or "revoke"
+		FileName        string              `json:"file_name"`         // filename when type is "file"
+		ReplyTo         string              `json:"reply_to"`          // message ID to quote when type is "text"
+		Mentions        []string            `json:"mentions"`          // phone numbers to @mention when type is "text"
+		LinkPreview     bool                `json:"link_preview"`      // attach a preview of the first link when type is "text"
+		Location        *models.Location    `json:"location"`          // location when type is "location"
+		Contact         *models.ContactCard `json:"contact"`           // contact card fields when type is "contact"
+		Poll            *models.PollRequest `json:"poll"`              // poll when type is "poll"
+		TargetMessageID string              `json:"target_message_id"` // message ID for "reaction", "edit" and "revoke"
+		Reaction        string              `json:"reaction"`          // emoji when type is "reaction", empty removes it
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
@@ -384,20 +535,33 @@ func (h *Handler) HandleSendMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate required fields
-	if request.Sender == "" || request.Recipient == "" {
+	// Validate message type
+	if request.Type == "" {
+		request.Type = "text" // default to text
+	}
+
+	isTargeted := request.Type == "reaction" || request.Type == "edit" || request.Type == "revoke"
+	switch request.Type {
+	case "text", "file", "location", "contact", "poll", "reaction", "edit", "revoke":
+	default:
 		response := models.APIResponse{
 			Status: "error",
-			Error:  "Missing required fields: sender, recipient",
+			Error:  fmt.Sprintf("Unsupported message type: %s", request.Type),
 		}
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(response)
 		return
 	}
 
-	// Validate message type
-	if request.Type == "" {
-		request.Type = "text" // default to text
+	// Validate required fields (targeted types take the chat from the original message)
+	if request.Sender == "" || (request.Recipient == "" && !isTargeted) {
+		response := models.APIResponse{
+			Status: "error",
+			Error:  "Missing required fields: sender, recipient",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
 	}
 
 	if request.Type == "text" && request.Message == "" {
@@ -410,6 +574,16 @@ func (h *Handler) HandleSendMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if missing := whatsapp.MissingMentions(request.Message, request.Mentions); request.Type == "text" && len(missing) > 0 {
+		response := models.APIResponse{
+			Status: "error",
+			Error:  fmt.Sprintf("Mentioned numbers must appear in the message as @<phone>, missing @%s", strings.Join(missing, ", @")),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
 	if request.Type == "file" && request.FileName == "" {
 		response := models.APIResponse{
 			Status: "error",
@@ -420,9 +594,111 @@ func (h *Handler) HandleSendMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if request.Type == "location" && request.Location == nil {
+		response := models.APIResponse{
+			Status: "error",
+			Error:  "Location is required for location type",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if request.Type == "location" && (request.Location.Latitude < -90 || request.Location.Latitude > 90 ||
+		request.Location.Longitude < -180 || request.Location.Longitude > 180) {
+		response := models.APIResponse{
+			Status: "error",
+			Error:  "Latitude must be between -90 and 90 and longitude between -180 and 180",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if request.Type == "contact" && (request.Contact == nil || request.Contact.Name == "" || request.Contact.Phone == "") {
+		response := models.APIResponse{
+			Status: "error",
+			Error:  "Contact name and phone are required for contact type",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if request.Type == "poll" && (request.Poll == nil || request.Poll.Question == "" || len(request.Poll.Options) < 2 || len(request.Poll.Options) > 12) {
+		response := models.APIResponse{
+			Status: "error",
+			Error:  "Poll question and 2 to 12 options are required for poll type",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if request.Type == "edit" && request.Message == "" {
+		response := models.APIResponse{
+			Status: "error",
+			Error:  "Message is required for edit type",
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if isTargeted && request.TargetMessageID == "" {
+		response := models.APIResponse{
+			Status: "error",
+			Error:  fmt.Sprintf("Target message ID is required for %s type", request.Type),
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// Look up the message being replied to, reacted to, edited or revoked
+	var original *models.Message
+	if originalID := request.TargetMessageID; isTargeted || request.ReplyTo != "" {
+		if !isTargeted {
+			originalID = request.ReplyTo
+		}
+
+		message, err := h.gormDB.GetMessageByMessageID(originalID)
+		if err != nil || (message.SenderPhone != request.Sender && message.RecipientPhone != request.Sender) {
+			response := models.APIResponse{
+				Status: "error",
+				Error:  fmt.Sprintf("Message %s not found for sender %s", originalID, request.Sender),
+			}
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+
+		if (request.Type == "edit" || request.Type == "revoke") && !message.IsFromMe {
+			response := models.APIResponse{
+				Status: "error",
+				Error:  fmt.Sprintf("Only messages sent by %s can be edited or revoked", request.Sender),
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(response)
+			return
+		}
+		original = message
+	}
+
+	auditEntry := models.AuditEntry{
+		Action:      models.AuditSend,
+		SenderPhone: request.Sender,
+		Target:      request.Recipient,
+		MessageType: request.Type,
+	}
+	if original != nil && isTargeted {
+		auditEntry.Target = original.ChatID
+	}
+
 	// Check if sender is registered and active
 	client, exists := h.userStoreManager.GetUserClient(request.Sender)
 	if !exists {
+		h.audit(r, auditEntry, fmt.Errorf("sender %s is not registered", request.Sender))
 		response := models.APIResponse{
 			Status: "error",
 			Error:  fmt.Sprintf("Sender %s is not registered", request.Sender),
@@ -433,6 +709,7 @@ func (h *Handler) HandleSendMessage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if !client.IsConnected() {
+		h.audit(r, auditEntry, fmt.Errorf("sender %s is not connected", request.Sender))
 		response := models.APIResponse{
 			Status: "error",
 			Error:  fmt.Sprintf("Sender %s is not connected", request.Sender),
@@ -443,13 +720,35 @@ func (h *Handler) HandleSendMessage(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Send the message or file with context
+	var messageID string
 	var err error
-	if request.Type == "file" {
-		err = h.sendFileWithContext(r.Context(), request.Sender, request.Recipient, request.FileName)
-	} else {
-		err = h.sendMessageWithContext(r.Context(), request.Sender, request.Recipient, request.Message)
+	switch request.Type {
+	case "file":
+		messageID, err = h.sendFileWithContext(r.Context(), request.Sender, request.Recipient, request.FileName)
+	case "location":
+		messageID, err = h.sendLocationWithContext(r.Context(), request.Sender, request.Recipient, request.Location)
+	case "contact":
+		messageID, err = h.sendContactWithContext(r.Context(), request.Sender, request.Recipient, request.Contact)
+	case "poll":
+		messageID, err = h.sendPollWithContext(r.Context(), request.Sender, request.Recipient, request.Poll)
+	case "reaction":
+		messageID, err = h.sendReactionWithContext(r.Context(), request.Sender, original, request.Reaction)
+	case "edit":
+		messageID, err = h.editMessageWithContext(r.Context(), request.Sender, original, request.Message)
+	case "revoke":
+		messageID, err = h.revokeMessageWithContext(r.Context(), request.Sender, original)
+	default:
+		opts := &whatsapp.SendTextOptions{
+			QuotedMessage: original,
+			Mentions:      request.Mentions,
+			LinkPreview:   request.LinkPreview,
+		}
+		messageID, err = h.sendMessageWithContext(r.Context(), request.Sender, request.Recipient, request.Message, opts)
 	}
 
+	auditEntry.MessageID = messageID
+	h.audit(r, auditEntry, err)
+
 	if err != nil {
 		// Check if context was cancelled
 		if r.Context().Err() != nil {
@@ -457,6 +756,13 @@ func (h *Handler) HandleSendMessage(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		h.eventBus.Publish(models.EventMessageStatus, request.Sender, &models.MessageStatusEvent{
+			Status:      "failed",
+			MessageType: request.Type,
+			Recipient:   request.Recipient,
+			Error:       err.Error(),
+		})
+
 		response := models.APIResponse{
 			Status: "error",
 			Error:  fmt.Sprintf("Failed to send %s: %v", request.Type, err),
@@ -466,99 +772,312 @@ func (h *Handler) HandleSendMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	response := models.APIResponse{
-		Status:  "success",
-		Message: "Message sent successfully",
+	response := models.SendMessageResponse{
+		Status:    "success",
+		Message:   "Message sent successfully",
+		MessageID: messageID,
 	}
 	json.NewEncoder(w).Encode(response)
 }
 
 // sendMessageWithContext sends a WhatsApp message with context support
-func (h *Handler) sendMessageWithContext(ctx context.Context, senderPhone, recipient, message string) error {
+func (h *Handler) sendMessageWithContext(ctx context.Context, senderPhone, recipient, message string, opts *whatsapp.SendTextOptions) (string, error) {
 	// Check if context is cancelled
 	select {
 	case <-ctx.Done():
-		return ctx.Err()
+		return "", ctx.Err()
 	default:
 	}
 
+	chat, err := whatsapp.RecipientJID(recipient)
+	if err != nil {
+		return "", err
+	}
+
 	// Send the message
-	err := h.clientManager.SendMessage(senderPhone, recipient, message)
+	messageID, err := h.clientManager.SendTextMessage(ctx, senderPhone, recipient, message, opts)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// Record sent message to MSSQL
 	sentMessage := models.Message{
 		SenderPhone:    senderPhone,
-		RecipientPhone: recipient,
+		RecipientPhone: chat.User,
 		MessageType:    "text",
 		Content:        message,
 		Timestamp:      time.Now(),
 		IsFromMe:       true,
-		ChatID:         recipient + "@s.whatsapp.net",
-		MessageID:      generateMessageID(),
+		ChatID:         chat.String(),
+		MessageID:      messageID,
 		CreatedAt:      time.Now(),
 		UpdatedAt:      time.Now(),
 	}
+	if opts != nil && opts.QuotedMessage != nil {
+		sentMessage.ParentMessageID = opts.QuotedMessage.MessageID
+	}
 
 	if err := h.gormDB.StoreMessage(&sentMessage); err != nil {
-		log.Printf("Warning: Failed to record sent message to MSSQL: %v", err)
+		slog.WarnContext(ctx, "Failed to record sent message to MSSQL", "sender", senderPhone, "chat", sentMessage.ChatID, "error", err)
+		// Don't return error as the message was sent successfully
+	}
+	h.publishSent(&sentMessage)
+
+	return messageID, nil
+}
+
+// sendLocationWithContext sends a location message with context support
+func (h *Handler) sendLocationWithContext(ctx context.Context, senderPhone, recipient string, location *models.Location) (string, error) {
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	default:
+	}
+
+	messageID, err := h.clientManager.SendLocation(ctx, senderPhone, recipient, location)
+	if err != nil {
+		return "", err
+	}
+
+	content := fmt.Sprintf("%f,%f", location.Latitude, location.Longitude)
+	if location.Name != "" {
+		content = location.Name + " (" + content + ")"
+	}
+	h.recordSentMessage(ctx, senderPhone, recipient, "location", content, messageID, &models.MessagePayload{
+		Latitude:     &location.Latitude,
+		Longitude:    &location.Longitude,
+		LocationName: location.Name,
+		Address:      location.Address,
+	})
+	return messageID, nil
+}
+
+// sendContactWithContext sends a contact card with context support
+func (h *Handler) sendContactWithContext(ctx context.Context, senderPhone, recipient string, contact *models.ContactCard) (string, error) {
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	default:
+	}
+
+	messageID, err := h.clientManager.SendContact(ctx, senderPhone, recipient, contact)
+	if err != nil {
+		return "", err
+	}
+
+	h.recordSentMessage(ctx, senderPhone, recipient, "contact", contact.Name, messageID, &models.MessagePayload{
+		ContactName: contact.Name,
+		VCards:      []string{whatsapp.BuildVCard(contact)},
+	})
+	return messageID, nil
+}
+
+// sendPollWithContext sends a poll with context support
+func (h *Handler) sendPollWithContext(ctx context.Context, senderPhone, recipient string, poll *models.PollRequest) (string, error) {
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	default:
+	}
+
+	messageID, err := h.clientManager.SendPoll(ctx, senderPhone, recipient, poll)
+	if err != nil {
+		return "", err
+	}
+
+	selectableCount := 1
+	if poll.MultiSelect {
+		selectableCount = 0
+	}
+
+	sentMessage := h.recordSentMessage(ctx, senderPhone, recipient, "poll", poll.Question, messageID, &models.MessagePayload{
+		PollOptions:     poll.Options,
+		SelectableCount: uint32(selectableCount),
+	})
+	if err := h.gormDB.StorePoll(&models.Poll{
+		MessageID:       messageID,
+		ChatID:          sentMessage.ChatID,
+		SenderPhone:     senderPhone,
+		Question:        poll.Question,
+		Options:         poll.Options,
+		SelectableCount: selectableCount,
+	}); err != nil {
+		slog.WarnContext(ctx, "Failed to record sent poll to MSSQL", "sender", senderPhone, "chat", sentMessage.ChatID, "error", err)
+	}
+	return messageID, nil
+}
+
+// recordSentMessage records a sent message to MSSQL
+func (h *Handler) recordSentMessage(ctx context.Context, senderPhone, recipient, messageType, content, messageID string, payload *models.MessagePayload) *models.Message {
+	chat, _ := whatsapp.RecipientJID(recipient) // already validated by the send
+
+	sentMessage := &models.Message{
+		SenderPhone:    senderPhone,
+		RecipientPhone: chat.User,
+		MessageType:    messageType,
+		Content:        content,
+		Timestamp:      time.Now(),
+		IsFromMe:       true,
+		ChatID:         chat.String(),
+		MessageID:      messageID,
+		Payload:        payload,
+		CreatedAt:      time.Now(),
+		UpdatedAt:      time.Now(),
+	}
+
+	if err := h.gormDB.StoreMessage(sentMessage); err != nil {
+		slog.WarnContext(ctx, "Failed to record sent message to MSSQL", "sender", senderPhone, "chat", sentMessage.ChatID, "type", messageType, "error", err)
 		// Don't return error as the message was sent successfully
 	}
+	h.publishSent(sentMessage)
+	return sentMessage
+}
+
+// publishSent pushes a successfully sent message to live subscribers
+func (h *Handler) publishSent(message *models.Message) {
+	h.eventBus.Publish(models.EventMessageStatus, message.SenderPhone, &models.MessageStatusEvent{
+		Status:      "sent",
+		MessageType: message.MessageType,
+		Recipient:   message.ChatID,
+		Message:     message,
+	})
+}
+
+// sendReactionWithContext reacts to a stored message with context support
+func (h *Handler) sendReactionWithContext(ctx context.Context, senderPhone string, target *models.Message, reaction string) (string, error) {
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	default:
+	}
+
+	messageID, err := h.clientManager.SendReaction(ctx, senderPhone, target, reaction)
+	if err != nil {
+		return "", err
+	}
 
-	return nil
+	h.recordFollowUpMessage(ctx, senderPhone, target, "reaction", reaction, messageID)
+	return messageID, nil
+}
+
+// editMessageWithContext edits a previously sent message with context support
+func (h *Handler) editMessageWithContext(ctx context.Context, senderPhone string, target *models.Message, message string) (string, error) {
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	default:
+	}
+
+	messageID, err := h.clientManager.EditMessage(ctx, senderPhone, target, message)
+	if err != nil {
+		return "", err
+	}
+
+	h.recordFollowUpMessage(ctx, senderPhone, target, "edit", message, messageID)
+	return messageID, nil
+}
+
+// revokeMessageWithContext deletes a previously sent message for everyone with context support
+func (h *Handler) revokeMessageWithContext(ctx context.Context, senderPhone string, target *models.Message) (string, error) {
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	default:
+	}
+
+	messageID, err := h.clientManager.RevokeMessage(ctx, senderPhone, target)
+	if err != nil {
+		return "", err
+	}
+
+	h.recordFollowUpMessage(ctx, senderPhone, target, "revoke", "", messageID)
+	return messageID, nil
+}
+
+// recordFollowUpMessage records a reaction, edit or revoke linked to the original message
+func (h *Handler) recordFollowUpMessage(ctx context.Context, senderPhone string, target *models.Message, messageType, content, messageID string) {
+	recipient := target.RecipientPhone
+	if !target.IsFromMe {
+		recipient = target.SenderPhone
+	}
+
+	sentMessage := models.Message{
+		SenderPhone:     senderPhone,
+		RecipientPhone:  recipient,
+		MessageType:     messageType,
+		Content:         content,
+		Timestamp:       time.Now(),
+		IsFromMe:        true,
+		ChatID:          target.ChatID,
+		MessageID:       messageID,
+		ParentMessageID: target.MessageID,
+		CreatedAt:       time.Now(),
+		UpdatedAt:       time.Now(),
+	}
+
+	if err := h.gormDB.StoreFollowUpMessage(&sentMessage); err != nil {
+		slog.WarnContext(ctx, "Failed to record sent message to MSSQL", "sender", senderPhone, "chat", sentMessage.ChatID, "type", messageType, "error", err)
+		// Don't return error as the message was sent successfully
+	}
+	h.publishSent(&sentMessage)
 }
 
 // sendFileWithContext sends a WhatsApp file with context support
-func (h *Handler) sendFileWithContext(ctx context.Context, senderPhone, recipient, fileName string) error {
+func (h *Handler) sendFileWithContext(ctx context.Context, senderPhone, recipient, fileName string) (string, error) {
 	// Check if context is cancelled
 	select {
 	case <-ctx.Done():
-		return ctx.Err()
+		return "", ctx.Err()
 	default:
 	}
 
+	chat, err := whatsapp.RecipientJID(recipient)
+	if err != nil {
+		return "", err
+	}
+
 	// Construct full file path (cross-platform)
 	filePath := filepath.Join(h.fileShareFolder, fileName)
 
 	// Check if file exists
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		return fmt.Errorf("file not found: %s", fileName)
+		return "", fmt.Errorf("file not found: %s", fileName)
 	}
 
 	// Send file using client manager
-	err := h.clientManager.SendFile(senderPhone, recipient, filePath)
+	messageID, err := h.clientManager.SendFile(ctx, senderPhone, recipient, filePath)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	// Record sent file message to MSSQL
 	sentMessage := models.Message{
 		SenderPhone:    senderPhone,
-		RecipientPhone: recipient,
+		RecipientPhone: chat.User,
 		MessageType:    "file",
 		Content:        fileName, // Store filename as content
 		MediaURL:       filePath, // Store file path as media URL
 		Timestamp:      time.Now(),
 		IsFromMe:       true,
-		ChatID:         recipient + "@s.whatsapp.net",
-		MessageID:      generateMessageID(),
+		ChatID:         chat.String(),
+		MessageID:      messageID,
 		CreatedAt:      time.Now(),
 		UpdatedAt:      time.Now(),
 	}
 
 	if err := h.gormDB.StoreMessage(&sentMessage); err != nil {
-		log.Printf("Warning: Failed to record sent file message to MSSQL: %v", err)
+		slog.WarnContext(ctx, "Failed to record sent file message to MSSQL", "sender", senderPhone, "chat", sentMessage.ChatID, "error", err)
 		// Don't return error as the file was sent successfully
 	}
+	h.publishSent(&sentMessage)
 
-	return nil
+	return messageID, nil
 }
 
 // sendMessage sends a WhatsApp message using a registered user client (legacy method)
 func (h *Handler) sendMessage(senderPhone, recipient, message string) error {
-	return h.sendMessageWithContext(context.Background(), senderPhone, recipient, message)
+	_, err := h.sendMessageWithContext(context.Background(), senderPhone, recipient, message, nil)
+	return err
 }
 
 // HandleGetMessages handles the /messages API endpoint
@@ -569,6 +1088,7 @@ func (h *Handler) HandleGetMessages(w http.ResponseWriter, r *http.Request) {
 	}
 
 	phone := r.URL.Query().Get("phone")
+	chatID := r.URL.Query().Get("chat_id")
 	limitStr := r.URL.Query().Get("limit")
 
 	limit := 50 // default limit
@@ -581,7 +1101,9 @@ func (h *Handler) HandleGetMessages(w http.ResponseWriter, r *http.Request) {
 	var messages []models.Message
 	var err error
 
-	if phone != "" {
+	if chatID != "" {
+		messages, err = h.gormDB.GetMessagesByChat(chatID, limit)
+	} else if phone != "" {
 		messages, err = h.gormDB.GetMessagesByPhone(phone, limit)
 	} else {
 		messages, err = h.gormDB.GetRecentMessages(limit)
@@ -602,6 +1124,71 @@ func (h *Handler) HandleGetMessages(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(messages)
 }
 
+// HandleGetPollResults handles the /polls/{message_id} API endpoint
+func (h *Handler) HandleGetPollResults(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	messageID := strings.TrimPrefix(r.URL.Path, "/polls/")
+	if messageID == "" {
+		response := models.APIResponse{
+			Status: "error",
+			Error:  "Poll message ID is required",
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	results, err := h.gormDB.GetPollResults(messageID)
+	if err != nil {
+		response := models.APIResponse{
+			Status: "error",
+			Error:  fmt.Sprintf("Poll not found: %v", err),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// HandleGetHistoryImport handles the /history API endpoint
+func (h *Handler) HandleGetHistoryImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	phone := r.URL.Query().Get("phone")
+	if phone == "" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.clientManager.GetAllHistoryImportProgress())
+		return
+	}
+
+	progress, exists := h.clientManager.GetHistoryImportProgress(phone)
+	if !exists {
+		response := models.APIResponse{
+			Status: "error",
+			Error:  fmt.Sprintf("No history import found for %s", phone),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(progress)
+}
+
 // HandleGetStats handles the /stats API endpoint
 func (h *Handler) HandleGetStats(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "GET" {
@@ -609,7 +1196,19 @@ func (h *Handler) HandleGetStats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stats, err := h.gormDB.GetMessageStats()
+	opts, err := parseStatsOptions(r)
+	if err != nil {
+		response := models.APIResponse{
+			Status: "error",
+			Error:  fmt.Sprintf("Invalid stats request: %v", err),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	report, err := h.gormDB.GetStatsReport(opts)
 	if err != nil {
 		response := models.APIResponse{
 			Status: "error",
@@ -621,137 +1220,116 @@ func (h *Handler) HandleGetStats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.URL.Query().Get("format") == "csv" {
+		writeStatsCSV(w, report)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(stats)
+	json.NewEncoder(w).Encode(report)
 }
 
-// sendHTMLResponse sends an HTML response with QR code display
-func (h *Handler) sendHTMLResponse(w http.ResponseWriter, title, message, qrCodePNG string, isError bool) {
-	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
+// parseStatsOptions reads the range, timezone, grouping and interval of a /stats request.
+// Dates without a time are whole days in the chosen timezone, so to=2024-05-31 includes that day.
+func parseStatsOptions(r *http.Request) (database.StatsOptions, error) {
+	query := r.URL.Query()
+	opts := database.StatsOptions{
+		Location: time.Local,
+		GroupBy:  query.Get("group_by"),
+		Interval: query.Get("interval"),
+	}
+
+	if tz := query.Get("tz"); tz != "" {
+		loc, err := time.LoadLocation(tz)
+		if err != nil {
+			return opts, fmt.Errorf("invalid timezone: %s", tz)
+		}
+		opts.Location = loc
+	}
+
+	switch opts.GroupBy {
+	case "", "sender", "contact", "type", "direction":
+	default:
+		return opts, fmt.Errorf("invalid group_by: %s (use sender, contact, type or direction)", opts.GroupBy)
+	}
 
-	html := `<!DOCTYPE html>
-<html lang="en">
-<head>
-    <meta charset="UTF-8">
-    <meta name="viewport" content="width=device-width, initial-scale=1.0">
-    <title>QR Code - ` + title + `</title>
-    <style>
-        body {
-            font-family: Arial, sans-serif;
-            max-width: 600px;
-            margin: 0 auto;
-            padding: 20px;
-            text-align: center;
-        }
-        .container {
-            background: #f9f9f9;
-            border-radius: 10px;
-            padding: 30px;
-            margin: 20px 0;
-        }
-        .qr-container {
-            margin: 20px 0;
-        }
-        .qr-image {
-            border: 2px solid #ddd;
-            border-radius: 10px;
-            padding: 20px;
-            background: white;
-            display: inline-block;
-        }
-        .error {
-            color: #d32f2f;
-            background: #ffebee;
-            border: 1px solid #ffcdd2;
-            border-radius: 5px;
-            padding: 15px;
-            margin: 20px 0;
-        }
-        .success {
-            color: #388e3c;
-            background: #e8f5e8;
-            border: 1px solid #c8e6c9;
-            border-radius: 5px;
-            padding: 15px;
-            margin: 20px 0;
-        }
-        .info {
-            color: #1976d2;
-            background: #e3f2fd;
-            border: 1px solid #bbdefb;
-            border-radius: 5px;
-            padding: 15px;
-            margin: 20px 0;
-        }
-        .instructions {
-            text-align: left;
-            background: #f5f5f5;
-            padding: 20px;
-            border-radius: 5px;
-            margin: 20px 0;
-        }
-        .instructions ol {
-            margin: 10px 0;
-            padding-left: 20px;
-        }
-        .instructions li {
-            margin: 5px 0;
-        }
-    </style>
-</head>
-<body>
-    <div class="container">
-        <h1>QR Code Authentication</h1>
-        <h2>` + title + `</h2>
-        
-        <div class="` + func() string {
-		if isError {
-			return "error"
-		}
-		return "info"
-	}() + `">
-            <p>` + message + `</p>
-        </div>`
-
-	if qrCodePNG != "" {
-		html += `
-        <div class="qr-container">
-            <h3>Scan this QR code with WhatsApp</h3>
-            <div class="qr-image">
-                <img src="data:image/png;base64,` + qrCodePNG + `" alt="QR Code" style="max-width: 300px;">
-            </div>
-        </div>`
-	}
-
-	html += `
-        <div class="instructions">
-            <h3>Instructions:</h3>
-            <ol>
-                <li>Open WhatsApp on your phone</li>
-                <li>Go to Settings > Linked Devices</li>
-                <li>Tap "Link a Device"</li>
-                <li>Point your camera at the QR code above</li>
-                <li>Wait for the authentication to complete</li>
-            </ol>
-        </div>
-        
-        <div class="info">
-            <p><strong>Note:</strong> This QR code will expire in ` + fmt.Sprintf("%d", h.qrExpiryMinutes) + ` minutes.</p>
-        </div>
-    </div>
-</body>
-</html>`
-
-	w.Write([]byte(html))
+	switch opts.Interval {
+	case "", "hour", "day", "week":
+	default:
+		return opts, fmt.Errorf("invalid interval: %s (use hour, day or week)", opts.Interval)
+	}
+
+	opts.To = time.Now()
+	if to := query.Get("to"); to != "" {
+		t, dateOnly, err := parseStatsTime(to, opts.Location)
+		if err != nil {
+			return opts, fmt.Errorf("invalid to: %s", to)
+		}
+		if dateOnly {
+			t = t.AddDate(0, 0, 1)
+		}
+		opts.To = t
+	}
+
+	opts.From = opts.To.AddDate(0, 0, -30)
+	if from := query.Get("from"); from != "" {
+		t, _, err := parseStatsTime(from, opts.Location)
+		if err != nil {
+			return opts, fmt.Errorf("invalid from: %s", from)
+		}
+		opts.From = t
+	}
+
+	if !opts.From.Before(opts.To) {
+		return opts, fmt.Errorf("from must be before to")
+	}
+	return opts, nil
 }
 
-// generateMessageID generates a unique message ID
-func generateMessageID() string {
-	bytes := make([]byte, 16)
-	if _, err := rand.Read(bytes); err != nil {
-		// Fallback to timestamp-based ID if crypto/rand fails
-		return fmt.Sprintf("msg_%d", time.Now().UnixNano())
+// parseStatsTime parses an RFC 3339 time or a YYYY-MM-DD date in loc
+func parseStatsTime(value string, loc *time.Location) (time.Time, bool, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, loc); err == nil {
+		return t, true, nil
 	}
-	return hex.EncodeToString(bytes)
+	t, err := time.Parse(time.RFC3339, value)
+	return t, false, err
+}
+
+// writeStatsCSV writes the time series of a report as CSV, or its groups when
+// there is no series, or just the totals
+func writeStatsCSV(w http.ResponseWriter, report *models.StatsReport) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="stats.csv"`)
+
+	writer := csv.NewWriter(w)
+	count := func(n int64) string { return strconv.FormatInt(n, 10) }
+
+	switch {
+	case report.Interval != "":
+		writer.Write([]string{"start", "group", "sent", "received", "total"})
+		for _, point := range report.Series {
+			writer.Write([]string{point.Start.Format(time.RFC3339), point.Group, count(point.Sent), count(point.Received), count(point.Total)})
+		}
+	case report.GroupBy != "":
+		writer.Write([]string{report.GroupBy, "sent", "received", "total"})
+		for _, group := range report.Groups {
+			writer.Write([]string{group.Key, count(group.Sent), count(group.Received), count(group.Total)})
+		}
+	default:
+		writer.Write([]string{"from", "to", "sent", "received", "total"})
+		writer.Write([]string{report.From.Format(time.RFC3339), report.To.Format(time.RFC3339),
+			count(report.Sent), count(report.Received), count(report.Sent + report.Received)})
+	}
+	writer.Flush()
+}
+
+// writeError writes a JSON error response
+func writeError(w http.ResponseWriter, status int, message string) {
+	response := models.APIResponse{
+		Status: "error",
+		Error:  message,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
 }
@@ -0,0 +1,309 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jaliph/auto-dm/models"
+	"github.com/jaliph/auto-dm/utils"
+)
+
+// privacyNotCovered lists the data a privacy request cannot reach
+var privacyNotCovered = []string{
+	"received media is not downloaded by the app, only its WhatsApp URL is stored with the message",
+	"application logs written to stderr (enable log redaction to keep phone numbers and message bodies out of them)",
+	"mentions of the phone number inside other contacts' messages",
+	"database backups and the MSSQL transaction log",
+}
+
+// HandlePrivacyContact handles GET /privacy/contacts/{phone}/export and
+// DELETE /privacy/contacts/{phone}
+func (h *Handler) HandlePrivacyContact(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/privacy/contacts/")
+	phone, action, _ := strings.Cut(path, "/")
+	phone = strings.TrimPrefix(phone, "+")
+
+	switch {
+	case action == "export" && r.Method == "GET":
+	case action == "" && r.Method == "DELETE":
+	case action == "export" || action == "":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := h.validateContactPhone(phone); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !h.gormDB.Available() {
+		writeError(w, http.StatusServiceUnavailable, "MSSQL is unavailable, try again later")
+		return
+	}
+
+	if action == "export" {
+		h.exportContact(w, r, phone)
+		return
+	}
+	h.eraseContact(w, r, phone)
+}
+
+// validateContactPhone checks that phone is a plain phone number and not one
+// of our own sender accounts, whose records are not a contact's data
+func (h *Handler) validateContactPhone(phone string) error {
+	if len(phone) < 7 || len(phone) > 15 || strings.Trim(phone, "0123456789") != "" {
+		return fmt.Errorf("invalid phone number %q, expected 7 to 15 digits", phone)
+	}
+	if _, err := h.db.GetSender(phone); err == nil {
+		return fmt.Errorf("%s is a registered sender, delete the sender instead", phone)
+	}
+	return nil
+}
+
+// exportContact streams a ZIP with every record that references a contact
+func (h *Handler) exportContact(w http.ResponseWriter, r *http.Request, phone string) {
+	report := h.newPrivacyReport(r, "export", "", phone)
+	auditEntry := models.AuditEntry{Action: models.AuditPrivacyExport, Target: phone}
+
+	data, err := h.gormDB.GetContactData(phone)
+	if err != nil {
+		h.audit(r, auditEntry, err)
+		slog.ErrorContext(r.Context(), "Privacy export failed", "contact", phone, "error", err)
+		writeError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to export contact data: %v", err))
+		return
+	}
+	contacts := h.contactAttributes(phone, report)
+
+	report.Messages = int64(len(data.Messages))
+	report.Polls = int64(len(data.Polls))
+	report.PollVotes = int64(len(data.PollVotes))
+	report.AuditEntries = int64(len(data.AuditEntries))
+	report.Contacts = int64(len(contacts))
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="contact_%s.zip"`, phone))
+
+	archive := zip.NewWriter(w)
+	files := []struct {
+		name  string
+		value any
+	}{
+		{"messages.json", data.Messages},
+		{"polls.json", data.Polls},
+		{"poll_votes.json", data.PollVotes},
+		{"contacts.json", contacts},
+		{"audit.json", data.AuditEntries},
+	}
+	for _, file := range files {
+		if err := writeZipJSON(archive, file.name, file.value); err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		}
+	}
+
+	for _, message := range data.Messages {
+		name, err := h.addSentMedia(archive, message)
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		} else if name != "" {
+			report.MediaFiles++
+		}
+	}
+
+	// The manifest is written last so it can report on the rest of the archive
+	report.CompletedAt = time.Now()
+	if err := writeZipJSON(archive, "manifest.json", report); err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	if err := archive.Close(); err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to finish archive: %v", err))
+	}
+
+	h.finishPrivacyRequest(r, auditEntry, report)
+}
+
+// contactAttributes collects what every sender's session store holds about a
+// contact, recording failures in the report
+func (h *Handler) contactAttributes(phone string, report *models.PrivacyReport) []models.ContactAttributes {
+	senders, err := h.db.GetAllSenders()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to list senders: %v", err))
+		return nil
+	}
+
+	contacts := []models.ContactAttributes{}
+	for _, sender := range senders {
+		attributes, err := h.userStoreManager.GetContactAttributes(sender.Phone, phone)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to read contacts of sender %s: %v", sender.Phone, err))
+			continue
+		}
+		contacts = append(contacts, attributes...)
+	}
+	return contacts
+}
+
+// addSentMedia copies a file the app sent to the contact from the share folder
+// into the archive and returns its name in the archive. Received media and
+// files no longer in the share folder are skipped.
+func (h *Handler) addSentMedia(archive *zip.Writer, message models.Message) (string, error) {
+	if message.MediaURL == "" || strings.Contains(message.MediaURL, "://") {
+		return "", nil
+	}
+	shareFolder, err := filepath.Abs(h.fileShareFolder)
+	if err != nil {
+		return "", nil
+	}
+	path, err := filepath.Abs(message.MediaURL)
+	if err != nil || !strings.HasPrefix(path, shareFolder+string(filepath.Separator)) {
+		return "", nil
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to open media of message %s: %v", message.MessageID, err)
+	}
+	defer file.Close()
+
+	name := fmt.Sprintf("media/%s_%s", message.MessageID, filepath.Base(path))
+	entry, err := archive.Create(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to add media of message %s: %v", message.MessageID, err)
+	}
+	if _, err := io.Copy(entry, file); err != nil {
+		return "", fmt.Errorf("failed to add media of message %s: %v", message.MessageID, err)
+	}
+	return name, nil
+}
+
+// writeZipJSON adds a JSON file to an archive
+func writeZipJSON(archive *zip.Writer, name string, value any) error {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		return fmt.Errorf("failed to encode %s: %v", name, err)
+	}
+
+	entry, err := archive.Create(name)
+	if err != nil {
+		return fmt.Errorf("failed to add %s: %v", name, err)
+	}
+	if _, err := entry.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	return nil
+}
+
+// eraseContact deletes or anonymizes every record that references a contact
+// and responds with the completion report
+func (h *Handler) eraseContact(w http.ResponseWriter, r *http.Request, phone string) {
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = models.ErasureDelete
+	}
+	if mode != models.ErasureDelete && mode != models.ErasureAnonymize {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Invalid mode %q, expected %s or %s", mode, models.ErasureDelete, models.ErasureAnonymize))
+		return
+	}
+
+	report := h.newPrivacyReport(r, "erase", mode, phone)
+	// The audit entry of an erasure must not bring the phone number back
+	auditEntry := models.AuditEntry{Action: models.AuditPrivacyErase, Target: models.ErasedPhone}
+
+	erasure, err := h.gormDB.EraseContact(phone, mode)
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	report.Messages = erasure.Messages
+	report.Polls = erasure.Polls
+	report.PollVotes = erasure.PollVotes
+	report.AuditEntries = erasure.AuditEntries
+
+	senders, err := h.db.GetAllSenders()
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to list senders: %v", err))
+	}
+	for _, sender := range senders {
+		erased, err := h.userStoreManager.EraseContact(sender.Phone, phone)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to erase contact from sender %s: %v", sender.Phone, err))
+			continue
+		}
+		report.Contacts += erased
+	}
+
+	// Buffered live events carry the phone number in messages, receipts and statuses
+	removed, err := h.eventBus.Remove(func(event models.Event) bool {
+		return bytes.Contains(event.Data, []byte(`"`+phone+`"`)) || bytes.Contains(event.Data, []byte(`"`+phone+`@`))
+	})
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to erase buffered events: %v", err))
+	}
+	report.Events = int64(removed)
+	report.CompletedAt = time.Now()
+
+	h.finishPrivacyRequest(r, auditEntry, report)
+
+	status := http.StatusOK
+	if len(report.Errors) > 0 {
+		status = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// newPrivacyReport starts the completion report of a privacy request
+func (h *Handler) newPrivacyReport(r *http.Request, action, mode, phone string) *models.PrivacyReport {
+	return &models.PrivacyReport{
+		Action:     action,
+		Mode:       mode,
+		Phone:      phone,
+		RequestID:  utils.RequestIDFromContext(r.Context()),
+		StartedAt:  time.Now(),
+		NotCovered: privacyNotCovered,
+	}
+}
+
+// finishPrivacyRequest logs and audits a completed privacy request
+func (h *Handler) finishPrivacyRequest(r *http.Request, auditEntry models.AuditEntry, report *models.PrivacyReport) {
+	var err error
+	if len(report.Errors) > 0 {
+		err = errors.New(strings.Join(report.Errors, "; "))
+	}
+	h.audit(r, auditEntry, err)
+
+	logArgs := []any{
+		"action", report.Action,
+		"mode", report.Mode,
+		"contact", report.Phone,
+		"messages", report.Messages,
+		"polls", report.Polls,
+		"poll_votes", report.PollVotes,
+		"audit_entries", report.AuditEntries,
+		"contacts", report.Contacts,
+		"events", report.Events,
+		"media_files", report.MediaFiles,
+		"duration", report.CompletedAt.Sub(report.StartedAt),
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Privacy request completed with errors", append(logArgs, "error", err)...)
+		return
+	}
+	slog.InfoContext(r.Context(), "Privacy request completed", logArgs...)
+}
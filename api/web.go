@@ -0,0 +1,41 @@
+package api
+
+import (
+	"embed"
+	"html/template"
+	"log/slog"
+	"net/http"
+)
+
+// webAssets holds the pages served by the binary
+//
+//go:embed web
+var webAssets embed.FS
+
+var qrPageTemplate = template.Must(template.ParseFS(webAssets, "web/qr.html"))
+
+// HandleAdmin handles the /admin endpoint. The dashboard is a single page that
+// works entirely through the public API endpoints.
+func (h *Handler) HandleAdmin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	page, err := webAssets.ReadFile("web/admin.html")
+	if err != nil {
+		http.Error(w, "Dashboard not available", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page)
+}
+
+// serveQRPage serves the live QR page for a session token. The page loads the
+// current code itself and follows the session through /qr/{token}/events.
+func (h *Handler) serveQRPage(w http.ResponseWriter, r *http.Request, token string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := qrPageTemplate.Execute(w, struct{ Token string }{token}); err != nil {
+		slog.ErrorContext(r.Context(), "Failed to render QR page", "error", err)
+	}
+}
@@ -0,0 +1,223 @@
+// Package backup writes and restores archives of the sender sessions, store.db
+// and config.ini, so a lost db directory does not mean linking every phone again.
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jaliph/auto-dm/database"
+	"github.com/jaliph/auto-dm/store"
+)
+
+// FormatVersion is the archive layout this build writes. Restores refuse
+// archives of a newer layout.
+const FormatVersion = 1
+
+// manifestName is the last entry of every archive, listing the files before it
+const manifestName = "manifest.json"
+
+// Kinds of archived files
+const (
+	KindDatabase = "database" // store.db
+	KindSession  = "session"  // a whatsmeow session store
+	KindConfig   = "config"   // config.ini
+)
+
+// notIncluded is what an archive never holds
+var notIncluded = []string{
+	"session keys and the keyring, keep them separately: encrypted session stores cannot be restored without them",
+	"the MSSQL database with messages, polls and the audit log, back it up with SQL Server",
+	"the MSSQL spool and the event stream history in db/",
+}
+
+// File is one file in an archive
+type File struct {
+	Path   string `json:"path"` // where the file is restored, relative to the working directory
+	Kind   string `json:"kind"`
+	Sender string `json:"sender,omitempty"` // sender of a per-sender session store
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	KeyID  string `json:"key_id,omitempty"` // session key an encrypted session store was written with
+}
+
+// Manifest describes an archive
+type Manifest struct {
+	FormatVersion int       `json:"format_version"`
+	CreatedAt     time.Time `json:"created_at"`
+	AppVersion    string    `json:"app_version"`
+	SessionLayout string    `json:"session_layout"`
+	Encrypted     bool      `json:"encrypted"`
+	Files         []File    `json:"files"`
+	NotIncluded   []string  `json:"not_included"`
+}
+
+// Sources are what a backup is taken from
+type Sources struct {
+	Database      *database.Database
+	Sessions      *store.UserStoreManager // the running server's stores, nil to read them from disk
+	SessionStores store.SessionStoreConfig
+	ConfigPath    string // skipped if it does not exist
+	AppVersion    string
+}
+
+// Create writes an archive of store.db, every session store and the config
+// file to w, encrypted with a key derived from passphrase unless it is empty.
+// Each database is copied in one transaction, so the backup can be taken while
+// the server is running.
+func Create(w io.Writer, sources Sources, passphrase string) (*Manifest, error) {
+	manifest := &Manifest{
+		FormatVersion: FormatVersion,
+		CreatedAt:     time.Now().UTC(),
+		AppVersion:    sources.AppVersion,
+		SessionLayout: sources.SessionStores.Layout,
+		Encrypted:     passphrase != "",
+		NotIncluded:   notIncluded,
+	}
+	if sources.SessionStores.Layout == store.LayoutShared && sources.SessionStores.Dialect == "postgres" {
+		manifest.NotIncluded = append(manifest.NotIncluded, "the shared PostgreSQL session store, back it up with pg_dump")
+	}
+
+	var encrypted *encryptWriter
+	if passphrase != "" {
+		var err error
+		if encrypted, err = newEncryptWriter(w, passphrase); err != nil {
+			return nil, err
+		}
+		w = encrypted
+	}
+	compressed := gzip.NewWriter(w)
+	archive := tar.NewWriter(compressed)
+
+	add := func(file File, data []byte) error {
+		sum := sha256.Sum256(data)
+		file.Path = filepath.ToSlash(file.Path)
+		file.Size = int64(len(data))
+		file.SHA256 = hex.EncodeToString(sum[:])
+		if err := writeEntry(archive, file.Path, data, manifest.CreatedAt); err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, file)
+		return nil
+	}
+
+	snapshot, err := sources.Database.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	if err := add(File{Path: filepath.Join("db", "store.db"), Kind: KindDatabase}, snapshot); err != nil {
+		return nil, err
+	}
+
+	addSession := func(sessionStore store.SessionStore, data []byte) error {
+		if !filepath.IsLocal(sessionStore.Path) {
+			manifest.NotIncluded = append(manifest.NotIncluded, fmt.Sprintf("the shared session store %s, which is outside the working directory", sessionStore.Path))
+			return nil
+		}
+		return add(File{Path: sessionStore.Path, Kind: KindSession, Sender: sessionStore.Phone, KeyID: sessionStore.KeyID}, data)
+	}
+	if sources.Sessions != nil {
+		err = sources.Sessions.SnapshotSessionStores(addSession)
+	} else {
+		err = store.SnapshotSessionStores(sources.SessionStores.SharedSQLitePath(), addSession)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if sources.ConfigPath != "" {
+		config, err := os.ReadFile(sources.ConfigPath)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			return nil, fmt.Errorf("failed to read %s: %v", sources.ConfigPath, err)
+		case !filepath.IsLocal(sources.ConfigPath):
+			manifest.NotIncluded = append(manifest.NotIncluded, fmt.Sprintf("%s, which is outside the working directory", sources.ConfigPath))
+		default:
+			if err := add(File{Path: sources.ConfigPath, Kind: KindConfig}, config); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeEntry(archive, manifestName, data, manifest.CreatedAt); err != nil {
+		return nil, err
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	if err := compressed.Close(); err != nil {
+		return nil, err
+	}
+	if encrypted != nil {
+		if err := encrypted.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return manifest, nil
+}
+
+// writeEntry adds one file to the archive. Entries are private to the owner,
+// since they hold sessions and credentials.
+func writeEntry(archive *tar.Writer, name string, data []byte, modTime time.Time) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     int64(len(data)),
+		Mode:     0600,
+		ModTime:  modTime,
+	}
+	if err := archive.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	if _, err := archive.Write(data); err != nil {
+		return fmt.Errorf("failed to write %s: %v", name, err)
+	}
+	return nil
+}
+
+// openArchive returns the tar stream of an archive, decrypting it when it is
+// encrypted. requireEncryption rejects plaintext archives.
+func openArchive(r io.Reader, passphrase string, requireEncryption bool) (*tar.Reader, error) {
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(len(encryptedMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	var plaintext io.Reader = buffered
+	switch {
+	case string(magic) == encryptedMagic:
+		if passphrase == "" {
+			return nil, errors.New("archive is encrypted, set BACKUP_PASSPHRASE or [backup] passphrase")
+		}
+		if plaintext, err = newDecryptReader(buffered, passphrase); err != nil {
+			return nil, err
+		}
+	case requireEncryption:
+		return nil, errors.New("archive is not encrypted")
+	}
+
+	decompressed, err := gzip.NewReader(plaintext)
+	if err != nil {
+		if errors.Is(err, gzip.ErrHeader) || errors.Is(err, io.EOF) {
+			return nil, errors.New("not an auto-dm backup archive")
+		}
+		return nil, err
+	}
+	return tar.NewReader(decompressed), nil
+}
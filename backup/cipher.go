@@ -0,0 +1,190 @@
+package backup
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// encryptedMagic starts every encrypted archive and versions its encryption
+const encryptedMagic = "ADMBKUP1"
+
+// Encrypted archives are split into chunks that are sealed one by one, so
+// neither side holds the whole archive in memory
+const chunkSize = 64 * 1024
+
+// Argon2id parameters for new archives. They are stored in the header, so
+// they can be raised without breaking older archives.
+const (
+	kdfTime    = 3
+	kdfMemory  = 64 * 1024 // KiB
+	kdfThreads = 4
+)
+
+// headerSize is the size of the encryption header: magic, salt, Argon2id
+// time, memory and threads
+const headerSize = len(encryptedMagic) + 16 + 4 + 4 + 1
+
+// archiveCipher derives the AES-256-GCM cipher of an archive from the passphrase
+func archiveCipher(passphrase string, header []byte) (cipher.AEAD, error) {
+	salt := header[len(encryptedMagic) : len(encryptedMagic)+16]
+	params := header[len(encryptedMagic)+16:]
+	iterations, memory, threads := binary.BigEndian.Uint32(params), binary.BigEndian.Uint32(params[4:]), params[8]
+	if iterations == 0 || iterations > 16 || memory == 0 || memory > 1024*1024 || threads == 0 {
+		return nil, errors.New("archive has invalid key derivation parameters")
+	}
+
+	key := argon2.IDKey([]byte(passphrase), salt, iterations, memory, threads, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of a chunk: its sequence number and whether it
+// is the last one, so chunks cannot be reordered, dropped or cut off
+func chunkNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// encryptWriter encrypts an archive with a key derived from a passphrase
+type encryptWriter struct {
+	w       io.Writer
+	gcm     cipher.AEAD
+	header  []byte // authenticated with every chunk
+	buf     []byte
+	counter uint64
+}
+
+// newEncryptWriter writes the encryption header and returns a writer that
+// encrypts everything written to it. Close must be called to seal the last chunk.
+func newEncryptWriter(w io.Writer, passphrase string) (*encryptWriter, error) {
+	header := make([]byte, 0, headerSize)
+	header = append(header, encryptedMagic...)
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", err)
+	}
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, kdfTime)
+	header = binary.BigEndian.AppendUint32(header, kdfMemory)
+	header = append(header, kdfThreads)
+
+	gcm, err := archiveCipher(passphrase, header)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, gcm: gcm, header: header, buf: make([]byte, 0, chunkSize+1)}, nil
+}
+
+// Write buffers p and seals every chunk that is known not to be the last
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := min(len(p), chunkSize+1-len(e.buf))
+		e.buf = append(e.buf, p[:n]...)
+		p = p[n:]
+		if len(e.buf) > chunkSize {
+			if err := e.seal(e.buf[:chunkSize], false); err != nil {
+				return 0, err
+			}
+			e.buf = append(e.buf[:0], e.buf[chunkSize])
+		}
+	}
+	return written, nil
+}
+
+// Close seals the last chunk
+func (e *encryptWriter) Close() error {
+	return e.seal(e.buf, true)
+}
+
+func (e *encryptWriter) seal(chunk []byte, last bool) error {
+	sealed := e.gcm.Seal(nil, chunkNonce(e.counter, last), chunk, e.header)
+	e.counter++
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// decryptReader decrypts an encrypted archive chunk by chunk
+type decryptReader struct {
+	r       *bufio.Reader
+	gcm     cipher.AEAD
+	header  []byte
+	chunk   []byte // decrypted and not read yet
+	sealed  []byte
+	counter uint64
+	last    bool
+}
+
+// newDecryptReader reads the encryption header from r, which must start with
+// encryptedMagic, and derives the key from the passphrase
+func newDecryptReader(r *bufio.Reader, passphrase string) (*decryptReader, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.New("encrypted archive is truncated")
+	}
+	gcm, err := archiveCipher(passphrase, header)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{r: r, gcm: gcm, header: header, sealed: make([]byte, chunkSize+gcm.Overhead())}, nil
+}
+
+// Read returns decrypted data. A wrong passphrase fails on the first chunk, a
+// modified or cut off archive on the chunk where it happens.
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.chunk) == 0 {
+		if d.last {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.chunk)
+	d.chunk = d.chunk[n:]
+	return n, nil
+}
+
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.sealed)
+	switch {
+	case errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF):
+		d.last = true
+	case err != nil:
+		return err
+	default:
+		// A full chunk is the last one only if nothing follows it
+		if _, err := d.r.Peek(1); errors.Is(err, io.EOF) {
+			d.last = true
+		}
+	}
+
+	chunk, err := d.gcm.Open(d.sealed[:0:0], chunkNonce(d.counter, d.last), d.sealed[:n], d.header)
+	if err != nil {
+		if d.counter == 0 {
+			return errors.New("failed to decrypt archive: wrong passphrase or corrupt archive")
+		}
+		return errors.New("failed to decrypt archive: the archive is corrupt or truncated")
+	}
+	d.counter++
+	d.chunk = chunk
+	return nil
+}
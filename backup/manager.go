@@ -0,0 +1,79 @@
+package backup
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io"
+
+	"github.com/jaliph/auto-dm/store"
+)
+
+// Manager takes backups of the running server and stages restores for its
+// next start. The rest of the API has no authentication, so the admin backup
+// endpoints only hand out and accept archives encrypted with the configured
+// passphrase, and only to callers with the backup token or, without one,
+// callers on the same host.
+type Manager struct {
+	sources        Sources
+	passphrase     string
+	token          string
+	maxRestoreSize int64 // bytes
+	keys           *store.SessionKeys
+}
+
+// NewManager creates a backup manager for the running server
+func NewManager(sources Sources, passphrase, token string, maxRestoreSize int64, keys *store.SessionKeys) *Manager {
+	return &Manager{sources: sources, passphrase: passphrase, token: token, maxRestoreSize: maxRestoreSize, keys: keys}
+}
+
+// Errors returned by Authorize
+var (
+	ErrInvalidToken = errors.New("invalid or missing backup token")
+	ErrNotLocal     = errors.New("the backup API is only available from the same host unless a backup token is set")
+)
+
+// Authorize checks whether an API caller may take backups and stage restores.
+// With a token configured the caller must present it, otherwise the caller
+// must connect from the same host.
+func (m *Manager) Authorize(token string, local bool) error {
+	if m.token == "" {
+		if !local {
+			return ErrNotLocal
+		}
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(m.token)) != 1 {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// MaxRestoreSize returns the size in bytes of the largest archive accepted through the API
+func (m *Manager) MaxRestoreSize() int64 {
+	return m.maxRestoreSize
+}
+
+// Enabled reports whether a backup passphrase is configured
+func (m *Manager) Enabled() bool {
+	return m.passphrase != ""
+}
+
+// Create writes an encrypted archive of the running server to w
+func (m *Manager) Create(w io.Writer) (*Manifest, error) {
+	return Create(w, m.sources, m.passphrase)
+}
+
+// Stage verifies an uploaded archive and, unless dryRun is set, saves it to
+// be restored on the next start
+func (m *Manager) Stage(r io.Reader, dryRun bool) (*RestoreResult, error) {
+	options := RestoreOptions{
+		Passphrase:        m.passphrase,
+		RequireEncryption: true,
+		SessionKeys:       m.keys,
+		DryRun:            dryRun,
+	}
+	if dryRun {
+		return Restore(r, options)
+	}
+	return StageRestore(r, options)
+}
@@ -0,0 +1,292 @@
+package backup
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jaliph/auto-dm/store"
+)
+
+// PendingRestorePath is where an archive uploaded through the admin API waits
+// to be restored on the next start, before any database is opened
+var PendingRestorePath = filepath.Join("db", "restore.pending")
+
+// replacedSuffix is appended to the files a restore replaces, which are kept
+// until the operator removes them
+const replacedSuffix = ".pre-restore"
+
+// RestoreOptions control how an archive is restored
+type RestoreOptions struct {
+	Passphrase        string
+	RequireEncryption bool               // reject plaintext archives
+	SessionKeys       *store.SessionKeys // decrypts encrypted session stores to verify them
+	SkipConfig        bool               // leave the config file alone
+	DryRun            bool               // verify the archive and report, without changing anything
+}
+
+// RestoredFile is a file a restore writes
+type RestoredFile struct {
+	File
+	Replaces bool   `json:"replaces"`          // a file exists at Path and is kept with the .pre-restore suffix
+	Check    string `json:"check"`             // "ok", or why the content could only be checked against its checksum
+	Skipped  bool   `json:"skipped,omitempty"` // left out by SkipConfig
+}
+
+// RestoreResult describes a restore, or with DryRun what it would do
+type RestoreResult struct {
+	Manifest *Manifest      `json:"manifest"`
+	Files    []RestoredFile `json:"files"`
+}
+
+// Restore verifies an archive and puts its files in place. Every file is
+// checked against the manifest, and databases with SQLite's quick_check,
+// before anything is replaced. The server must not be running.
+func Restore(r io.Reader, options RestoreOptions) (*RestoreResult, error) {
+	staging, err := os.MkdirTemp(".", ".restore-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %v", err)
+	}
+	defer os.RemoveAll(staging)
+
+	manifest, err := extract(r, options, staging)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RestoreResult{Manifest: manifest}
+	for _, file := range manifest.Files {
+		restored := RestoredFile{File: file, Check: "ok"}
+		restored.Skipped = file.Kind == KindConfig && options.SkipConfig
+		if _, err := os.Stat(filepath.FromSlash(file.Path)); err == nil {
+			restored.Replaces = true
+		}
+		if err := verifyFile(filepath.Join(staging, filepath.FromSlash(file.Path)), file, options.SessionKeys); err != nil {
+			if !errors.Is(err, errNoSessionKey) {
+				return nil, fmt.Errorf("%s: %v", file.Path, err)
+			}
+			restored.Check = fmt.Sprintf("checksum only, encrypted with session key %s which is not configured", file.KeyID)
+		}
+		result.Files = append(result.Files, restored)
+	}
+	if options.DryRun {
+		return result, nil
+	}
+
+	for _, file := range result.Files {
+		if file.Skipped {
+			continue
+		}
+		if err := replaceFile(filepath.Join(staging, filepath.FromSlash(file.Path)), file.File); err != nil {
+			return result, fmt.Errorf("failed to restore %s, the files replaced so far are kept with the %s suffix: %v", file.Path, replacedSuffix, err)
+		}
+	}
+	return result, nil
+}
+
+// extract unpacks an archive into the staging directory and checks it
+// against its manifest
+func extract(r io.Reader, options RestoreOptions, staging string) (*Manifest, error) {
+	archive, err := openArchive(r, options.Passphrase, options.RequireEncryption)
+	if err != nil {
+		return nil, err
+	}
+
+	type extracted struct {
+		size   int64
+		sha256 string
+	}
+	files := make(map[string]extracted)
+	var manifest *Manifest
+	for {
+		header, err := archive.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %v", err)
+		}
+		if manifest != nil {
+			return nil, fmt.Errorf("archive has %s after the manifest", header.Name)
+		}
+		if header.Typeflag != tar.TypeReg || !filepath.IsLocal(filepath.FromSlash(header.Name)) {
+			return nil, fmt.Errorf("archive has an unexpected entry %s", header.Name)
+		}
+
+		if header.Name == manifestName {
+			manifest = &Manifest{}
+			if err := json.NewDecoder(io.LimitReader(archive, 16<<20)).Decode(manifest); err != nil {
+				return nil, fmt.Errorf("failed to read manifest: %v", err)
+			}
+			if manifest.FormatVersion < 1 || manifest.FormatVersion > FormatVersion {
+				return nil, fmt.Errorf("archive format version %d is not supported, this build reads up to version %d", manifest.FormatVersion, FormatVersion)
+			}
+			continue
+		}
+		if _, exists := files[header.Name]; exists {
+			return nil, fmt.Errorf("archive has %s twice", header.Name)
+		}
+		size, sum, err := extractFile(archive, filepath.Join(staging, filepath.FromSlash(header.Name)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to extract %s: %v", header.Name, err)
+		}
+		files[header.Name] = extracted{size: size, sha256: sum}
+	}
+	if manifest == nil {
+		return nil, errors.New("archive has no manifest, it is incomplete or not an auto-dm backup")
+	}
+
+	for _, file := range manifest.Files {
+		got, exists := files[file.Path]
+		if !exists {
+			return nil, fmt.Errorf("%s is missing from the archive", file.Path)
+		}
+		if got.size != file.Size || got.sha256 != file.SHA256 {
+			return nil, fmt.Errorf("%s does not match its checksum", file.Path)
+		}
+		delete(files, file.Path)
+	}
+	for name := range files {
+		return nil, fmt.Errorf("archive has %s, which the manifest does not list", name)
+	}
+	return manifest, nil
+}
+
+// extractFile writes one archive entry and returns its size and SHA-256
+func extractFile(r io.Reader, path string) (int64, string, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return 0, "", err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), r)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), file.Close()
+}
+
+// errNoSessionKey reports an encrypted session store that cannot be decrypted
+// to be verified
+var errNoSessionKey = errors.New("no session key")
+
+// verifyFile checks that an extracted database is intact
+func verifyFile(path string, file File, keys *store.SessionKeys) error {
+	switch file.Kind {
+	case KindDatabase:
+		return store.CheckSQLite(path)
+	case KindSession:
+		sessionStore := store.SessionStore{Phone: file.Sender, Path: path, Encrypted: strings.HasSuffix(path, ".enc")}
+		if sessionStore.Encrypted && (keys == nil || !keys.Has(file.KeyID)) {
+			return errNoSessionKey
+		}
+		return store.VerifySessionStore(sessionStore, keys)
+	case KindConfig:
+		return nil
+	default:
+		return fmt.Errorf("unknown file kind %q", file.Kind)
+	}
+}
+
+// replaceFile moves an extracted file into place. The file it replaces, its
+// SQLite journals and, for a session store, the store in the other encryption
+// state are kept with the .pre-restore suffix, so a stale journal is never
+// applied to the restored database.
+func replaceFile(staged string, file File) error {
+	path := filepath.FromSlash(file.Path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	replaced := []string{path}
+	if file.Kind != KindConfig {
+		replaced = append(replaced, path+"-journal", path+"-wal", path+"-shm")
+	}
+	if file.Kind == KindSession {
+		if plaintext, encrypted := strings.CutSuffix(path, ".enc"); encrypted {
+			replaced = append(replaced, plaintext, plaintext+"-journal", plaintext+"-wal", plaintext+"-shm")
+		} else {
+			replaced = append(replaced, path+".enc")
+		}
+	}
+	for _, old := range replaced {
+		if err := os.Rename(old, old+replacedSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.Rename(staged, path)
+}
+
+// StageRestore verifies an archive and saves it to be restored on the next
+// start, for restores through the admin API while the server is running
+func StageRestore(r io.Reader, options RestoreOptions) (*RestoreResult, error) {
+	if err := os.MkdirAll(filepath.Dir(PendingRestorePath), 0755); err != nil {
+		return nil, err
+	}
+	tmpPath := PendingRestorePath + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save archive: %v", err)
+	}
+	defer os.Remove(tmpPath)
+	_, err = io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to save archive: %v", err)
+	}
+
+	saved, err := os.Open(tmpPath)
+	if err != nil {
+		return nil, err
+	}
+	options.DryRun = true
+	result, err := Restore(saved, options)
+	saved.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmpPath, PendingRestorePath); err != nil {
+		return nil, fmt.Errorf("failed to save archive: %v", err)
+	}
+	return result, nil
+}
+
+// ApplyPendingRestore restores an archive staged by StageRestore. It returns
+// nil if there is none. An archive that fails is renamed to restore.failed,
+// so the next start does not try it again.
+func ApplyPendingRestore(options RestoreOptions) (*RestoreResult, error) {
+	archive, err := os.Open(PendingRestorePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("Restoring staged backup", "archive", PendingRestorePath)
+	result, err := Restore(archive, options)
+	archive.Close()
+	if err != nil {
+		failedPath := strings.TrimSuffix(PendingRestorePath, ".pending") + ".failed"
+		if renameErr := os.Rename(PendingRestorePath, failedPath); renameErr != nil {
+			slog.Warn("Failed to set aside staged backup", "archive", PendingRestorePath, "error", renameErr)
+		}
+		return result, err
+	}
+	return result, os.Remove(PendingRestorePath)
+}
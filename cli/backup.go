@@ -0,0 +1,166 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/jaliph/auto-dm/backup"
+	"github.com/jaliph/auto-dm/config"
+	"github.com/jaliph/auto-dm/database"
+	"github.com/jaliph/auto-dm/store"
+)
+
+// runBackup handles "auto-dm backup". It can run while the server is running.
+func runBackup(cfg *config.Config, version string, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	out := flags.String("out", "", "archive to write (default auto-dm-backup-<time>.tar.gz, .enc when encrypted)")
+	plaintext := flags.Bool("plaintext", false, "do not encrypt the archive even if a backup passphrase is configured")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: auto-dm backup [-out file] [-plaintext]")
+		fmt.Fprintln(os.Stderr, "The archive is encrypted with BACKUP_PASSPHRASE or [backup] passphrase when one is set.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		flags.Usage()
+		return ErrUsage
+	}
+
+	passphrase := cfg.BackupPassphrase
+	if *plaintext {
+		passphrase = ""
+	}
+	if *out == "" {
+		*out = fmt.Sprintf("auto-dm-backup-%s.tar.gz", time.Now().UTC().Format("20060102-150405"))
+		if passphrase != "" {
+			*out += ".enc"
+		}
+	}
+
+	db, err := database.OpenDatabase()
+	if err != nil {
+		return fmt.Errorf("failed to open SQLite database: %v", err)
+	}
+	defer db.Close()
+
+	// Written next to the destination and renamed, so a failed backup never
+	// leaves an archive that looks complete
+	tmpPath := *out + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create archive: %v", err)
+	}
+	defer os.Remove(tmpPath)
+	manifest, err := backup.Create(file, BackupSources(cfg, version, db, nil), passphrase)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, *out)
+	}
+	if err != nil {
+		return fmt.Errorf("backup failed: %v", err)
+	}
+
+	for _, file := range manifest.Files {
+		fmt.Printf("%-40s %-9s %d\n", file.Path, file.Kind, file.Size)
+	}
+	for _, note := range manifest.NotIncluded {
+		fmt.Printf("not included: %s\n", note)
+	}
+	if passphrase == "" {
+		fmt.Println("warning: the archive is not encrypted and holds the WhatsApp sessions of every sender, store it safely")
+	}
+	fmt.Printf("wrote %s with %d file(s)\n", *out, len(manifest.Files))
+	return nil
+}
+
+// runRestore handles "auto-dm restore". Apart from a dry run the server must
+// be stopped, since the restored stores replace the ones it has open.
+func runRestore(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "verify the archive and list what would be restored, without changing anything")
+	skipConfig := flags.Bool("skip-config", false, "keep the current "+config.File)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: auto-dm restore [-dry-run] [-skip-config] archive")
+		fmt.Fprintln(os.Stderr, "Stop the server before restoring. Replaced files are kept with the .pre-restore suffix.")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		flags.Usage()
+		return ErrUsage
+	}
+
+	keys, err := store.LoadSessionKeys(SessionKeyConfig(cfg))
+	if err != nil {
+		return fmt.Errorf("invalid session encryption configuration: %v", err)
+	}
+	archive, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %v", err)
+	}
+	defer archive.Close()
+
+	result, err := backup.Restore(archive, backup.RestoreOptions{
+		Passphrase:  cfg.BackupPassphrase,
+		SessionKeys: keys,
+		SkipConfig:  *skipConfig,
+		DryRun:      *dryRun,
+	})
+	if result != nil {
+		printRestore(result)
+	}
+	if err != nil {
+		return fmt.Errorf("restore failed: %v", err)
+	}
+	if *dryRun {
+		fmt.Printf("archive verified, %d file(s) would be restored\n", len(result.Files))
+		return nil
+	}
+	fmt.Printf("restored %d file(s), replaced files are kept with the .pre-restore suffix\n", len(result.Files))
+	return nil
+}
+
+// printRestore lists the files of a restore
+func printRestore(result *backup.RestoreResult) {
+	fmt.Printf("backup taken %s by version %s, %s session layout\n", result.Manifest.CreatedAt.Format(time.RFC3339), result.Manifest.AppVersion, result.Manifest.SessionLayout)
+	for _, file := range result.Files {
+		action := "new"
+		switch {
+		case file.Skipped:
+			action = "skipped"
+		case file.Replaces:
+			action = "replace"
+		}
+		fmt.Printf("%-40s %-9s %-10d %-8s %s\n", file.Path, file.Kind, file.Size, action, file.Check)
+	}
+}
+
+// ApplyPendingRestore restores a backup staged through the admin API and
+// reports whether it replaced the configuration file. The server calls it
+// before opening any database.
+func ApplyPendingRestore(cfg *config.Config) (bool, error) {
+	// A broken key configuration is reported when the session stores open;
+	// without keys encrypted stores are only checked against their checksums
+	keys, _ := store.LoadSessionKeys(SessionKeyConfig(cfg))
+	result, err := backup.ApplyPendingRestore(backup.RestoreOptions{
+		Passphrase:        cfg.BackupPassphrase,
+		RequireEncryption: true,
+		SessionKeys:       keys,
+	})
+	if err != nil || result == nil {
+		return false, err
+	}
+
+	restoredConfig := false
+	for _, file := range result.Files {
+		restoredConfig = restoredConfig || file.Kind == backup.KindConfig
+	}
+	slog.Info("Restored staged backup", "created_at", result.Manifest.CreatedAt, "files", len(result.Files))
+	return restoredConfig, nil
+}
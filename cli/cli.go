@@ -0,0 +1,72 @@
+// Package cli implements the auto-dm subcommands that run instead of the server:
+// migrate, sessions, backup and restore
+package cli
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/jaliph/auto-dm/backup"
+	"github.com/jaliph/auto-dm/config"
+	"github.com/jaliph/auto-dm/database"
+	"github.com/jaliph/auto-dm/store"
+)
+
+// ErrUsage is returned when a subcommand is called with invalid arguments, after
+// printing its usage. Errors wrapping it explain what is missing instead.
+var ErrUsage = errors.New("invalid usage")
+
+// Run runs the subcommand named by args[0] with the remaining arguments.
+// It reports false if args don't name a subcommand, so the server should start.
+func Run(cfg *config.Config, version string, args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	switch args[0] {
+	case "migrate":
+		return true, runMigrate(cfg, args[1:])
+	case "sessions":
+		return true, runSessions(cfg, args[1:])
+	case "backup":
+		return true, runBackup(cfg, version, args[1:])
+	case "restore":
+		return true, runRestore(cfg, args[1:])
+	}
+	return false, nil
+}
+
+// SessionStoreConfig returns where the whatsmeow device sessions are kept
+func SessionStoreConfig(cfg *config.Config) store.SessionStoreConfig {
+	return store.SessionStoreConfig{
+		Layout:  cfg.SessionStoreLayout,
+		Dialect: cfg.SessionStoreDialect,
+		Address: cfg.SessionStoreAddress,
+	}
+}
+
+// SessionKeyConfig returns where the session store keys come from
+func SessionKeyConfig(cfg *config.Config) store.SessionKeyConfig {
+	keyConfig := store.SessionKeyConfig{
+		Key:     cfg.SessionKey,
+		KeyFile: cfg.SessionKeyFile,
+		Keyring: cfg.SessionKeyring,
+	}
+	for _, key := range strings.Split(cfg.SessionPreviousKeys, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keyConfig.PreviousKeys = append(keyConfig.PreviousKeys, key)
+		}
+	}
+	return keyConfig
+}
+
+// BackupSources returns what backups are taken from. Without a running
+// server sessions is nil and the session stores are read from disk.
+func BackupSources(cfg *config.Config, version string, db *database.Database, sessions *store.UserStoreManager) backup.Sources {
+	return backup.Sources{
+		Database:      db,
+		Sessions:      sessions,
+		SessionStores: SessionStoreConfig(cfg),
+		ConfigPath:    config.File,
+		AppVersion:    version,
+	}
+}
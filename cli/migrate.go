@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jaliph/auto-dm/config"
+	"github.com/jaliph/auto-dm/database"
+)
+
+// runMigrate handles "auto-dm migrate up|down|status"
+func runMigrate(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	target := flags.String("db", "all", "database to migrate: store, mssql or all")
+	steps := flags.Int("steps", 1, "number of migrations to revert with down")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: auto-dm migrate up|down|status [-db store|mssql|all] [-steps N]")
+		flags.PrintDefaults()
+	}
+	if len(args) == 0 {
+		flags.Usage()
+		return ErrUsage
+	}
+	command := args[0]
+	if err := flags.Parse(args[1:]); err != nil {
+		return ErrUsage
+	}
+	if command != "up" && command != "down" && command != "status" {
+		flags.Usage()
+		return ErrUsage
+	}
+	if *target != "store" && *target != "mssql" && *target != "all" {
+		flags.Usage()
+		return ErrUsage
+	}
+
+	var migrators []*database.Migrator
+	if *target == "store" || *target == "all" {
+		db, err := database.OpenDatabase()
+		if err != nil {
+			return fmt.Errorf("failed to open SQLite database: %v", err)
+		}
+		defer db.Close()
+		migrators = append(migrators, db.Migrator())
+	}
+	if *target == "mssql" || *target == "all" {
+		gormDB, err := database.OpenGormDB(cfg.MSSQLServer, cfg.MSSQLDatabase, cfg.MSSQLUsername, cfg.MSSQLPassword)
+		if err != nil {
+			return fmt.Errorf("failed to open MSSQL: %v", err)
+		}
+		defer gormDB.Close()
+		migrators = append(migrators, gormDB.Migrator())
+	}
+
+	for _, migrator := range migrators {
+		switch command {
+		case "up":
+			applied, err := migrator.Up()
+			if err != nil {
+				return fmt.Errorf("%s: migration failed after applying %d: %v", migrator.Name(), applied, err)
+			}
+			fmt.Printf("%s: applied %d migration(s), schema is at version %d\n", migrator.Name(), applied, migrator.Latest())
+		case "down":
+			reverted, err := migrator.Down(*steps)
+			if err != nil {
+				return fmt.Errorf("%s: migration failed after reverting %d: %v", migrator.Name(), reverted, err)
+			}
+			current, _ := migrator.Current()
+			fmt.Printf("%s: reverted %d migration(s), schema is at version %d\n", migrator.Name(), reverted, current)
+		case "status":
+			statuses, err := migrator.Status()
+			if err != nil {
+				return fmt.Errorf("%s: failed to read migration status: %v", migrator.Name(), err)
+			}
+			fmt.Printf("%s (this build supports up to version %d):\n", migrator.Name(), migrator.Latest())
+			for _, status := range statuses {
+				applied := "pending"
+				if status.AppliedAt != nil {
+					applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+				}
+				fmt.Printf("  %4d  %-40s %s\n", status.Version, status.Name, applied)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/jaliph/auto-dm/config"
+	"github.com/jaliph/auto-dm/store"
+)
+
+// runSessions handles "auto-dm sessions status|encrypt|decrypt|rotate|keygen|merge".
+// Apart from status and keygen the server must be stopped, since it keeps the
+// stores it has open in memory.
+func runSessions(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("sessions", flag.ContinueOnError)
+	generate := flags.Bool("generate", false, "rotate: add a new key to the keyring and make it active first")
+	prune := flags.Bool("prune", false, "rotate: remove the other keys from the keyring once every store is rotated")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: auto-dm sessions status|encrypt|decrypt|rotate|keygen|merge [-generate] [-prune]")
+		fmt.Fprintln(os.Stderr, "Stop the server before running encrypt, decrypt, rotate or merge.")
+		flags.PrintDefaults()
+	}
+	if len(args) == 0 {
+		flags.Usage()
+		return ErrUsage
+	}
+	command := args[0]
+	if err := flags.Parse(args[1:]); err != nil {
+		return ErrUsage
+	}
+
+	keyConfig := SessionKeyConfig(cfg)
+	switch command {
+	case "keygen":
+		key, err := store.GenerateSessionKey()
+		if err != nil {
+			return fmt.Errorf("failed to generate session key: %v", err)
+		}
+		fmt.Println(key)
+		return nil
+	case "rotate":
+		if *generate {
+			if keyConfig.Keyring == "" {
+				return fmt.Errorf("%w: -generate needs a keyring, set SESSION_KEYRING or [session_encryption] keyring", ErrUsage)
+			}
+			id, err := store.GenerateKeyringKey(keyConfig.Keyring)
+			if err != nil {
+				return fmt.Errorf("failed to generate keyring key: %v", err)
+			}
+			fmt.Printf("generated key %s in %s\n", id, keyConfig.Keyring)
+		}
+	case "merge":
+		return runSessionsMerge(cfg)
+	case "status", "encrypt", "decrypt":
+	default:
+		flags.Usage()
+		return ErrUsage
+	}
+
+	keys, err := store.LoadSessionKeys(keyConfig)
+	if err != nil {
+		return fmt.Errorf("invalid session encryption configuration: %v", err)
+	}
+	if keys == nil && command != "status" {
+		return fmt.Errorf("%w: no session key configured, set SESSION_KEY, SESSION_KEY_FILE or SESSION_KEYRING", ErrUsage)
+	}
+	stores, err := store.ListSessionStores(SessionStoreConfig(cfg).SharedSQLitePath())
+	if err != nil {
+		return fmt.Errorf("failed to list session stores: %v", err)
+	}
+
+	failed := 0
+	for _, sessionStore := range stores {
+		switch {
+		case command == "status":
+			state := "plaintext"
+			if sessionStore.Encrypted {
+				state = "encrypted with key " + sessionStore.KeyID
+				if keys != nil && sessionStore.KeyID != keys.ActiveID() {
+					state += " (not the active key, run rotate)"
+				}
+			}
+			fmt.Printf("%-16s %-10d %s\n", sessionStoreLabel(sessionStore), sessionStore.Size, state)
+			continue
+		case command == "encrypt" && !sessionStore.Encrypted:
+			err = store.EncryptSessionStore(sessionStore, keys)
+		case command == "decrypt" && sessionStore.Encrypted:
+			err = store.DecryptSessionStore(sessionStore, keys)
+		case command == "rotate" && sessionStore.Encrypted:
+			var rotated bool
+			if rotated, err = store.RotateSessionStore(sessionStore, keys); err == nil && !rotated {
+				continue
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			slog.Error("Failed to "+command+" session store", "store", sessionStoreLabel(sessionStore), "error", err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: %sed\n", sessionStoreLabel(sessionStore), strings.TrimSuffix(command, "e"))
+	}
+	if command == "status" {
+		if keys != nil {
+			fmt.Printf("active key: %s\n", keys.ActiveID())
+		}
+		return nil
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d session store(s) failed", failed)
+	}
+
+	if command == "rotate" && *prune {
+		if keyConfig.Keyring == "" {
+			fmt.Println("every store uses the active key, SESSION_PREVIOUS_KEYS can now be removed")
+			return nil
+		}
+		removed, err := store.PruneKeyring(keyConfig.Keyring)
+		if err != nil {
+			return fmt.Errorf("failed to prune keyring: %v", err)
+		}
+		fmt.Printf("removed %d old key(s) from %s\n", removed, keyConfig.Keyring)
+	}
+	return nil
+}
+
+// runSessionsMerge handles "auto-dm sessions merge"
+func runSessionsMerge(cfg *config.Config) error {
+	keys, err := store.LoadSessionKeys(SessionKeyConfig(cfg))
+	if err != nil {
+		return fmt.Errorf("invalid session encryption configuration: %v", err)
+	}
+	merged, err := store.MergeSessionStores(SessionStoreConfig(cfg), keys)
+	if err != nil {
+		return fmt.Errorf("failed to merge session stores: %v", err)
+	}
+
+	failed := 0
+	for _, result := range merged {
+		if result.Err != nil {
+			slog.Error("Failed to merge session store", "sender", result.Phone, "error", result.Err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s: merged %d device(s), %d new row(s)\n", result.Phone, result.Devices, result.Rows)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d session store(s) failed", failed)
+	}
+	fmt.Println("the per-sender files in db/ are no longer used and can be removed once the senders connect")
+	return nil
+}
+
+// sessionStoreLabel names a session store in the sessions command output
+func sessionStoreLabel(sessionStore store.SessionStore) string {
+	if sessionStore.Phone == "" {
+		return "(shared)"
+	}
+	return sessionStore.Phone
+}
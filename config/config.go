@@ -1,7 +1,7 @@
 package config
 
 import (
-	"log"
+	"log/slog"
 	"os"
 	"strconv"
 
@@ -17,15 +17,57 @@ type Config struct {
 	MSSQLPassword string
 
 	// API settings
-	APIPort string
+	APIPort         string
+	ShutdownTimeout int // seconds to drain requests and close connections on shutdown
 
 	// WhatsApp settings
 	ConnectionCheckInterval int // in minutes
 
+	// History sync settings
+	HistoryImport       bool // import past conversations WhatsApp sends after linking
+	HistoryLookbackDays int  // only import messages from the last N days (0 = all)
+
 	// File sharing settings
 	FileShareFolder string // folder path for file sharing
+
+	// Readiness settings
+	ReadyMinConnectedSenders int // /readyz fails with fewer connected senders than this
+	ReadyMinConnectedPercent int // /readyz fails when fewer than this percent of linked senders are connected
+
+	// Retention settings
+	RetentionMessageDays     int    // delete or anonymize messages older than N days (0 = keep forever)
+	RetentionMode            string // "delete" or "anonymize"
+	RetentionRules           string // per sender and type overrides, <sender|*>/<type|*>=<days>[:mode],...
+	RetentionMediaDays       int    // clear media references of messages older than N days (0 = keep)
+	RetentionSoftDeletedDays int    // hard-delete messages soft-deleted more than N days ago (0 = keep)
+	RetentionInterval        int    // in minutes
+	RetentionBatchSize       int    // messages purged per statement
+
+	// Session store settings
+	SessionStoreLayout  string // "per_sender" (a SQLite file each) or "shared" (one container)
+	SessionStoreDialect string // shared layout: "sqlite3" or "postgres"
+	SessionStoreAddress string // shared layout: SQLite file or PostgreSQL connection URL
+
+	// Session encryption settings (at most one key source)
+	SessionKey          string // base64 AES-256 key
+	SessionKeyFile      string // file holding a base64 AES-256 key
+	SessionKeyring      string // local keyring file standing in for a key management service
+	SessionPreviousKeys string // comma-separated base64 keys stores may still be encrypted with
+
+	// Backup settings
+	BackupPassphrase   string // encrypts backup archives, required for the admin backup API
+	BackupToken        string // bearer token for the admin backup API, which is local only without one
+	BackupMaxRestoreMB int    // largest archive the admin restore API accepts, in MiB
+
+	// Logging settings
+	LogLevel  string // "debug", "info", "warn" or "error"
+	LogFormat string // "text" or "json"
+	LogRedact bool   // mask phone numbers and message bodies in logs
 }
 
+// File is the configuration file, read from the working directory
+const File = "config.ini"
+
 // LoadConfig loads configuration from config.ini file or environment variables
 func LoadConfig() *Config {
 	config := &Config{
@@ -36,19 +78,57 @@ func LoadConfig() *Config {
 		MSSQLPassword: getEnv("MSSQL_PASSWORD", "YourStrong@Passw0rd"),
 
 		// API settings
-		APIPort: getEnv("API_PORT", ":8080"),
+		APIPort:         getEnv("API_PORT", ":8080"),
+		ShutdownTimeout: getEnvInt("SHUTDOWN_TIMEOUT", 30),
 
 		// WhatsApp settings
 		ConnectionCheckInterval: 1, // 1 minute
 
+		// History sync settings
+		HistoryImport:       getEnvBool("HISTORY_IMPORT", false),
+		HistoryLookbackDays: getEnvInt("HISTORY_LOOKBACK_DAYS", 30),
+
 		// File sharing settings
 		FileShareFolder: getEnv("FILE_SHARE_FOLDER", "./files"),
+
+		// Readiness settings
+		ReadyMinConnectedSenders: getEnvInt("READY_MIN_CONNECTED_SENDERS", 0),
+		ReadyMinConnectedPercent: getEnvInt("READY_MIN_CONNECTED_PERCENT", 50),
+
+		// Retention settings
+		RetentionMessageDays:     getEnvInt("RETENTION_MESSAGE_DAYS", 0),
+		RetentionMode:            getEnv("RETENTION_MODE", "delete"),
+		RetentionRules:           getEnv("RETENTION_RULES", ""),
+		RetentionMediaDays:       getEnvInt("RETENTION_MEDIA_DAYS", 0),
+		RetentionSoftDeletedDays: getEnvInt("RETENTION_SOFT_DELETED_DAYS", 0),
+		RetentionInterval:        getEnvInt("RETENTION_INTERVAL_MINUTES", 60),
+		RetentionBatchSize:       getEnvInt("RETENTION_BATCH_SIZE", 500),
+
+		// Session store settings
+		SessionStoreLayout:  getEnv("SESSION_STORE_LAYOUT", "per_sender"),
+		SessionStoreDialect: getEnv("SESSION_STORE_DIALECT", "sqlite3"),
+		SessionStoreAddress: getEnv("SESSION_STORE_ADDRESS", ""),
+
+		// Session encryption settings
+		SessionKey:          getEnv("SESSION_KEY", ""),
+		SessionKeyFile:      getEnv("SESSION_KEY_FILE", ""),
+		SessionKeyring:      getEnv("SESSION_KEYRING", ""),
+		SessionPreviousKeys: getEnv("SESSION_PREVIOUS_KEYS", ""),
+
+		// Backup settings
+		BackupPassphrase:   getEnv("BACKUP_PASSPHRASE", ""),
+		BackupToken:        getEnv("BACKUP_TOKEN", ""),
+		BackupMaxRestoreMB: getEnvInt("BACKUP_MAX_RESTORE_MB", 1024),
+
+		// Logging settings
+		LogLevel:  getEnv("LOG_LEVEL", "info"),
+		LogFormat: getEnv("LOG_FORMAT", "text"),
+		LogRedact: getEnvBool("LOG_REDACT", false),
 	}
 
 	// Try to load from config.ini file
 	if err := loadFromINI(config); err != nil {
-		log.Printf("Warning: Failed to load config.ini: %v", err)
-		log.Println("Using environment variables or defaults")
+		slog.Warn("Failed to load config.ini, using environment variables or defaults", "error", err)
 	}
 
 	return config
@@ -56,7 +136,7 @@ func LoadConfig() *Config {
 
 // loadFromINI loads configuration from config.ini file
 func loadFromINI(config *Config) error {
-	cfg, err := ini.Load("config.ini")
+	cfg, err := ini.Load(File)
 	if err != nil {
 		return err
 	}
@@ -82,6 +162,11 @@ func loadFromINI(config *Config) error {
 		if port := apiSection.Key("port").String(); port != "" {
 			config.APIPort = port
 		}
+		if timeout := apiSection.Key("shutdown_timeout").String(); timeout != "" {
+			if val, err := strconv.Atoi(timeout); err == nil {
+				config.ShutdownTimeout = val
+			}
+		}
 	}
 
 	// WhatsApp section
@@ -91,6 +176,16 @@ func loadFromINI(config *Config) error {
 				config.ConnectionCheckInterval = val
 			}
 		}
+		if historyImport := waSection.Key("history_import").String(); historyImport != "" {
+			if val, err := strconv.ParseBool(historyImport); err == nil {
+				config.HistoryImport = val
+			}
+		}
+		if lookback := waSection.Key("history_lookback_days").String(); lookback != "" {
+			if val, err := strconv.Atoi(lookback); err == nil {
+				config.HistoryLookbackDays = val
+			}
+		}
 	}
 
 	// File sharing section
@@ -100,6 +195,114 @@ func loadFromINI(config *Config) error {
 		}
 	}
 
+	// Health section
+	if healthSection := cfg.Section("health"); healthSection != nil {
+		if minSenders := healthSection.Key("min_connected_senders").String(); minSenders != "" {
+			if val, err := strconv.Atoi(minSenders); err == nil {
+				config.ReadyMinConnectedSenders = val
+			}
+		}
+		if minPercent := healthSection.Key("min_connected_percent").String(); minPercent != "" {
+			if val, err := strconv.Atoi(minPercent); err == nil {
+				config.ReadyMinConnectedPercent = val
+			}
+		}
+	}
+
+	// Retention section
+	if retentionSection := cfg.Section("retention"); retentionSection != nil {
+		if days := retentionSection.Key("message_days").String(); days != "" {
+			if val, err := strconv.Atoi(days); err == nil {
+				config.RetentionMessageDays = val
+			}
+		}
+		if mode := retentionSection.Key("mode").String(); mode != "" {
+			config.RetentionMode = mode
+		}
+		if rules := retentionSection.Key("rules").String(); rules != "" {
+			config.RetentionRules = rules
+		}
+		if days := retentionSection.Key("media_days").String(); days != "" {
+			if val, err := strconv.Atoi(days); err == nil {
+				config.RetentionMediaDays = val
+			}
+		}
+		if days := retentionSection.Key("soft_deleted_days").String(); days != "" {
+			if val, err := strconv.Atoi(days); err == nil {
+				config.RetentionSoftDeletedDays = val
+			}
+		}
+		if interval := retentionSection.Key("interval_minutes").String(); interval != "" {
+			if val, err := strconv.Atoi(interval); err == nil {
+				config.RetentionInterval = val
+			}
+		}
+		if batchSize := retentionSection.Key("batch_size").String(); batchSize != "" {
+			if val, err := strconv.Atoi(batchSize); err == nil {
+				config.RetentionBatchSize = val
+			}
+		}
+	}
+
+	// Session store section
+	if storeSection := cfg.Section("session_store"); storeSection != nil {
+		if layout := storeSection.Key("layout").String(); layout != "" {
+			config.SessionStoreLayout = layout
+		}
+		if dialect := storeSection.Key("dialect").String(); dialect != "" {
+			config.SessionStoreDialect = dialect
+		}
+		if address := storeSection.Key("address").String(); address != "" {
+			config.SessionStoreAddress = address
+		}
+	}
+
+	// Session encryption section
+	if sessionSection := cfg.Section("session_encryption"); sessionSection != nil {
+		if key := sessionSection.Key("key").String(); key != "" {
+			config.SessionKey = key
+		}
+		if keyFile := sessionSection.Key("key_file").String(); keyFile != "" {
+			config.SessionKeyFile = keyFile
+		}
+		if keyring := sessionSection.Key("keyring").String(); keyring != "" {
+			config.SessionKeyring = keyring
+		}
+		if previousKeys := sessionSection.Key("previous_keys").String(); previousKeys != "" {
+			config.SessionPreviousKeys = previousKeys
+		}
+	}
+
+	// Backup section
+	if backupSection := cfg.Section("backup"); backupSection != nil {
+		if passphrase := backupSection.Key("passphrase").String(); passphrase != "" {
+			config.BackupPassphrase = passphrase
+		}
+		if token := backupSection.Key("token").String(); token != "" {
+			config.BackupToken = token
+		}
+		if maxRestore := backupSection.Key("max_restore_mb").String(); maxRestore != "" {
+			if val, err := strconv.Atoi(maxRestore); err == nil {
+				config.BackupMaxRestoreMB = val
+			}
+		}
+	}
+
+	// Logging section
+	if logSection := cfg.Section("logging"); logSection != nil {
+		if level := logSection.Key("level").String(); level != "" {
+			config.LogLevel = level
+		}
+		if format := logSection.Key("format").String(); format != "" {
+			config.LogFormat = format
+		}
+		if redact := logSection.Key("redact").String(); redact != "" {
+			if val, err := strconv.ParseBool(redact); err == nil {
+				config.LogRedact = val
+			}
+		}
+	}
+
 	return nil
 }
 
@@ -110,3 +313,23 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// getEnvBool gets a boolean environment variable or returns a default value
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if val, err := strconv.ParseBool(value); err == nil {
+			return val
+		}
+	}
+	return defaultValue
+}
+
+// getEnvInt gets an integer environment variable or returns a default value
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if val, err := strconv.Atoi(value); err == nil {
+			return val
+		}
+	}
+	return defaultValue
+}
@@ -0,0 +1,71 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jaliph/auto-dm/models"
+)
+
+// AuditFilter selects audit entries. Empty fields match everything.
+type AuditFilter struct {
+	Actor       string
+	Action      string
+	SenderPhone string
+	Target      string
+	MessageID   string
+	RequestID   string
+	Outcome     string
+	From        time.Time
+	To          time.Time
+	Limit       int // 0 returns all matching entries
+}
+
+// StoreAuditEntry appends an entry to the audit log
+func (gdb *GormDB) StoreAuditEntry(entry *models.AuditEntry) error {
+	if err := gdb.db.Create(entry).Error; err != nil {
+		return fmt.Errorf("failed to store audit entry: %v", err)
+	}
+	return nil
+}
+
+// GetAuditEntries retrieves audit entries matching a filter, newest first
+func (gdb *GormDB) GetAuditEntries(filter AuditFilter) ([]models.AuditEntry, error) {
+	query := gdb.db.Model(&models.AuditEntry{})
+	if filter.Actor != "" {
+		query = query.Where("actor = ?", filter.Actor)
+	}
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	if filter.SenderPhone != "" {
+		query = query.Where("sender_phone = ?", filter.SenderPhone)
+	}
+	if filter.Target != "" {
+		query = query.Where("target = ?", filter.Target)
+	}
+	if filter.MessageID != "" {
+		query = query.Where("message_id = ?", filter.MessageID)
+	}
+	if filter.RequestID != "" {
+		query = query.Where("request_id = ?", filter.RequestID)
+	}
+	if filter.Outcome != "" {
+		query = query.Where("outcome = ?", filter.Outcome)
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("timestamp >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("timestamp < ?", filter.To)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+
+	var entries []models.AuditEntry
+	if err := query.Order("timestamp DESC, id DESC").Find(&entries).Error; err != nil {
+		return nil, fmt.Errorf("failed to get audit entries: %v", err)
+	}
+	return entries, nil
+}
@@ -1,74 +1,53 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
-	"time"
 
 	"github.com/jaliph/auto-dm/models"
 	_ "github.com/mattn/go-sqlite3"
 )
 
-// Database represents the database connection and operations
+// Database represents the database connection and operations. Sender changes
+// are recorded in an outbox that SenderRelay publishes to MSSQL.
 type Database struct {
-	db     *sql.DB
-	gormDB *GormDB
+	db           *sql.DB
+	outboxNotify chan struct{} // signalled after each sender change
 }
 
-// NewDatabase creates a new database instance
-func NewDatabase(gormDB *GormDB) (*Database, error) {
-	// Ensure db directory exists (cross-platform permissions)
-	if err := os.MkdirAll("db", 0755); err != nil {
-		return nil, fmt.Errorf("failed to create db directory: %v", err)
-	}
-
-	db, err := sql.Open("sqlite3", filepath.Join("db", "store.db")+"?_foreign_keys=on")
+// NewDatabase opens store.db and applies any pending schema migrations
+func NewDatabase() (*Database, error) {
+	database, err := OpenDatabase()
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %v", err)
+		return nil, err
 	}
 
-	database := &Database{db: db, gormDB: gormDB}
-	if err := database.init(); err != nil {
+	if _, err := database.Migrator().Up(); err != nil {
+		database.Close()
 		return nil, err
 	}
 
+	slog.Info("Database initialized successfully")
 	return database, nil
 }
 
-// init initializes the database tables
-func (d *Database) init() error {
-	// Create phone_map table
-	_, err := d.db.Exec(`
-		CREATE TABLE IF NOT EXISTS phone_map (
-			phone TEXT PRIMARY KEY,
-			device_id TEXT NOT NULL,
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
-		)
-	`)
-	if err != nil {
-		return fmt.Errorf("failed to create phone_map table: %v", err)
+// OpenDatabase opens store.db without migrating it, for the migrate command
+func OpenDatabase() (*Database, error) {
+	// Ensure db directory exists (cross-platform permissions)
+	if err := os.MkdirAll("db", 0755); err != nil {
+		return nil, fmt.Errorf("failed to create db directory: %v", err)
 	}
 
-	// Create senders table
-	_, err = d.db.Exec(`
-		CREATE TABLE IF NOT EXISTS senders (
-			phone TEXT PRIMARY KEY,
-			device_id TEXT,
-			status TEXT NOT NULL DEFAULT 'pending',
-			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			authenticated_at TIMESTAMP,
-			invalidated_at TIMESTAMP
-		)
-	`)
+	db, err := sql.Open("sqlite3", filepath.Join("db", "store.db")+"?_foreign_keys=on")
 	if err != nil {
-		return fmt.Errorf("failed to create senders table: %v", err)
+		return nil, fmt.Errorf("failed to open database: %v", err)
 	}
 
-	log.Println("Database initialized successfully")
-	return nil
+	return &Database{db: db, outboxNotify: make(chan struct{}, 1)}, nil
 }
 
 // StorePhoneMapping stores a phone number to device ID mapping
@@ -102,7 +81,7 @@ func (d *Database) GetAllPhoneMappings() (map[string]string, error) {
 	for rows.Next() {
 		var phone, deviceID string
 		if err := rows.Scan(&phone, &deviceID); err != nil {
-			log.Printf("Failed to scan phone mapping: %v", err)
+			slog.Warn("Failed to scan phone mapping", "error", err)
 			continue
 		}
 		mappings[phone] = deviceID
@@ -130,52 +109,47 @@ func (d *Database) PhoneExists(phone string) bool {
 // Sender methods
 // CreateSender creates a new sender record
 func (d *Database) CreateSender(phone string) error {
-	_, err := d.db.Exec("INSERT INTO senders (phone, status) VALUES (?, 'pending')", phone)
-	if err != nil {
-		return fmt.Errorf("failed to create sender: %v", err)
-	}
-
-	// Sync to MSSQL if available
-	if d.gormDB != nil {
-		sender := &models.Sender{
-			Phone:     phone,
-			Status:    "pending",
-			CreatedAt: time.Now(),
+	return d.changeSender(phone, func(tx *sql.Tx) (sql.Result, error) {
+		result, err := tx.Exec("INSERT INTO senders (phone, status) VALUES (?, 'pending')", phone)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create sender: %v", err)
 		}
-		return d.gormDB.SyncSenderToMSSQL(sender)
-	}
-	return nil
+		return result, nil
+	})
 }
 
+// senderColumns are the columns read by scanSender
+const senderColumns = "phone, device_id, status, created_at, authenticated_at, invalidated_at"
+
 // GetSender retrieves a sender by phone number
 func (d *Database) GetSender(phone string) (*models.Sender, error) {
+	sender, err := scanSender(d.db.QueryRow("SELECT "+senderColumns+" FROM senders WHERE phone = ?", phone))
+	if err != nil {
+		return nil, fmt.Errorf("sender not found: %v", err)
+	}
+	return sender, nil
+}
+
+// scanSender reads a sender selected with senderColumns
+func scanSender(row interface{ Scan(dest ...any) error }) (*models.Sender, error) {
 	var s models.Sender
 	var deviceID sql.NullString
 	var authenticatedAt, invalidatedAt sql.NullTime
 
-	err := d.db.QueryRow(`
-		SELECT phone, device_id, status, created_at, authenticated_at, invalidated_at 
-		FROM senders WHERE phone = ?
-	`, phone).Scan(&s.Phone, &deviceID, &s.Status, &s.CreatedAt, &authenticatedAt, &invalidatedAt)
-
-	if err != nil {
-		return nil, fmt.Errorf("sender not found: %v", err)
+	if err := row.Scan(&s.Phone, &deviceID, &s.Status, &s.CreatedAt, &authenticatedAt, &invalidatedAt); err != nil {
+		return nil, err
 	}
 
 	// Handle NULL device_id
 	if deviceID.Valid {
 		s.DeviceID = deviceID.String
-	} else {
-		s.DeviceID = ""
 	}
-
 	if authenticatedAt.Valid {
 		s.AuthenticatedAt = &authenticatedAt.Time
 	}
 	if invalidatedAt.Valid {
 		s.InvalidatedAt = &invalidatedAt.Time
 	}
-
 	return &s, nil
 }
 
@@ -191,29 +165,24 @@ func (d *Database) UpdateSenderStatus(phone, status string) error {
 		query = "UPDATE senders SET status = ? WHERE phone = ?"
 	}
 
-	_, err := d.db.Exec(query, status, phone)
-	if err != nil {
-		return fmt.Errorf("failed to update sender status: %v", err)
-	}
-
-	// Sync to MSSQL if available
-	if d.gormDB != nil {
-		sender, err := d.GetSender(phone)
+	return d.changeSender(phone, func(tx *sql.Tx) (sql.Result, error) {
+		result, err := tx.Exec(query, status, phone)
 		if err != nil {
-			return fmt.Errorf("failed to get sender for sync: %v", err)
+			return nil, fmt.Errorf("failed to update sender status: %v", err)
 		}
-		return d.gormDB.SyncSenderToMSSQL(sender)
-	}
-	return nil
+		return result, nil
+	})
 }
 
 // UpdateSenderDeviceID updates the device ID of a sender
 func (d *Database) UpdateSenderDeviceID(phone, deviceID string) error {
-	_, err := d.db.Exec("UPDATE senders SET device_id = ? WHERE phone = ?", deviceID, phone)
-	if err != nil {
-		return fmt.Errorf("failed to update sender device ID: %v", err)
-	}
-	return nil
+	return d.changeSender(phone, func(tx *sql.Tx) (sql.Result, error) {
+		result, err := tx.Exec("UPDATE senders SET device_id = ? WHERE phone = ?", deviceID, phone)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update sender device ID: %v", err)
+		}
+		return result, nil
+	})
 }
 
 // GetAllSenders retrieves all senders
@@ -235,7 +204,7 @@ func (d *Database) GetAllSenders() ([]*models.Sender, error) {
 
 		err := rows.Scan(&s.Phone, &deviceID, &s.Status, &s.CreatedAt, &authenticatedAt, &invalidatedAt)
 		if err != nil {
-			log.Printf("Failed to scan sender: %v", err)
+			slog.Warn("Failed to scan sender", "error", err)
 			continue
 		}
 
@@ -269,21 +238,49 @@ func (d *Database) SenderExists(phone string) bool {
 // DeleteSender deletes a sender from the database
 func (d *Database) DeleteSender(phone string) error {
 	// Delete from senders table
-	_, err := d.db.Exec("DELETE FROM senders WHERE phone = ?", phone)
+	err := d.changeSender(phone, func(tx *sql.Tx) (sql.Result, error) {
+		result, err := tx.Exec("DELETE FROM senders WHERE phone = ?", phone)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete sender: %v", err)
+		}
+		return result, nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to delete sender: %v", err)
+		return err
 	}
 
 	// Delete from phone_map table (if exists)
 	_, err = d.db.Exec("DELETE FROM phone_map WHERE phone = ?", phone)
 	if err != nil {
-		log.Printf("Warning: Failed to delete phone mapping for %s: %v", phone, err)
+		slog.Warn("Failed to delete phone mapping", "sender", phone, "error", err)
 		// Don't return error as the main deletion succeeded
 	}
 
 	return nil
 }
 
+// Ping checks that store.db can still be queried
+func (d *Database) Ping(ctx context.Context) error {
+	var count int
+	return d.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM senders").Scan(&count)
+}
+
+// Snapshot returns a consistent copy of store.db. VACUUM INTO copies the
+// database inside a read transaction, so it can run while senders change.
+func (d *Database) Snapshot() ([]byte, error) {
+	// VACUUM INTO accepts an empty file, so the copy gets a unique name
+	copyFile, err := os.CreateTemp("db", ".snapshot-*.db")
+	if err != nil {
+		return nil, fmt.Errorf("failed to snapshot store.db: %v", err)
+	}
+	copyFile.Close()
+	defer os.Remove(copyFile.Name())
+	if _, err := d.db.Exec("VACUUM INTO ?", copyFile.Name()); err != nil {
+		return nil, fmt.Errorf("failed to snapshot store.db: %v", err)
+	}
+	return os.ReadFile(copyFile.Name())
+}
+
 // Close closes the database connection
 func (d *Database) Close() error {
 	return d.db.Close()
@@ -1,62 +1,341 @@
 package database
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"sort"
+	"sync/atomic"
 	"time"
 
 	"gorm.io/driver/sqlserver"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
 
+	"github.com/jaliph/auto-dm/metrics"
 	"github.com/jaliph/auto-dm/models"
 )
 
-// GormDB represents the GORM database connection
+// followUpMessageTypes are stored as separate rows but shown on their original message
+var followUpMessageTypes = []string{"reaction", "edit", "revoke"}
+
+// GormDB represents the GORM database connection. Message writes made while
+// MSSQL is unavailable are spooled to disk and replayed once it recovers.
 type GormDB struct {
-	db *gorm.DB
+	db         *gorm.DB
+	spool      *spool
+	available  atomic.Bool // direct writes are going to MSSQL
+	migrated   atomic.Bool
+	recovering atomic.Bool // a recovery loop is running
+	done       chan struct{}
+}
+
+// NewGormDB creates a new GORM database connection. If MSSQL can't be reached
+// the app starts in degraded mode: writes are spooled to spoolPath and the
+// connection and migrations are retried in the background.
+func NewGormDB(server, database, username, password, spoolPath string) (*GormDB, error) {
+	gormDB, err := OpenGormDB(server, database, username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	spool, err := openSpool(spoolPath)
+	if err != nil {
+		return nil, err
+	}
+	gormDB.spool = spool
+
+	// Apply pending schema migrations
+	if err := gormDB.migrate(); err != nil {
+		if errors.Is(err, ErrSchemaTooNew) {
+			return nil, err
+		}
+		slog.Warn("MSSQL unavailable at startup, starting in degraded mode", "error", err)
+		gormDB.markUnavailable(err)
+		return gormDB, nil
+	}
+	gormDB.migrated.Store(true)
+
+	if spool.pending > 0 {
+		// Replay what was spooled before the last shutdown before writing anything new
+		slog.Info("Replaying writes spooled during an earlier MSSQL outage", "pending", spool.pending)
+		gormDB.markUnavailable(nil)
+		return gormDB, nil
+	}
+
+	gormDB.available.Store(true)
+	slog.Info("GORM database connected successfully")
+	return gormDB, nil
 }
 
-// NewGormDB creates a new GORM database connection
-func NewGormDB(server, database, username, password string) (*GormDB, error) {
+// OpenGormDB opens the MSSQL connection without migrating it or spooling
+// writes, for the migrate command
+func OpenGormDB(server, database, username, password string) (*GormDB, error) {
 	dsn := fmt.Sprintf("sqlserver://%s:%s@%s?database=%s", username, password, server, database)
 
 	db, err := gorm.Open(sqlserver.Open(dsn), &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Info),
+		Logger:               newGormLogger(),
+		DisableAutomaticPing: true,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to MSSQL: %v", err)
+		return nil, fmt.Errorf("failed to open MSSQL: %v", err)
 	}
+	return &GormDB{db: db, done: make(chan struct{})}, nil
+}
 
-	gormDB := &GormDB{db: db}
+// Available reports whether writes are going straight to MSSQL rather than the spool
+func (gdb *GormDB) Available() bool {
+	return gdb.available.Load()
+}
 
-	// Auto migrate the database
-	if err := gormDB.migrate(); err != nil {
-		return nil, fmt.Errorf("failed to migrate database: %v", err)
+// newGormLogger routes GORM's logs through slog. SQL statements are only traced
+// at debug level, and without their values when logs are redacted.
+func newGormLogger() logger.Interface {
+	level, writer := logger.Warn, gormLogWriter{level: slog.LevelWarn}
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		level, writer = logger.Info, gormLogWriter{level: slog.LevelDebug}
 	}
+	return logger.New(writer, logger.Config{
+		SlowThreshold:             time.Second,
+		LogLevel:                  level,
+		IgnoreRecordNotFoundError: true,
+		ParameterizedQueries:      true, // values include message bodies
+	})
+}
 
-	log.Println("GORM database connected successfully")
-	return gormDB, nil
+// gormLogWriter writes GORM's preformatted log lines to slog at a fixed level
+type gormLogWriter struct {
+	level slog.Level
+}
+
+func (w gormLogWriter) Printf(format string, args ...interface{}) {
+	slog.Log(context.Background(), w.level, fmt.Sprintf(format, args...), "component", "gorm")
 }
 
-// migrate runs database migrations
+// migrate applies any pending schema migrations
 func (gdb *GormDB) migrate() error {
-	return gdb.db.AutoMigrate(&models.Message{}, &models.Sender{})
+	_, err := gdb.Migrator().Up()
+	return err
 }
 
 // StoreMessage stores a WhatsApp message in the database
 func (gdb *GormDB) StoreMessage(message *models.Message) error {
-	result := gdb.db.Create(message)
-	if result.Error != nil {
-		return fmt.Errorf("failed to store message: %v", result.Error)
+	return gdb.write(spoolEntry{Op: spoolStoreMessage, Message: message}, func() error {
+		return gdb.storeMessage(message)
+	})
+}
+
+func (gdb *GormDB) storeMessage(message *models.Message) error {
+	err := gdb.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(message).Error; err != nil {
+			return fmt.Errorf("failed to store message: %v", err)
+		}
+
+		// History sync delivers the newest messages first, so edits and revokes
+		// may already be stored when the message they refer to arrives
+		var followUps []models.Message
+		if err := tx.Where("parent_message_id = ? AND message_type IN ?", message.MessageID, []string{"edit", "revoke"}).
+			Order("timestamp ASC").Find(&followUps).Error; err != nil {
+			return fmt.Errorf("failed to get follow-ups of message %s: %v", message.MessageID, err)
+		}
+		for i := range followUps {
+			if err := applyFollowUp(tx, message, &followUps[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		metrics.DBWriteErrors.WithLabelValues("store_message").Inc()
+		return err
 	}
 	return nil
 }
 
+// MessageExists checks if a message with the given WhatsApp message ID is already stored
+func (gdb *GormDB) MessageExists(messageID string) bool {
+	var count int64
+	gdb.db.Model(&models.Message{}).Where("message_id = ?", messageID).Count(&count)
+	return count > 0
+}
+
+// StoreFollowUpMessage stores a reaction, edit or revoke and applies it to the
+// original message in the same transaction. Edits replace the original content
+// (keeping the first version in OriginalContent) and revokes mark it as deleted.
+func (gdb *GormDB) StoreFollowUpMessage(message *models.Message) error {
+	return gdb.write(spoolEntry{Op: spoolStoreFollowUp, Message: message}, func() error {
+		return gdb.storeFollowUpMessage(message)
+	})
+}
+
+func (gdb *GormDB) storeFollowUpMessage(message *models.Message) error {
+	return gdb.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(message).Error; err != nil {
+			return fmt.Errorf("failed to store %s: %v", message.MessageType, err)
+		}
+
+		var original models.Message
+		if err := tx.Where("message_id = ?", message.ParentMessageID).First(&original).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				// The original message was never stored, keep the follow-up on its own
+				return nil
+			}
+			return fmt.Errorf("failed to get original message %s: %v", message.ParentMessageID, err)
+		}
+
+		return applyFollowUp(tx, &original, message)
+	})
+}
+
+// applyFollowUp applies an edit or revoke to the original message. Edits older
+// than the one already applied are ignored.
+func applyFollowUp(tx *gorm.DB, original, followUp *models.Message) error {
+	var updates map[string]interface{}
+	switch followUp.MessageType {
+	case "edit":
+		if original.EditedAt != nil && followUp.Timestamp.Before(*original.EditedAt) {
+			return nil
+		}
+		updates = map[string]interface{}{
+			"content":   followUp.Content,
+			"edited_at": followUp.Timestamp,
+		}
+		if original.EditedAt == nil {
+			updates["original_content"] = original.Content
+		}
+	case "revoke":
+		updates = map[string]interface{}{
+			"revoked_at": followUp.Timestamp,
+		}
+	default:
+		return nil
+	}
+
+	if err := tx.Model(original).Updates(updates).Error; err != nil {
+		return fmt.Errorf("failed to apply %s to message %s: %v", followUp.MessageType, original.MessageID, err)
+	}
+
+	// Keep the original in step so several follow-ups can be applied in a row
+	timestamp := followUp.Timestamp
+	if followUp.MessageType == "edit" {
+		if original.EditedAt == nil {
+			original.OriginalContent = original.Content
+		}
+		original.Content = followUp.Content
+		original.EditedAt = &timestamp
+	} else {
+		original.RevokedAt = &timestamp
+	}
+	return nil
+}
+
+// StorePoll stores the question and options of a poll
+func (gdb *GormDB) StorePoll(poll *models.Poll) error {
+	return gdb.write(spoolEntry{Op: spoolStorePoll, Poll: poll}, func() error {
+		return gdb.storePoll(poll)
+	})
+}
+
+func (gdb *GormDB) storePoll(poll *models.Poll) error {
+	if err := gdb.db.Create(poll).Error; err != nil {
+		return fmt.Errorf("failed to store poll: %v", err)
+	}
+	return nil
+}
+
+// GetPoll retrieves a poll by the message ID of its creation message
+func (gdb *GormDB) GetPoll(messageID string) (*models.Poll, error) {
+	var poll models.Poll
+	if err := gdb.db.Where("message_id = ?", messageID).First(&poll).Error; err != nil {
+		return nil, fmt.Errorf("failed to get poll %s: %v", messageID, err)
+	}
+	return &poll, nil
+}
+
+// StorePollVote stores the current selection of a voter, replacing any earlier vote
+func (gdb *GormDB) StorePollVote(vote *models.PollVote) error {
+	return gdb.write(spoolEntry{Op: spoolStorePollVote, PollVote: vote}, func() error {
+		return gdb.storePollVote(vote)
+	})
+}
+
+func (gdb *GormDB) storePollVote(vote *models.PollVote) error {
+	var existingVote models.PollVote
+	result := gdb.db.Where("poll_message_id = ? AND voter_phone = ?", vote.PollMessageID, vote.VoterPhone).First(&existingVote)
+
+	if result.Error != nil {
+		if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+			return gdb.db.Create(vote).Error
+		}
+		return fmt.Errorf("failed to get poll vote: %v", result.Error)
+	}
+
+	// Votes can arrive out of order, only keep the latest one
+	if vote.Timestamp.Before(existingVote.Timestamp) {
+		return nil
+	}
+
+	existingVote.SelectedOptions = vote.SelectedOptions
+	existingVote.Timestamp = vote.Timestamp
+	return gdb.db.Save(&existingVote).Error
+}
+
+// GetPollResults tallies the current votes of a poll
+func (gdb *GormDB) GetPollResults(messageID string) (*models.PollResults, error) {
+	poll, err := gdb.GetPoll(messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	var votes []models.PollVote
+	if err := gdb.db.Where("poll_message_id = ?", messageID).Order("timestamp ASC").Find(&votes).Error; err != nil {
+		return nil, fmt.Errorf("failed to get poll votes: %v", err)
+	}
+
+	results := &models.PollResults{
+		MessageID: poll.MessageID,
+		Question:  poll.Question,
+		Options:   make([]models.PollOptionResults, len(poll.Options)),
+	}
+	optionIndex := make(map[string]int, len(poll.Options))
+	for i, option := range poll.Options {
+		results.Options[i] = models.PollOptionResults{Name: option, Voters: []string{}}
+		optionIndex[option] = i
+	}
+
+	for _, vote := range votes {
+		// An empty selection means the voter retracted their vote
+		if len(vote.SelectedOptions) == 0 {
+			continue
+		}
+		results.TotalVoters++
+		for _, option := range vote.SelectedOptions {
+			if i, ok := optionIndex[option]; ok {
+				results.Options[i].Votes++
+				results.Options[i].Voters = append(results.Options[i].Voters, vote.VoterPhone)
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// GetMessageByMessageID retrieves a single message by its WhatsApp message ID
+func (gdb *GormDB) GetMessageByMessageID(messageID string) (*models.Message, error) {
+	var message models.Message
+	result := gdb.db.Where("message_id = ?", messageID).First(&message)
+	if result.Error != nil {
+		return nil, fmt.Errorf("failed to get message %s: %v", messageID, result.Error)
+	}
+	return &message, nil
+}
+
 // GetMessagesByPhone retrieves messages for a specific phone number
 func (gdb *GormDB) GetMessagesByPhone(phone string, limit int) ([]models.Message, error) {
 	var messages []models.Message
 	result := gdb.db.Where("sender_phone = ? OR recipient_phone = ?", phone, phone).
+		Where("message_type NOT IN ?", followUpMessageTypes).
 		Order("timestamp DESC").
 		Limit(limit).
 		Find(&messages)
@@ -64,13 +343,14 @@ func (gdb *GormDB) GetMessagesByPhone(phone string, limit int) ([]models.Message
 	if result.Error != nil {
 		return nil, fmt.Errorf("failed to get messages: %v", result.Error)
 	}
-	return messages, nil
+	return messages, gdb.attachReactions(messages)
 }
 
 // GetMessagesByChat retrieves messages for a specific chat
 func (gdb *GormDB) GetMessagesByChat(chatID string, limit int) ([]models.Message, error) {
 	var messages []models.Message
 	result := gdb.db.Where("chat_id = ?", chatID).
+		Where("message_type NOT IN ?", followUpMessageTypes).
 		Order("timestamp DESC").
 		Limit(limit).
 		Find(&messages)
@@ -78,48 +358,184 @@ func (gdb *GormDB) GetMessagesByChat(chatID string, limit int) ([]models.Message
 	if result.Error != nil {
 		return nil, fmt.Errorf("failed to get chat messages: %v", result.Error)
 	}
-	return messages, nil
+	return messages, gdb.attachReactions(messages)
 }
 
-// GetMessageStats retrieves message statistics
-func (gdb *GormDB) GetMessageStats() (*models.MessageStats, error) {
+// chatExportBatchSize is how many messages EachChatMessage reads at a time
+const chatExportBatchSize = 500
+
+// EachChatMessage calls fn with every message of a chat sent in [from, to),
+// oldest first, the way GetMessagesByChat shows them. Messages are read in
+// batches, so a long chat is never held in memory as a whole. A non-empty
+// sender limits the chat to one sender account, a zero from or to leaves that
+// end of the range open. It stops at the first error of fn.
+func (gdb *GormDB) EachChatMessage(chatID, sender string, from, to time.Time, fn func(message *models.Message) error) error {
+	var last *models.Message
+	for {
+		query := gdb.db.Where("chat_id = ?", chatID).
+			Where("message_type NOT IN ?", followUpMessageTypes)
+		if sender != "" {
+			query = query.Where("sender_phone = ? OR recipient_phone = ?", sender, sender)
+		}
+		if !from.IsZero() {
+			query = query.Where("timestamp >= ?", from)
+		}
+		if !to.IsZero() {
+			query = query.Where("timestamp < ?", to)
+		}
+		if last != nil {
+			// Continue after the last message, ties on the timestamp are broken by ID
+			query = query.Where("timestamp > ? OR (timestamp = ? AND id > ?)", last.Timestamp, last.Timestamp, last.ID)
+		}
+
+		var messages []models.Message
+		if err := query.Order("timestamp ASC, id ASC").Limit(chatExportBatchSize).Find(&messages).Error; err != nil {
+			return fmt.Errorf("failed to get chat messages: %v", err)
+		}
+		if err := gdb.attachReactions(messages); err != nil {
+			return err
+		}
+
+		for i := range messages {
+			if err := fn(&messages[i]); err != nil {
+				return err
+			}
+		}
+		if len(messages) < chatExportBatchSize {
+			return nil
+		}
+		last = &messages[len(messages)-1]
+	}
+}
+
+// GetMessageStats retrieves message statistics. "Today" starts at midnight in loc.
+// Reactions, edits and revokes are not counted, as they are shown on their
+// original message.
+func (gdb *GormDB) GetMessageStats(loc *time.Location) (*models.MessageStats, error) {
 	var stats models.MessageStats
+	messages := func() *gorm.DB {
+		return gdb.db.Model(&models.Message{}).Where("message_type NOT IN ?", followUpMessageTypes)
+	}
 
 	// Total messages
-	if err := gdb.db.Model(&models.Message{}).Count(&stats.TotalMessages).Error; err != nil {
+	if err := messages().Count(&stats.TotalMessages).Error; err != nil {
 		return nil, fmt.Errorf("failed to count total messages: %v", err)
 	}
 
 	// Messages today
-	today := time.Now().Truncate(24 * time.Hour)
-	if err := gdb.db.Model(&models.Message{}).Where("timestamp >= ?", today).Count(&stats.MessagesToday).Error; err != nil {
+	now := time.Now().In(loc)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	if err := messages().Where("timestamp >= ?", today).Count(&stats.MessagesToday).Error; err != nil {
 		return nil, fmt.Errorf("failed to count today's messages: %v", err)
 	}
 
 	// Messages this week
 	weekAgo := time.Now().AddDate(0, 0, -7)
-	if err := gdb.db.Model(&models.Message{}).Where("timestamp >= ?", weekAgo).Count(&stats.MessagesThisWeek).Error; err != nil {
+	if err := messages().Where("timestamp >= ?", weekAgo).Count(&stats.MessagesThisWeek).Error; err != nil {
 		return nil, fmt.Errorf("failed to count this week's messages: %v", err)
 	}
 
 	// Messages this month
 	monthAgo := time.Now().AddDate(0, -1, 0)
-	if err := gdb.db.Model(&models.Message{}).Where("timestamp >= ?", monthAgo).Count(&stats.MessagesThisMonth).Error; err != nil {
+	if err := messages().Where("timestamp >= ?", monthAgo).Count(&stats.MessagesThisMonth).Error; err != nil {
 		return nil, fmt.Errorf("failed to count this month's messages: %v", err)
 	}
 
 	return &stats, nil
 }
 
+// UpdateMessageReceipts records a delivery, read or played receipt on outbound
+// messages. Only the first receipt of each kind is kept.
+func (gdb *GormDB) UpdateMessageReceipts(messageIDs []string, receiptType string, timestamp time.Time) error {
+	if len(messageIDs) == 0 {
+		return nil
+	}
+
+	messages := gdb.db.Model(&models.Message{}).Where("message_id IN ? AND is_from_me = ?", messageIDs, true)
+	switch receiptType {
+	case "delivered":
+		if err := messages.Where("delivered_at IS NULL").Update("delivered_at", timestamp).Error; err != nil {
+			return fmt.Errorf("failed to record delivery receipt: %v", err)
+		}
+	case "read", "played":
+		// A read message was delivered too, even if that receipt never arrived
+		return gdb.db.Transaction(func(tx *gorm.DB) error {
+			scoped := tx.Model(&models.Message{}).Where("message_id IN ? AND is_from_me = ?", messageIDs, true)
+			if err := scoped.Where("read_at IS NULL").Update("read_at", timestamp).Error; err != nil {
+				return fmt.Errorf("failed to record read receipt: %v", err)
+			}
+			scoped = tx.Model(&models.Message{}).Where("message_id IN ? AND is_from_me = ?", messageIDs, true)
+			if err := scoped.Where("delivered_at IS NULL").Update("delivered_at", timestamp).Error; err != nil {
+				return fmt.Errorf("failed to record delivery receipt: %v", err)
+			}
+			return nil
+		})
+	}
+	return nil
+}
+
 // GetRecentMessages retrieves recent messages
 func (gdb *GormDB) GetRecentMessages(limit int) ([]models.Message, error) {
 	var messages []models.Message
-	result := gdb.db.Order("timestamp DESC").Limit(limit).Find(&messages)
+	result := gdb.db.Where("message_type NOT IN ?", followUpMessageTypes).
+		Order("timestamp DESC").
+		Limit(limit).
+		Find(&messages)
 
 	if result.Error != nil {
 		return nil, fmt.Errorf("failed to get recent messages: %v", result.Error)
 	}
-	return messages, nil
+	return messages, gdb.attachReactions(messages)
+}
+
+// attachReactions fills in the current reactions of each message and hides the
+// content of revoked messages, the way the phone shows a conversation
+func (gdb *GormDB) attachReactions(messages []models.Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	messageIDs := make([]string, 0, len(messages))
+	for i := range messages {
+		if messages[i].RevokedAt != nil {
+			messages[i].Content = ""
+			messages[i].MediaURL = ""
+		}
+		messageIDs = append(messageIDs, messages[i].MessageID)
+	}
+
+	var reactions []models.Message
+	result := gdb.db.Where("message_type = ? AND parent_message_id IN ?", "reaction", messageIDs).
+		Order("timestamp ASC").
+		Find(&reactions)
+	if result.Error != nil {
+		return fmt.Errorf("failed to get reactions: %v", result.Error)
+	}
+
+	// Only the latest reaction of each participant counts, an empty one removes it
+	latest := make(map[string]map[string]models.Reaction)
+	for _, reaction := range reactions {
+		if latest[reaction.ParentMessageID] == nil {
+			latest[reaction.ParentMessageID] = make(map[string]models.Reaction)
+		}
+		latest[reaction.ParentMessageID][reaction.SenderPhone] = models.Reaction{
+			SenderPhone: reaction.SenderPhone,
+			Emoji:       reaction.Content,
+			Timestamp:   reaction.Timestamp,
+		}
+	}
+
+	for i := range messages {
+		for _, reaction := range latest[messages[i].MessageID] {
+			if reaction.Emoji != "" {
+				messages[i].Reactions = append(messages[i].Reactions, reaction)
+			}
+		}
+		sort.Slice(messages[i].Reactions, func(a, b int) bool {
+			return messages[i].Reactions[a].Timestamp.Before(messages[i].Reactions[b].Timestamp)
+		})
+	}
+	return nil
 }
 
 // GetAllSenders retrieves all senders from the database
@@ -152,65 +568,142 @@ func (gdb *GormDB) UpdateSenderStatus(phone, status string) error {
 	return nil
 }
 
-// Close closes the database connection
-func (gdb *GormDB) Close() error {
+// Ping checks that MSSQL is reachable
+func (gdb *GormDB) Ping(ctx context.Context) error {
 	sqlDB, err := gdb.db.DB()
 	if err != nil {
 		return err
 	}
-	return sqlDB.Close()
+	return sqlDB.PingContext(ctx)
 }
 
-// SyncSenderToMSSQL syncs a sender from SQLite to MSSQL
-func (gdb *GormDB) SyncSenderToMSSQL(sender *models.Sender) error {
-	var existingSender models.Sender
-	result := gdb.db.Where("phone = ?", sender.Phone).First(&existingSender)
-
-	if result.Error != nil {
-		if result.Error.Error() == "record not found" {
-			// Create new sender
-			return gdb.db.Create(sender).Error
+// Close stops retrying MSSQL and closes the connection. Writes still in the
+// spool are kept on disk and replayed on the next start.
+func (gdb *GormDB) Close() error {
+	close(gdb.done)
+	if gdb.spool != nil {
+		pending, err := gdb.spool.close()
+		if err != nil {
+			slog.Warn("Failed to close spool", "error", err)
+		}
+		if pending > 0 {
+			slog.Warn("Writes still spooled at shutdown, they will be replayed on the next start", "pending", pending)
 		}
-		return result.Error
 	}
 
-	// Update existing sender with specific fields using WHERE clause
-	return gdb.db.Model(&models.Sender{}).Where("phone = ?", sender.Phone).Updates(map[string]interface{}{
+	sqlDB, err := gdb.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+// SyncSenderToMSSQL writes a sender published from the SQLite outbox. The
+// version is the outbox entry ID: a sender already written at that or a later
+// version is left alone, so republishing a change after a retry is harmless.
+func (gdb *GormDB) SyncSenderToMSSQL(sender *models.Sender, version int64) error {
+	result := gdb.db.Model(&models.Sender{}).Where("phone = ? AND sync_version < ?", sender.Phone, version).Updates(map[string]interface{}{
 		"device_id":        sender.DeviceID,
 		"status":           sender.Status,
 		"authenticated_at": sender.AuthenticatedAt,
 		"invalidated_at":   sender.InvalidatedAt,
-	}).Error
-}
+		"sync_version":     version,
+	})
+	if result.Error != nil {
+		return fmt.Errorf("failed to update sender in MSSQL: %v", result.Error)
+	}
+	if result.RowsAffected > 0 {
+		return nil
+	}
 
-// SyncAllSendersToMSSQL syncs all senders from SQLite to MSSQL
-func (gdb *GormDB) SyncAllSendersToMSSQL(senders []*models.Sender) error {
-	for _, sender := range senders {
-		if err := gdb.SyncSenderToMSSQL(sender); err != nil {
-			return fmt.Errorf("failed to sync sender %s: %v", sender.Phone, err)
+	return gdb.db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&models.Sender{}).Where("phone = ?", sender.Phone).Count(&count).Error; err != nil {
+			return fmt.Errorf("failed to check sender in MSSQL: %v", err)
 		}
-	}
-	return nil
+		if count > 0 {
+			// Already at this version or newer
+			return nil
+		}
+
+		// A change from before the sender was deleted must not bring it back
+		var tombstone models.SenderTombstone
+		err := tx.Where("phone = ?", sender.Phone).Limit(1).Find(&tombstone).Error
+		if err != nil {
+			return fmt.Errorf("failed to check sender tombstone in MSSQL: %v", err)
+		}
+		if tombstone.Phone != "" {
+			if tombstone.SyncVersion >= version {
+				return nil
+			}
+			if err := tx.Delete(&tombstone).Error; err != nil {
+				return fmt.Errorf("failed to remove sender tombstone from MSSQL: %v", err)
+			}
+		}
+
+		created := *sender
+		created.SyncVersion = version
+		if err := tx.Create(&created).Error; err != nil {
+			return fmt.Errorf("failed to create sender in MSSQL: %v", err)
+		}
+		return nil
+	})
 }
 
-// ForceSyncAllSenders forces a complete sync of all senders from SQLite to MSSQL
-func (gdb *GormDB) ForceSyncAllSenders(sqliteDB interface {
-	GetAllSenders() ([]*models.Sender, error)
-}) error {
-	senders, err := sqliteDB.GetAllSenders()
-	if err != nil {
-		return fmt.Errorf("failed to get senders from SQLite: %v", err)
-	}
+// DeleteSender deletes a sender from MSSQL, unless it was written by a change
+// newer than version. The delete is recorded in a tombstone so older changes
+// replayed afterwards don't re-create the sender.
+func (gdb *GormDB) DeleteSender(phone string, version int64) error {
+	return gdb.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("phone = ? AND sync_version < ?", phone, version).Delete(&models.Sender{})
+		if result.Error != nil {
+			return fmt.Errorf("failed to delete sender from MSSQL: %v", result.Error)
+		}
 
-	log.Printf("Force syncing %d senders from SQLite to MSSQL", len(senders))
-	return gdb.SyncAllSendersToMSSQL(senders)
+		var count int64
+		if err := tx.Model(&models.Sender{}).Where("phone = ?", phone).Count(&count).Error; err != nil {
+			return fmt.Errorf("failed to check sender in MSSQL: %v", err)
+		}
+		if count > 0 {
+			// Re-created by a newer change, which supersedes the delete
+			return nil
+		}
+
+		tombstone := models.SenderTombstone{Phone: phone, SyncVersion: version, RemovedAt: time.Now()}
+		result = tx.Model(&models.SenderTombstone{}).Where("phone = ? AND sync_version < ?", phone, version).
+			Updates(map[string]interface{}{"sync_version": version, "removed_at": tombstone.RemovedAt})
+		if result.Error != nil {
+			return fmt.Errorf("failed to update sender tombstone in MSSQL: %v", result.Error)
+		}
+		if result.RowsAffected > 0 {
+			return nil
+		}
+
+		var existing int64
+		if err := tx.Model(&models.SenderTombstone{}).Where("phone = ?", phone).Count(&existing).Error; err != nil {
+			return fmt.Errorf("failed to check sender tombstone in MSSQL: %v", err)
+		}
+		if existing > 0 {
+			// Already deleted at this version or a newer one
+			return nil
+		}
+		if err := tx.Create(&tombstone).Error; err != nil {
+			return fmt.Errorf("failed to record sender tombstone in MSSQL: %v", err)
+		}
+		return nil
+	})
 }
 
-// DeleteSender deletes a sender from MSSQL database
-func (gdb *GormDB) DeleteSender(phone string) error {
-	result := gdb.db.Where("phone = ?", phone).Delete(&models.Sender{})
-	if result.Error != nil {
-		return fmt.Errorf("failed to delete sender from MSSQL: %v", result.Error)
+// PurgeSenderMessages permanently deletes every message a sender account sent
+// or received, with the polls they created and the votes on those polls, and
+// returns how many messages were deleted. Messages are deleted in batches; on
+// error the count covers those deleted before it.
+func (gdb *GormDB) PurgeSenderMessages(phone string) (int64, error) {
+	count, err := gdb.inBatches(500, func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("sender_phone = ? OR recipient_phone = ?", phone, phone)
+	}, deleteMessages)
+	if err != nil {
+		return count, fmt.Errorf("failed to purge messages of %s: %v", phone, err)
 	}
-	return nil
+	return count, nil
 }
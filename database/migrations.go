@@ -0,0 +1,147 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+)
+
+// ErrSchemaTooNew is returned when a database was migrated by a newer version
+// of the app than the one running, which could misread or corrupt its data
+var ErrSchemaTooNew = errors.New("database schema is newer than this version of auto-dm supports")
+
+// migration identifies one numbered schema change. The statements themselves
+// live in the migration lists of each database, which differ in how they run.
+type migration struct {
+	version int
+	name    string
+}
+
+// MigrationStatus reports whether one migration has been applied
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	AppliedAt *time.Time `json:"applied_at,omitempty"`
+}
+
+// Migrator applies the numbered up and down migrations of one database and
+// tracks them in its schema_migrations table
+type Migrator struct {
+	name       string
+	migrations []migration // in version order
+	applied    func() (map[int]time.Time, error)
+	run        func(version int, up bool) error // runs one migration and records it in the same transaction
+}
+
+// Latest returns the highest migration version this build knows about
+func (m *Migrator) Latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].version
+}
+
+// Current returns the highest applied migration version
+func (m *Migrator) Current() (int, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+	current := 0
+	for version := range applied {
+		current = max(current, version)
+	}
+	return current, nil
+}
+
+// Check fails with ErrSchemaTooNew if the database has migrations this build doesn't know
+func (m *Migrator) Check() error {
+	current, err := m.Current()
+	if err != nil {
+		return err
+	}
+	if current > m.Latest() {
+		return fmt.Errorf("%w: %s is at version %d, this build supports up to %d", ErrSchemaTooNew, m.name, current, m.Latest())
+	}
+	return nil
+}
+
+// Up applies every pending migration in order and returns how many were applied
+func (m *Migrator) Up() (int, error) {
+	if err := m.Check(); err != nil {
+		return 0, err
+	}
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, migration := range m.migrations {
+		if _, done := applied[migration.version]; done {
+			continue
+		}
+		if err := m.run(migration.version, true); err != nil {
+			return count, fmt.Errorf("%s migration %d (%s) failed: %v", m.name, migration.version, migration.name, err)
+		}
+		slog.Info("Applied migration", "database", m.name, "version", migration.version, "name", migration.name)
+		count++
+	}
+	return count, nil
+}
+
+// Down reverts the last steps applied migrations, newest first, and returns how many were reverted
+func (m *Migrator) Down(steps int) (int, error) {
+	if err := m.Check(); err != nil {
+		return 0, err
+	}
+	applied, err := m.applied()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for i := len(m.migrations) - 1; i >= 0 && count < steps; i-- {
+		migration := m.migrations[i]
+		if _, done := applied[migration.version]; !done {
+			continue
+		}
+		if err := m.run(migration.version, false); err != nil {
+			return count, fmt.Errorf("%s migration %d (%s) failed to revert: %v", m.name, migration.version, migration.name, err)
+		}
+		slog.Info("Reverted migration", "database", m.name, "version", migration.version, "name", migration.name)
+		count++
+	}
+	return count, nil
+}
+
+// Status lists every known migration with the time it was applied, if it was.
+// Applied versions this build doesn't know are listed without a name.
+func (m *Migrator) Status() ([]MigrationStatus, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []MigrationStatus
+	for _, migration := range m.migrations {
+		status := MigrationStatus{Version: migration.version, Name: migration.name}
+		if appliedAt, done := applied[migration.version]; done {
+			status.AppliedAt = &appliedAt
+		}
+		statuses = append(statuses, status)
+		delete(applied, migration.version)
+	}
+	for version, appliedAt := range applied {
+		statuses = append(statuses, MigrationStatus{Version: version, Name: "(unknown)", AppliedAt: &appliedAt})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+	return statuses, nil
+}
+
+// Name returns the name of the database the migrations belong to
+func (m *Migrator) Name() string {
+	return m.name
+}
@@ -0,0 +1,125 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/jaliph/auto-dm/models"
+)
+
+// messageMigration is a schema change of the MSSQL message database
+type messageMigration struct {
+	migration
+	up   func(tx *gorm.DB) error
+	down func(tx *gorm.DB) error
+}
+
+// messageMigrations are the schema changes of the message database in version
+// order. Never edit or renumber a released migration, add a new one instead.
+//
+// Version 1 is the schema that AutoMigrate built before versioning, so existing
+// databases adopt it unchanged. It creates tables from the current models, so
+// later migrations must check the migrator (HasColumn, HasIndex, ...) before
+// changing anything a fresh database already got from version 1.
+var messageMigrations = []messageMigration{
+	{
+		migration: migration{1, "baseline schema"},
+		up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&models.Message{}, &models.Sender{}, &models.Poll{}, &models.PollVote{}, &models.AuditEntry{})
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&models.AuditEntry{}, &models.PollVote{}, &models.Poll{}, &models.Sender{}, &models.Message{})
+		},
+	},
+	{
+		// Marks messages whose content the retention policy removed
+		migration: migration{2, "add anonymized_at to whatsapp_messages"},
+		up: func(tx *gorm.DB) error {
+			if tx.Migrator().HasColumn(&models.Message{}, "AnonymizedAt") {
+				return nil
+			}
+			return tx.Migrator().AddColumn(&models.Message{}, "AnonymizedAt")
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&models.Message{}, "AnonymizedAt")
+		},
+	},
+	{
+		// Keeps replayed sender changes from re-creating deleted senders
+		migration: migration{3, "create sender_tombstones"},
+		up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&models.SenderTombstone{})
+		},
+		down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&models.SenderTombstone{})
+		},
+	},
+}
+
+// schemaMigration records an applied migration of the message database
+type schemaMigration struct {
+	Version   int       `gorm:"primaryKey;autoIncrement:false"`
+	Name      string    `gorm:"size:200;not null"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+// TableName specifies the table name for the schemaMigration model
+func (schemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+// Migrator returns the schema migrations of the message database
+func (gdb *GormDB) Migrator() *Migrator {
+	byVersion := make(map[int]messageMigration, len(messageMigrations))
+	migrations := make([]migration, len(messageMigrations))
+	for i, m := range messageMigrations {
+		byVersion[m.version] = m
+		migrations[i] = m.migration
+	}
+
+	return &Migrator{
+		name:       "mssql",
+		migrations: migrations,
+		applied:    gdb.appliedMigrations,
+		run: func(version int, up bool) error {
+			return gdb.runMigration(byVersion[version], up)
+		},
+	}
+}
+
+// appliedMigrations reads the schema_migrations table, creating it on first use
+func (gdb *GormDB) appliedMigrations() (map[int]time.Time, error) {
+	if err := gdb.db.AutoMigrate(&schemaMigration{}); err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations table: %v", err)
+	}
+
+	var rows []schemaMigration
+	if err := gdb.db.Find(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to query schema_migrations: %v", err)
+	}
+
+	applied := make(map[int]time.Time, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row.AppliedAt
+	}
+	return applied, nil
+}
+
+// runMigration applies or reverts one migration and records it in the same transaction
+func (gdb *GormDB) runMigration(m messageMigration, up bool) error {
+	return gdb.db.Transaction(func(tx *gorm.DB) error {
+		if !up {
+			if err := m.down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&schemaMigration{}, m.version).Error
+		}
+
+		if err := m.up(tx); err != nil {
+			return err
+		}
+		return tx.Create(&schemaMigration{Version: m.version, Name: m.name, AppliedAt: time.Now()}).Error
+	})
+}
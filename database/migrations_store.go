@@ -0,0 +1,140 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// storeMigration is a schema change of the SQLite store.db
+type storeMigration struct {
+	migration
+	up   func(tx *sql.Tx) error
+	down func(tx *sql.Tx) error
+}
+
+// storeMigrations are the schema changes of store.db in version order. Never
+// edit or renumber a released migration, add a new one instead. Version 1
+// uses IF NOT EXISTS so databases created before versioning adopt it as is.
+var storeMigrations = []storeMigration{
+	{
+		migration: migration{1, "create phone_map and senders"},
+		up: execAll(`
+			CREATE TABLE IF NOT EXISTS phone_map (
+				phone TEXT PRIMARY KEY,
+				device_id TEXT NOT NULL,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`, `
+			CREATE TABLE IF NOT EXISTS senders (
+				phone TEXT PRIMARY KEY,
+				device_id TEXT,
+				status TEXT NOT NULL DEFAULT 'pending',
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+				authenticated_at TIMESTAMP,
+				invalidated_at TIMESTAMP
+			)`),
+		down: execAll("DROP TABLE senders", "DROP TABLE phone_map"),
+	},
+	{
+		// Sender changes not yet published to MSSQL
+		migration: migration{2, "create sender_outbox"},
+		up: execAll(`
+			CREATE TABLE IF NOT EXISTS sender_outbox (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				phone TEXT NOT NULL,
+				operation TEXT NOT NULL,
+				payload TEXT,
+				attempts INTEGER NOT NULL DEFAULT 0,
+				last_error TEXT,
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`),
+		down: execAll("DROP TABLE sender_outbox"),
+	},
+}
+
+// execAll returns a migration step that runs statements in order
+func execAll(statements ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Migrator returns the schema migrations of store.db
+func (d *Database) Migrator() *Migrator {
+	byVersion := make(map[int]storeMigration, len(storeMigrations))
+	migrations := make([]migration, len(storeMigrations))
+	for i, m := range storeMigrations {
+		byVersion[m.version] = m
+		migrations[i] = m.migration
+	}
+
+	return &Migrator{
+		name:       "store.db",
+		migrations: migrations,
+		applied:    d.appliedMigrations,
+		run: func(version int, up bool) error {
+			return d.runMigration(byVersion[version], up)
+		},
+	}
+}
+
+// appliedMigrations reads the schema_migrations table, creating it on first use
+func (d *Database) appliedMigrations() (map[int]time.Time, error) {
+	_, err := d.db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations table: %v", err)
+	}
+
+	rows, err := d.db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query schema_migrations: %v", err)
+	}
+	defer rows.Close()
+
+	applied := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan schema_migrations: %v", err)
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// runMigration applies or reverts one migration and records it in the same transaction
+func (d *Database) runMigration(m storeMigration, up bool) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if up {
+		if err := m.up(tx); err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO schema_migrations (version, name) VALUES (?, ?)", m.version, m.name)
+	} else {
+		if err := m.down(tx); err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM schema_migrations WHERE version = ?", m.version)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record migration: %v", err)
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,339 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jaliph/auto-dm/metrics"
+	"github.com/jaliph/auto-dm/models"
+)
+
+// Operations recorded in the sender outbox
+const (
+	outboxUpsert = "upsert" // payload holds the sender as it is after the change
+	outboxDelete = "delete"
+)
+
+const (
+	outboxBatchSize         = 100
+	outboxPollInterval      = 5 * time.Second  // picks up changes even if a notification is missed
+	outboxMaxBackoff        = time.Minute      // longest wait between retries while MSSQL rejects changes
+	senderReconcileInterval = 15 * time.Minute // how often SQLite and MSSQL senders are compared
+)
+
+// outboxEntry is a sender change waiting to be published to MSSQL. Its ID
+// orders the changes and is stored in MSSQL as the sender's sync version.
+type outboxEntry struct {
+	ID        int64
+	Phone     string
+	Operation string
+	Sender    *models.Sender // set for upserts
+	Attempts  int
+}
+
+// changeSender applies a change to the senders table and, in the same
+// transaction, records the resulting state of the sender in the outbox.
+// Changes that match no row are not recorded.
+func (d *Database) changeSender(phone string, change func(tx *sql.Tx) (sql.Result, error)) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin sender change: %v", err)
+	}
+	defer tx.Rollback()
+
+	result, err := change(tx)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err == nil && affected == 0 {
+		return tx.Commit()
+	}
+
+	if err := enqueueSenderChange(tx, phone); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit sender change: %v", err)
+	}
+
+	select {
+	case d.outboxNotify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// enqueueSenderChange records the current state of a sender in the outbox, or
+// a delete if the sender no longer exists
+func enqueueSenderChange(tx *sql.Tx, phone string) error {
+	operation, payload := outboxUpsert, sql.NullString{}
+	sender, err := scanSender(tx.QueryRow("SELECT "+senderColumns+" FROM senders WHERE phone = ?", phone))
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		operation = outboxDelete
+	case err != nil:
+		return fmt.Errorf("failed to read sender for outbox: %v", err)
+	default:
+		encoded, err := json.Marshal(sender)
+		if err != nil {
+			return fmt.Errorf("failed to encode sender for outbox: %v", err)
+		}
+		payload = sql.NullString{String: string(encoded), Valid: true}
+	}
+
+	_, err = tx.Exec("INSERT INTO sender_outbox (phone, operation, payload) VALUES (?, ?, ?)", phone, operation, payload)
+	if err != nil {
+		return fmt.Errorf("failed to write sender outbox: %v", err)
+	}
+	return nil
+}
+
+// ResyncSender queues the current state of a sender for publishing to MSSQL
+func (d *Database) ResyncSender(phone string) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin sender resync: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := enqueueSenderChange(tx, phone); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit sender resync: %v", err)
+	}
+
+	select {
+	case d.outboxNotify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// pendingSenderChanges returns the oldest unpublished sender changes
+func (d *Database) pendingSenderChanges(limit int) ([]outboxEntry, error) {
+	rows, err := d.db.Query("SELECT id, phone, operation, payload, attempts FROM sender_outbox ORDER BY id LIMIT ?", limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query sender outbox: %v", err)
+	}
+	defer rows.Close()
+
+	var entries []outboxEntry
+	for rows.Next() {
+		var entry outboxEntry
+		var payload sql.NullString
+		if err := rows.Scan(&entry.ID, &entry.Phone, &entry.Operation, &payload, &entry.Attempts); err != nil {
+			return nil, fmt.Errorf("failed to scan sender outbox: %v", err)
+		}
+		if payload.Valid {
+			entry.Sender = &models.Sender{}
+			if err := json.Unmarshal([]byte(payload.String), entry.Sender); err != nil {
+				return nil, fmt.Errorf("failed to decode sender outbox entry %d: %v", entry.ID, err)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// countSenderChanges returns how many sender changes are waiting to be published
+func (d *Database) countSenderChanges() (int, error) {
+	var count int
+	err := d.db.QueryRow("SELECT COUNT(*) FROM sender_outbox").Scan(&count)
+	return count, err
+}
+
+// completeSenderChange removes a published change from the outbox
+func (d *Database) completeSenderChange(id int64) error {
+	_, err := d.db.Exec("DELETE FROM sender_outbox WHERE id = ?", id)
+	return err
+}
+
+// failSenderChange records a failed publish attempt of a change
+func (d *Database) failSenderChange(id int64, publishErr error) error {
+	_, err := d.db.Exec("UPDATE sender_outbox SET attempts = attempts + 1, last_error = ? WHERE id = ?", publishErr.Error(), id)
+	return err
+}
+
+// SenderRelay publishes the sender changes recorded in the SQLite outbox to
+// MSSQL in order, retrying with backoff until MSSQL accepts them
+type SenderRelay struct {
+	db     *Database
+	gormDB *GormDB
+	mu     sync.Mutex // one publish run at a time
+}
+
+// NewSenderRelay creates a relay from the SQLite outbox to MSSQL
+func NewSenderRelay(db *Database, gormDB *GormDB) *SenderRelay {
+	return &SenderRelay{db: db, gormDB: gormDB}
+}
+
+// Run publishes sender changes as they are recorded and periodically
+// reconciles SQLite with MSSQL, until ctx is cancelled
+func (r *SenderRelay) Run(ctx context.Context) {
+	reconcileTicker := time.NewTicker(senderReconcileInterval)
+	defer reconcileTicker.Stop()
+
+	failures, reconciled := 0, false
+	for {
+		wait, notify := outboxPollInterval, r.db.outboxNotify
+		if err := r.publish(); err != nil {
+			failures++
+			wait = min(time.Duration(1<<min(failures, 6))*time.Second, outboxMaxBackoff)
+			notify = nil // new changes queue behind the failing one anyway
+			slog.Warn("Failed to publish sender changes to MSSQL, will retry", "retry_in", wait, "error", err)
+		} else {
+			failures = 0
+			// Reconcile once the changes made at startup are out
+			if !reconciled {
+				if _, err := r.Reconcile(); err != nil {
+					slog.Warn("Failed to reconcile senders", "error", err)
+				}
+				reconciled = true
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-notify:
+		case <-timer.C:
+		case <-reconcileTicker.C:
+			if _, err := r.Reconcile(); err != nil {
+				slog.Warn("Failed to reconcile senders", "error", err)
+			}
+		}
+		timer.Stop()
+	}
+}
+
+// Flush publishes every pending sender change, e.g. before shutting down
+func (r *SenderRelay) Flush(ctx context.Context) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := r.publish(); err != nil {
+			return err
+		}
+		pending, err := r.db.countSenderChanges()
+		if err != nil || pending == 0 {
+			return err
+		}
+	}
+}
+
+// publish sends one batch of pending changes to MSSQL, stopping at the first
+// failure so later changes never overtake an earlier one
+func (r *SenderRelay) publish() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	defer r.updatePendingMetric()
+
+	entries, err := r.db.pendingSenderChanges(outboxBatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		var publishErr error
+		switch entry.Operation {
+		case outboxUpsert:
+			publishErr = r.gormDB.SyncSenderToMSSQL(entry.Sender, entry.ID)
+		case outboxDelete:
+			publishErr = r.gormDB.DeleteSender(entry.Phone, entry.ID)
+		default:
+			// Can't be published, skip it rather than block the outbox forever
+			slog.Error("Dropping sender outbox entry with unknown operation", "id", entry.ID, "sender", entry.Phone, "operation", entry.Operation)
+		}
+
+		if publishErr != nil {
+			metrics.DBWriteErrors.WithLabelValues("sender_outbox").Inc()
+			if err := r.db.failSenderChange(entry.ID, publishErr); err != nil {
+				slog.Warn("Failed to record sender outbox attempt", "id", entry.ID, "error", err)
+			}
+			return fmt.Errorf("failed to publish change %d of sender %s after %d attempts: %v", entry.ID, entry.Phone, entry.Attempts+1, publishErr)
+		}
+		if err := r.db.completeSenderChange(entry.ID); err != nil {
+			return fmt.Errorf("failed to remove published sender change %d: %v", entry.ID, err)
+		}
+	}
+	return nil
+}
+
+func (r *SenderRelay) updatePendingMetric() {
+	if pending, err := r.db.countSenderChanges(); err == nil {
+		metrics.SenderOutboxPending.Set(float64(pending))
+	}
+}
+
+// Reconcile compares the senders in SQLite with those in MSSQL and returns how
+// many differ. Each difference is logged and a resync is queued through the
+// outbox. It is skipped while changes are pending, as those would show up as drift.
+func (r *SenderRelay) Reconcile() (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pending, err := r.db.countSenderChanges()
+	if err != nil {
+		return 0, err
+	}
+	if pending > 0 {
+		slog.Debug("Skipping sender reconciliation while changes are pending", "pending", pending)
+		return 0, nil
+	}
+
+	local, err := r.db.GetAllSenders()
+	if err != nil {
+		return 0, err
+	}
+	remote, err := r.gormDB.GetAllSenders()
+	if err != nil {
+		return 0, err
+	}
+
+	remoteByPhone := make(map[string]models.Sender, len(remote))
+	for _, sender := range remote {
+		remoteByPhone[sender.Phone] = sender
+	}
+
+	var drifted []string
+	for _, sender := range local {
+		remoteSender, exists := remoteByPhone[sender.Phone]
+		delete(remoteByPhone, sender.Phone)
+		switch {
+		case !exists:
+			slog.Warn("Sender drift: missing in MSSQL", "sender", sender.Phone, "status", sender.Status)
+		case remoteSender.Status != sender.Status || remoteSender.DeviceID != sender.DeviceID:
+			slog.Warn("Sender drift: MSSQL differs from SQLite", "sender", sender.Phone,
+				"status", sender.Status, "mssql_status", remoteSender.Status,
+				"device_id", sender.DeviceID, "mssql_device_id", remoteSender.DeviceID)
+		default:
+			continue
+		}
+		drifted = append(drifted, sender.Phone)
+	}
+	for phone := range remoteByPhone {
+		slog.Warn("Sender drift: only in MSSQL", "sender", phone)
+		drifted = append(drifted, phone)
+	}
+
+	metrics.SenderDrift.Set(float64(len(drifted)))
+	for _, phone := range drifted {
+		if err := r.db.ResyncSender(phone); err != nil {
+			slog.Warn("Failed to queue sender resync", "sender", phone, "error", err)
+		}
+	}
+	if len(drifted) > 0 {
+		slog.Warn("Senders drifted between SQLite and MSSQL, resync queued", "count", len(drifted))
+	}
+	return len(drifted), nil
+}
@@ -0,0 +1,143 @@
+package database
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/jaliph/auto-dm/models"
+)
+
+// ContactData is everything the message database holds about one contact
+type ContactData struct {
+	Messages     []models.Message
+	Polls        []models.Poll
+	PollVotes    []models.PollVote
+	AuditEntries []models.AuditEntry
+}
+
+// ContactErasure counts the records an erasure deleted or anonymized
+type ContactErasure struct {
+	Messages     int64
+	Polls        int64
+	PollVotes    int64
+	AuditEntries int64
+}
+
+// contactJID returns the chat ID of the one-to-one chat with a phone number
+func contactJID(phone string) string {
+	return phone + "@s.whatsapp.net"
+}
+
+// contactMessages selects the messages a contact sent or received, or that
+// belong to the one-to-one chat with them, including soft-deleted ones
+func contactMessages(tx *gorm.DB, phone string) *gorm.DB {
+	return tx.Unscoped().Model(&models.Message{}).
+		Where("sender_phone = ? OR recipient_phone = ? OR chat_id = ?", phone, phone, contactJID(phone))
+}
+
+// contactPolls selects the polls a contact created or that were sent in the chat with them
+func contactPolls(tx *gorm.DB, phone string) *gorm.DB {
+	return tx.Model(&models.Poll{}).Where("sender_phone = ? OR chat_id = ?", phone, contactJID(phone))
+}
+
+// GetContactData retrieves every message, poll, vote and audit entry that
+// references a contact's phone number, oldest first
+func (gdb *GormDB) GetContactData(phone string) (*ContactData, error) {
+	var data ContactData
+	if err := contactMessages(gdb.db, phone).Order("timestamp, id").Find(&data.Messages).Error; err != nil {
+		return nil, fmt.Errorf("failed to get contact messages: %v", err)
+	}
+	if err := contactPolls(gdb.db, phone).Order("id").Find(&data.Polls).Error; err != nil {
+		return nil, fmt.Errorf("failed to get contact polls: %v", err)
+	}
+	if err := gdb.db.Where("voter_phone = ?", phone).Order("timestamp").Find(&data.PollVotes).Error; err != nil {
+		return nil, fmt.Errorf("failed to get contact poll votes: %v", err)
+	}
+	if err := gdb.db.Where("target = ?", phone).Order("timestamp").Find(&data.AuditEntries).Error; err != nil {
+		return nil, fmt.Errorf("failed to get contact audit entries: %v", err)
+	}
+	return &data, nil
+}
+
+// EraseContact removes a contact's phone number from the message database in
+// one transaction. In delete mode their messages and polls are hard-deleted; in
+// anonymize mode they are kept for stats without content and with the phone
+// number replaced by models.ErasedPhone. Their poll votes are deleted either
+// way. Audit entries targeting the phone number are the one exception to the
+// audit log being append-only: their target is replaced as well.
+func (gdb *GormDB) EraseContact(phone, mode string) (ContactErasure, error) {
+	var erasure ContactErasure
+	err := gdb.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("voter_phone = ?", phone).Delete(&models.PollVote{})
+		if result.Error != nil {
+			return fmt.Errorf("failed to delete poll votes: %v", result.Error)
+		}
+		erasure.PollVotes = result.RowsAffected
+
+		if mode == models.ErasureAnonymize {
+			if err := anonymizeContact(tx, phone, &erasure); err != nil {
+				return err
+			}
+		} else {
+			result = contactPolls(tx, phone).Delete(&models.Poll{})
+			if result.Error != nil {
+				return fmt.Errorf("failed to delete polls: %v", result.Error)
+			}
+			erasure.Polls = result.RowsAffected
+
+			result = contactMessages(tx, phone).Delete(&models.Message{})
+			if result.Error != nil {
+				return fmt.Errorf("failed to delete messages: %v", result.Error)
+			}
+			erasure.Messages = result.RowsAffected
+		}
+
+		result = tx.Model(&models.AuditEntry{}).Where("target = ?", phone).Update("target", models.ErasedPhone)
+		if result.Error != nil {
+			return fmt.Errorf("failed to erase audit entries: %v", result.Error)
+		}
+		erasure.AuditEntries = result.RowsAffected
+		return nil
+	})
+	if err != nil {
+		return ContactErasure{}, err
+	}
+	return erasure, nil
+}
+
+// anonymizeContact clears the content of a contact's messages and polls and
+// replaces their phone number, keeping the rows for stats
+func anonymizeContact(tx *gorm.DB, phone string, erasure *ContactErasure) error {
+	result := contactPolls(tx, phone).Updates(map[string]any{"question": "", "options": gorm.Expr("NULL")})
+	if result.Error != nil {
+		return fmt.Errorf("failed to anonymize polls: %v", result.Error)
+	}
+	erasure.Polls = result.RowsAffected
+	for _, column := range []string{"sender_phone", "chat_id"} {
+		if err := tx.Model(&models.Poll{}).Where(column+" IN ?", []string{phone, contactJID(phone)}).
+			Update(column, models.ErasedPhone).Error; err != nil {
+			return fmt.Errorf("failed to anonymize polls: %v", err)
+		}
+	}
+
+	result = contactMessages(tx, phone).Updates(map[string]any{
+		"content":          "",
+		"original_content": "",
+		"media_url":        "",
+		"payload":          gorm.Expr("NULL"),
+		"anonymized_at":    time.Now(),
+	})
+	if result.Error != nil {
+		return fmt.Errorf("failed to anonymize messages: %v", result.Error)
+	}
+	erasure.Messages = result.RowsAffected
+	for _, column := range []string{"sender_phone", "recipient_phone", "chat_id"} {
+		if err := tx.Unscoped().Model(&models.Message{}).Where(column+" IN ?", []string{phone, contactJID(phone)}).
+			Update(column, models.ErasedPhone).Error; err != nil {
+			return fmt.Errorf("failed to anonymize messages: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,394 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"github.com/jaliph/auto-dm/metrics"
+	"github.com/jaliph/auto-dm/models"
+)
+
+// What a retention rule does with expired messages
+const (
+	RetentionDelete    = "delete"    // remove the message and its poll for good
+	RetentionAnonymize = "anonymize" // keep the message for stats but remove its content
+)
+
+// RetentionRule sets how long the messages of a sender and/or message type are
+// kept. An empty Sender or MessageType matches any.
+type RetentionRule struct {
+	Sender      string
+	MessageType string
+	Days        int    // 0 keeps matching messages forever
+	Mode        string // RetentionDelete or RetentionAnonymize
+}
+
+// specificity ranks rules so that the most specific one matching a message
+// applies: sender and type, then sender, then type, then the global rule
+func (r RetentionRule) specificity() int {
+	rank := 0
+	if r.Sender != "" {
+		rank += 2
+	}
+	if r.MessageType != "" {
+		rank++
+	}
+	return rank
+}
+
+// overlaps reports whether some message could match both rules
+func (r RetentionRule) overlaps(other RetentionRule) bool {
+	return (r.Sender == "" || other.Sender == "" || r.Sender == other.Sender) &&
+		(r.MessageType == "" || other.MessageType == "" || r.MessageType == other.MessageType)
+}
+
+func (r RetentionRule) String() string {
+	sender, messageType := r.Sender, r.MessageType
+	if sender == "" {
+		sender = "*"
+	}
+	if messageType == "" {
+		messageType = "*"
+	}
+	return fmt.Sprintf("%s/%s=%d:%s", sender, messageType, r.Days, r.Mode)
+}
+
+// ParseRetentionRules parses a comma-separated list of rules in the form
+// <sender|*>/<type|*>=<days>[:delete|anonymize], using defaultMode for rules
+// without a mode. The global rule */* is not accepted here, it comes from the
+// message_days setting.
+func ParseRetentionRules(spec, defaultMode string) ([]RetentionRule, error) {
+	if defaultMode != RetentionDelete && defaultMode != RetentionAnonymize {
+		return nil, fmt.Errorf("invalid retention mode %q, expected %s or %s", defaultMode, RetentionDelete, RetentionAnonymize)
+	}
+
+	var rules []RetentionRule
+	seen := make(map[string]bool)
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		scope, value, ok := strings.Cut(item, "=")
+		sender, messageType, hasType := strings.Cut(strings.TrimSpace(scope), "/")
+		if !ok || !hasType {
+			return nil, fmt.Errorf("invalid retention rule %q, expected <sender|*>/<type|*>=<days>[:mode]", item)
+		}
+
+		days, mode, hasMode := strings.Cut(strings.TrimSpace(value), ":")
+		if !hasMode {
+			mode = defaultMode
+		}
+		rule := RetentionRule{Sender: strings.TrimSpace(sender), MessageType: strings.TrimSpace(messageType), Mode: strings.TrimSpace(mode)}
+		if rule.Sender == "*" {
+			rule.Sender = ""
+		}
+		if rule.MessageType == "*" {
+			rule.MessageType = ""
+		}
+
+		var err error
+		if rule.Days, err = strconv.Atoi(strings.TrimSpace(days)); err != nil || rule.Days < 0 {
+			return nil, fmt.Errorf("invalid days in retention rule %q", item)
+		}
+		if rule.Mode != RetentionDelete && rule.Mode != RetentionAnonymize {
+			return nil, fmt.Errorf("invalid mode in retention rule %q, expected %s or %s", item, RetentionDelete, RetentionAnonymize)
+		}
+
+		if rule.Sender == "" && rule.MessageType == "" {
+			return nil, fmt.Errorf("retention rule %q matches every message, set message_days instead", item)
+		}
+		key := rule.Sender + "/" + rule.MessageType
+		if seen[key] {
+			return nil, fmt.Errorf("duplicate retention rule for %s", key)
+		}
+		seen[key] = true
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// RetentionPolicy sets what the retention job purges
+type RetentionPolicy struct {
+	Rules           []RetentionRule // at most one rule per sender and type, the global rule has neither
+	MediaDays       int             // clear media references of messages older than this, 0 keeps them
+	SoftDeletedDays int             // hard-delete rows soft-deleted longer ago than this, 0 keeps them
+	BatchSize       int             // rows changed per statement
+}
+
+// Enabled reports whether the policy purges anything
+func (p RetentionPolicy) Enabled() bool {
+	for _, rule := range p.Rules {
+		if rule.Days > 0 {
+			return true
+		}
+	}
+	return p.MediaDays > 0 || p.SoftDeletedDays > 0
+}
+
+// RetentionReport counts what one retention run purged
+type RetentionReport struct {
+	Deleted           int64 `json:"deleted"`
+	Anonymized        int64 `json:"anonymized"`
+	MediaCleared      int64 `json:"media_cleared"`
+	SoftDeletedPurged int64 `json:"soft_deleted_purged"`
+}
+
+// Total returns how many messages the run changed
+func (r RetentionReport) Total() int64 {
+	return r.Deleted + r.Anonymized + r.MediaCleared + r.SoftDeletedPurged
+}
+
+// ApplyRetention enforces a retention policy relative to now. Messages are
+// changed in batches so a large backlog never holds long locks. On error the
+// report covers what was purged before it.
+func (gdb *GormDB) ApplyRetention(policy RetentionPolicy, now time.Time) (RetentionReport, error) {
+	var report RetentionReport
+	// SQL Server accepts at most 2100 parameters, and each ID in a batch is one
+	batchSize := policy.BatchSize
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+	batchSize = min(batchSize, 2000)
+
+	for _, rule := range policy.Rules {
+		if rule.Days <= 0 {
+			continue
+		}
+		cutoff := now.AddDate(0, 0, -rule.Days)
+		scope := func(tx *gorm.DB) *gorm.DB {
+			return retentionScope(tx.Where("timestamp < ?", cutoff), rule, policy.Rules)
+		}
+
+		if rule.Mode == RetentionAnonymize {
+			count, err := gdb.inBatches(batchSize, func(tx *gorm.DB) *gorm.DB {
+				return scope(tx).Where("anonymized_at IS NULL")
+			}, func(tx *gorm.DB, ids []uint) error {
+				return anonymizeMessages(tx, ids, now)
+			})
+			report.Anonymized += count
+			if err != nil {
+				return report, fmt.Errorf("retention rule %s: %v", rule, err)
+			}
+			continue
+		}
+
+		count, err := gdb.inBatches(batchSize, scope, deleteMessages)
+		report.Deleted += count
+		if err != nil {
+			return report, fmt.Errorf("retention rule %s: %v", rule, err)
+		}
+	}
+
+	if policy.MediaDays > 0 {
+		cutoff := now.AddDate(0, 0, -policy.MediaDays)
+		count, err := gdb.inBatches(batchSize, func(tx *gorm.DB) *gorm.DB {
+			return tx.Where("timestamp < ? AND media_url <> ''", cutoff)
+		}, func(tx *gorm.DB, ids []uint) error {
+			return tx.Unscoped().Model(&models.Message{}).Where("id IN ?", ids).Update("media_url", "").Error
+		})
+		report.MediaCleared += count
+		if err != nil {
+			return report, fmt.Errorf("media retention: %v", err)
+		}
+	}
+
+	if policy.SoftDeletedDays > 0 {
+		cutoff := now.AddDate(0, 0, -policy.SoftDeletedDays)
+		count, err := gdb.inBatches(batchSize, func(tx *gorm.DB) *gorm.DB {
+			return tx.Where("deleted_at IS NOT NULL AND deleted_at < ?", cutoff)
+		}, deleteMessages)
+		report.SoftDeletedPurged += count
+		if err != nil {
+			return report, fmt.Errorf("soft-deleted retention: %v", err)
+		}
+	}
+
+	return report, nil
+}
+
+// retentionScope restricts a query to the messages a rule governs: those it
+// matches and no more specific rule matches
+func retentionScope(query *gorm.DB, rule RetentionRule, rules []RetentionRule) *gorm.DB {
+	if rule.Sender != "" {
+		query = query.Where("sender_phone = ?", rule.Sender)
+	}
+	if rule.MessageType != "" {
+		query = query.Where("message_type = ?", rule.MessageType)
+	}
+
+	for _, other := range rules {
+		if other.specificity() <= rule.specificity() || !other.overlaps(rule) {
+			continue
+		}
+		switch {
+		case other.Sender != "" && other.MessageType != "":
+			query = query.Where("NOT (sender_phone = ? AND message_type = ?)", other.Sender, other.MessageType)
+		case other.Sender != "":
+			query = query.Where("sender_phone <> ?", other.Sender)
+		default:
+			query = query.Where("message_type <> ?", other.MessageType)
+		}
+	}
+	return query
+}
+
+// inBatches repeatedly selects up to batchSize message IDs matching scope,
+// including soft-deleted rows, and applies change to them in a transaction
+// until none are left. It returns how many messages were changed.
+func (gdb *GormDB) inBatches(batchSize int, scope func(tx *gorm.DB) *gorm.DB, change func(tx *gorm.DB, ids []uint) error) (int64, error) {
+	var total int64
+	for {
+		var ids []uint
+		query := scope(gdb.db.Unscoped().Model(&models.Message{}))
+		if err := query.Order("id").Limit(batchSize).Pluck("id", &ids).Error; err != nil {
+			return total, fmt.Errorf("failed to select messages: %v", err)
+		}
+		if len(ids) == 0 {
+			return total, nil
+		}
+
+		if err := gdb.db.Transaction(func(tx *gorm.DB) error { return change(tx, ids) }); err != nil {
+			return total, err
+		}
+		total += int64(len(ids))
+		if len(ids) < batchSize {
+			return total, nil
+		}
+	}
+}
+
+// deleteMessages permanently deletes messages along with the polls they
+// created and the votes cast on those polls
+func deleteMessages(tx *gorm.DB, ids []uint) error {
+	var messageIDs []string
+	if err := tx.Unscoped().Model(&models.Message{}).Where("id IN ?", ids).Pluck("message_id", &messageIDs).Error; err != nil {
+		return fmt.Errorf("failed to look up messages: %v", err)
+	}
+	if len(messageIDs) > 0 {
+		if err := tx.Where("poll_message_id IN ?", messageIDs).Delete(&models.PollVote{}).Error; err != nil {
+			return fmt.Errorf("failed to delete poll votes: %v", err)
+		}
+		if err := tx.Where("message_id IN ?", messageIDs).Delete(&models.Poll{}).Error; err != nil {
+			return fmt.Errorf("failed to delete polls: %v", err)
+		}
+	}
+	if err := tx.Unscoped().Where("id IN ?", ids).Delete(&models.Message{}).Error; err != nil {
+		return fmt.Errorf("failed to delete messages: %v", err)
+	}
+	return nil
+}
+
+// anonymizeMessages removes the content of messages, and of the polls they
+// created, while keeping who sent what type of message when for the stats
+func anonymizeMessages(tx *gorm.DB, ids []uint, now time.Time) error {
+	var messageIDs []string
+	if err := tx.Unscoped().Model(&models.Message{}).Where("id IN ?", ids).Pluck("message_id", &messageIDs).Error; err != nil {
+		return fmt.Errorf("failed to look up messages: %v", err)
+	}
+	if len(messageIDs) > 0 {
+		if err := tx.Model(&models.PollVote{}).Where("poll_message_id IN ?", messageIDs).
+			Update("selected_options", gorm.Expr("NULL")).Error; err != nil {
+			return fmt.Errorf("failed to anonymize poll votes: %v", err)
+		}
+		if err := tx.Model(&models.Poll{}).Where("message_id IN ?", messageIDs).
+			Updates(map[string]any{"question": "", "options": gorm.Expr("NULL")}).Error; err != nil {
+			return fmt.Errorf("failed to anonymize polls: %v", err)
+		}
+	}
+
+	err := tx.Unscoped().Model(&models.Message{}).Where("id IN ?", ids).Updates(map[string]any{
+		"content":          "",
+		"original_content": "",
+		"media_url":        "",
+		"payload":          gorm.Expr("NULL"),
+		"anonymized_at":    now,
+	}).Error
+	if err != nil {
+		return fmt.Errorf("failed to anonymize messages: %v", err)
+	}
+	return nil
+}
+
+// RetentionJob enforces a retention policy on a schedule
+type RetentionJob struct {
+	gormDB   *GormDB
+	policy   RetentionPolicy
+	interval time.Duration
+}
+
+// NewRetentionJob creates a job that applies policy every interval
+func NewRetentionJob(gormDB *GormDB, policy RetentionPolicy, interval time.Duration) *RetentionJob {
+	return &RetentionJob{gormDB: gormDB, policy: policy, interval: interval}
+}
+
+// Run applies the policy right away and then every interval, until ctx is cancelled
+func (j *RetentionJob) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		j.RunOnce()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce applies the policy and reports what was purged in the log, the
+// metrics and, when anything changed, the audit log
+func (j *RetentionJob) RunOnce() (RetentionReport, error) {
+	if !j.gormDB.Available() {
+		slog.Debug("Skipping retention run while MSSQL is unavailable")
+		return RetentionReport{}, nil
+	}
+
+	started := time.Now()
+	report, err := j.gormDB.ApplyRetention(j.policy, started)
+
+	metrics.RetentionPurged.WithLabelValues("delete").Add(float64(report.Deleted))
+	metrics.RetentionPurged.WithLabelValues("anonymize").Add(float64(report.Anonymized))
+	metrics.RetentionPurged.WithLabelValues("clear_media").Add(float64(report.MediaCleared))
+	metrics.RetentionPurged.WithLabelValues("purge_soft_deleted").Add(float64(report.SoftDeletedPurged))
+
+	logArgs := []any{
+		"deleted", report.Deleted,
+		"anonymized", report.Anonymized,
+		"media_cleared", report.MediaCleared,
+		"soft_deleted_purged", report.SoftDeletedPurged,
+		"duration", time.Since(started),
+	}
+	if err != nil {
+		metrics.DBWriteErrors.WithLabelValues("retention").Inc()
+		slog.Error("Retention run failed", append(logArgs, "error", err)...)
+	} else {
+		slog.Info("Retention run finished", logArgs...)
+	}
+
+	if report.Total() > 0 {
+		entry := &models.AuditEntry{
+			Timestamp: started,
+			Actor:     "system",
+			Action:    models.AuditRetention,
+			Target: fmt.Sprintf("deleted=%d anonymized=%d media_cleared=%d soft_deleted_purged=%d",
+				report.Deleted, report.Anonymized, report.MediaCleared, report.SoftDeletedPurged),
+			Outcome: "success",
+		}
+		if err != nil {
+			entry.Outcome, entry.Error = "failure", err.Error()
+		}
+		if auditErr := j.gormDB.StoreAuditEntry(entry); auditErr != nil {
+			slog.Warn("Failed to audit retention run", "error", auditErr)
+		}
+	}
+	return report, err
+}
@@ -0,0 +1,334 @@
+package database
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jaliph/auto-dm/metrics"
+	"github.com/jaliph/auto-dm/models"
+)
+
+// Writes that can be spooled while MSSQL is unavailable
+const (
+	spoolStoreMessage  = "store_message"
+	spoolStoreFollowUp = "store_follow_up"
+	spoolStorePoll     = "store_poll"
+	spoolStorePollVote = "store_poll_vote"
+)
+
+// spoolEntry is one write waiting to be replayed. Only the field matching Op is set.
+type spoolEntry struct {
+	Op        string           `json:"op"`
+	SpooledAt time.Time        `json:"spooled_at"`
+	Message   *models.Message  `json:"message,omitempty"`
+	Poll      *models.Poll     `json:"poll,omitempty"`
+	PollVote  *models.PollVote `json:"poll_vote,omitempty"`
+}
+
+// spool is an append-only journal of the writes made while MSSQL was
+// unavailable, kept on disk so they survive a restart. Direct writes hold the
+// read lock, so appending and replaying wait for them and keep the order.
+type spool struct {
+	path    string
+	file    *os.File
+	pending int
+	mu      sync.RWMutex
+}
+
+// openSpool opens the journal at path, counting the entries left by a previous run
+func openSpool(path string) (*spool, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create spool directory: %v", err)
+	}
+
+	s := &spool{path: path}
+	entries, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	s.pending = len(entries)
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	metrics.DBSpoolPending.Set(float64(s.pending))
+	return s, nil
+}
+
+func (s *spool) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open spool: %v", err)
+	}
+	s.file = file
+	return nil
+}
+
+// append adds an entry to the end of the journal and syncs it to disk
+func (s *spool) append(entry spoolEntry) error {
+	entry.SpooledAt = time.Now()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode spool entry: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return fmt.Errorf("spool is closed")
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write spool entry: %v", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync spool: %v", err)
+	}
+	s.pending++
+	metrics.DBSpoolPending.Set(float64(s.pending))
+	return nil
+}
+
+// read returns the entries in the journal, oldest first. The caller must hold
+// the lock unless the spool is not shared yet.
+func (s *spool) read() ([]spoolEntry, error) {
+	file, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spool: %v", err)
+	}
+	defer file.Close()
+
+	var entries []spoolEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry spoolEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A crash can leave a partly written last line, which was never acknowledged
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read spool: %v", err)
+	}
+	return entries, nil
+}
+
+// rewrite replaces the journal with the entries that are still waiting. The
+// caller must hold the lock.
+func (s *spool) rewrite(remaining []spoolEntry) error {
+	tmpPath := s.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create spool: %v", err)
+	}
+
+	writer := bufio.NewWriter(tmp)
+	for _, entry := range remaining {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to encode spool entry: %v", err)
+		}
+		writer.Write(append(line, '\n'))
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write spool: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync spool: %v", err)
+	}
+	tmp.Close()
+
+	if s.file != nil {
+		s.file.Close()
+	}
+	if err := os.Rename(tmpPath, s.path); err != nil {
+		s.open()
+		return fmt.Errorf("failed to replace spool: %v", err)
+	}
+	s.pending = len(remaining)
+	metrics.DBSpoolPending.Set(float64(s.pending))
+	return s.open()
+}
+
+// close closes the journal file and returns how many entries are still
+// waiting. They stay on disk for the next run.
+func (s *spool) close() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return s.pending, nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return s.pending, err
+}
+
+// spoolRetryInterval is how often MSSQL is retried while writes are being spooled
+const spoolRetryInterval = 10 * time.Second
+
+// pingTimeout bounds the check that tells an unreachable MSSQL from a failed write
+const pingTimeout = 5 * time.Second
+
+// write applies a write to MSSQL, or spools it when MSSQL is unavailable or
+// earlier writes are still waiting, so writes reach MSSQL in order
+func (gdb *GormDB) write(entry spoolEntry, apply func() error) error {
+	gdb.spool.mu.RLock()
+	if gdb.spool.pending == 0 && gdb.available.Load() {
+		err := apply()
+		if err == nil || gdb.reachable() {
+			gdb.spool.mu.RUnlock()
+			return err
+		}
+		gdb.markUnavailable(err)
+	}
+	gdb.spool.mu.RUnlock()
+
+	if err := gdb.spool.append(entry); err != nil {
+		return fmt.Errorf("MSSQL unavailable and spooling failed: %v", err)
+	}
+	return nil
+}
+
+// reachable reports whether MSSQL answers a ping, which tells a rejected write
+// such as a duplicate apart from a lost connection
+func (gdb *GormDB) reachable() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	return gdb.Ping(ctx) == nil
+}
+
+// markUnavailable switches to spooling writes and starts retrying MSSQL in the background
+func (gdb *GormDB) markUnavailable(err error) {
+	if gdb.available.Swap(false) {
+		slog.Warn("MSSQL unavailable, spooling writes until it recovers", "error", err)
+	}
+	if gdb.recovering.CompareAndSwap(false, true) {
+		go gdb.recoverLoop()
+	}
+}
+
+// recoverLoop retries MSSQL until it is reachable, finishes any pending
+// migration and replays the spooled writes before direct writes resume
+func (gdb *GormDB) recoverLoop() {
+	ticker := time.NewTicker(spoolRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		if gdb.tryRecover() {
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-gdb.done:
+			return
+		}
+	}
+}
+
+// tryRecover makes one recovery attempt and reports whether MSSQL is usable again
+func (gdb *GormDB) tryRecover() bool {
+	if !gdb.reachable() {
+		return false
+	}
+	if !gdb.migrated.Load() {
+		if err := gdb.migrate(); err != nil {
+			slog.Warn("Failed to migrate database after MSSQL recovered", "error", err)
+			return false
+		}
+		gdb.migrated.Store(true)
+	}
+
+	gdb.spool.mu.Lock()
+	defer gdb.spool.mu.Unlock()
+
+	replayed, err := gdb.replay()
+	if err != nil {
+		slog.Warn("Failed to replay spooled writes, will retry", "replayed", replayed, "remaining", gdb.spool.pending, "error", err)
+		return false
+	}
+	// Clear the flag first so a failure right after resuming starts a new loop
+	gdb.recovering.Store(false)
+	gdb.available.Store(true)
+	slog.Info("MSSQL available, direct writes resumed", "replayed", replayed)
+	return true
+}
+
+// replay applies the spooled writes in order and removes the ones that were
+// applied from the journal. The caller must hold the spool lock.
+func (gdb *GormDB) replay() (int, error) {
+	entries, err := gdb.spool.read()
+	if err != nil {
+		return 0, err
+	}
+
+	for i, entry := range entries {
+		if err := gdb.applySpooled(entry); err != nil {
+			if !gdb.reachable() {
+				// Keep the rest for the next attempt
+				if rewriteErr := gdb.spool.rewrite(entries[i:]); rewriteErr != nil {
+					return i, rewriteErr
+				}
+				return i, err
+			}
+			// MSSQL rejected the write itself, retrying would never succeed
+			metrics.DBWriteErrors.WithLabelValues("spool_replay").Inc()
+			slog.Error("Dropping spooled write rejected by MSSQL", "op", entry.Op, "spooled_at", entry.SpooledAt, "error", err)
+		}
+	}
+	return len(entries), gdb.spool.rewrite(nil)
+}
+
+// applySpooled replays one spooled write. Messages and polls that are already
+// stored are skipped using their unique message ID, so a replay interrupted by
+// a crash can run again safely.
+func (gdb *GormDB) applySpooled(entry spoolEntry) error {
+	switch entry.Op {
+	case spoolStoreMessage, spoolStoreFollowUp:
+		if entry.Message == nil {
+			return fmt.Errorf("spooled %s has no message", entry.Op)
+		}
+		if gdb.MessageExists(entry.Message.MessageID) {
+			return nil
+		}
+		if entry.Op == spoolStoreFollowUp {
+			return gdb.storeFollowUpMessage(entry.Message)
+		}
+		return gdb.storeMessage(entry.Message)
+	case spoolStorePoll:
+		if entry.Poll == nil {
+			return fmt.Errorf("spooled %s has no poll", entry.Op)
+		}
+		var count int64
+		if err := gdb.db.Model(&models.Poll{}).Where("message_id = ?", entry.Poll.MessageID).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return nil
+		}
+		return gdb.storePoll(entry.Poll)
+	case spoolStorePollVote:
+		if entry.PollVote == nil {
+			return fmt.Errorf("spooled %s has no vote", entry.Op)
+		}
+		// Votes only replace older ones, so replaying them again is harmless
+		return gdb.storePollVote(entry.PollVote)
+	default:
+		return fmt.Errorf("unknown spooled write %q", entry.Op)
+	}
+}
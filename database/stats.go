@@ -0,0 +1,281 @@
+package database
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/jaliph/auto-dm/models"
+)
+
+// maxStatsBuckets keeps a time series from growing unbounded, e.g. hourly over years
+const maxStatsBuckets = 10000
+
+// StatsOptions selects the range, grouping and time series of a stats report
+type StatsOptions struct {
+	From     time.Time
+	To       time.Time
+	Location *time.Location // timezone used for "today" and the time series buckets
+	GroupBy  string         // "", "sender", "contact", "type" or "direction"
+	Interval string         // "", "hour", "day" or "week"
+}
+
+// statsRow holds the columns of a message needed for a stats report
+type statsRow struct {
+	SenderPhone    string
+	RecipientPhone string
+	ChatID         string
+	MessageType    string
+	IsFromMe       bool
+	Timestamp      time.Time
+	DeliveredAt    *time.Time
+	ReadAt         *time.Time
+}
+
+// seriesKey identifies a time series point by bucket and group
+type seriesKey struct {
+	start int64 // bucket start as Unix time
+	group string
+}
+
+// GetStatsReport builds message statistics over a date range. Messages are
+// streamed in chat order rather than loaded at once, so large ranges stay cheap.
+func (gdb *GormDB) GetStatsReport(opts StatsOptions) (*models.StatsReport, error) {
+	if opts.Interval != "" {
+		buckets := 0
+		for start := bucketStart(opts.From, opts.Interval, opts.Location); start.Before(opts.To); start = nextBucket(start, opts.Interval) {
+			if buckets++; buckets > maxStatsBuckets {
+				return nil, fmt.Errorf("range too large for %s interval (more than %d buckets)", opts.Interval, maxStatsBuckets)
+			}
+		}
+	}
+
+	totals, err := gdb.GetMessageStats(opts.Location)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &models.StatsReport{
+		MessageStats: *totals,
+		From:         opts.From,
+		To:           opts.To,
+		Timezone:     opts.Location.String(),
+		GroupBy:      opts.GroupBy,
+		Interval:     opts.Interval,
+	}
+
+	rows, err := gdb.db.Model(&models.Message{}).
+		Select("sender_phone, recipient_phone, chat_id, message_type, is_from_me, timestamp, delivered_at, read_at").
+		Where("timestamp >= ? AND timestamp < ?", opts.From, opts.To).
+		Where("message_type NOT IN ?", followUpMessageTypes).
+		Order("chat_id, timestamp").
+		Rows()
+	if err != nil {
+		return nil, fmt.Errorf("failed to query messages for stats: %v", err)
+	}
+	defer rows.Close()
+
+	groups := make(map[string]*models.StatsGroup)
+	series := make(map[seriesKey]*models.StatsPoint)
+	delivery := &models.DeliveryStats{}
+	var replyTimes []float64
+
+	// Inbound messages waiting for a reply in the current chat
+	var currentChat string
+	var waitingSince *time.Time
+
+	for rows.Next() {
+		var row statsRow
+		if err := gdb.db.ScanRows(rows, &row); err != nil {
+			return nil, fmt.Errorf("failed to read message for stats: %v", err)
+		}
+
+		if row.IsFromMe {
+			report.Sent++
+			delivery.Sent++
+			if row.DeliveredAt != nil || row.ReadAt != nil {
+				delivery.Delivered++
+			}
+			if row.ReadAt != nil {
+				delivery.Read++
+			}
+		} else {
+			report.Received++
+		}
+
+		if opts.GroupBy != "" {
+			key := statsGroupKey(row, opts.GroupBy)
+			group, exists := groups[key]
+			if !exists {
+				group = &models.StatsGroup{Key: key}
+				groups[key] = group
+			}
+			countStatsMessage(&group.Sent, &group.Received, &group.Total, row.IsFromMe)
+		}
+
+		if opts.Interval != "" {
+			start := bucketStart(row.Timestamp, opts.Interval, opts.Location)
+			key := seriesKey{start: start.Unix()}
+			if opts.GroupBy != "" {
+				key.group = statsGroupKey(row, opts.GroupBy)
+			}
+			point, exists := series[key]
+			if !exists {
+				point = &models.StatsPoint{Start: start, Group: key.group}
+				series[key] = point
+			}
+			countStatsMessage(&point.Sent, &point.Received, &point.Total, row.IsFromMe)
+		}
+
+		if row.ChatID != currentChat {
+			currentChat = row.ChatID
+			waitingSince = nil
+		}
+		switch {
+		case !row.IsFromMe && waitingSince == nil:
+			timestamp := row.Timestamp
+			waitingSince = &timestamp
+		case row.IsFromMe && waitingSince != nil:
+			replyTimes = append(replyTimes, row.Timestamp.Sub(*waitingSince).Seconds())
+			waitingSince = nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read messages for stats: %v", err)
+	}
+
+	for _, group := range groups {
+		report.Groups = append(report.Groups, *group)
+	}
+	sort.Slice(report.Groups, func(i, j int) bool {
+		if report.Groups[i].Total != report.Groups[j].Total {
+			return report.Groups[i].Total > report.Groups[j].Total
+		}
+		return report.Groups[i].Key < report.Groups[j].Key
+	})
+
+	if opts.Interval != "" {
+		report.Series = buildSeries(series, opts)
+	}
+
+	if len(replyTimes) > 0 {
+		sort.Float64s(replyTimes)
+		var sum float64
+		for _, seconds := range replyTimes {
+			sum += seconds
+		}
+		report.ResponseTime = &models.ResponseTimeStats{
+			Replies:        len(replyTimes),
+			MedianSeconds:  percentile(replyTimes, 0.5),
+			AverageSeconds: sum / float64(len(replyTimes)),
+			P90Seconds:     percentile(replyTimes, 0.9),
+		}
+	}
+
+	// Rates are only meaningful once receipts are being recorded
+	if delivery.Delivered > 0 {
+		delivery.DeliveryRate = float64(delivery.Delivered) / float64(delivery.Sent)
+		delivery.ReadRate = float64(delivery.Read) / float64(delivery.Sent)
+		report.Delivery = delivery
+	}
+
+	return report, nil
+}
+
+// buildSeries orders the time series points. Without grouping, empty buckets
+// are filled in so charts get an evenly spaced series.
+func buildSeries(points map[seriesKey]*models.StatsPoint, opts StatsOptions) []models.StatsPoint {
+	var series []models.StatsPoint
+	if opts.GroupBy == "" {
+		for start := bucketStart(opts.From, opts.Interval, opts.Location); start.Before(opts.To); start = nextBucket(start, opts.Interval) {
+			if point, exists := points[seriesKey{start: start.Unix()}]; exists {
+				series = append(series, *point)
+			} else {
+				series = append(series, models.StatsPoint{Start: start})
+			}
+		}
+		return series
+	}
+
+	for _, point := range points {
+		series = append(series, *point)
+	}
+	sort.Slice(series, func(i, j int) bool {
+		if !series[i].Start.Equal(series[j].Start) {
+			return series[i].Start.Before(series[j].Start)
+		}
+		return series[i].Group < series[j].Group
+	})
+	return series
+}
+
+// statsGroupKey returns the group a message belongs to
+func statsGroupKey(row statsRow, groupBy string) string {
+	switch groupBy {
+	case "sender":
+		// The registered sender account the message went through
+		if row.IsFromMe {
+			return row.SenderPhone
+		}
+		return row.RecipientPhone
+	case "contact":
+		// The other side of the conversation
+		if row.IsFromMe {
+			return row.RecipientPhone
+		}
+		return row.SenderPhone
+	case "type":
+		return row.MessageType
+	case "direction":
+		if row.IsFromMe {
+			return "sent"
+		}
+		return "received"
+	}
+	return ""
+}
+
+// countStatsMessage adds a message to a set of counters
+func countStatsMessage(sent, received, total *int64, isFromMe bool) {
+	if isFromMe {
+		*sent++
+	} else {
+		*received++
+	}
+	*total++
+}
+
+// bucketStart returns the start of the hour, day or week (starting Monday) containing t in loc
+func bucketStart(t time.Time, interval string, loc *time.Location) time.Time {
+	t = t.In(loc)
+	switch interval {
+	case "hour":
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, loc)
+	case "week":
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+}
+
+// nextBucket returns the start of the bucket after start
+func nextBucket(start time.Time, interval string) time.Time {
+	switch interval {
+	case "hour":
+		return start.Add(time.Hour)
+	case "week":
+		return start.AddDate(0, 0, 7)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// percentile returns the p-th percentile of sorted values, interpolating between neighbours
+func percentile(sorted []float64, p float64) float64 {
+	position := p * float64(len(sorted)-1)
+	lower := int(position)
+	if lower+1 >= len(sorted) {
+		return sorted[lower]
+	}
+	fraction := position - float64(lower)
+	return sorted[lower] + fraction*(sorted[lower+1]-sorted[lower])
+}
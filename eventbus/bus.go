@@ -0,0 +1,388 @@
+package eventbus
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jaliph/auto-dm/models"
+)
+
+// subscriberBufferSize is how many events a slow subscriber may fall behind
+// before it is dropped. Dropped clients reconnect and resume from their last event ID.
+const subscriberBufferSize = 256
+
+// volatileTypes are event types kept in memory only. Message events carry
+// plaintext bodies and QR events carry pairing codes, neither belongs on disk.
+var volatileTypes = map[string]bool{
+	models.EventMessage:       true,
+	models.EventMessageStatus: true,
+	models.EventQR:            true,
+}
+
+// Bus fans out live events to subscribers and keeps the most recent ones in a
+// small on-disk buffer so clients can resume after a reconnect. The file is
+// written by a background goroutine so publishers never wait on disk I/O.
+type Bus struct {
+	path        string
+	maxEvents   int
+	buffer      []models.Event // most recent events, oldest first
+	pending     []models.Event // events waiting to be written to the file
+	nextID      uint64
+	subscribers map[*Subscription]struct{}
+	closed      bool
+	mu          sync.Mutex
+
+	file       *os.File
+	fileEvents int // events written to the file since the last compaction
+	fileMu     sync.Mutex
+
+	flush chan struct{} // wakes the writer when events are pending
+	done  chan struct{} // closed when the writer has stopped
+}
+
+// Filter selects the events a subscriber receives. Empty lists match everything.
+type Filter struct {
+	Senders []string
+	Types   []string
+}
+
+// Subscription is a live feed of events matching a filter
+type Subscription struct {
+	Events <-chan models.Event // closed when the subscription ends or falls behind
+	events chan models.Event
+	filter Filter
+}
+
+// NewBus creates an event bus backed by the buffer file at path, keeping at most maxEvents
+func NewBus(path string, maxEvents int) (*Bus, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create event buffer directory: %v", err)
+	}
+
+	// Volatile events are not in the file, so the highest ID in it is not the
+	// last one handed out. Seeding from the clock keeps IDs increasing across
+	// restarts, so resuming clients never see an ID reused.
+	bus := &Bus{
+		path:        path,
+		maxEvents:   maxEvents,
+		nextID:      uint64(time.Now().UnixMicro()),
+		subscribers: make(map[*Subscription]struct{}),
+		flush:       make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+
+	if err := bus.load(); err != nil {
+		return nil, err
+	}
+	// Rewriting the file right away also drops volatile events left by older versions
+	if err := bus.compact(bus.buffer); err != nil {
+		return nil, err
+	}
+	go bus.writer()
+	return bus, nil
+}
+
+// load reads the buffered events left by a previous run
+func (b *Bus) load() error {
+	file, err := os.Open(b.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open event buffer: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var event models.Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			// A crash can leave a partial last line behind
+			continue
+		}
+		b.buffer = append(b.buffer, event)
+		if event.ID >= b.nextID {
+			b.nextID = event.ID + 1
+		}
+	}
+	if len(b.buffer) > b.maxEvents {
+		b.buffer = b.buffer[len(b.buffer)-b.maxEvents:]
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the buffer file with the non-volatile events of buffer,
+// the caller must hold fileMu
+func (b *Bus) compact(buffer []models.Event) error {
+	if b.file != nil {
+		b.file.Close()
+		b.file = nil
+	}
+
+	tmpPath := b.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create event buffer: %v", err)
+	}
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	written := 0
+	for _, event := range buffer {
+		if volatileTypes[event.Type] {
+			continue
+		}
+		if err := encoder.Encode(event); err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to write event buffer: %v", err)
+		}
+		written++
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write event buffer: %v", err)
+	}
+	tmp.Close()
+
+	if err := os.Rename(tmpPath, b.path); err != nil {
+		return fmt.Errorf("failed to replace event buffer: %v", err)
+	}
+
+	b.file, err = os.OpenFile(b.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open event buffer: %v", err)
+	}
+	b.fileEvents = written
+	return nil
+}
+
+// Publish records an event and delivers it to all matching subscribers
+func (b *Bus) Publish(eventType, sender string, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		slog.Warn("Failed to encode event", "type", eventType, "sender", sender, "error", err)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	event := models.Event{
+		ID:        b.nextID,
+		Type:      eventType,
+		Sender:    sender,
+		Timestamp: time.Now(),
+		Data:      payload,
+	}
+	b.nextID++
+
+	b.buffer = append(b.buffer, event)
+	if len(b.buffer) > b.maxEvents {
+		b.buffer = b.buffer[len(b.buffer)-b.maxEvents:]
+	}
+	if !b.closed && !volatileTypes[eventType] {
+		b.pending = append(b.pending, event)
+		select {
+		case b.flush <- struct{}{}:
+		default:
+		}
+	}
+
+	for sub := range b.subscribers {
+		if !sub.filter.Matches(event) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			slog.Warn("Dropping slow event subscriber", "event_id", event.ID)
+			b.remove(sub)
+		}
+	}
+}
+
+// writer writes pending events to the buffer file until the bus is closed
+func (b *Bus) writer() {
+	defer close(b.done)
+	for range b.flush {
+		b.writePending()
+	}
+	// Events published just before Close
+	b.writePending()
+}
+
+// writePending appends the pending events to the buffer file. Once the file
+// holds twice as many events as are kept it is rewritten instead.
+func (b *Bus) writePending() {
+	b.fileMu.Lock()
+	defer b.fileMu.Unlock()
+
+	// The snapshot already holds the pending events, so both are taken together
+	b.mu.Lock()
+	events := b.pending
+	b.pending = nil
+	var snapshot []models.Event
+	if len(events) > 0 && b.fileEvents+len(events) > 2*b.maxEvents {
+		snapshot = slices.Clone(b.buffer)
+	}
+	b.mu.Unlock()
+
+	if snapshot != nil {
+		if err := b.compact(snapshot); err != nil {
+			slog.Warn("Failed to compact event buffer", "error", err)
+		}
+		return
+	}
+	if b.file == nil || len(events) == 0 {
+		return
+	}
+
+	var lines []byte
+	for _, event := range events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			slog.Warn("Failed to encode event", "event_id", event.ID, "sender", event.Sender, "error", err)
+			continue
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+	if _, err := b.file.Write(lines); err != nil {
+		slog.Warn("Failed to write events to buffer", "events", len(events), "error", err)
+		return
+	}
+	b.fileEvents += len(events)
+}
+
+// Subscribe starts a subscription. When resume is set, buffered events after
+// lastEventID are returned so they can be sent before the live ones without a gap.
+func (b *Bus) Subscribe(filter Filter, lastEventID uint64, resume bool) (*Subscription, []models.Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	events := make(chan models.Event, subscriberBufferSize)
+	sub := &Subscription{
+		Events: events,
+		events: events,
+		filter: filter,
+	}
+	b.subscribers[sub] = struct{}{}
+
+	var backlog []models.Event
+	if resume {
+		for _, event := range b.buffer {
+			if event.ID > lastEventID && filter.Matches(event) {
+				backlog = append(backlog, event)
+			}
+		}
+	}
+	return sub, backlog
+}
+
+// Unsubscribe ends a subscription
+func (b *Bus) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remove(sub)
+}
+
+// remove closes and forgets a subscription, the caller must hold the lock
+func (b *Bus) remove(sub *Subscription) {
+	if _, exists := b.subscribers[sub]; !exists {
+		return
+	}
+	delete(b.subscribers, sub)
+	close(sub.events)
+}
+
+// CloseSubscriptions ends all subscriptions so streaming clients disconnect,
+// while events are still buffered for them to resume from
+func (b *Bus) CloseSubscriptions() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subscribers {
+		b.remove(sub)
+	}
+}
+
+// Close ends all subscriptions, writes the pending events and closes the
+// buffer file. Events published afterwards are kept in memory only.
+func (b *Bus) Close() error {
+	b.mu.Lock()
+	for sub := range b.subscribers {
+		b.remove(sub)
+	}
+	alreadyClosed := b.closed
+	b.closed = true
+	b.mu.Unlock()
+
+	if alreadyClosed {
+		return nil
+	}
+	close(b.flush)
+	<-b.done
+
+	b.fileMu.Lock()
+	defer b.fileMu.Unlock()
+	if b.file == nil {
+		return nil
+	}
+	err := b.file.Close()
+	b.file = nil
+	return err
+}
+
+// Remove drops the buffered events that match selects, from memory and from
+// the buffer file, and returns how many were dropped
+func (b *Bus) Remove(match func(models.Event) bool) (int, error) {
+	b.fileMu.Lock()
+	defer b.fileMu.Unlock()
+
+	// The rewritten file holds the pending events too, so they are dropped
+	// along with the snapshot
+	b.mu.Lock()
+	kept := make([]models.Event, 0, len(b.buffer))
+	for _, event := range b.buffer {
+		if !match(event) {
+			kept = append(kept, event)
+		}
+	}
+	removed := len(b.buffer) - len(kept)
+	b.buffer = kept
+	b.pending = nil
+	closed := b.closed
+	b.mu.Unlock()
+
+	// The file may also hold events already dropped from memory, so it is
+	// rewritten even when none of the kept events matched
+	if closed {
+		return removed, nil
+	}
+	return removed, b.compact(kept)
+}
+
+// Matches reports whether an event passes the filter
+func (f Filter) Matches(event models.Event) bool {
+	return matchesAny(f.Senders, event.Sender) && matchesAny(f.Types, event.Type)
+}
+
+// matchesAny reports whether value is in values, an empty list matches everything
+func matchesAny(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package lifecycle
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Exit codes returned by Wait
+const (
+	ExitOK         = 0 // stopped by a signal and shut down cleanly
+	ExitFailure    = 1 // stopped because a component failed at runtime
+	ExitIncomplete = 2 // a shutdown step failed, timed out or was interrupted
+)
+
+// step is one named stage of the shutdown sequence
+type step struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// Manager waits for the application to be asked to stop, then runs its
+// shutdown steps in the order they were registered within a shared deadline
+type Manager struct {
+	timeout time.Duration
+	steps   []step
+	failed  chan error
+}
+
+// NewManager creates a lifecycle manager whose shutdown must finish within timeout
+func NewManager(timeout time.Duration) *Manager {
+	return &Manager{
+		timeout: timeout,
+		failed:  make(chan error, 1),
+	}
+}
+
+// OnShutdown adds a step to the end of the shutdown sequence. Steps run one
+// after another, so later steps can rely on earlier ones having finished.
+func (m *Manager) OnShutdown(name string, run func(ctx context.Context) error) {
+	m.steps = append(m.steps, step{name: name, run: run})
+}
+
+// Fail reports that a component stopped unexpectedly, which shuts the
+// application down with ExitFailure
+func (m *Manager) Fail(err error) {
+	select {
+	case m.failed <- err:
+	default:
+		// Shutdown is already under way
+	}
+}
+
+// Wait blocks until SIGINT or SIGTERM is received or a component fails, runs
+// the shutdown steps and returns the process exit code. A second signal during
+// shutdown skips the remaining steps.
+func (m *Manager) Wait() int {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	exitCode := ExitOK
+	select {
+	case sig := <-signals:
+		slog.Info("Received signal, shutting down", "signal", sig.String(), "timeout", m.timeout)
+	case err := <-m.failed:
+		slog.Error("Component failed, shutting down", "error", err, "timeout", m.timeout)
+		exitCode = ExitFailure
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	done := make(chan bool, 1)
+	go func() {
+		done <- m.runSteps(ctx)
+	}()
+
+	select {
+	case ok := <-done:
+		if !ok && exitCode == ExitOK {
+			exitCode = ExitIncomplete
+		}
+	case sig := <-signals:
+		slog.Warn("Received second signal, exiting without finishing shutdown", "signal", sig.String())
+		return ExitIncomplete
+	}
+
+	slog.Info("Shutdown complete", "exit_code", exitCode)
+	return exitCode
+}
+
+// runSteps runs every shutdown step in order and reports whether all of them
+// succeeded. Steps still run after the deadline has passed so that resources
+// are released, but steps that honour the context will return right away.
+func (m *Manager) runSteps(ctx context.Context) bool {
+	ok := true
+	for _, step := range m.steps {
+		start := time.Now()
+		if err := step.run(ctx); err != nil {
+			slog.Error("Shutdown step failed", "step", step.name, "error", err)
+			ok = false
+			continue
+		}
+		slog.Info("Shutdown step finished", "step", step.name, "duration", time.Since(start))
+	}
+	if ctx.Err() != nil {
+		slog.Warn("Shutdown exceeded its timeout", "timeout", m.timeout)
+		ok = false
+	}
+	return ok
+}
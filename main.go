@@ -2,14 +2,23 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
 	"os"
-	"os/signal"
+	"path/filepath"
+	"time"
+	_ "time/tzdata" // /stats timezones must resolve on hosts without a zoneinfo database
 
+	"github.com/jaliph/auto-dm/backup"
+	"github.com/jaliph/auto-dm/cli"
 	"github.com/jaliph/auto-dm/config"
 	"github.com/jaliph/auto-dm/database"
+	"github.com/jaliph/auto-dm/eventbus"
+	"github.com/jaliph/auto-dm/lifecycle"
 	"github.com/jaliph/auto-dm/server"
 	"github.com/jaliph/auto-dm/store"
+	"github.com/jaliph/auto-dm/utils"
 	"github.com/jaliph/auto-dm/whatsapp"
 )
 
@@ -21,81 +30,201 @@ var (
 )
 
 func main() {
+	os.Exit(run())
+}
+
+// run starts the application, blocks until it is stopped and returns the exit code
+func run() int {
 	// Load configuration
 	cfg := config.LoadConfig()
+	utils.Init(cfg.LogLevel, cfg.LogFormat, cfg.LogRedact)
+
+	// Subcommands run instead of the server
+	if handled, err := cli.Run(cfg, version, os.Args[1:]); handled {
+		return commandExitCode(os.Args[1], err)
+	}
+
+	// Restore a backup staged through the admin API before any database is opened
+	restored, err := cli.ApplyPendingRestore(cfg)
+	if err != nil {
+		return startupFailed("Failed to restore staged backup", err)
+	}
+	if restored {
+		cfg = config.LoadConfig()
+	}
 
-	// Create context with cancellation
-	_, cancel := context.WithCancel(context.Background())
+	// Check the configuration before anything is opened or connected
+	sessionKeys, err := store.LoadSessionKeys(cli.SessionKeyConfig(cfg))
+	if err != nil {
+		return startupFailed("Invalid session encryption configuration", err)
+	}
+	if err := cli.SessionStoreConfig(cfg).Validate(sessionKeys); err != nil {
+		return startupFailed("Invalid session store configuration", err)
+	}
+	retentionRules, err := database.ParseRetentionRules(cfg.RetentionRules, cfg.RetentionMode)
+	if err != nil {
+		return startupFailed("Invalid retention configuration", err)
+	}
+	retentionPolicy := database.RetentionPolicy{
+		Rules:           append([]database.RetentionRule{{Days: cfg.RetentionMessageDays, Mode: cfg.RetentionMode}}, retentionRules...),
+		MediaDays:       cfg.RetentionMediaDays,
+		SoftDeletedDays: cfg.RetentionSoftDeletedDays,
+		BatchSize:       cfg.RetentionBatchSize,
+	}
+
+	// Create context with cancellation for the background loops
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Initialize GORM database for message storage
+	// What is opened so far is closed again if a later step fails
+	var opened []func()
+	openFailed := func(msg string, err error) int {
+		for i := len(opened) - 1; i >= 0; i-- {
+			opened[i]()
+		}
+		return startupFailed(msg, err)
+	}
+
+	// Initialize GORM database for message storage, spooling writes locally while MSSQL is down
 	gormDB, err := database.NewGormDB(
 		cfg.MSSQLServer,
 		cfg.MSSQLDatabase,
 		cfg.MSSQLUsername,
 		cfg.MSSQLPassword,
+		filepath.Join("db", "mssql_spool.jsonl"),
 	)
 	if err != nil {
-		log.Fatalf("Failed to initialize GORM database: %v", err)
+		return startupFailed("Failed to initialize GORM database", err)
 	}
-	defer gormDB.Close()
+	opened = append(opened, func() { gormDB.Close() })
 
 	// Initialize SQLite database for phone mappings
-	db, err := database.NewDatabase(gormDB)
+	db, err := database.NewDatabase()
 	if err != nil {
-		log.Fatalf("Failed to initialize SQLite database: %v", err)
+		return openFailed("Failed to initialize SQLite database", err)
 	}
-	defer db.Close()
+	opened = append(opened, func() { db.Close() })
 
-	// Initialize user store manager
-	userStoreManager := store.NewUserStoreManager()
-	defer userStoreManager.CloseAll()
+	// Initialize user store manager, encrypting session stores when a key is configured
+	if sessionKeys != nil {
+		slog.Info("Session stores are encrypted at rest", "key", sessionKeys.ActiveID())
+	}
+	userStoreManager, err := store.NewUserStoreManager(cli.SessionStoreConfig(cfg), sessionKeys)
+	if err != nil {
+		return openFailed("Failed to open session store", err)
+	}
+	opened = append(opened, userStoreManager.CloseAll)
+
+	// Initialize live event stream, keeping the last events on disk for resuming clients
+	eventBus, err := eventbus.NewBus(filepath.Join("db", "events.jsonl"), 1000)
+	if err != nil {
+		return openFailed("Failed to initialize event stream", err)
+	}
 
 	// Initialize WhatsApp client manager (without admin functionality)
-	clientManager := whatsapp.NewClientManager(userStoreManager, db, gormDB)
+	clientManager := whatsapp.NewClientManager(userStoreManager, db, gormDB, eventBus, cfg.HistoryImport, cfg.HistoryLookbackDays)
 
 	// Initialize QR manager
-	qrManager := whatsapp.NewQRManager(db, userStoreManager)
-	qrManager.StartCleanup()
+	qrManager := whatsapp.NewQRManager(db, userStoreManager, clientManager, eventBus)
+	qrManager.StartCleanup(ctx)
 
 	// Load and authenticate existing senders
 	if err := clientManager.LoadAllSenders(); err != nil {
-		log.Printf("Warning: Failed to load senders: %v", err)
+		slog.Warn("Failed to load senders", "error", err)
 	}
 
-	// Force sync all senders from SQLite to MSSQL
-	if err := gormDB.ForceSyncAllSenders(db); err != nil {
-		log.Printf("Warning: Failed to force sync senders to MSSQL: %v", err)
-	} else {
-		log.Printf("Successfully force synced all senders to MSSQL")
-	}
+	// Publish sender changes from the SQLite outbox to MSSQL
+	senderRelay := database.NewSenderRelay(db, gormDB)
+	go senderRelay.Run(ctx)
 
 	// Start connection monitoring
-	go clientManager.MonitorConnections()
+	go clientManager.MonitorConnections(ctx)
+
+	// Purge messages past their retention period
+	if retentionPolicy.Enabled() {
+		retentionJob := database.NewRetentionJob(gormDB, retentionPolicy, time.Duration(max(cfg.RetentionInterval, 1))*time.Minute)
+		go retentionJob.Run(ctx)
+	}
+
+	lifecycleManager := lifecycle.NewManager(time.Duration(cfg.ShutdownTimeout) * time.Second)
 
 	// Start REST API server
 	baseURL := "http://localhost:" + cfg.APIPort
 	qrExpiryMinutes := 10 // QR codes expire after 10 minutes
-	apiServer := server.NewServer(userStoreManager, gormDB, db, clientManager, qrManager, baseURL, qrExpiryMinutes, cfg.FileShareFolder)
+	buildInfo := server.BuildInfo{Version: version, Commit: commit, Date: date}
+	readiness := server.ReadinessThresholds{
+		MinConnectedSenders: cfg.ReadyMinConnectedSenders,
+		MinConnectedPercent: cfg.ReadyMinConnectedPercent,
+	}
+	backupManager := backup.NewManager(cli.BackupSources(cfg, version, db, userStoreManager), cfg.BackupPassphrase, cfg.BackupToken, int64(cfg.BackupMaxRestoreMB)<<20, sessionKeys)
+	apiServer := server.NewServer(userStoreManager, gormDB, db, clientManager, qrManager, eventBus, baseURL, qrExpiryMinutes, cfg.FileShareFolder, buildInfo, readiness, backupManager)
 	go func() {
 		if err := apiServer.Start(cfg.APIPort); err != nil {
-			log.Printf("Failed to start API server: %v", err)
+			lifecycleManager.Fail(fmt.Errorf("API server failed: %v", err))
 		}
 	}()
 
-	log.Printf("Auto-DM server started successfully!")
-	log.Printf("Version: %s (commit: %s, built: %s)", version, commit, date)
-	log.Printf("API server running on port %s", cfg.APIPort)
-	log.Printf("Register endpoint: POST %s/register", baseURL)
-	log.Printf("QR code endpoint: GET %s/qr/{token}", baseURL)
-	log.Printf("Senders endpoint: GET %s/senders", baseURL)
-	log.Printf("Send message endpoint: POST %s/send", baseURL)
-
-	// Wait for interrupt signal
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, os.Interrupt)
-	<-sigChan
-
-	log.Println("Shutting down...")
-	clientManager.Shutdown()
+	// Shutdown runs in this order: stop taking requests and let in-flight
+	// sends finish, stop the background loops, then release clients and storage
+	lifecycleManager.OnShutdown("http server", apiServer.Shutdown)
+	lifecycleManager.OnShutdown("background jobs", func(context.Context) error {
+		cancel()
+		return nil
+	})
+	lifecycleManager.OnShutdown("whatsapp clients", func(context.Context) error {
+		clientManager.Shutdown()
+		return nil
+	})
+	lifecycleManager.OnShutdown("sender outbox", func(ctx context.Context) error {
+		if err := senderRelay.Flush(ctx); err != nil {
+			// The changes are safe in store.db and are published on the next start
+			slog.Warn("Sender changes left in the outbox", "error", err)
+		}
+		return nil
+	})
+	lifecycleManager.OnShutdown("event stream", func(context.Context) error {
+		return eventBus.Close()
+	})
+	lifecycleManager.OnShutdown("sqlite database", func(context.Context) error {
+		return db.Close()
+	})
+	lifecycleManager.OnShutdown("mssql database", func(context.Context) error {
+		return gormDB.Close()
+	})
+
+	slog.Info("Auto-DM server started successfully", "version", version, "commit", commit, "built", date, "port", cfg.APIPort)
+	slog.Info("Register endpoint", "url", "POST "+baseURL+"/register")
+	slog.Info("QR code endpoint", "url", "GET "+baseURL+"/qr/{token}")
+	slog.Info("Senders endpoint", "url", "GET "+baseURL+"/senders")
+	slog.Info("Send message endpoint", "url", "POST "+baseURL+"/send")
+	slog.Info("Event stream endpoint", "url", "GET "+baseURL+"/events")
+	slog.Info("Admin dashboard", "url", baseURL+"/admin")
+	slog.Info("Backup endpoint", "url", "POST "+baseURL+"/admin/backup")
+	slog.Info("Prometheus metrics", "url", baseURL+"/metrics")
+	slog.Info("Health endpoints", "liveness", baseURL+"/healthz", "readiness", baseURL+"/readyz")
+
+	// Wait for SIGINT/SIGTERM or a server failure, then shut down
+	return lifecycleManager.Wait()
+}
+
+// commandExitCode logs a failed subcommand and returns its exit code: 2 for
+// invalid usage, 1 for any other failure
+func commandExitCode(command string, err error) int {
+	if err == nil {
+		return 0
+	}
+	// A bare ErrUsage means the usage was already printed
+	if err != cli.ErrUsage {
+		slog.Error("Command failed", "command", command, "error", err)
+	}
+	if errors.Is(err, cli.ErrUsage) {
+		return 2
+	}
+	return 1
+}
+
+// startupFailed logs why the server could not start and returns the exit code
+func startupFailed(msg string, err error) int {
+	slog.Error(msg, "error", err)
+	return 1
 }
@@ -0,0 +1,67 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// sendLatencyBuckets are the upper bounds in seconds of the send latency histogram.
+// Large messages and slow connections can take several seconds.
+var sendLatencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Metrics exposed on /metrics. Labels only take values from small fixed sets,
+// never phone numbers, so /metrics stays bounded and holds no personal data.
+var (
+	Senders = NewGaugeFunc("autodm_senders",
+		"Registered senders by status in the senders table.", "status")
+	SenderClients = NewGaugeFunc("autodm_sender_clients",
+		"Loaded sender clients by live connection state.", "state")
+
+	MessagesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "autodm_messages_sent_total",
+		Help: "Messages sent through the API.",
+	}, []string{"type"})
+	MessagesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "autodm_messages_received_total",
+		Help: "Inbound messages received by senders.",
+	}, []string{"type"})
+	SendFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "autodm_send_failures_total",
+		Help: "Failed sends by reason.",
+	}, []string{"reason"})
+	SendLatency = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "autodm_send_duration_seconds",
+		Help:    "Time taken for WhatsApp to accept a sent message, excluding media uploads.",
+		Buckets: sendLatencyBuckets,
+	}, []string{"type"})
+
+	QRSessions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "autodm_qr_sessions_total",
+		Help: "QR sessions created, expired and authenticated.",
+	}, []string{"event"})
+	ReconnectAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "autodm_reconnect_attempts_total",
+		Help: "Automatic reconnect attempts after a dropped connection, by result.",
+	}, []string{"result"})
+
+	DBWriteErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "autodm_db_write_errors_total",
+		Help: "Failed database writes by operation.",
+	}, []string{"operation"})
+	DBSpoolPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "autodm_db_spool_pending",
+		Help: "Writes spooled to disk while MSSQL is unavailable, waiting to be replayed.",
+	})
+	SenderOutboxPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "autodm_sender_outbox_pending",
+		Help: "Sender changes recorded in SQLite and not yet published to MSSQL.",
+	})
+	SenderDrift = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "autodm_sender_drift",
+		Help: "Senders that differed between SQLite and MSSQL at the last reconciliation.",
+	})
+	RetentionPurged = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "autodm_retention_purged_total",
+		Help: "Messages purged by the retention policy, by action.",
+	}, []string{"action"})
+)
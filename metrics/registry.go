@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Handler serves all registered metrics, along with the Go runtime and
+// process metrics, in the Prometheus exposition format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// GaugeFunc is a single-label gauge read from a function on every scrape, for
+// gauges whose label values come from data. Label values that are gone from
+// the data are gone from the next scrape.
+type GaugeFunc struct {
+	desc   *prometheus.Desc
+	source func() map[string]float64
+	mu     sync.Mutex
+}
+
+// NewGaugeFunc creates and registers a gauge with one label. It reports
+// nothing until SetSource is called.
+func NewGaugeFunc(name, help, label string) *GaugeFunc {
+	g := &GaugeFunc{desc: prometheus.NewDesc(name, help, []string{label}, nil)}
+	prometheus.MustRegister(g)
+	return g
+}
+
+// SetSource sets the function returning the gauge's values by label value.
+// A nil map skips the gauge for that scrape.
+func (g *GaugeFunc) SetSource(source func() map[string]float64) {
+	g.mu.Lock()
+	g.source = source
+	g.mu.Unlock()
+}
+
+// Describe implements prometheus.Collector
+func (g *GaugeFunc) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+// Collect implements prometheus.Collector
+func (g *GaugeFunc) Collect(ch chan<- prometheus.Metric) {
+	g.mu.Lock()
+	source := g.source
+	g.mu.Unlock()
+	if source == nil {
+		return
+	}
+	for labelValue, value := range source() {
+		ch <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, value, labelValue)
+	}
+}
@@ -0,0 +1,39 @@
+package models
+
+import "time"
+
+// Audit actions recorded by the API
+const (
+	AuditRegister      = "register"       // new number linked or a failed sender re-registered
+	AuditDeleteSender  = "delete_sender"  // sender unlinked and removed
+	AuditPauseSender   = "pause_sender"   // sender disconnected, its device stays linked
+	AuditResumeSender  = "resume_sender"  // paused sender connected again
+	AuditSend          = "send"           // message, file, reaction, edit or revoke sent
+	AuditRetention     = "retention"      // messages purged by the retention policy
+	AuditPrivacyExport = "privacy_export" // data of a contact exported
+	AuditPrivacyErase  = "privacy_erase"  // data of a contact erased, the target is never kept
+	AuditBackup        = "backup"         // backup archive downloaded
+	AuditRestore       = "restore"        // backup archive staged for restore, or checked with a dry run
+)
+
+// AuditEntry represents one administrative or sending action. Entries are only
+// ever appended, never updated or deleted.
+type AuditEntry struct {
+	ID          uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	Timestamp   time.Time `gorm:"not null;index" json:"timestamp"`
+	Actor       string    `gorm:"size:100;not null;index" json:"actor"` // API client or proxy-authenticated user
+	Action      string    `gorm:"size:50;not null;index" json:"action"`
+	SenderPhone string    `gorm:"size:20;index" json:"sender_phone,omitempty"` // sender account acted on or sent from
+	Target      string    `gorm:"size:255" json:"target,omitempty"`            // recipient, message or phone acted on
+	MessageType string    `gorm:"size:50" json:"message_type,omitempty"`
+	MessageID   string    `gorm:"size:100;index" json:"message_id,omitempty"` // WhatsApp ID of a sent message
+	RequestID   string    `gorm:"size:64;index" json:"request_id,omitempty"`
+	SourceIP    string    `gorm:"size:64" json:"source_ip,omitempty"`
+	Outcome     string    `gorm:"size:20;not null" json:"outcome"` // "success" or "failure"
+	Error       string    `gorm:"type:text" json:"error,omitempty"`
+}
+
+// TableName specifies the table name for the AuditEntry model
+func (AuditEntry) TableName() string {
+	return "audit_log"
+}
@@ -0,0 +1,57 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Event types pushed to /events subscribers
+const (
+	EventMessage       = "message"        // inbound message, edit, revoke or reaction
+	EventMessageStatus = "message_status" // outbound message sent or failed
+	EventReceipt       = "receipt"        // delivery, read or played receipt
+	EventQR            = "qr"             // QR code rotated or session status changed
+	EventConnection    = "connection"     // sender connected, disconnected or logged out
+)
+
+// Event represents a live update pushed to /events subscribers
+type Event struct {
+	ID        uint64          `json:"id"`
+	Type      string          `json:"type"`
+	Sender    string          `json:"sender"` // phone number of the sender account the event belongs to
+	Timestamp time.Time       `json:"timestamp"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// MessageStatusEvent represents the outcome of an outbound send
+type MessageStatusEvent struct {
+	Status      string   `json:"status"` // "sent" or "failed"
+	MessageType string   `json:"message_type"`
+	Recipient   string   `json:"recipient,omitempty"`
+	Error       string   `json:"error,omitempty"`
+	Message     *Message `json:"message,omitempty"` // recorded message when sent
+}
+
+// ReceiptEvent represents a receipt for one or more messages
+type ReceiptEvent struct {
+	Type       string    `json:"type"` // "delivered", "read", "played", ...
+	MessageIDs []string  `json:"message_ids"`
+	ChatID     string    `json:"chat_id"`
+	From       string    `json:"from"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// QREvent represents a QR code rotation or a change of a QR session's status
+type QREvent struct {
+	Token     string    `json:"token"`
+	Status    string    `json:"status"` // "pending", "authenticated", "expired"
+	QRCode    string    `json:"qr_code,omitempty"`
+	QRCodePNG string    `json:"qr_code_png,omitempty"` // base64 PNG, only on the /qr/{token}/events stream
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ConnectionEvent represents a change of a sender's connection state
+type ConnectionEvent struct {
+	Status string `json:"status"` // "connected", "disconnected", "logged_out"
+	Reason string `json:"reason,omitempty"`
+}
@@ -0,0 +1,29 @@
+package models
+
+// HealthReport represents the response of the /healthz and /readyz endpoints
+type HealthReport struct {
+	Status        string                     `json:"status"` // "ok", "ready" or "not_ready"
+	Version       string                     `json:"version"`
+	Commit        string                     `json:"commit"`
+	BuildDate     string                     `json:"build_date"`
+	Uptime        string                     `json:"uptime"`
+	UptimeSeconds int64                      `json:"uptime_seconds"`
+	Checks        map[string]ComponentHealth `json:"checks,omitempty"`
+}
+
+// ComponentHealth represents the result of checking one dependency
+type ComponentHealth struct {
+	Status    string `json:"status"` // "ok" or "failing"
+	Error     string `json:"error,omitempty"`
+	LatencyMS int64  `json:"latency_ms"`
+	Path      string `json:"path,omitempty"` // file share folder
+	*SenderHealth
+}
+
+// SenderHealth represents the connected sender counts checked for readiness
+type SenderHealth struct {
+	Connected           int `json:"connected"`
+	Expected            int `json:"expected"` // linked senders, i.e. those with a device ID, that are not paused
+	MinConnected        int `json:"min_connected"`
+	MinConnectedPercent int `json:"min_connected_percent"`
+}
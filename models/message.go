@@ -8,19 +8,28 @@ import (
 
 // Message represents a WhatsApp message stored in the database
 type Message struct {
-	ID             uint           `gorm:"primaryKey;autoIncrement" json:"id"`
-	SenderPhone    string         `gorm:"size:20;not null;index" json:"sender_phone"`
-	RecipientPhone string         `gorm:"size:20;not null;index" json:"recipient_phone"`
-	MessageType    string         `gorm:"size:50;not null" json:"message_type"` // text, image, video, etc.
-	Content        string         `gorm:"type:text" json:"content"`
-	MediaURL       string         `gorm:"size:500" json:"media_url,omitempty"`
-	Timestamp      time.Time      `gorm:"not null;index" json:"timestamp"`
-	IsFromMe       bool           `gorm:"not null;default:false" json:"is_from_me"`
-	ChatID         string         `gorm:"size:100;not null;index" json:"chat_id"`
-	MessageID      string         `gorm:"size:100;uniqueIndex" json:"message_id"`
-	CreatedAt      time.Time      `json:"created_at"`
-	UpdatedAt      time.Time      `json:"updated_at"`
-	DeletedAt      gorm.DeletedAt `gorm:"index" json:"-"`
+	ID              uint            `gorm:"primaryKey;autoIncrement" json:"id"`
+	SenderPhone     string          `gorm:"size:20;not null;index" json:"sender_phone"`
+	RecipientPhone  string          `gorm:"size:20;not null;index" json:"recipient_phone"`
+	MessageType     string          `gorm:"size:50;not null" json:"message_type"` // text, image, video, etc.
+	Content         string          `gorm:"type:text" json:"content"`
+	MediaURL        string          `gorm:"size:500" json:"media_url,omitempty"`
+	Timestamp       time.Time       `gorm:"not null;index" json:"timestamp"`
+	IsFromMe        bool            `gorm:"not null;default:false" json:"is_from_me"`
+	ChatID          string          `gorm:"size:100;not null;index" json:"chat_id"`
+	MessageID       string          `gorm:"size:100;uniqueIndex" json:"message_id"`
+	ParentMessageID string          `gorm:"size:100;index" json:"parent_message_id,omitempty"` // original message for replies, reactions, edits and revokes
+	OriginalContent string          `gorm:"type:text" json:"original_content,omitempty"`       // content before the first edit
+	EditedAt        *time.Time      `json:"edited_at,omitempty"`
+	RevokedAt       *time.Time      `json:"revoked_at,omitempty"`                               // deleted for everyone
+	DeliveredAt     *time.Time      `json:"delivered_at,omitempty"`                             // first delivery receipt of an outbound message
+	ReadAt          *time.Time      `json:"read_at,omitempty"`                                  // first read or played receipt of an outbound message
+	Payload         *MessagePayload `gorm:"type:text;serializer:json" json:"payload,omitempty"` // structured fields of non-text messages
+	AnonymizedAt    *time.Time      `json:"anonymized_at,omitempty"`                            // content removed by the retention policy
+	Reactions       []Reaction      `gorm:"-" json:"reactions,omitempty"`
+	CreatedAt       time.Time       `json:"created_at"`
+	UpdatedAt       time.Time       `json:"updated_at"`
+	DeletedAt       gorm.DeletedAt  `gorm:"index" json:"-"`
 }
 
 // TableName specifies the table name for the Message model
@@ -28,6 +37,60 @@ func (Message) TableName() string {
 	return "whatsapp_messages"
 }
 
+// MessagePayload holds the structured fields decoded from a WhatsApp message.
+// Only the fields relevant to the message type are set.
+type MessagePayload struct {
+	// Wrappers the message was unwrapped from
+	Ephemeral bool `json:"ephemeral,omitempty"`
+	ViewOnce  bool `json:"view_once,omitempty"`
+
+	// Media (image, video, audio, document, sticker)
+	Caption    string `json:"caption,omitempty"`
+	MimeType   string `json:"mime_type,omitempty"`
+	FileName   string `json:"file_name,omitempty"`
+	FileLength uint64 `json:"file_length,omitempty"`
+	Seconds    uint32 `json:"seconds,omitempty"`
+	Width      uint32 `json:"width,omitempty"`
+	Height     uint32 `json:"height,omitempty"`
+	PageCount  uint32 `json:"page_count,omitempty"`
+	Voice      bool   `json:"voice,omitempty"`    // push-to-talk audio
+	Gif        bool   `json:"gif,omitempty"`      // video played as GIF
+	Animated   bool   `json:"animated,omitempty"` // animated sticker
+
+	// Location and live location
+	Latitude     *float64 `json:"latitude,omitempty"`
+	Longitude    *float64 `json:"longitude,omitempty"`
+	LocationName string   `json:"location_name,omitempty"`
+	Address      string   `json:"address,omitempty"`
+	LocationURL  string   `json:"location_url,omitempty"`
+
+	// Contacts
+	ContactName string   `json:"contact_name,omitempty"`
+	VCards      []string `json:"vcards,omitempty"`
+
+	// Button, list and interactive responses
+	SelectedID          string `json:"selected_id,omitempty"`
+	SelectedDisplayText string `json:"selected_display_text,omitempty"`
+	ResponseParams      string `json:"response_params,omitempty"` // JSON parameters of native flow responses
+
+	// Text extras
+	LinkURL         string   `json:"link_url,omitempty"`
+	LinkTitle       string   `json:"link_title,omitempty"`
+	LinkDescription string   `json:"link_description,omitempty"`
+	Mentions        []string `json:"mentions,omitempty"`
+
+	// Polls
+	PollOptions     []string `json:"poll_options,omitempty"`
+	SelectableCount uint32   `json:"selectable_count,omitempty"`
+}
+
+// Reaction represents the current emoji reaction of one participant on a message
+type Reaction struct {
+	SenderPhone string    `json:"sender_phone"`
+	Emoji       string    `json:"emoji"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
 // MessageStats represents message statistics
 type MessageStats struct {
 	TotalMessages     int64 `json:"total_messages"`
@@ -0,0 +1,52 @@
+package models
+
+import "time"
+
+// Poll represents a WhatsApp poll created by or sent to a sender
+type Poll struct {
+	ID              uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	MessageID       string    `gorm:"size:100;uniqueIndex" json:"message_id"`
+	ChatID          string    `gorm:"size:100;not null;index" json:"chat_id"`
+	SenderPhone     string    `gorm:"size:20;not null;index" json:"sender_phone"`
+	Question        string    `gorm:"type:text" json:"question"`
+	Options         []string  `gorm:"type:text;serializer:json" json:"options"`
+	SelectableCount int       `gorm:"not null;default:0" json:"selectable_count"` // 0 means any number of options
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// TableName specifies the table name for the Poll model
+func (Poll) TableName() string {
+	return "whatsapp_polls"
+}
+
+// PollVote represents the current selection of one voter on a poll
+type PollVote struct {
+	ID              uint      `gorm:"primaryKey;autoIncrement" json:"id"`
+	PollMessageID   string    `gorm:"size:100;not null;uniqueIndex:idx_poll_voter" json:"poll_message_id"`
+	VoterPhone      string    `gorm:"size:20;not null;uniqueIndex:idx_poll_voter" json:"voter_phone"`
+	SelectedOptions []string  `gorm:"type:text;serializer:json" json:"selected_options"`
+	Timestamp       time.Time `gorm:"not null" json:"timestamp"`
+	CreatedAt       time.Time `json:"created_at"`
+	UpdatedAt       time.Time `json:"updated_at"`
+}
+
+// TableName specifies the table name for the PollVote model
+func (PollVote) TableName() string {
+	return "whatsapp_poll_votes"
+}
+
+// PollResults represents the tallied votes of a poll
+type PollResults struct {
+	MessageID   string              `json:"message_id"`
+	Question    string              `json:"question"`
+	Options     []PollOptionResults `json:"options"`
+	TotalVoters int                 `json:"total_voters"`
+}
+
+// PollOptionResults represents the votes for a single poll option
+type PollOptionResults struct {
+	Name   string   `json:"name"`
+	Votes  int      `json:"votes"`
+	Voters []string `json:"voters"`
+}
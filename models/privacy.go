@@ -0,0 +1,42 @@
+package models
+
+import "time"
+
+// ErasedPhone replaces the phone number of an erased contact in records that
+// are anonymized rather than deleted
+const ErasedPhone = "erased"
+
+// Erasure modes of DELETE /privacy/contacts/{phone}
+const (
+	ErasureDelete    = "delete"    // hard-delete every record of the contact
+	ErasureAnonymize = "anonymize" // keep messages for stats, without content or phone number
+)
+
+// ContactAttributes is what one sender's session store holds about a contact
+type ContactAttributes struct {
+	Sender       string `json:"sender"` // sender account whose store holds the contact
+	JID          string `json:"jid"`
+	FirstName    string `json:"first_name,omitempty"`
+	FullName     string `json:"full_name,omitempty"`
+	PushName     string `json:"push_name,omitempty"`
+	BusinessName string `json:"business_name,omitempty"`
+}
+
+// PrivacyReport is the completion report of a data subject export or erasure
+type PrivacyReport struct {
+	Action       string    `json:"action"` // "export" or "erase"
+	Mode         string    `json:"mode,omitempty"`
+	Phone        string    `json:"phone"`
+	RequestID    string    `json:"request_id,omitempty"`
+	StartedAt    time.Time `json:"started_at"`
+	CompletedAt  time.Time `json:"completed_at"`
+	Messages     int64     `json:"messages"`
+	Polls        int64     `json:"polls"`
+	PollVotes    int64     `json:"poll_votes"`
+	AuditEntries int64     `json:"audit_entries"`
+	Contacts     int64     `json:"contacts"`              // contact entries in sender session stores
+	Events       int64     `json:"events,omitempty"`      // buffered live events
+	MediaFiles   int64     `json:"media_files,omitempty"` // files included in an export
+	Errors       []string  `json:"errors,omitempty"`      // parts that failed, the rest was still done
+	NotCovered   []string  `json:"not_covered,omitempty"` // data the app holds but could not include or erase
+}
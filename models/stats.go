@@ -0,0 +1,55 @@
+package models
+
+import "time"
+
+// StatsReport represents message statistics over a date range, optionally
+// grouped and bucketed into a time series
+type StatsReport struct {
+	MessageStats
+	From         time.Time          `json:"from"`
+	To           time.Time          `json:"to"`
+	Timezone     string             `json:"timezone"`
+	GroupBy      string             `json:"group_by,omitempty"` // "sender", "contact", "type" or "direction"
+	Interval     string             `json:"interval,omitempty"` // "hour", "day" or "week"
+	Sent         int64              `json:"sent"`
+	Received     int64              `json:"received"`
+	Groups       []StatsGroup       `json:"groups,omitempty"`
+	Series       []StatsPoint       `json:"series,omitempty"`
+	ResponseTime *ResponseTimeStats `json:"response_time,omitempty"`
+	Delivery     *DeliveryStats     `json:"delivery,omitempty"`
+}
+
+// StatsGroup represents the message counts of one group
+type StatsGroup struct {
+	Key      string `json:"key"`
+	Sent     int64  `json:"sent"`
+	Received int64  `json:"received"`
+	Total    int64  `json:"total"`
+}
+
+// StatsPoint represents the message counts of one time bucket, per group when grouped
+type StatsPoint struct {
+	Start    time.Time `json:"start"`
+	Group    string    `json:"group,omitempty"`
+	Sent     int64     `json:"sent"`
+	Received int64     `json:"received"`
+	Total    int64     `json:"total"`
+}
+
+// ResponseTimeStats represents how long senders took to reply to inbound messages.
+// A reply is the first outbound message in a chat after one or more inbound ones.
+type ResponseTimeStats struct {
+	Replies        int     `json:"replies"`
+	MedianSeconds  float64 `json:"median_seconds"`
+	AverageSeconds float64 `json:"average_seconds"`
+	P90Seconds     float64 `json:"p90_seconds"`
+}
+
+// DeliveryStats represents the delivery and read receipts of outbound messages
+type DeliveryStats struct {
+	Sent         int64   `json:"sent"`
+	Delivered    int64   `json:"delivered"`
+	Read         int64   `json:"read"`
+	DeliveryRate float64 `json:"delivery_rate"` // delivered / sent
+	ReadRate     float64 `json:"read_rate"`     // read / sent
+}
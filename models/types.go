@@ -26,10 +26,51 @@ type APIResponse struct {
 type Sender struct {
 	Phone           string     `json:"phone"`
 	DeviceID        string     `json:"device_id,omitempty"`
-	Status          string     `json:"status"` // "pending", "authenticated", "invalidated"
+	Status          string     `json:"status"` // "pending", "authenticated", "invalidated", "paused"
 	CreatedAt       time.Time  `json:"created_at"`
 	AuthenticatedAt *time.Time `json:"authenticated_at,omitempty"`
 	InvalidatedAt   *time.Time `json:"invalidated_at,omitempty"`
+	Connected       bool       `gorm:"-" json:"connected"`              // live connection state of the sender's client
+	ClientState     string     `gorm:"-" json:"client_state,omitempty"` // lifecycle state of the sender's client and session store
+	SyncVersion     int64      `gorm:"not null;default:0" json:"-"`     // last outbox change written to MSSQL
+}
+
+// SenderTombstone records the outbox version at which a sender was deleted
+// from MSSQL, so an older change replayed afterwards can't re-create it
+type SenderTombstone struct {
+	Phone       string    `gorm:"size:20;primaryKey"`
+	SyncVersion int64     `gorm:"not null"`
+	RemovedAt   time.Time `gorm:"not null"`
+}
+
+// TableName specifies the table name for the SenderTombstone model
+func (SenderTombstone) TableName() string {
+	return "sender_tombstones"
+}
+
+// Delete modes of DELETE /senders/{phone}
+const (
+	DeleteSenderHard = "hard" // unlink the device, delete the session store and the sender
+	DeleteSenderSoft = "soft" // pause the sender, its device stays linked
+)
+
+// SendMessageResponse reports a sent message
+type SendMessageResponse struct {
+	Status    string `json:"status"`
+	Message   string `json:"message"`
+	MessageID string `json:"message_id"` // WhatsApp ID, for replies, reactions, edits, revokes and /polls
+}
+
+// DeleteSenderResponse reports what deleting or pausing a sender did
+type DeleteSenderResponse struct {
+	Status         string `json:"status"`
+	Message        string `json:"message"`
+	Error          string `json:"error,omitempty"`
+	Mode           string `json:"mode"`
+	Unlinked       bool   `json:"unlinked"`                  // the device was removed from the sender's phone
+	UnlinkError    string `json:"unlink_error,omitempty"`    // why it was not, it is then listed on the phone until removed there
+	Forced         bool   `json:"forced,omitempty"`          // deleted with force=true although the device was not unlinked
+	MessagesPurged *int64 `json:"messages_purged,omitempty"` // set with purge_messages
 }
 
 // RegisterRequest represents a registration request
@@ -53,3 +94,41 @@ type QRCodeResponse struct {
 	Error     string `json:"error,omitempty"`
 	Expired   bool   `json:"expired"`
 }
+
+// Location represents a location to send as a location message
+type Location struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Name      string  `json:"name,omitempty"`
+	Address   string  `json:"address,omitempty"`
+}
+
+// ContactCard represents the fields used to build a vCard for a contact message
+type ContactCard struct {
+	Name         string `json:"name"`
+	Phone        string `json:"phone"`
+	Email        string `json:"email,omitempty"`
+	Organization string `json:"organization,omitempty"`
+}
+
+// PollRequest represents a poll to send
+type PollRequest struct {
+	Question    string   `json:"question"`
+	Options     []string `json:"options"`
+	MultiSelect bool     `json:"multi_select"`
+}
+
+// HistoryImportProgress represents the progress of a sender's history sync import
+type HistoryImportProgress struct {
+	Phone         string    `json:"phone"`
+	Status        string    `json:"status"` // "importing", "completed"
+	SyncType      string    `json:"sync_type"`
+	Progress      uint32    `json:"progress"` // percentage reported by WhatsApp
+	Chunks        int       `json:"chunks"`
+	Conversations int       `json:"conversations"`
+	Imported      int       `json:"imported"`
+	Skipped       int       `json:"skipped"` // duplicates and messages outside the lookback window
+	Failed        int       `json:"failed"`
+	StartedAt     time.Time `json:"started_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
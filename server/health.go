@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jaliph/auto-dm/models"
+)
+
+// healthCheckTimeout bounds each dependency check so a hung database can't hang the probe
+const healthCheckTimeout = 2 * time.Second
+
+// BuildInfo identifies the running binary in health responses
+type BuildInfo struct {
+	Version string
+	Commit  string
+	Date    string
+}
+
+// ReadinessThresholds decide how many senders must be connected for /readyz to pass
+type ReadinessThresholds struct {
+	MinConnectedSenders int // absolute minimum of connected senders
+	MinConnectedPercent int // minimum percentage of linked senders that are connected
+}
+
+// handleLiveness handles the /healthz endpoint. It only reports that the
+// process is serving requests, so it doesn't depend on MSSQL or WhatsApp.
+func (s *Server) handleLiveness(w http.ResponseWriter, r *http.Request) {
+	report := s.healthReport("ok")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleReadiness handles the /readyz endpoint. It checks every dependency
+// needed to serve sends and responds 503 when any of them is failing.
+func (s *Server) handleReadiness(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]models.ComponentHealth{
+		"mssql":      runCheck(r.Context(), s.gormDB.Ping),
+		"sqlite":     runCheck(r.Context(), s.db.Ping),
+		"file_share": s.checkFileShare(),
+		"senders":    s.checkSenders(),
+	}
+
+	report := s.healthReport("ready")
+	report.Checks = checks
+	status := http.StatusOK
+	for _, check := range checks {
+		if check.Status != "ok" {
+			report.Status = "not_ready"
+			status = http.StatusServiceUnavailable
+			break
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// healthReport fills in the build and uptime fields shared by both endpoints
+func (s *Server) healthReport(status string) models.HealthReport {
+	uptime := time.Since(s.startedAt)
+	return models.HealthReport{
+		Status:        status,
+		Version:       s.buildInfo.Version,
+		Commit:        s.buildInfo.Commit,
+		BuildDate:     s.buildInfo.Date,
+		Uptime:        uptime.Round(time.Second).String(),
+		UptimeSeconds: int64(uptime.Seconds()),
+	}
+}
+
+// runCheck runs a dependency check with a timeout and records how long it took
+func runCheck(ctx context.Context, check func(ctx context.Context) error) models.ComponentHealth {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check(ctx)
+	result := models.ComponentHealth{
+		Status:    "ok",
+		LatencyMS: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		result.Status = "failing"
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// checkFileShare checks that the file share folder exists and can be listed
+func (s *Server) checkFileShare() models.ComponentHealth {
+	result := runCheck(context.Background(), func(context.Context) error {
+		dir, err := os.Open(s.fileShareFolder)
+		if err != nil {
+			return err
+		}
+		defer dir.Close()
+
+		info, err := dir.Stat()
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", s.fileShareFolder)
+		}
+		// Listing catches folders that exist but can't be read
+		if _, err := dir.Readdirnames(1); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		return nil
+	})
+	result.Path = s.fileShareFolder
+	return result
+}
+
+// checkSenders compares the connected senders with the linked ones against the
+// readiness thresholds
+func (s *Server) checkSenders() models.ComponentHealth {
+	counts := &models.SenderHealth{
+		MinConnected:        s.readiness.MinConnectedSenders,
+		MinConnectedPercent: s.readiness.MinConnectedPercent,
+	}
+
+	result := runCheck(context.Background(), func(context.Context) error {
+		senders, err := s.db.GetAllSenders()
+		if err != nil {
+			return err
+		}
+
+		userClients := s.userStoreManager.GetAllUserClients()
+		for _, sender := range senders {
+			if sender.DeviceID == "" || sender.Status == "paused" {
+				continue // not linked yet, or disconnected on purpose
+			}
+			counts.Expected++
+			if client, exists := userClients[sender.Phone]; exists && client.IsConnected() {
+				counts.Connected++
+			}
+		}
+
+		if counts.Connected < counts.MinConnected {
+			return fmt.Errorf("%d senders connected, at least %d required", counts.Connected, counts.MinConnected)
+		}
+		if counts.Expected > 0 && counts.Connected*100 < counts.Expected*counts.MinConnectedPercent {
+			return fmt.Errorf("%d of %d senders connected, at least %d%% required", counts.Connected, counts.Expected, counts.MinConnectedPercent)
+		}
+		return nil
+	})
+	result.SenderHealth = counts
+	return result
+}
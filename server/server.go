@@ -1,14 +1,22 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"log/slog"
+	"net"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/jaliph/auto-dm/api"
+	"github.com/jaliph/auto-dm/backup"
 	"github.com/jaliph/auto-dm/database"
+	"github.com/jaliph/auto-dm/eventbus"
+	"github.com/jaliph/auto-dm/metrics"
 	"github.com/jaliph/auto-dm/store"
+	"github.com/jaliph/auto-dm/utils"
 	"github.com/jaliph/auto-dm/whatsapp"
 )
 
@@ -20,14 +28,22 @@ type Server struct {
 	clientManager    *whatsapp.ClientManager
 	qrManager        *whatsapp.QRManager
 	handler          *api.Handler
+	httpServer       *http.Server
 	baseURL          string
 	qrExpiryMinutes  int
 	fileShareFolder  string
+	buildInfo        BuildInfo
+	readiness        ReadinessThresholds
+	startedAt        time.Time
 }
 
 // NewServer creates a new HTTP server
-func NewServer(userStoreManager *store.UserStoreManager, gormDB *database.GormDB, db *database.Database, clientManager *whatsapp.ClientManager, qrManager *whatsapp.QRManager, baseURL string, qrExpiryMinutes int, fileShareFolder string) *Server {
-	handler := api.NewHandler(userStoreManager, gormDB, db, clientManager, qrManager, baseURL, qrExpiryMinutes, fileShareFolder)
+func NewServer(userStoreManager *store.UserStoreManager, gormDB *database.GormDB, db *database.Database, clientManager *whatsapp.ClientManager, qrManager *whatsapp.QRManager, eventBus *eventbus.Bus, baseURL string, qrExpiryMinutes int, fileShareFolder string, buildInfo BuildInfo, readiness ReadinessThresholds, backupManager *backup.Manager) *Server {
+	handler := api.NewHandler(userStoreManager, gormDB, db, clientManager, qrManager, eventBus, baseURL, qrExpiryMinutes, fileShareFolder, backupManager)
+	httpServer := &http.Server{Handler: withRequestID(http.DefaultServeMux)}
+	// Event streams never finish on their own, so end them once shutdown
+	// begins instead of letting them hold up the drain
+	httpServer.RegisterOnShutdown(eventBus.CloseSubscriptions)
 	return &Server{
 		userStoreManager: userStoreManager,
 		gormDB:           gormDB,
@@ -35,26 +51,73 @@ func NewServer(userStoreManager *store.UserStoreManager, gormDB *database.GormDB
 		clientManager:    clientManager,
 		qrManager:        qrManager,
 		handler:          handler,
+		httpServer:       httpServer,
 		baseURL:          baseURL,
 		qrExpiryMinutes:  qrExpiryMinutes,
 		fileShareFolder:  fileShareFolder,
+		buildInfo:        buildInfo,
+		readiness:        readiness,
+		startedAt:        time.Now(),
 	}
 }
 
-// Start starts the HTTP server
+// Start starts the HTTP server and blocks until it fails or is shut down.
+// It returns nil after a call to Shutdown.
 func (s *Server) Start(addr string) error {
 	// Register routes
 	http.HandleFunc("/", s.handleHealth)
+	http.HandleFunc("/healthz", s.handleLiveness)
+	http.HandleFunc("/readyz", s.handleReadiness)
 	http.HandleFunc("/register", s.handler.HandleRegister)
 	http.HandleFunc("/qr/", s.handleQRCode)
 	http.HandleFunc("/senders", s.handler.HandleGetSenders)
-	http.HandleFunc("/senders/", s.handleDeleteSender)
+	http.HandleFunc("/senders/", s.handleSender)
 	http.HandleFunc("/send", s.handler.HandleSendMessage)
 	http.HandleFunc("/messages", s.handler.HandleGetMessages)
+	http.HandleFunc("/chats/", s.handler.HandleExportChat)
 	http.HandleFunc("/stats", s.handler.HandleGetStats)
+	http.HandleFunc("/polls/", s.handler.HandleGetPollResults)
+	http.HandleFunc("/history", s.handler.HandleGetHistoryImport)
+	http.HandleFunc("/events", s.handler.HandleEvents)
+	http.HandleFunc("/admin", s.handler.HandleAdmin)
+	http.HandleFunc("/admin/backup", s.handler.HandleBackup)
+	http.HandleFunc("/admin/restore", s.handler.HandleRestore)
+	http.HandleFunc("/audit", s.handler.HandleGetAudit)
+	http.HandleFunc("/privacy/contacts/", s.handler.HandlePrivacyContact)
+	http.Handle("/metrics", metrics.Handler())
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Starting REST API server", "addr", addr)
+	if err := s.httpServer.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
 
-	log.Printf("Starting REST API server on %s", addr)
-	return http.ListenAndServe(addr, nil)
+// Shutdown stops accepting connections and waits for in-flight requests, such
+// as sends still waiting on WhatsApp, to finish or for ctx to expire
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
+// withRequestID tags each request with an ID, taken from the X-Request-ID header
+// or generated, so its log lines can be correlated. The ID is echoed in the response.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get("X-Request-ID")
+		if requestID == "" || len(requestID) > 64 {
+			requestID = utils.NewRequestID()
+		}
+		w.Header().Set("X-Request-ID", requestID)
+
+		ctx := utils.ContextWithRequestID(r.Context(), requestID)
+		slog.DebugContext(ctx, "HTTP request", "method", r.Method, "path", r.URL.Path, "remote_addr", r.RemoteAddr)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
 }
 
 // handleHealth handles the root endpoint for health checks
@@ -64,7 +127,6 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("DEBUG: Health check request received")
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{
@@ -75,54 +137,56 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 
 // handleQRCode handles QR code requests with dynamic token extraction
 func (s *Server) handleQRCode(w http.ResponseWriter, r *http.Request) {
-	log.Printf("DEBUG: handleQRCode called with path: %s", r.URL.Path)
-
 	// Extract token from URL path
 	path := r.URL.Path
 	if !strings.HasPrefix(path, "/qr/") {
-		log.Printf("DEBUG: Path doesn't start with /qr/: %s", path)
 		http.Error(w, "Invalid QR code URL", http.StatusBadRequest)
 		return
 	}
 
 	// Remove /qr/ prefix to get token
 	token := strings.TrimPrefix(path, "/qr/")
-	log.Printf("DEBUG: Extracted token: %s", token)
 	if token == "" {
-		log.Printf("DEBUG: Empty token")
 		http.Error(w, "Missing QR code token", http.StatusBadRequest)
 		return
 	}
 
+	// The live QR page follows the session through /qr/{token}/events
+	if strings.HasSuffix(token, "/events") {
+		s.handler.HandleQRCodeEvents(w, r)
+		return
+	}
+
 	// Create a new request with the token in the path for the handler
 	r.URL.Path = "/qr/" + token
-	log.Printf("DEBUG: Calling HandleGetQRCode with modified path: %s", r.URL.Path)
 	s.handler.HandleGetQRCode(w, r)
 }
 
-// handleDeleteSender handles DELETE requests for /senders/{phone}
-func (s *Server) handleDeleteSender(w http.ResponseWriter, r *http.Request) {
-	log.Printf("DEBUG: handleDeleteSender called with path: %s", r.URL.Path)
-
+// handleSender handles DELETE requests for /senders/{phone} and POST requests
+// for /senders/{phone}/resume
+func (s *Server) handleSender(w http.ResponseWriter, r *http.Request) {
 	// Extract phone number from URL path
 	path := r.URL.Path
 	if !strings.HasPrefix(path, "/senders/") {
-		log.Printf("DEBUG: Path doesn't start with /senders/: %s", path)
 		http.Error(w, "Invalid sender URL", http.StatusBadRequest)
 		return
 	}
 
 	// Remove /senders/ prefix to get phone number
-	phone := strings.TrimPrefix(path, "/senders/")
-	log.Printf("DEBUG: Extracted phone: %s", phone)
+	phone, action, _ := strings.Cut(strings.TrimPrefix(path, "/senders/"), "/")
 	if phone == "" {
-		log.Printf("DEBUG: Empty phone number")
 		http.Error(w, "Missing phone number", http.StatusBadRequest)
 		return
 	}
 
-	// Create a new request with the phone in the path for the handler
-	r.URL.Path = "/senders/" + phone
-	log.Printf("DEBUG: Calling HandleDeleteSender with modified path: %s", r.URL.Path)
-	s.handler.HandleDeleteSender(w, r)
+	switch action {
+	case "":
+		// Create a new request with the phone in the path for the handler
+		r.URL.Path = "/senders/" + phone
+		s.handler.HandleDeleteSender(w, r)
+	case "resume":
+		s.handler.HandleResumeSender(w, r)
+	default:
+		http.NotFound(w, r)
+	}
 }
@@ -0,0 +1,342 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sessionFileMagic starts every encrypted session store and versions the format
+const sessionFileMagic = "ADMSESS1"
+
+// sessionSnapshotDelay coalesces a burst of session changes, such as the
+// key uploads after linking, into one snapshot
+const sessionSnapshotDelay = time.Second
+
+// encryptedStorePath returns the encrypted session store file of a sender
+func encryptedStorePath(phone string) string {
+	return userStorePath(phone) + ".enc"
+}
+
+// encryptSnapshot encrypts a serialized session database with the active key.
+// The file is laid out as magic, key ID length, key ID, nonce and the AES-GCM
+// ciphertext. The header and the store's name, the sender's phone number or
+// sharedStoreName, are authenticated, so stores cannot be swapped.
+func encryptSnapshot(keys *SessionKeys, name string, snapshot []byte) ([]byte, error) {
+	gcm, err := sessionCipher(keys, keys.activeID)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append([]byte(sessionFileMagic), byte(len(keys.activeID)))
+	header = append(header, keys.activeID...)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	additionalData := append(bytes.Clone(header), name...)
+	sealed := append(header, nonce...)
+	return gcm.Seal(sealed, nonce, snapshot, additionalData), nil
+}
+
+// decryptSnapshot decrypts an encrypted session store and returns the
+// serialized database and the ID of the key it was encrypted with
+func decryptSnapshot(keys *SessionKeys, name string, sealed []byte) ([]byte, string, error) {
+	header, keyID, err := parseSnapshotHeader(sealed)
+	if err != nil {
+		return nil, "", err
+	}
+	gcm, err := sessionCipher(keys, keyID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	rest := sealed[len(header):]
+	if len(rest) < gcm.NonceSize() {
+		return nil, "", errors.New("encrypted session store is truncated")
+	}
+	nonce, ciphertext := rest[:gcm.NonceSize()], rest[gcm.NonceSize():]
+	snapshot, err := gcm.Open(nil, nonce, ciphertext, append(bytes.Clone(header), name...))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to decrypt session store with key %s: the store is corrupt or belongs to another sender", keyID)
+	}
+	return snapshot, keyID, nil
+}
+
+// parseSnapshotHeader returns the header of an encrypted session store and
+// the ID of the key it was encrypted with
+func parseSnapshotHeader(sealed []byte) ([]byte, string, error) {
+	if len(sealed) < len(sessionFileMagic)+1 || string(sealed[:len(sessionFileMagic)]) != sessionFileMagic {
+		return nil, "", errors.New("not an encrypted session store")
+	}
+	end := len(sessionFileMagic) + 1 + int(sealed[len(sessionFileMagic)])
+	if len(sealed) < end {
+		return nil, "", errors.New("encrypted session store is truncated")
+	}
+	return sealed[:end], string(sealed[len(sessionFileMagic)+1 : end]), nil
+}
+
+// sessionCipher returns the AES-GCM cipher of a session key
+func sessionCipher(keys *SessionKeys, keyID string) (cipher.AEAD, error) {
+	key, err := keys.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// writeFileAtomic replaces a file so that a crash leaves either the old or
+// the new content, never a partial write
+func writeFileAtomic(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Base(path), err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %v", filepath.Base(path), err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync %s: %v", filepath.Base(path), err)
+	}
+	tmp.Close()
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// encryptedStore is a SQLite session database when encryption is enabled.
+// The database lives in memory and every change is persisted as an encrypted
+// snapshot, so the Signal keys never reach the disk in plaintext.
+type encryptedStore struct {
+	path string // encrypted file
+	name string // authenticated with the snapshot, see encryptSnapshot
+	keys *SessionKeys
+	db   *sql.DB
+	conn *sqlite3.SQLiteConn // the one connection that holds the database
+
+	dirty   atomic.Bool   // changed since the last snapshot
+	changed chan struct{} // wakes the snapshot loop
+	done    chan struct{}
+	stopped chan struct{}
+
+	mu     sync.Mutex // keeps snapshots for backups from racing Close
+	closed bool
+}
+
+// errStoreClosed is returned for a snapshot of a store that was closed
+var errStoreClosed = errors.New("session store is closed")
+
+// openEncryptedStore decrypts a session store into memory, or starts an empty
+// one if the file does not exist yet
+func openEncryptedStore(path, name string, keys *SessionKeys) (*encryptedStore, error) {
+	var snapshot []byte
+	var keyID string
+	sealed, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, fmt.Errorf("failed to read encrypted session store: %v", err)
+	default:
+		if snapshot, keyID, err = decryptSnapshot(keys, name, sealed); err != nil {
+			return nil, err
+		}
+	}
+
+	store := &encryptedStore{
+		path:    path,
+		name:    name,
+		keys:    keys,
+		changed: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	store.db, store.conn, err = openMemoryDB(snapshot, store.markChanged)
+	if err != nil {
+		return nil, err
+	}
+	go store.run()
+
+	// A store still encrypted with a previous key is rotated as soon as it is opened
+	if keyID != "" && keyID != keys.activeID {
+		slog.Info("Re-encrypting session store with the active key", "store", filepath.Base(path), "from_key", keyID, "to_key", keys.activeID)
+		store.markChanged()
+	}
+	return store, nil
+}
+
+// openMemoryDB opens an in-memory SQLite database, restores a serialized
+// database into it if there is one and calls onCommit after every commit
+func openMemoryDB(snapshot []byte, onCommit func()) (*sql.DB, *sqlite3.SQLiteConn, error) {
+	db, err := sql.Open("sqlite3", "file::memory:?_foreign_keys=on")
+	if err != nil {
+		return nil, nil, err
+	}
+	// The database only exists inside its connection, which must never be
+	// closed or replaced by a second one
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+	db.SetConnMaxLifetime(0)
+	db.SetConnMaxIdleTime(0)
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	defer conn.Close()
+
+	var sqliteConn *sqlite3.SQLiteConn
+	err = conn.Raw(func(driverConn any) error {
+		sqliteConn = driverConn.(*sqlite3.SQLiteConn)
+		if snapshot != nil {
+			if err := restoreSnapshot(sqliteConn, snapshot); err != nil {
+				return err
+			}
+		}
+		if onCommit != nil {
+			sqliteConn.RegisterCommitHook(func() int {
+				onCommit()
+				return 0
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return db, sqliteConn, nil
+}
+
+// restoreSnapshot copies a serialized database into a connection. SQLite
+// cannot grow a deserialized database, so it is deserialized into a scratch
+// connection and copied with the backup API instead.
+func restoreSnapshot(dest *sqlite3.SQLiteConn, snapshot []byte) error {
+	driverConn, err := (&sqlite3.SQLiteDriver{}).Open(":memory:")
+	if err != nil {
+		return err
+	}
+	source := driverConn.(*sqlite3.SQLiteConn)
+	defer source.Close()
+
+	if err := source.Deserialize(snapshot, "main"); err != nil {
+		return fmt.Errorf("failed to load session store: %v", err)
+	}
+	backup, err := dest.Backup("main", source, "main")
+	if err != nil {
+		return fmt.Errorf("failed to load session store: %v", err)
+	}
+	if _, err := backup.Step(-1); err != nil {
+		backup.Finish()
+		return fmt.Errorf("failed to load session store: %v", err)
+	}
+	return backup.Finish()
+}
+
+// serialize returns a copy of the database held by a connection of db
+func serialize(db *sql.DB, want *sqlite3.SQLiteConn) ([]byte, error) {
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var snapshot []byte
+	err = conn.Raw(func(driverConn any) error {
+		sqliteConn := driverConn.(*sqlite3.SQLiteConn)
+		if want != nil && sqliteConn != want {
+			return errors.New("the in-memory session database was lost")
+		}
+		snapshot, err = sqliteConn.Serialize("main")
+		return err
+	})
+	return snapshot, err
+}
+
+// markChanged schedules a snapshot. It runs inside SQLite's commit hook and
+// must not touch the database.
+func (s *encryptedStore) markChanged() {
+	s.dirty.Store(true)
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// run persists the store shortly after it changes until the store is closed
+func (s *encryptedStore) run() {
+	defer close(s.stopped)
+	for {
+		select {
+		case <-s.changed:
+		case <-s.done:
+			return
+		}
+		select {
+		case <-time.After(sessionSnapshotDelay):
+		case <-s.done:
+			return
+		}
+		if err := s.flush(); err != nil {
+			slog.Error("Failed to persist encrypted session store", "store", filepath.Base(s.path), "error", err)
+			s.markChanged()
+		}
+	}
+}
+
+// flush writes an encrypted snapshot of the store if it changed. The snapshot
+// waits for the connection, so it never includes half of a transaction.
+func (s *encryptedStore) flush() error {
+	if !s.dirty.Swap(false) {
+		return nil
+	}
+	snapshot, err := serialize(s.db, s.conn)
+	if err == nil {
+		var sealed []byte
+		if sealed, err = encryptSnapshot(s.keys, s.name, snapshot); err == nil {
+			err = writeFileAtomic(s.path, sealed)
+		}
+	}
+	if err != nil {
+		s.dirty.Store(true)
+		return err
+	}
+	return nil
+}
+
+// Close writes the last snapshot and releases the in-memory database
+func (s *encryptedStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	close(s.done)
+	<-s.stopped
+	err := s.flush()
+	if closeErr := s.db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,126 @@
+package store
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	keys := newTestKeys(t)
+	snapshot := []byte("SQLite format 3\x00 serialized session database")
+
+	sealed, err := encryptSnapshot(keys, "919876543210", snapshot)
+	if err != nil {
+		t.Fatalf("failed to encrypt snapshot: %v", err)
+	}
+	if !bytes.HasPrefix(sealed, []byte(sessionFileMagic)) {
+		t.Errorf("sealed snapshot does not start with %s", sessionFileMagic)
+	}
+	if bytes.Contains(sealed, snapshot) {
+		t.Error("sealed snapshot contains the plaintext")
+	}
+
+	opened, keyID, err := decryptSnapshot(keys, "919876543210", sealed)
+	if err != nil {
+		t.Fatalf("failed to decrypt snapshot: %v", err)
+	}
+	if !bytes.Equal(opened, snapshot) {
+		t.Errorf("decrypted snapshot = %q, want %q", opened, snapshot)
+	}
+	if keyID != keys.ActiveID() {
+		t.Errorf("key ID = %s, want %s", keyID, keys.ActiveID())
+	}
+}
+
+func TestSnapshotRejected(t *testing.T) {
+	keys := newTestKeys(t)
+	sealed, err := encryptSnapshot(keys, "919876543210", []byte("session database"))
+	if err != nil {
+		t.Fatalf("failed to encrypt snapshot: %v", err)
+	}
+	header, _, err := parseSnapshotHeader(sealed)
+	if err != nil {
+		t.Fatalf("failed to parse header: %v", err)
+	}
+
+	// Another key under the same ID reaches the GCM open, which must fail
+	wrongKey := &SessionKeys{
+		activeID: keys.ActiveID(),
+		keys:     map[string][]byte{keys.ActiveID(): bytes.Repeat([]byte{0x42}, sessionKeySize)},
+	}
+	flip := func(i int) []byte {
+		tampered := bytes.Clone(sealed)
+		tampered[i] ^= 0x01
+		return tampered
+	}
+
+	tests := []struct {
+		name    string
+		keys    *SessionKeys
+		store   string
+		sealed  []byte
+		wantErr string
+	}{
+		{"wrong key", wrongKey, "919876543210", sealed, "failed to decrypt"},
+		{"unknown key", newTestKeys(t), "919876543210", sealed, "is not configured"},
+		{"other sender", keys, "919123456780", sealed, "failed to decrypt"},
+		{"tampered ciphertext", keys, "919876543210", flip(len(sealed) - 20), "failed to decrypt"},
+		{"tampered tag", keys, "919876543210", flip(len(sealed) - 1), "failed to decrypt"},
+		{"tampered nonce", keys, "919876543210", flip(len(header)), "failed to decrypt"},
+		{"truncated", keys, "919876543210", sealed[:len(header)+4], "truncated"},
+		{"plaintext", keys, "919876543210", []byte("SQLite format 3\x00"), "not an encrypted session store"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := decryptSnapshot(test.keys, test.store, test.sealed)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("error = %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestEncryptedStoreReopen(t *testing.T) {
+	keys := newTestKeys(t)
+	path := filepath.Join(t.TempDir(), "user_919876543210.db.enc")
+
+	store, err := openEncryptedStore(path, "919876543210", keys)
+	if err != nil {
+		t.Fatalf("failed to open encrypted store: %v", err)
+	}
+	if _, err := store.db.Exec("CREATE TABLE identities (id TEXT PRIMARY KEY, key BLOB)"); err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	if _, err := store.db.Exec("INSERT INTO identities VALUES ('919123456780', 'identity-key-secret')"); err != nil {
+		t.Fatalf("failed to insert row: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("failed to close encrypted store: %v", err)
+	}
+
+	sealed, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read encrypted store: %v", err)
+	}
+	if bytes.Contains(sealed, []byte("identity-key-secret")) {
+		t.Error("encrypted store file contains plaintext session data")
+	}
+
+	store, err = openEncryptedStore(path, "919876543210", keys)
+	if err != nil {
+		t.Fatalf("failed to reopen encrypted store: %v", err)
+	}
+	var key string
+	err = store.db.QueryRow("SELECT key FROM identities WHERE id = '919123456780'").Scan(&key)
+	store.Close()
+	if err != nil || key != "identity-key-secret" {
+		t.Fatalf("reopened store returned %q, %v", key, err)
+	}
+
+	if _, err := openEncryptedStore(path, "919123456780", keys); err == nil {
+		t.Error("expected the store to be rejected under another sender's name")
+	}
+}
@@ -0,0 +1,256 @@
+package store
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// sessionKeySize is the size of the AES-256 keys session stores are encrypted with
+const sessionKeySize = 32
+
+// SessionKeys are the keys session stores are encrypted with. Stores are
+// always written with the active key; the other keys are only used to read
+// stores that were written before a key rotation.
+type SessionKeys struct {
+	activeID string
+	keys     map[string][]byte // key ID -> key
+}
+
+// SessionKeyConfig tells LoadSessionKeys where the active key comes from. At
+// most one of Key, KeyFile and Keyring may be set.
+type SessionKeyConfig struct {
+	Key          string   // base64 key
+	KeyFile      string   // file holding a base64 key
+	Keyring      string   // local keyring file, a stand-in for a key management service
+	PreviousKeys []string // base64 keys stores may still be encrypted with
+}
+
+// Enabled reports whether a key source is configured
+func (c SessionKeyConfig) Enabled() bool {
+	return c.Key != "" || c.KeyFile != "" || c.Keyring != ""
+}
+
+// LoadSessionKeys loads the session store keys. It returns nil if no key
+// source is configured, in which case session stores are kept in plaintext.
+func LoadSessionKeys(config SessionKeyConfig) (*SessionKeys, error) {
+	sources := 0
+	for _, source := range []string{config.Key, config.KeyFile, config.Keyring} {
+		if source != "" {
+			sources++
+		}
+	}
+	switch {
+	case sources == 0 && len(config.PreviousKeys) > 0:
+		return nil, errors.New("previous session keys are set without an active key")
+	case sources == 0:
+		return nil, nil
+	case sources > 1:
+		return nil, errors.New("only one of the session key, key file and keyring can be set")
+	}
+
+	keys := &SessionKeys{keys: make(map[string][]byte)}
+	switch {
+	case config.Keyring != "":
+		keyring, err := readKeyring(config.Keyring)
+		if err != nil {
+			return nil, err
+		}
+		if keyring == nil {
+			return nil, fmt.Errorf("keyring %s does not exist, create it with \"auto-dm sessions rotate -generate\"", config.Keyring)
+		}
+		for _, entry := range keyring.Keys {
+			key, err := decodeSessionKey(entry.Key)
+			if err != nil {
+				return nil, fmt.Errorf("keyring key %s: %v", entry.ID, err)
+			}
+			keys.keys[entry.ID] = key
+		}
+		if _, ok := keys.keys[keyring.Active]; !ok {
+			return nil, fmt.Errorf("keyring %s has no active key", config.Keyring)
+		}
+		keys.activeID = keyring.Active
+	case config.KeyFile != "":
+		data, err := os.ReadFile(config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read session key file: %v", err)
+		}
+		key, err := decodeSessionKey(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("session key file %s: %v", config.KeyFile, err)
+		}
+		keys.activeID = keys.add(key)
+	default:
+		key, err := decodeSessionKey(config.Key)
+		if err != nil {
+			return nil, fmt.Errorf("session key: %v", err)
+		}
+		keys.activeID = keys.add(key)
+	}
+
+	for i, encoded := range config.PreviousKeys {
+		key, err := decodeSessionKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("previous session key %d: %v", i+1, err)
+		}
+		keys.add(key)
+	}
+	return keys, nil
+}
+
+// ActiveID returns the ID of the key stores are written with
+func (k *SessionKeys) ActiveID() string {
+	return k.activeID
+}
+
+// Has reports whether the key with an ID is configured
+func (k *SessionKeys) Has(id string) bool {
+	_, ok := k.keys[id]
+	return ok
+}
+
+// add adds a key under an ID derived from its value and returns the ID
+func (k *SessionKeys) add(key []byte) string {
+	sum := sha256.Sum256(key)
+	id := hex.EncodeToString(sum[:4])
+	k.keys[id] = key
+	return id
+}
+
+// key returns the key with an ID
+func (k *SessionKeys) key(id string) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("session key %s is not configured", id)
+	}
+	return key, nil
+}
+
+// decodeSessionKey decodes a base64 AES-256 key
+func decodeSessionKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64: %v", err)
+	}
+	if len(key) != sessionKeySize {
+		return nil, fmt.Errorf("expected a %d byte key, got %d bytes", sessionKeySize, len(key))
+	}
+	return key, nil
+}
+
+// GenerateSessionKey returns a new random base64 session key
+func GenerateSessionKey() (string, error) {
+	key := make([]byte, sessionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate session key: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// keyring is the local keyring file: every key that may still be needed to
+// read a session store, and which of them new snapshots are written with
+type keyring struct {
+	Active string       `json:"active"`
+	Keys   []keyringKey `json:"keys"`
+}
+
+// keyringKey is one version of the session key
+type keyringKey struct {
+	ID        string    `json:"id"`
+	Key       string    `json:"key"` // base64
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// readKeyring reads a keyring file, returning nil if it does not exist
+func readKeyring(path string) (*keyring, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %v", err)
+	}
+	var ring keyring
+	if err := json.Unmarshal(data, &ring); err != nil {
+		return nil, fmt.Errorf("failed to parse keyring %s: %v", path, err)
+	}
+	return &ring, nil
+}
+
+// writeKeyring replaces a keyring file, readable by the owner only
+func writeKeyring(path string, ring *keyring) error {
+	data, err := json.MarshalIndent(ring, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode keyring: %v", err)
+	}
+	return writeFileAtomic(path, append(data, '\n'))
+}
+
+// GenerateKeyringKey adds a new key to a keyring file, creating the file if it
+// does not exist, and makes it the active key. Earlier keys are kept until
+// PruneKeyring removes them.
+func GenerateKeyringKey(path string) (string, error) {
+	ring, err := readKeyring(path)
+	if err != nil {
+		return "", err
+	}
+	if ring == nil {
+		ring = &keyring{}
+	}
+
+	encoded, err := GenerateSessionKey()
+	if err != nil {
+		return "", err
+	}
+	// Key IDs are versions that keep counting up after older keys are pruned
+	version := 0
+	for _, entry := range ring.Keys {
+		var n int
+		if _, err := fmt.Sscanf(entry.ID, "v%d", &n); err == nil && n > version {
+			version = n
+		}
+	}
+	id := fmt.Sprintf("v%d", version+1)
+	ring.Keys = append(ring.Keys, keyringKey{ID: id, Key: encoded, CreatedAt: time.Now().UTC()})
+	ring.Active = id
+	if err := writeKeyring(path, ring); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// PruneKeyring removes every key but the active one from a keyring file and
+// returns how many were removed. Stores still encrypted with a removed key
+// can no longer be read, so only prune after rotating every store.
+func PruneKeyring(path string) (int, error) {
+	ring, err := readKeyring(path)
+	if err != nil {
+		return 0, err
+	}
+	if ring == nil {
+		return 0, fmt.Errorf("keyring %s does not exist", path)
+	}
+
+	var kept []keyringKey
+	for _, entry := range ring.Keys {
+		if entry.ID == ring.Active {
+			kept = append(kept, entry)
+		}
+	}
+	if len(kept) == 0 {
+		return 0, fmt.Errorf("keyring %s has no active key", path)
+	}
+	removed := len(ring.Keys) - len(kept)
+	ring.Keys = kept
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, writeKeyring(path, ring)
+}
@@ -0,0 +1,124 @@
+package store
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestKey returns a random base64 session key
+func newTestKey(t *testing.T) string {
+	t.Helper()
+	key, err := GenerateSessionKey()
+	if err != nil {
+		t.Fatalf("failed to generate session key: %v", err)
+	}
+	return key
+}
+
+// newTestKeys returns session keys with a random active key
+func newTestKeys(t *testing.T) *SessionKeys {
+	t.Helper()
+	keys, err := LoadSessionKeys(SessionKeyConfig{Key: newTestKey(t)})
+	if err != nil {
+		t.Fatalf("failed to load session keys: %v", err)
+	}
+	return keys
+}
+
+func TestLoadSessionKeys(t *testing.T) {
+	keys, err := LoadSessionKeys(SessionKeyConfig{})
+	if err != nil || keys != nil {
+		t.Fatalf("expected no keys without a key source, got %v, %v", keys, err)
+	}
+
+	active, previous := newTestKey(t), newTestKey(t)
+	keys, err = LoadSessionKeys(SessionKeyConfig{Key: active, PreviousKeys: []string{previous}})
+	if err != nil {
+		t.Fatalf("failed to load session keys: %v", err)
+	}
+	previousKeys, err := LoadSessionKeys(SessionKeyConfig{Key: previous})
+	if err != nil {
+		t.Fatalf("failed to load session keys: %v", err)
+	}
+	if !keys.Has(keys.ActiveID()) || !keys.Has(previousKeys.ActiveID()) {
+		t.Errorf("expected both the active and the previous key to be configured")
+	}
+	if keys.ActiveID() == previousKeys.ActiveID() {
+		t.Errorf("different keys got the same ID %s", keys.ActiveID())
+	}
+}
+
+func TestLoadSessionKeysInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  SessionKeyConfig
+		wantErr string
+	}{
+		{"invalid base64", SessionKeyConfig{Key: "not base64!"}, "invalid base64"},
+		{"short key", SessionKeyConfig{Key: "c2hvcnQ="}, "expected a 32 byte key"},
+		{"two sources", SessionKeyConfig{Key: newTestKey(t), KeyFile: "session.key"}, "only one of"},
+		{"previous without active", SessionKeyConfig{PreviousKeys: []string{newTestKey(t)}}, "without an active key"},
+		{"missing keyring", SessionKeyConfig{Keyring: filepath.Join(t.TempDir(), "keyring.json")}, "does not exist"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := LoadSessionKeys(test.config)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("error = %v, want one containing %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	first, err := GenerateKeyringKey(path)
+	if err != nil {
+		t.Fatalf("failed to generate keyring key: %v", err)
+	}
+	oldKeys, err := LoadSessionKeys(SessionKeyConfig{Keyring: path})
+	if err != nil {
+		t.Fatalf("failed to load keyring: %v", err)
+	}
+	sealed, err := encryptSnapshot(oldKeys, "919876543210", []byte("snapshot"))
+	if err != nil {
+		t.Fatalf("failed to encrypt snapshot: %v", err)
+	}
+
+	second, err := GenerateKeyringKey(path)
+	if err != nil {
+		t.Fatalf("failed to generate keyring key: %v", err)
+	}
+	if first != "v1" || second != "v2" {
+		t.Fatalf("key IDs = %s, %s, want v1, v2", first, second)
+	}
+	keys, err := LoadSessionKeys(SessionKeyConfig{Keyring: path})
+	if err != nil {
+		t.Fatalf("failed to load keyring: %v", err)
+	}
+	if keys.ActiveID() != second {
+		t.Errorf("active key = %s, want %s", keys.ActiveID(), second)
+	}
+
+	// Stores written before the rotation are still readable
+	snapshot, keyID, err := decryptSnapshot(keys, "919876543210", sealed)
+	if err != nil || keyID != first || string(snapshot) != "snapshot" {
+		t.Fatalf("decrypt with the previous key = %q, %s, %v", snapshot, keyID, err)
+	}
+
+	removed, err := PruneKeyring(path)
+	if err != nil || removed != 1 {
+		t.Fatalf("prune = %d, %v, want 1 removed", removed, err)
+	}
+	keys, err = LoadSessionKeys(SessionKeyConfig{Keyring: path})
+	if err != nil {
+		t.Fatalf("failed to load keyring: %v", err)
+	}
+	if keys.Has(first) {
+		t.Errorf("pruned key %s is still in the keyring", first)
+	}
+	if _, _, err := decryptSnapshot(keys, "919876543210", sealed); err == nil {
+		t.Error("expected a store encrypted with a pruned key to be unreadable")
+	}
+}
@@ -0,0 +1,206 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// SnapshotSessionStores calls fn with a consistent copy of every session store
+// in the db directory and of the shared SQLite store at sharedPath. It can run
+// next to a server in another process: plaintext stores are copied by SQLite
+// inside a read transaction and encrypted files are only ever replaced whole.
+func SnapshotSessionStores(sharedPath string, fn func(store SessionStore, data []byte) error) error {
+	stores, err := ListSessionStores(sharedPath)
+	if err != nil {
+		return err
+	}
+	return snapshotSessionStores(stores, nil, fn)
+}
+
+// SnapshotSessionStores is the package function for a running server. The
+// encrypted stores it holds in memory are copied from memory, so the snapshot
+// includes changes that are not written to disk yet.
+func (usm *UserStoreManager) SnapshotSessionStores(fn func(store SessionStore, data []byte) error) error {
+	stores, err := ListSessionStores(usm.config.SharedSQLitePath())
+	if err != nil {
+		return err
+	}
+
+	// The stores open right now, by file
+	open := make(map[string]*encryptedStore)
+	usm.mu.RLock()
+	for _, entry := range usm.senders {
+		if entry.encrypted != nil {
+			open[entry.encrypted.path] = entry.encrypted
+		}
+	}
+	if usm.shared != nil && usm.shared.encrypted != nil {
+		open[usm.shared.encrypted.path] = usm.shared.encrypted
+	}
+	usm.mu.RUnlock()
+
+	// Stores opened since the last snapshot may not be on disk yet
+	for _, sessionStore := range stores {
+		delete(open, sessionStore.Path)
+	}
+	for path, encrypted := range open {
+		phone := encrypted.name
+		if usm.shared != nil {
+			phone = ""
+		}
+		stores = append(stores, SessionStore{Phone: phone, Path: path, Encrypted: true})
+	}
+
+	return snapshotSessionStores(stores, func(sessionStore SessionStore) *encryptedStore {
+		return usm.openEncryptedStore(sessionStore.Path)
+	}, fn)
+}
+
+// openEncryptedStore returns the in-memory store behind a session store
+// file, or nil if the store is not open
+func (usm *UserStoreManager) openEncryptedStore(path string) *encryptedStore {
+	usm.mu.RLock()
+	defer usm.mu.RUnlock()
+	if usm.shared != nil && usm.shared.encrypted != nil && usm.shared.encrypted.path == path {
+		return usm.shared.encrypted
+	}
+	for _, entry := range usm.senders {
+		if entry.encrypted != nil && entry.encrypted.path == path {
+			return entry.encrypted
+		}
+	}
+	return nil
+}
+
+// snapshotSessionStores copies the stores that open returns from memory and
+// the others from disk
+func snapshotSessionStores(stores []SessionStore, open func(SessionStore) *encryptedStore, fn func(store SessionStore, data []byte) error) error {
+	for _, sessionStore := range stores {
+		var data []byte
+		var err error
+		switch {
+		case !sessionStore.Encrypted:
+			data, err = snapshotSQLite(sessionStore.Path)
+		case open != nil && open(sessionStore) != nil:
+			data, err = open(sessionStore).sealedSnapshot()
+			if errors.Is(err, errStoreClosed) {
+				// Closed since, with its last snapshot written
+				data, err = os.ReadFile(sessionStore.Path)
+			}
+		default:
+			data, err = os.ReadFile(sessionStore.Path)
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			continue // deleted since it was listed
+		}
+		if err != nil {
+			return fmt.Errorf("failed to snapshot %s: %v", sessionStore.Path, err)
+		}
+		sessionStore.Size = int64(len(data))
+		if sessionStore.Encrypted {
+			if _, sessionStore.KeyID, err = parseSnapshotHeader(data); err != nil {
+				return fmt.Errorf("failed to snapshot %s: %v", sessionStore.Path, err)
+			}
+		}
+		if err := fn(sessionStore, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sealedSnapshot returns the store's current content encrypted with the
+// active key, without writing it
+func (s *encryptedStore) sealedSnapshot() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, errStoreClosed
+	}
+	snapshot, err := serialize(s.db, s.conn)
+	if err != nil {
+		return nil, err
+	}
+	return encryptSnapshot(s.keys, s.name, snapshot)
+}
+
+// snapshotSQLite returns a consistent copy of a SQLite database file. VACUUM
+// INTO writes the copy inside a read transaction, so writers in this or
+// another process are neither blocked for long nor included halfway.
+func snapshotSQLite(path string) ([]byte, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_busy_timeout=5000", path))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	// VACUUM INTO accepts an empty file, so the copy gets a unique name
+	copyFile, err := os.CreateTemp(filepath.Dir(path), ".snapshot-*.db")
+	if err != nil {
+		return nil, err
+	}
+	copyFile.Close()
+	defer os.Remove(copyFile.Name())
+	if _, err := db.Exec("VACUUM INTO ?", copyFile.Name()); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(copyFile.Name())
+}
+
+// VerifySessionStore checks that a session store file is an intact SQLite
+// database. An encrypted store is decrypted in memory first, which needs the
+// key it was written with.
+func VerifySessionStore(sessionStore SessionStore, keys *SessionKeys) error {
+	if !sessionStore.Encrypted {
+		return CheckSQLite(sessionStore.Path)
+	}
+	if keys == nil {
+		return errors.New("store is encrypted but no session key is configured")
+	}
+	sealed, err := os.ReadFile(sessionStore.Path)
+	if err != nil {
+		return err
+	}
+	snapshot, _, err := decryptSnapshot(keys, sessionStore.Name(), sealed)
+	if err != nil {
+		return err
+	}
+
+	db, _, err := openMemoryDB(snapshot, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return quickCheck(db)
+}
+
+// CheckSQLite runs SQLite's quick_check on a database file
+func CheckSQLite(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro", path))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return quickCheck(db)
+}
+
+// quickCheck runs SQLite's quick_check on an open database
+func quickCheck(db *sql.DB) error {
+	var check string
+	if err := db.QueryRow("PRAGMA quick_check").Scan(&check); err != nil {
+		return fmt.Errorf("failed to check database: %v", err)
+	}
+	if check != "ok" {
+		return fmt.Errorf("database is corrupt: %s", check)
+	}
+	return nil
+}
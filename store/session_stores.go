@@ -0,0 +1,214 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SessionStore describes a SQLite session store file on disk
+type SessionStore struct {
+	Phone     string // sender of a per-sender store, empty for the shared store
+	Path      string // file on disk, ending in .enc when encrypted
+	Encrypted bool
+	KeyID     string // key an encrypted store was written with
+	Size      int64
+}
+
+// Name returns the name of the store, authenticated when it is encrypted
+func (s SessionStore) Name() string {
+	if s.Phone == "" {
+		return sharedStoreName
+	}
+	return s.Phone
+}
+
+// plaintextPath returns the path of the store without encryption
+func (s SessionStore) plaintextPath() string {
+	return strings.TrimSuffix(s.Path, ".enc")
+}
+
+// ListSessionStores returns the per-sender session store files in the db
+// directory and the shared SQLite store at sharedPath if there is one,
+// plaintext and encrypted, sorted by phone number with the shared store first
+func ListSessionStores(sharedPath string) ([]SessionStore, error) {
+	paths, err := filepath.Glob(filepath.Join("db", "user_*.db*"))
+	if err != nil {
+		return nil, err
+	}
+	if sharedPath != "" {
+		paths = append(paths, sharedPath, sharedPath+".enc")
+	}
+
+	var stores []SessionStore
+	for _, path := range paths {
+		name := filepath.Base(path)
+		encrypted := strings.HasSuffix(name, ".enc")
+		var phone string
+		if path != sharedPath && path != sharedPath+".enc" {
+			if !encrypted && !strings.HasSuffix(name, ".db") || encrypted && !strings.HasSuffix(name, ".db.enc") {
+				continue // journals and interrupted writes
+			}
+			phone = strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(name, "user_"), ".enc"), ".db")
+		}
+
+		info, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		store := SessionStore{Phone: phone, Path: path, Encrypted: encrypted, Size: info.Size()}
+		if encrypted {
+			if store.KeyID, err = readSnapshotKeyID(path); err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+		}
+		stores = append(stores, store)
+	}
+	sort.Slice(stores, func(i, j int) bool { return stores[i].Phone < stores[j].Phone })
+	return stores, nil
+}
+
+// readSnapshotKeyID returns the ID of the key an encrypted store was written with
+func readSnapshotKeyID(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	header := make([]byte, len(sessionFileMagic)+1+255)
+	n, err := file.Read(header)
+	if err != nil {
+		return "", err
+	}
+	_, keyID, err := parseSnapshotHeader(header[:n])
+	return keyID, err
+}
+
+// EncryptSessionStore encrypts a plaintext session store with the active key,
+// checks that the encrypted store can be read back and then overwrites and
+// deletes the plaintext file. The server must not be running.
+func EncryptSessionStore(store SessionStore, keys *SessionKeys) error {
+	path := store.plaintextPath()
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	if _, err := os.Stat(path + ".enc"); err == nil {
+		return fmt.Errorf("%s.enc already exists", path)
+	}
+
+	// Reading through SQLite rolls back a journal left by a crash
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_foreign_keys=on", path))
+	if err != nil {
+		return err
+	}
+	var check string
+	if err := db.QueryRow("PRAGMA quick_check").Scan(&check); err != nil {
+		db.Close()
+		return fmt.Errorf("failed to check plaintext session store: %v", err)
+	}
+	if check != "ok" {
+		db.Close()
+		return fmt.Errorf("plaintext session store is corrupt: %s", check)
+	}
+	snapshot, err := serialize(db, nil)
+	db.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read plaintext session store: %v", err)
+	}
+
+	if err := writeEncryptedStore(path+".enc", store.Name(), keys, snapshot); err != nil {
+		return err
+	}
+	return removePlaintextStore(path)
+}
+
+// DecryptSessionStore turns an encrypted session store back into a plaintext
+// one, for turning encryption off. The server must not be running.
+func DecryptSessionStore(store SessionStore, keys *SessionKeys) error {
+	path := store.plaintextPath()
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+	sealed, err := os.ReadFile(path + ".enc")
+	if err != nil {
+		return err
+	}
+	snapshot, _, err := decryptSnapshot(keys, store.Name(), sealed)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, snapshot); err != nil {
+		return err
+	}
+	return os.Remove(path + ".enc")
+}
+
+// RotateSessionStore re-encrypts a session store with the active key and
+// reports whether it had to. The server must not be running.
+func RotateSessionStore(store SessionStore, keys *SessionKeys) (bool, error) {
+	path := store.plaintextPath() + ".enc"
+	sealed, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	snapshot, keyID, err := decryptSnapshot(keys, store.Name(), sealed)
+	if err != nil {
+		return false, err
+	}
+	if keyID == keys.activeID {
+		return false, nil
+	}
+	return true, writeEncryptedStore(path, store.Name(), keys, snapshot)
+}
+
+// writeEncryptedStore encrypts a serialized session database and verifies
+// that the written file decrypts to the same database
+func writeEncryptedStore(path, name string, keys *SessionKeys, snapshot []byte) error {
+	sealed, err := encryptSnapshot(keys, name, snapshot)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, sealed); err != nil {
+		return err
+	}
+
+	written, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	verified, _, err := decryptSnapshot(keys, name, written)
+	if err != nil {
+		return fmt.Errorf("failed to verify encrypted session store: %v", err)
+	}
+	if string(verified) != string(snapshot) {
+		return errors.New("failed to verify encrypted session store: content differs")
+	}
+	return nil
+}
+
+// removePlaintextStore overwrites a plaintext session store with zeros before
+// deleting it and its journals. Filesystems that copy on write or SSDs that
+// remap blocks may still keep the old content, so the overwrite is best effort.
+func removePlaintextStore(path string) error {
+	if info, err := os.Stat(path); err == nil {
+		if file, err := os.OpenFile(path, os.O_WRONLY, 0); err == nil {
+			file.Write(make([]byte, info.Size()))
+			file.Sync()
+			file.Close()
+		}
+	}
+	for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+		if err := os.Remove(path + suffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	_ "github.com/lib/pq"
+	wastore "go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Session store layouts
+const (
+	LayoutPerSender = "per_sender" // a SQLite file per sender, db/user_<phone>.db
+	LayoutShared    = "shared"     // every sender's device in one container
+)
+
+// sharedStoreName is the name an encrypted shared store is authenticated with
+const sharedStoreName = "shared"
+
+// whatsmeowTables are the tables of a whatsmeow store, in an order that
+// satisfies their foreign keys
+var whatsmeowTables = []string{
+	"whatsmeow_device",
+	"whatsmeow_identity_keys",
+	"whatsmeow_pre_keys",
+	"whatsmeow_sessions",
+	"whatsmeow_sender_keys",
+	"whatsmeow_app_state_sync_keys",
+	"whatsmeow_app_state_version",
+	"whatsmeow_app_state_mutation_macs",
+	"whatsmeow_contacts",
+	"whatsmeow_chat_settings",
+	"whatsmeow_message_secrets",
+	"whatsmeow_privacy_tokens",
+	"whatsmeow_lid_map",
+	"whatsmeow_event_buffer",
+}
+
+// SessionStoreConfig selects where whatsmeow device sessions are kept
+type SessionStoreConfig struct {
+	Layout  string // LayoutPerSender or LayoutShared
+	Dialect string // shared layout: "sqlite3" or "postgres"
+	Address string // shared layout: SQLite file, or PostgreSQL connection URL
+}
+
+// Validate checks the session store configuration against the session keys
+func (c SessionStoreConfig) Validate(keys *SessionKeys) error {
+	switch c.Layout {
+	case LayoutPerSender:
+		return nil
+	case LayoutShared:
+	default:
+		return fmt.Errorf("invalid session store layout %q, expected %s or %s", c.Layout, LayoutPerSender, LayoutShared)
+	}
+	switch c.Dialect {
+	case "sqlite3":
+		return nil
+	case "postgres":
+		if c.Address == "" {
+			return errors.New("the shared PostgreSQL session store needs an address")
+		}
+		if keys != nil {
+			return errors.New("session encryption only applies to SQLite session stores, use PostgreSQL's encryption at rest instead")
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid session store dialect %q, expected sqlite3 or postgres", c.Dialect)
+	}
+}
+
+// SharedSQLitePath returns the file of the shared SQLite store, or an empty
+// string if the configuration does not use one
+func (c SessionStoreConfig) SharedSQLitePath() string {
+	if c.Layout != LayoutShared || c.Dialect != "sqlite3" {
+		return ""
+	}
+	if c.Address == "" {
+		return filepath.Join("db", "sessions.db")
+	}
+	return c.Address
+}
+
+// sharedStore is the one container that holds every sender's device in the
+// shared layout
+type sharedStore struct {
+	container *sqlstore.Container
+	db        *sql.DB
+	encrypted *encryptedStore // behind db when the SQLite store is encrypted
+}
+
+// openSharedStore opens and upgrades the shared session store
+func openSharedStore(config SessionStoreConfig, keys *SessionKeys) (*sharedStore, error) {
+	shared := &sharedStore{}
+	if path := config.SharedSQLitePath(); path != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create session store directory: %v", err)
+		}
+		if keys == nil {
+			if _, err := os.Stat(path + ".enc"); err == nil {
+				return nil, fmt.Errorf("shared session store %s is encrypted but no session key is configured", path)
+			}
+			db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_foreign_keys=on&_busy_timeout=5000&_journal_mode=WAL", path))
+			if err != nil {
+				return nil, err
+			}
+			shared.db = db
+		} else {
+			if _, err := os.Stat(path); err == nil {
+				return nil, fmt.Errorf("shared session store %s is not encrypted yet, stop the server and run \"auto-dm sessions encrypt\"", path)
+			}
+			encrypted, err := openEncryptedStore(path+".enc", sharedStoreName, keys)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open encrypted shared session store: %v", err)
+			}
+			shared.db, shared.encrypted = encrypted.db, encrypted
+		}
+	} else {
+		db, err := sql.Open(config.Dialect, config.Address)
+		if err != nil {
+			return nil, err
+		}
+		shared.db = db
+	}
+
+	shared.container = sqlstore.NewWithDB(shared.db, config.Dialect, nil)
+	if err := shared.container.Upgrade(context.Background()); err != nil {
+		shared.Close()
+		return nil, fmt.Errorf("failed to upgrade shared session store: %v", err)
+	}
+	return shared, nil
+}
+
+// device returns a sender's device in the shared store, looked up by the
+// sender's device JID, or by phone number when the JID is not known. It
+// returns a new device if the sender has none.
+func (s *sharedStore) device(ctx context.Context, phone, deviceID string) (*wastore.Device, error) {
+	if jid, err := types.ParseJID(deviceID); err == nil && deviceID != "" {
+		device, err := s.container.GetDevice(ctx, jid)
+		if device != nil || err != nil {
+			return device, err
+		}
+	}
+	devices, err := s.container.GetAllDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		if device.ID != nil && device.ID.User == phone {
+			return device, nil
+		}
+	}
+	return s.container.NewDevice(), nil
+}
+
+// Close closes the shared store, writing the last snapshot of an encrypted one
+func (s *sharedStore) Close() error {
+	if s.encrypted != nil {
+		return s.encrypted.Close()
+	}
+	return s.db.Close()
+}
+
+// MergedStore is the outcome of merging one per-sender store into the shared store
+type MergedStore struct {
+	Phone   string
+	Devices int
+	Rows    int64 // rows copied, not counting rows the shared store already had
+	Err     error
+}
+
+// MergeSessionStores copies every per-sender session store in the db
+// directory, devices with their keys, sessions and contacts, into the shared
+// store. Rows the shared store already has are kept, so a merge can be
+// repeated. The per-sender files are left in place. The server must not be
+// running.
+func MergeSessionStores(config SessionStoreConfig, keys *SessionKeys) ([]MergedStore, error) {
+	if config.Layout != LayoutShared {
+		return nil, errors.New("set the session store layout to shared before merging")
+	}
+	if err := config.Validate(keys); err != nil {
+		return nil, err
+	}
+	stores, err := ListSessionStores("")
+	if err != nil {
+		return nil, err
+	}
+	shared, err := openSharedStore(config, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	var merged []MergedStore
+	for _, source := range stores {
+		result := MergedStore{Phone: source.Phone}
+		result.Devices, result.Rows, result.Err = mergeSessionStore(source, keys, shared.db)
+		merged = append(merged, result)
+	}
+	return merged, shared.Close()
+}
+
+// mergeSessionStore copies one per-sender store into the shared store in one
+// transaction and returns how many devices it holds and how many rows were copied
+func mergeSessionStore(source SessionStore, keys *SessionKeys, dest *sql.DB) (int, int64, error) {
+	var db *sql.DB
+	if source.Encrypted {
+		if keys == nil {
+			return 0, 0, errors.New("store is encrypted but no session key is configured")
+		}
+		encrypted, err := openEncryptedStore(source.Path, source.Phone, keys)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer encrypted.Close()
+		db = encrypted.db
+	} else {
+		var err error
+		if db, err = sql.Open("sqlite3", fmt.Sprintf("file:%s?_foreign_keys=on", source.Path)); err != nil {
+			return 0, 0, err
+		}
+		defer db.Close()
+	}
+
+	// Both sides must have the same schema, so the source is upgraded first
+	if err := sqlstore.NewWithDB(db, "sqlite3", nil).Upgrade(context.Background()); err != nil {
+		return 0, 0, fmt.Errorf("failed to upgrade store: %v", err)
+	}
+	var devices int
+	if err := db.QueryRow("SELECT COUNT(*) FROM whatsmeow_device").Scan(&devices); err != nil {
+		return 0, 0, err
+	}
+
+	tx, err := dest.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	var copied int64
+	for _, table := range whatsmeowTables {
+		rows, err := copyTable(db, tx, table)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to copy %s: %v", table, err)
+		}
+		copied += rows
+	}
+	return devices, copied, tx.Commit()
+}
+
+// copyTable inserts the rows of a table that the destination does not have yet
+func copyTable(source *sql.DB, dest *sql.Tx, table string) (int64, error) {
+	rows, err := source.Query("SELECT * FROM " + table)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	placeholders := make([]string, len(columns))
+	for i := range columns {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ON CONFLICT DO NOTHING",
+		table, strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+
+	var copied int64
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(pointers...); err != nil {
+			return 0, err
+		}
+		result, err := dest.Exec(insert, values...)
+		if err != nil {
+			return 0, err
+		}
+		affected, _ := result.RowsAffected()
+		copied += affected
+	}
+	return copied, rows.Err()
+}
@@ -2,143 +2,690 @@ package store
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"go.mau.fi/whatsmeow"
+	wastore "go.mau.fi/whatsmeow/store"
 	"go.mau.fi/whatsmeow/store/sqlstore"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+
+	"github.com/jaliph/auto-dm/models"
 )
 
-// UserStoreManager manages individual user WhatsApp stores
+// SenderState is the lifecycle state of a sender's client and session store
+type SenderState string
+
+// Sender lifecycle states. A sender starts in StateCreating and ends in
+// StateClosed, after which the manager no longer tracks it.
+const (
+	StateCreating     SenderState = "creating"     // session store opening, client being built
+	StateConnecting   SenderState = "connecting"   // client connecting, or waiting for a QR code scan
+	StateConnected    SenderState = "connected"    // logged in to WhatsApp
+	StateDisconnected SenderState = "disconnected" // connection lost, whatsmeow reconnects on its own
+	StateLoggedOut    SenderState = "logged_out"   // unlinked from the phone, the sender must register again
+	StateClosed       SenderState = "closed"       // client disconnected and session store closed
+)
+
+// ErrManagerClosed is returned once CloseAll has run
+var ErrManagerClosed = errors.New("session stores are closed")
+
+// ErrUnlinkFailed is returned by LogoutUser when a linked device could not be
+// unlinked and the session store was kept
+var ErrUnlinkFailed = errors.New("failed to unlink device")
+
+// senderEntry is a sender's client and the session store behind it. Its
+// fields are guarded by the manager's mutex.
+type senderEntry struct {
+	state     SenderState
+	client    *whatsmeow.Client   // nil while creating
+	container *sqlstore.Container // the shared container in the shared layout
+	encrypted *encryptedStore     // in-memory store behind the container when encrypted
+}
+
+// UserStoreManager manages individual user WhatsApp stores. It is safe for
+// concurrent use; slow work such as opening stores and connecting happens
+// outside its lock.
 type UserStoreManager struct {
-	userClients map[string]*whatsmeow.Client   // phone -> client
-	containers  map[string]*sqlstore.Container // phone -> container
+	mu      sync.RWMutex
+	senders map[string]*senderEntry // phone -> client and store
+	closed  bool                    // set by CloseAll
+
+	keys   *SessionKeys // nil keeps session stores in plaintext
+	shared *sharedStore // every sender's container in the shared layout
+	config SessionStoreConfig
 }
 
-// NewUserStoreManager creates a new user store manager
-func NewUserStoreManager() *UserStoreManager {
-	return &UserStoreManager{
-		userClients: make(map[string]*whatsmeow.Client),
-		containers:  make(map[string]*sqlstore.Container),
+// NewUserStoreManager creates a new user store manager. In the shared layout
+// the shared session store is opened right away. With session keys, SQLite
+// session stores are encrypted at rest.
+func NewUserStoreManager(config SessionStoreConfig, keys *SessionKeys) (*UserStoreManager, error) {
+	if err := config.Validate(keys); err != nil {
+		return nil, err
+	}
+	usm := &UserStoreManager{
+		senders: make(map[string]*senderEntry),
+		keys:    keys,
+		config:  config,
 	}
+	if config.Layout == LayoutShared {
+		shared, err := openSharedStore(config, keys)
+		if err != nil {
+			return nil, err
+		}
+		usm.shared = shared
+	}
+	return usm, nil
 }
 
-// CreateUserStore creates a new WhatsApp store for a specific user (without connecting)
-func (usm *UserStoreManager) CreateUserStore(phone string) (*whatsmeow.Client, error) {
+// openContainer opens the whatsmeow store container of a sender. With session
+// encryption their store is decrypted into memory and returned with the
+// container. In the shared layout every sender gets the shared container.
+func (usm *UserStoreManager) openContainer(phone string) (*sqlstore.Container, *encryptedStore, error) {
+	if usm.shared != nil {
+		return usm.shared.container, nil, nil
+	}
+
 	// Ensure db directory exists
 	if err := os.MkdirAll("db", 0755); err != nil {
-		return nil, fmt.Errorf("failed to create db directory: %v", err)
+		return nil, nil, fmt.Errorf("failed to create db directory: %v", err)
+	}
+	dbPath := userStorePath(phone)
+
+	if usm.keys == nil {
+		if _, err := os.Stat(encryptedStorePath(phone)); err == nil {
+			return nil, nil, fmt.Errorf("session store of %s is encrypted but no session key is configured", phone)
+		}
+		container, err := sqlstore.New(context.Background(), "sqlite3", fmt.Sprintf("file:%s?_foreign_keys=on", dbPath), nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create user store container for %s: %v", phone, err)
+		}
+		return container, nil, nil
 	}
 
-	// Create user-specific database file (cross-platform)
-	dbPath := filepath.Join("db", fmt.Sprintf("user_%s.db", phone))
+	if _, err := os.Stat(dbPath); err == nil {
+		return nil, nil, fmt.Errorf("session store of %s is not encrypted yet, stop the server and run \"auto-dm sessions encrypt\"", phone)
+	}
+	store, err := openEncryptedStore(encryptedStorePath(phone), phone, usm.keys)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open encrypted session store for %s: %v", phone, err)
+	}
+	container := sqlstore.NewWithDB(store.db, "sqlite3", nil)
+	if err := container.Upgrade(context.Background()); err != nil {
+		store.Close()
+		return nil, nil, fmt.Errorf("failed to upgrade user store for %s: %v", phone, err)
+	}
+	return container, store, nil
+}
 
-	// Create the store container for this user
-	container, err := sqlstore.New(context.Background(), "sqlite3", fmt.Sprintf("file:%s?_foreign_keys=on", dbPath), nil)
+// closeEntry disconnects a sender's client and closes their store container.
+// An encrypted store writes its last snapshot first. The shared container
+// stays open for the other senders. The entry must already be out of the map.
+func (usm *UserStoreManager) closeEntry(phone string, entry *senderEntry) {
+	if entry.client != nil {
+		entry.client.Disconnect()
+	}
+	var err error
+	switch {
+	case entry.container == nil:
+	case usm.shared != nil && entry.container == usm.shared.container:
+	case entry.encrypted != nil:
+		err = entry.encrypted.Close()
+	default:
+		err = entry.container.Close()
+	}
 	if err != nil {
-		return nil, fmt.Errorf("failed to create user store container for %s: %v", phone, err)
+		slog.Warn("Failed to close user store", "sender", phone, "error", err)
 	}
+}
 
-	// Get the first device store for user (loads existing session)
-	deviceStore, err := container.GetFirstDevice(context.Background())
+// begin registers a sender as creating. A sender that is already tracked is
+// closed first so their store is never open twice, unless it is still being
+// created by another call.
+func (usm *UserStoreManager) begin(phone string) (*senderEntry, error) {
+	usm.mu.Lock()
+	if usm.closed {
+		usm.mu.Unlock()
+		return nil, ErrManagerClosed
+	}
+	previous, exists := usm.senders[phone]
+	if exists && previous.state == StateCreating {
+		usm.mu.Unlock()
+		return nil, fmt.Errorf("sender %s is already being set up", phone)
+	}
+	entry := &senderEntry{state: StateCreating}
+	usm.senders[phone] = entry
+	if exists {
+		previous.state = StateClosed
+	}
+	usm.mu.Unlock()
+
+	if exists {
+		usm.closeEntry(phone, previous)
+		slog.Info("Closed previous user client", "sender", phone)
+	}
+	return entry, nil
+}
+
+// create opens a sender's store and builds their client, leaving them
+// connecting. The store is only handed to the entry once it is complete, and
+// closed again if the sender was closed in the meantime. With requireDevice
+// the sender must already be linked.
+func (usm *UserStoreManager) create(phone, deviceID string, requireDevice bool) (*senderEntry, *whatsmeow.Client, error) {
+	entry, err := usm.begin(phone)
 	if err != nil {
+		return nil, nil, err
+	}
+
+	opened := &senderEntry{}
+	opened.container, opened.encrypted, err = usm.openContainer(phone)
+	if err != nil {
+		usm.abandon(phone, entry)
+		return nil, nil, err
+	}
+
+	// Get the device store for user (loads existing session)
+	deviceStore, err := usm.getDevice(opened.container, phone, deviceID)
+	switch {
+	case err != nil && !requireDevice:
 		// If no device exists, create a new one
-		log.Printf("No existing device found for %s, creating new one", phone)
-		deviceStore = container.NewDevice()
+		slog.Info("No existing device found, creating new one", "sender", phone)
+		deviceStore = opened.container.NewDevice()
+	case err != nil || deviceStore.ID == nil && requireDevice:
+		// If no device exists, this is unexpected for existing users
+		slog.Warn("User needs authentication, but this is unexpected for existing users", "sender", phone)
+		usm.abandon(phone, entry)
+		usm.closeEntry(phone, opened)
+		return nil, nil, fmt.Errorf("user %s needs authentication", phone)
+	}
+	opened.client = whatsmeow.NewClient(deviceStore, nil)
+	opened.client.AddEventHandler(usm.trackState(phone, opened.client))
+
+	usm.mu.Lock()
+	current := usm.senders[phone] == entry && entry.state == StateCreating
+	if current {
+		entry.client, entry.container, entry.encrypted = opened.client, opened.container, opened.encrypted
+		entry.state = StateConnecting
+	}
+	usm.mu.Unlock()
+	if !current {
+		usm.closeEntry(phone, opened)
+		return nil, nil, fmt.Errorf("sender %s was closed while being set up", phone)
 	}
+	return entry, opened.client, nil
+}
 
-	// Create user client (without connecting)
-	userClient := whatsmeow.NewClient(deviceStore, nil)
+// abandon removes a sender whose setup failed and closes what the entry
+// holds, unless someone else already closed it
+func (usm *UserStoreManager) abandon(phone string, entry *senderEntry) {
+	usm.mu.Lock()
+	owned := usm.senders[phone] == entry && entry.state != StateClosed
+	if owned {
+		delete(usm.senders, phone)
+		entry.state = StateClosed
+	}
+	usm.mu.Unlock()
 
-	// Store references
-	usm.userClients[phone] = userClient
-	usm.containers[phone] = container
+	if owned {
+		usm.closeEntry(phone, entry)
+	}
+}
 
-	log.Printf("Created user store for %s", phone)
-	return userClient, nil
+// trackState returns an event handler that follows a client's connection
+// state. Events of a client that was replaced or closed are ignored.
+func (usm *UserStoreManager) trackState(phone string, client *whatsmeow.Client) func(any) {
+	return func(evt any) {
+		var state SenderState
+		switch evt.(type) {
+		case *events.Connected:
+			state = StateConnected
+		case *events.Disconnected, *events.StreamReplaced, *events.KeepAliveTimeout:
+			state = StateDisconnected
+		case *events.LoggedOut:
+			state = StateLoggedOut
+		default:
+			return
+		}
+
+		usm.mu.Lock()
+		defer usm.mu.Unlock()
+		entry, exists := usm.senders[phone]
+		if !exists || entry.client != client || entry.state == StateClosed {
+			return
+		}
+		// A logged out client stays logged out until the sender registers again
+		if entry.state == StateLoggedOut && state != StateConnected {
+			return
+		}
+		entry.state = state
+	}
+}
+
+// CreateUserStore creates a new WhatsApp store for a specific user (without
+// connecting). The sender stays connecting until the QR code is scanned.
+func (usm *UserStoreManager) CreateUserStore(phone string) (*whatsmeow.Client, error) {
+	_, client, err := usm.create(phone, "", false)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Created user store", "sender", phone)
+	return client, nil
 }
 
-// GetUserClient returns a user client by phone number
+// getDevice returns a sender's device store, or a new one if they have none.
+// A per-sender container holds only their device; in the shared container it
+// is looked up by the sender's device JID.
+func (usm *UserStoreManager) getDevice(container *sqlstore.Container, phone, deviceID string) (*wastore.Device, error) {
+	if usm.shared != nil {
+		return usm.shared.device(context.Background(), phone, deviceID)
+	}
+	return container.GetFirstDevice(context.Background())
+}
+
+// GetUserClient returns a user client by phone number. Senders still being
+// created have no client yet.
 func (usm *UserStoreManager) GetUserClient(phone string) (*whatsmeow.Client, bool) {
-	client, exists := usm.userClients[phone]
-	return client, exists
+	usm.mu.RLock()
+	defer usm.mu.RUnlock()
+	entry, exists := usm.senders[phone]
+	if !exists || entry.client == nil {
+		return nil, false
+	}
+	return entry.client, true
 }
 
-// LoadUserStore loads an existing user store from database
-func (usm *UserStoreManager) LoadUserStore(phone, deviceID string) (*whatsmeow.Client, error) {
-	// Ensure db directory exists
-	if err := os.MkdirAll("db", 0755); err != nil {
-		return nil, fmt.Errorf("failed to create db directory: %v", err)
+// SenderState returns the lifecycle state of a sender, or false if the
+// manager does not track them
+func (usm *UserStoreManager) SenderState(phone string) (SenderState, bool) {
+	usm.mu.RLock()
+	defer usm.mu.RUnlock()
+	entry, exists := usm.senders[phone]
+	if !exists {
+		return "", false
 	}
+	return entry.state, true
+}
 
-	// Create user-specific database file (cross-platform)
-	dbPath := filepath.Join("db", fmt.Sprintf("user_%s.db", phone))
+// SenderStates returns a snapshot of the lifecycle state of every tracked sender
+func (usm *UserStoreManager) SenderStates() map[string]SenderState {
+	usm.mu.RLock()
+	defer usm.mu.RUnlock()
+	states := make(map[string]SenderState, len(usm.senders))
+	for phone, entry := range usm.senders {
+		states[phone] = entry.state
+	}
+	return states
+}
 
-	// Create the store container for this user
-	container, err := sqlstore.New(context.Background(), "sqlite3", fmt.Sprintf("file:%s?_foreign_keys=on", dbPath), nil)
+// LoadUserStore loads an existing user store from database and connects it
+func (usm *UserStoreManager) LoadUserStore(phone, deviceID string) (*whatsmeow.Client, error) {
+	entry, userClient, err := usm.create(phone, deviceID, true)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create user store container for %s: %v", phone, err)
+		return nil, err
 	}
 
-	// Get the first device store for user (loads existing session)
-	deviceStore, err := container.GetFirstDevice(context.Background())
-	if err != nil {
-		// If no device exists, this is unexpected for existing users
-		log.Printf("User %s needs authentication, but this is unexpected for existing users", phone)
-		return nil, fmt.Errorf("user %s needs authentication", phone)
+	// User is already authenticated, connect them
+	slog.Info("User already authenticated", "sender", phone, "device_id", userClient.Store.ID.String())
+
+	// Connect the already authenticated user client
+	if err := userClient.Connect(); err != nil {
+		usm.abandon(phone, entry)
+		return nil, fmt.Errorf("failed to connect authenticated user client for %s: %v", phone, err)
 	}
+	slog.Info("User connected successfully", "sender", phone)
 
-	// Create user client
-	userClient := whatsmeow.NewClient(deviceStore, nil)
+	slog.Info("Loaded user store", "sender", phone)
+	return userClient, nil
+}
 
-	// Check if user is already authenticated
-	if userClient.Store.ID == nil {
-		// User needs to authenticate - this shouldn't happen for existing users
-		// but we'll handle it gracefully
-		log.Printf("User %s needs authentication, but this is unexpected for existing users", phone)
-		return nil, fmt.Errorf("user %s needs authentication", phone)
-	} else {
-		// User is already authenticated, connect them
-		log.Printf("User %s already authenticated as: %s", phone, userClient.Store.ID)
+// DisconnectUser disconnects a user client and closes their session store
+func (usm *UserStoreManager) DisconnectUser(phone string) {
+	usm.mu.Lock()
+	entry, exists := usm.senders[phone]
+	if exists {
+		delete(usm.senders, phone)
+		entry.state = StateClosed
+	}
+	usm.mu.Unlock()
 
-		// Connect the already authenticated user client
-		if err := userClient.Connect(); err != nil {
-			return nil, fmt.Errorf("failed to connect authenticated user client for %s: %v", phone, err)
-		}
-		log.Printf("User %s connected successfully", phone)
+	if exists {
+		usm.closeEntry(phone, entry)
+		slog.Info("Disconnected user client", "sender", phone)
 	}
+}
 
-	// Store references
-	usm.userClients[phone] = userClient
-	usm.containers[phone] = container
+// unlinkTimeout bounds how long LogoutUser waits for a sender that was not
+// connected to log in, so their device can be unlinked
+const unlinkTimeout = 20 * time.Second
 
-	log.Printf("Loaded user store for %s", phone)
-	return userClient, nil
+// LogoutResult reports whether LogoutUser unlinked a sender's device
+type LogoutResult struct {
+	Linked      bool   // the sender had a linked device
+	Unlinked    bool   // the device was removed from the sender's phone
+	UnlinkError string // why it was not, the phone then lists it until it is removed there
+	Forced      bool   // the session store was deleted although the device was not unlinked
 }
 
-// DisconnectUser disconnects a user client
-func (usm *UserStoreManager) DisconnectUser(phone string) {
-	if client, exists := usm.userClients[phone]; exists {
-		client.Disconnect()
-		delete(usm.userClients, phone)
-		log.Printf("Disconnected user client: %s", phone)
+// LogoutUser unlinks a sender's device from their phone and deletes their
+// session store. WhatsApp only accepts the unlink from the device itself, so
+// a sender that is not logged in is connected first: a tracked client is
+// reconnected in place, an untracked sender is loaded for the unlink only. If
+// the unlink fails, for example because the phone already removed the
+// device, the store is kept and ErrUnlinkFailed is returned, unless force is
+// set, in which case the store is deleted anyway and the reason is reported
+// in the result.
+func (usm *UserStoreManager) LogoutUser(ctx context.Context, phone, deviceID string, force bool) (LogoutResult, error) {
+	var result LogoutResult
+	client, exists := usm.GetUserClient(phone)
+	result.Linked = exists && client.Store.ID != nil || deviceID != ""
+	temporary := false
+	switch {
+	case !result.Linked || exists && client.IsLoggedIn():
+	case exists && client.Store.ID != nil:
+		// The tracked client keeps its event handlers, so it is reconnected
+		// rather than replaced
+		if err := client.Connect(); err != nil && !errors.Is(err, whatsmeow.ErrAlreadyConnected) {
+			result.UnlinkError = err.Error()
+		} else if !client.WaitForConnection(unlinkTimeout) {
+			result.UnlinkError = "timed out waiting for the client to log in"
+		}
+	case exists:
+		result.UnlinkError = "the sender is registering again, its linked device is not loaded"
+	default:
+		loaded, err := usm.LoadUserStore(phone, deviceID)
+		switch {
+		case err != nil:
+			result.UnlinkError = err.Error()
+		case !loaded.WaitForConnection(unlinkTimeout):
+			result.UnlinkError = "timed out waiting for the client to log in"
+		}
+		client, temporary = loaded, err == nil
+	}
+	if result.Linked && result.UnlinkError == "" {
+		// Logout also deletes the device from the session store
+		if err := client.Logout(ctx); err != nil {
+			result.UnlinkError = err.Error()
+		} else {
+			result.Unlinked = true
+		}
+	}
+	if result.UnlinkError != "" && !force {
+		slog.Warn("Failed to unlink device, keeping the session store", "sender", phone, "error", result.UnlinkError)
+		// A client loaded only for the unlink is not left connected
+		if temporary {
+			usm.DisconnectUser(phone)
+		}
+		return result, fmt.Errorf("%w of %s: %s", ErrUnlinkFailed, phone, result.UnlinkError)
+	}
+	if result.UnlinkError != "" {
+		result.Forced = true
+		slog.Warn("Failed to unlink device, deleting the session store as forced", "sender", phone, "error", result.UnlinkError)
+	}
+
+	usm.DisconnectUser(phone)
+	if err := usm.deleteUserStore(ctx, phone, deviceID); err != nil {
+		return result, fmt.Errorf("failed to delete session store of %s: %v", phone, err)
+	}
+	slog.Info("Logged out user", "sender", phone, "unlinked", result.Unlinked, "forced", result.Forced)
+	return result, nil
+}
+
+// deleteUserStore deletes a sender's session store: their files in the
+// per-sender layout, or their device in the shared store. The sender must
+// already be disconnected.
+func (usm *UserStoreManager) deleteUserStore(ctx context.Context, phone, deviceID string) error {
+	usm.mu.RLock()
+	closed, shared := usm.closed, usm.shared
+	usm.mu.RUnlock()
+	if closed {
+		return ErrManagerClosed
+	}
+
+	if shared == nil {
+		if err := removePlaintextStore(userStorePath(phone)); err != nil {
+			return err
+		}
+		if err := os.Remove(encryptedStorePath(phone)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	device, err := shared.device(ctx, phone, deviceID)
+	if err != nil || device.ID == nil {
+		return err
 	}
+	return shared.container.DeleteDevice(ctx, device)
 }
 
-// GetAllUserClients returns all user clients
+// GetAllUserClients returns a snapshot of the user clients by phone number.
+// Senders still being created are left out.
 func (usm *UserStoreManager) GetAllUserClients() map[string]*whatsmeow.Client {
-	return usm.userClients
+	usm.mu.RLock()
+	defer usm.mu.RUnlock()
+	clients := make(map[string]*whatsmeow.Client, len(usm.senders))
+	for phone, entry := range usm.senders {
+		if entry.client != nil {
+			clients[phone] = entry.client
+		}
+	}
+	return clients
 }
 
-// CloseAll closes all user stores
+// CloseAll disconnects all user clients and then closes their session
+// databases. The manager cannot be used afterwards.
 func (usm *UserStoreManager) CloseAll() {
-	for phone, client := range usm.userClients {
-		client.Disconnect()
-		log.Printf("Disconnected user client: %s", phone)
+	usm.mu.Lock()
+	senders := usm.senders
+	usm.senders = make(map[string]*senderEntry)
+	usm.closed = true
+	for _, entry := range senders {
+		entry.state = StateClosed
 	}
-	usm.userClients = make(map[string]*whatsmeow.Client)
-	usm.containers = make(map[string]*sqlstore.Container)
+	shared := usm.shared
+	usm.mu.Unlock()
+
+	// Every client is disconnected before any store is closed, so no client
+	// writes to a closed store
+	for phone, entry := range senders {
+		if entry.client != nil {
+			entry.client.Disconnect()
+			slog.Info("Disconnected user client", "sender", phone)
+		}
+	}
+	for phone, entry := range senders {
+		usm.closeEntry(phone, entry)
+	}
+	if shared != nil {
+		if err := shared.Close(); err != nil {
+			slog.Warn("Failed to close shared session store", "error", err)
+		}
+	}
+}
+
+// userStorePath returns the session database file of a sender
+func userStorePath(phone string) string {
+	return filepath.Join("db", fmt.Sprintf("user_%s.db", phone))
+}
+
+// withUserStoreDB runs fn on a sender's session database for reading and
+// erasing contact data, which the whatsmeow store has no API for. fn gets
+// the LIKE pattern of the sender's own JIDs, to tell their rows apart in the
+// shared store. Plaintext stores get a second connection; an encrypted store
+// is used through the open in-memory copy, or decrypted just for fn. fn is
+// not called if the sender has no session database.
+func (usm *UserStoreManager) withUserStoreDB(phone string, fn func(db *sql.DB, owner string) error) error {
+	if usm.shared != nil {
+		return fn(usm.shared.db, phone+":%")
+	}
+	usm.mu.RLock()
+	entry, exists := usm.senders[phone]
+	var open *encryptedStore
+	if exists {
+		open = entry.encrypted
+	}
+	usm.mu.RUnlock()
+	if open != nil {
+		return fn(open.db, "%")
+	}
+
+	if usm.keys != nil {
+		if _, err := os.Stat(encryptedStorePath(phone)); os.IsNotExist(err) {
+			return nil
+		}
+		store, err := openEncryptedStore(encryptedStorePath(phone), phone, usm.keys)
+		if err != nil {
+			return err
+		}
+		err = fn(store.db, "%")
+		if closeErr := store.Close(); err == nil {
+			err = closeErr
+		}
+		return err
+	}
+
+	path := userStorePath(phone)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?_foreign_keys=on&_busy_timeout=5000", path))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return fn(db, "%")
+}
+
+// contactJIDs returns the JIDs a sender's store may know a contact by: their
+// phone number JID and, once WhatsApp has told us, their LID
+func contactJIDs(db *sql.DB, contactPhone string) ([]string, string, error) {
+	jids := []string{types.NewJID(contactPhone, types.DefaultUserServer).String()}
+	var lid string
+	err := db.QueryRow("SELECT lid FROM whatsmeow_lid_map WHERE pn = $1", contactPhone).Scan(&lid)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return nil, "", fmt.Errorf("failed to look up LID: %v", err)
+	default:
+		jids = append(jids, types.NewJID(lid, types.HiddenUserServer).String())
+	}
+	return jids, lid, nil
+}
+
+// contactKnownToOthers reports whether a device in the shared store other than
+// owner's still holds names, settings, tokens, secrets or encryption sessions
+// for a contact, and so still needs the contact's LID mapping
+func contactKnownToOthers(tx *sql.Tx, owner, contactPhone, lid string, jids []string) (bool, error) {
+	var known bool
+	err := tx.QueryRow(`SELECT
+		EXISTS (SELECT 1 FROM whatsmeow_contacts WHERE our_jid NOT LIKE $1 AND their_jid IN ($2, $3))
+		OR EXISTS (SELECT 1 FROM whatsmeow_chat_settings WHERE our_jid NOT LIKE $1 AND chat_jid IN ($2, $3))
+		OR EXISTS (SELECT 1 FROM whatsmeow_privacy_tokens WHERE our_jid NOT LIKE $1 AND their_jid IN ($2, $3))
+		OR EXISTS (SELECT 1 FROM whatsmeow_message_secrets WHERE our_jid NOT LIKE $1 AND (chat_jid IN ($2, $3) OR sender_jid IN ($2, $3)))
+		OR EXISTS (SELECT 1 FROM whatsmeow_sessions WHERE our_jid NOT LIKE $1 AND (their_id LIKE $4 OR their_id LIKE $5))`,
+		owner, jids[0], jids[len(jids)-1], contactPhone+":%", lid+"_1:%").Scan(&known)
+	if err != nil {
+		return false, fmt.Errorf("failed to check other senders for contact: %v", err)
+	}
+	return known, nil
+}
+
+// GetContactAttributes returns the names a sender's session store holds for a contact
+func (usm *UserStoreManager) GetContactAttributes(senderPhone, contactPhone string) ([]models.ContactAttributes, error) {
+	var contacts []models.ContactAttributes
+	err := usm.withUserStoreDB(senderPhone, func(db *sql.DB, owner string) error {
+		jids, _, err := contactJIDs(db, contactPhone)
+		if err != nil {
+			return err
+		}
+
+		rows, err := db.Query(`SELECT their_jid, first_name, full_name, push_name, business_name
+			FROM whatsmeow_contacts WHERE our_jid LIKE $1 AND their_jid IN ($2, $3)`, owner, jids[0], jids[len(jids)-1])
+		if err != nil {
+			return fmt.Errorf("failed to query contacts: %v", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var firstName, fullName, pushName, businessName sql.NullString
+			contact := models.ContactAttributes{Sender: senderPhone}
+			if err := rows.Scan(&contact.JID, &firstName, &fullName, &pushName, &businessName); err != nil {
+				return fmt.Errorf("failed to scan contact: %v", err)
+			}
+			contact.FirstName, contact.FullName = firstName.String, fullName.String
+			contact.PushName, contact.BusinessName = pushName.String, businessName.String
+			contacts = append(contacts, contact)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return contacts, nil
+}
+
+// EraseContact deletes the names, chat settings, privacy tokens, message
+// secrets and LID mapping a sender's session store holds for a contact, and
+// returns how many contact entries were deleted. Encryption sessions and
+// identity keys are kept so messaging the contact keeps working. In the
+// shared store the LID mapping is kept while other senders still need it.
+func (usm *UserStoreManager) EraseContact(senderPhone, contactPhone string) (int64, error) {
+	var contacts int64
+	err := usm.withUserStoreDB(senderPhone, func(db *sql.DB, owner string) error {
+		jids, lid, err := contactJIDs(db, contactPhone)
+		if err != nil {
+			return err
+		}
+		first, last := jids[0], jids[len(jids)-1]
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		result, err := tx.Exec("DELETE FROM whatsmeow_contacts WHERE our_jid LIKE $1 AND their_jid IN ($2, $3)", owner, first, last)
+		if err != nil {
+			return fmt.Errorf("failed to delete contact: %v", err)
+		}
+		deleted, _ := result.RowsAffected()
+
+		statements := []string{
+			"DELETE FROM whatsmeow_chat_settings WHERE our_jid LIKE $1 AND chat_jid IN ($2, $3)",
+			"DELETE FROM whatsmeow_privacy_tokens WHERE our_jid LIKE $1 AND their_jid IN ($2, $3)",
+			"DELETE FROM whatsmeow_message_secrets WHERE our_jid LIKE $1 AND (chat_jid IN ($2, $3) OR sender_jid IN ($2, $3))",
+		}
+		for _, statement := range statements {
+			if _, err := tx.Exec(statement, owner, first, last); err != nil {
+				return fmt.Errorf("failed to erase contact data: %v", err)
+			}
+		}
+		// The shared store has one LID map for all senders, so the mapping is
+		// only deleted once no other sender holds data for the contact
+		keepLID := false
+		if lid != "" && usm.shared != nil {
+			if keepLID, err = contactKnownToOthers(tx, owner, contactPhone, lid, jids); err != nil {
+				return err
+			}
+		}
+		if lid != "" && !keepLID {
+			if _, err := tx.Exec("DELETE FROM whatsmeow_lid_map WHERE pn = $1", contactPhone); err != nil {
+				return fmt.Errorf("failed to delete LID mapping: %v", err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		contacts = deleted
+		return nil
+	})
+	return contacts, err
 }
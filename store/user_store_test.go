@@ -0,0 +1,132 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestManager returns a manager with per-sender plaintext stores in a
+// temporary working directory
+func newTestManager(t *testing.T) *UserStoreManager {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	usm, err := NewUserStoreManager(SessionStoreConfig{Layout: LayoutPerSender}, nil)
+	if err != nil {
+		t.Fatalf("failed to create user store manager: %v", err)
+	}
+	return usm
+}
+
+// expectedCreateError reports whether a failed create lost a race the test provokes
+func expectedCreateError(err error) bool {
+	return errors.Is(err, ErrManagerClosed) ||
+		strings.Contains(err.Error(), "is already being set up") ||
+		strings.Contains(err.Error(), "was closed while being set up")
+}
+
+func TestUserStoreManagerLifecycle(t *testing.T) {
+	usm := newTestManager(t)
+
+	client, err := usm.CreateUserStore("919876543210")
+	if err != nil {
+		t.Fatalf("failed to create user store: %v", err)
+	}
+	if state, ok := usm.SenderState("919876543210"); !ok || state != StateConnecting {
+		t.Errorf("state = %s, %v, want %s", state, ok, StateConnecting)
+	}
+	if got, ok := usm.GetUserClient("919876543210"); !ok || got != client {
+		t.Error("expected the created client to be tracked")
+	}
+
+	// Creating again replaces the client instead of opening the store twice
+	replacement, err := usm.CreateUserStore("919876543210")
+	if err != nil {
+		t.Fatalf("failed to recreate user store: %v", err)
+	}
+	if got, _ := usm.GetUserClient("919876543210"); got != replacement || got == client {
+		t.Error("expected the new client to replace the old one")
+	}
+
+	usm.DisconnectUser("919876543210")
+	if _, ok := usm.SenderState("919876543210"); ok {
+		t.Error("expected a disconnected sender to be forgotten")
+	}
+
+	usm.CloseAll()
+	if _, err := usm.CreateUserStore("919876543210"); !errors.Is(err, ErrManagerClosed) {
+		t.Errorf("create after CloseAll = %v, want %v", err, ErrManagerClosed)
+	}
+}
+
+func TestUserStoreManagerConcurrent(t *testing.T) {
+	usm := newTestManager(t)
+	phones := make([]string, 6)
+	for i := range phones {
+		phones[i] = fmt.Sprintf("91987654321%d", i)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 1000)
+	for worker := 0; worker < 4; worker++ {
+		for _, phone := range phones {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 5; i++ {
+					if _, err := usm.CreateUserStore(phone); err != nil && !expectedCreateError(err) {
+						errs <- err
+					}
+					usm.GetAllUserClients()
+					usm.SenderStates()
+					if i%2 == worker%2 {
+						usm.DisconnectUser(phone)
+					}
+				}
+			}()
+		}
+	}
+
+	// Readers run throughout and CloseAll lands while creates are in flight
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			for phone, client := range usm.GetAllUserClients() {
+				if client == nil {
+					errs <- fmt.Errorf("nil client listed for %s", phone)
+				}
+			}
+			for phone, state := range usm.SenderStates() {
+				if state == StateClosed {
+					errs <- fmt.Errorf("closed sender %s is still tracked", phone)
+				}
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for _, phone := range phones[:3] {
+			usm.DisconnectUser(phone)
+		}
+		usm.CloseAll()
+	}()
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if states := usm.SenderStates(); len(states) != 0 {
+		t.Errorf("senders still tracked after CloseAll: %v", states)
+	}
+	if clients := usm.GetAllUserClients(); len(clients) != 0 {
+		t.Errorf("clients still listed after CloseAll: %d", len(clients))
+	}
+	if _, err := usm.CreateUserStore(phones[0]); !errors.Is(err, ErrManagerClosed) {
+		t.Errorf("create after CloseAll = %v, want %v", err, ErrManagerClosed)
+	}
+}
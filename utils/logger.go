@@ -1,27 +1,206 @@
 package utils
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"log/slog"
 	"os"
+	"regexp"
+	"strings"
 	"sync"
 )
 
-var Logger *slog.Logger
+// Logger is the application logger. Init also installs it as the slog default,
+// so packages log through slog's top-level functions.
+var Logger = slog.Default()
 var once sync.Once
 
-func Init(level string) {
+// Init sets up the application logger with a level ("debug", "info", "warn" or
+// "error"), a format ("text" or "json") and optional redaction of phone numbers
+// and message bodies
+func Init(level, format string, redact bool) {
 	once.Do(func() {
-		switch level {
-		case "debug":
-			Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
-		case "info":
-			Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
-		case "warn":
-			Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn}))
-		case "error":
-			Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
-		default:
-			Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+		options := &slog.HandlerOptions{Level: parseLevel(level)}
+
+		var handler slog.Handler
+		if format == "json" {
+			handler = slog.NewJSONHandler(os.Stderr, options)
+		} else {
+			handler = slog.NewTextHandler(os.Stderr, options)
 		}
+		// Request IDs are added below redaction so they are never masked
+		handler = &contextHandler{next: handler}
+		if redact {
+			handler = &redactHandler{next: handler}
+		}
+
+		Logger = slog.New(handler)
+		slog.SetDefault(Logger)
 	})
 }
+
+func parseLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+type requestIDKey struct{}
+
+// NewRequestID generates a random ID for correlating the log lines of a request
+func NewRequestID() string {
+	bytes := make([]byte, 8)
+	if _, err := rand.Read(bytes); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(bytes)
+}
+
+// ContextWithRequestID returns a context whose log lines carry the request ID
+func ContextWithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestIDFromContext returns the request ID of a context, or "" outside a request
+func RequestIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// contextHandler adds the request ID of the logging context to each record
+type contextHandler struct {
+	next slog.Handler
+}
+
+func (h *contextHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if requestID := RequestIDFromContext(ctx); requestID != "" {
+		record.AddAttrs(slog.String("request_id", requestID))
+	}
+	return h.next.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{next: h.next.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{next: h.next.WithGroup(name)}
+}
+
+// phoneKeys hold phone numbers, which keep their last digits when redacted
+var phoneKeys = map[string]bool{
+	"sender":    true,
+	"recipient": true,
+	"phone":     true,
+	"from":      true,
+	"voter":     true,
+	"contact":   true,
+	"chat":      true,
+}
+
+// bodyKeys hold message contents, which are replaced entirely when redacted
+var bodyKeys = map[string]bool{
+	"content":  true,
+	"message":  true,
+	"question": true,
+	"reaction": true,
+	"file":     true,
+	"link":     true,
+}
+
+// phonePattern finds phone numbers inside free text such as error messages
+var phonePattern = regexp.MustCompile(`\d{7,}`)
+
+// redactHandler masks phone numbers and message bodies before records are written
+type redactHandler struct {
+	next slog.Handler
+}
+
+func (h *redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactHandler) Handle(ctx context.Context, record slog.Record) error {
+	redacted := slog.NewRecord(record.Time, record.Level, maskPhones(record.Message), record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(redactAttr(attr))
+		return true
+	})
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, attr := range attrs {
+		redacted[i] = redactAttr(attr)
+	}
+	return &redactHandler{next: h.next.WithAttrs(redacted)}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{next: h.next.WithGroup(name)}
+}
+
+// redactAttr masks the value of one attribute according to its key
+func redactAttr(attr slog.Attr) slog.Attr {
+	value := attr.Value.Resolve()
+	switch value.Kind() {
+	case slog.KindGroup:
+		group := value.Group()
+		redacted := make([]any, len(group))
+		for i, member := range group {
+			redacted[i] = redactAttr(member)
+		}
+		return slog.Group(attr.Key, redacted...)
+	case slog.KindString, slog.KindAny:
+		text := value.String()
+		if err, ok := value.Any().(error); ok {
+			text = err.Error()
+		}
+		switch {
+		case bodyKeys[attr.Key]:
+			return slog.String(attr.Key, fmt.Sprintf("[redacted %d chars]", len(text)))
+		case phoneKeys[attr.Key]:
+			return slog.String(attr.Key, maskPhone(text))
+		default:
+			return slog.String(attr.Key, maskPhones(text))
+		}
+	}
+	return slog.Attr{Key: attr.Key, Value: value}
+}
+
+// maskPhones masks every phone number inside a piece of text
+func maskPhones(text string) string {
+	return phonePattern.ReplaceAllStringFunc(text, maskPhone)
+}
+
+// maskPhone masks a phone number or JID, keeping the last four digits of the
+// number and any @server suffix, e.g. "******7890@s.whatsapp.net"
+func maskPhone(phone string) string {
+	user, server, hasServer := strings.Cut(phone, "@")
+	if len(user) > 4 {
+		user = strings.Repeat("*", len(user)-4) + user[len(user)-4:]
+	} else if user != "" {
+		user = "****"
+	}
+	if hasServer {
+		return user + "@" + server
+	}
+	return user
+}
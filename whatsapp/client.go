@@ -3,9 +3,9 @@ package whatsapp
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
-	"sync"
+	"strings"
 	"time"
 
 	"go.mau.fi/whatsmeow"
@@ -15,6 +15,9 @@ import (
 	"google.golang.org/protobuf/proto"
 
 	"github.com/jaliph/auto-dm/database"
+	"github.com/jaliph/auto-dm/eventbus"
+	"github.com/jaliph/auto-dm/metrics"
+	"github.com/jaliph/auto-dm/models"
 	"github.com/jaliph/auto-dm/store"
 )
 
@@ -24,20 +27,51 @@ type ClientManager struct {
 	db               *database.Database
 	gormDB           *database.GormDB
 	messageHandler   *MessageHandler
-	clientToPhone    map[*whatsmeow.Client]string // Maps client to phone number
-	mu               sync.RWMutex
+	historyImporter  *HistoryImporter
+	eventBus         *eventbus.Bus
 }
 
 // NewClientManager creates a new WhatsApp client manager
-func NewClientManager(userStoreManager *store.UserStoreManager, db *database.Database, gormDB *database.GormDB) *ClientManager {
-	messageHandler := NewMessageHandler(gormDB)
-	return &ClientManager{
+func NewClientManager(userStoreManager *store.UserStoreManager, db *database.Database, gormDB *database.GormDB, eventBus *eventbus.Bus, historyImport bool, historyLookbackDays int) *ClientManager {
+	messageHandler := NewMessageHandler(gormDB, eventBus)
+	cm := &ClientManager{
 		userStoreManager: userStoreManager,
 		db:               db,
 		gormDB:           gormDB,
 		messageHandler:   messageHandler,
-		clientToPhone:    make(map[*whatsmeow.Client]string),
+		historyImporter:  NewHistoryImporter(gormDB, messageHandler, historyImport, historyLookbackDays),
+		eventBus:         eventBus,
 	}
+	metrics.Senders.SetSource(cm.senderStatusCounts)
+	metrics.SenderClients.SetSource(cm.senderClientCounts)
+	return cm
+}
+
+// senderStatusCounts counts the senders in the senders table by status for /metrics
+func (cm *ClientManager) senderStatusCounts() map[string]float64 {
+	senders, err := cm.db.GetAllSenders()
+	if err != nil {
+		slog.Warn("Failed to load senders for metrics", "error", err)
+		return nil
+	}
+	counts := make(map[string]float64)
+	for _, sender := range senders {
+		counts[sender.Status]++
+	}
+	return counts
+}
+
+// senderClientCounts counts the loaded clients by connection state for /metrics
+func (cm *ClientManager) senderClientCounts() map[string]float64 {
+	counts := map[string]float64{"connected": 0, "disconnected": 0}
+	for _, client := range cm.userStoreManager.GetAllUserClients() {
+		if client.IsConnected() {
+			counts["connected"]++
+		} else {
+			counts["disconnected"]++
+		}
+	}
+	return counts
 }
 
 // LoadAllSenders loads all previously registered senders from database
@@ -48,67 +82,182 @@ func (cm *ClientManager) LoadAllSenders() error {
 	}
 
 	if len(senders) == 0 {
-		log.Println("No registered senders found")
+		slog.Info("No registered senders found")
 		return nil
 	}
 
-	log.Printf("Found %d registered senders, attempting auto-authentication...", len(senders))
+	slog.Info("Found registered senders, attempting auto-authentication", "count", len(senders))
 
 	successCount := 0
 	for _, sender := range senders {
+		// Paused senders stay disconnected until they are resumed
+		if sender.Status == "paused" {
+			slog.Info("Sender is paused, not connecting", "sender", sender.Phone)
+			continue
+		}
 		// Try to authenticate any sender that has a device_id
 		if sender.DeviceID != "" {
-			log.Printf("Attempting to authenticate sender %s with device_id %s (current status: %s)",
-				sender.Phone, sender.DeviceID, sender.Status)
-
-			userClient, err := cm.userStoreManager.LoadUserStore(sender.Phone, sender.DeviceID)
-			if err != nil {
-				log.Printf("Failed to auto-authenticate sender %s: %v", sender.Phone, err)
-				// Mark as invalidated if we can't load the client
-				cm.db.UpdateSenderStatus(sender.Phone, "invalidated")
-				continue
-			}
-
-			// Check if client is connected
-			if userClient.IsConnected() {
-				// Register message handler for user client with phone number
-				userClient.AddEventHandler(cm.createMessageHandler(sender.Phone))
-				// Store client to phone mapping
-				cm.mu.Lock()
-				cm.clientToPhone[userClient] = sender.Phone
-				cm.mu.Unlock()
-				// Update status to authenticated
-				cm.db.UpdateSenderStatus(sender.Phone, "authenticated")
+			if cm.connectSender(sender) == nil {
 				successCount++
-				log.Printf("✅ Auto-authenticated sender: %s", sender.Phone)
-			} else {
-				log.Printf("⚠️  Sender %s client loaded but not connected", sender.Phone)
-				cm.db.UpdateSenderStatus(sender.Phone, "invalidated")
 			}
 		} else {
-			log.Printf("⚠️  Sender %s has no device_id (status: %s)", sender.Phone, sender.Status)
+			slog.Warn("Sender has no device_id", "sender", sender.Phone, "status", sender.Status)
 		}
 	}
 
-	log.Printf("Successfully auto-authenticated %d/%d sender clients", successCount, len(senders))
+	slog.Info("Finished auto-authenticating sender clients", "authenticated", successCount, "total", len(senders))
 	return nil
 }
 
+// connectSender loads a linked sender's session store and connects their
+// client. The sender is marked authenticated, or invalidated if it fails.
+func (cm *ClientManager) connectSender(sender *models.Sender) error {
+	slog.Info("Attempting to authenticate sender", "sender", sender.Phone, "device_id", sender.DeviceID, "status", sender.Status)
+
+	userClient, err := cm.userStoreManager.LoadUserStore(sender.Phone, sender.DeviceID)
+	if err != nil {
+		slog.Warn("Failed to auto-authenticate sender", "sender", sender.Phone, "error", err)
+		// Mark as invalidated if we can't load the client
+		cm.db.UpdateSenderStatus(sender.Phone, "invalidated")
+		return err
+	}
+
+	// Check if client is connected
+	if !userClient.IsConnected() {
+		slog.Warn("Sender client loaded but not connected", "sender", sender.Phone)
+		cm.db.UpdateSenderStatus(sender.Phone, "invalidated")
+		return fmt.Errorf("client of %s loaded but not connected", sender.Phone)
+	}
+
+	// Register message handler for user client with phone number
+	cm.RegisterClient(sender.Phone, userClient)
+	// Update status to authenticated
+	cm.db.UpdateSenderStatus(sender.Phone, "authenticated")
+	slog.Info("Auto-authenticated sender", "sender", sender.Phone)
+	return nil
+}
+
+// PauseSender disconnects a sender and keeps them disconnected across
+// restarts. Their device stays linked and their session store is kept, so
+// ResumeSender can connect them again without a QR code.
+func (cm *ClientManager) PauseSender(phone string) error {
+	if err := cm.db.UpdateSenderStatus(phone, "paused"); err != nil {
+		return err
+	}
+	cm.userStoreManager.DisconnectUser(phone)
+	slog.Info("Paused sender", "sender", phone)
+	return nil
+}
+
+// ResumeSender connects a paused sender again
+func (cm *ClientManager) ResumeSender(phone string) error {
+	sender, err := cm.db.GetSender(phone)
+	if err != nil {
+		return err
+	}
+	if sender.Status != "paused" {
+		return fmt.Errorf("sender %s is not paused", phone)
+	}
+	if sender.DeviceID == "" {
+		return fmt.Errorf("sender %s was never linked, register it again", phone)
+	}
+	return cm.connectSender(sender)
+}
+
+// RegisterClient adds the message handler and reconnect hook to a sender's client
+func (cm *ClientManager) RegisterClient(phone string, client *whatsmeow.Client) {
+	client.AddEventHandler(cm.createMessageHandler(phone))
+	// whatsmeow calls the hook after each failed reconnect and retries while it returns true
+	client.AutoReconnectHook = func(err error) bool {
+		metrics.ReconnectAttempts.WithLabelValues("failed").Inc()
+		slog.Warn("Reconnect attempt failed", "sender", phone, "attempt", client.AutoReconnectErrors, "error", err)
+		return true
+	}
+}
+
+// GetHistoryImportProgress returns the history import progress of a sender
+func (cm *ClientManager) GetHistoryImportProgress(phone string) (*models.HistoryImportProgress, bool) {
+	return cm.historyImporter.GetProgress(phone)
+}
+
+// GetAllHistoryImportProgress returns the history import progress of all senders
+func (cm *ClientManager) GetAllHistoryImportProgress() []models.HistoryImportProgress {
+	return cm.historyImporter.GetAllProgress()
+}
+
 // createMessageHandler creates a message handler for a specific authenticated sender
 func (cm *ClientManager) createMessageHandler(authenticatedSenderPhone string) func(interface{}) {
+	// Set after a disconnect, so the next connection counts as a successful reconnect
+	reconnecting := false
+
 	return func(evt interface{}) {
 		switch v := evt.(type) {
 		case *events.Message:
+			// Poll votes are encrypted and need the sender's client to be read
+			if v.Message.GetPollUpdateMessage() != nil {
+				client, exists := cm.userStoreManager.GetUserClient(authenticatedSenderPhone)
+				if !exists {
+					return
+				}
+				if err := cm.messageHandler.HandlePollUpdate(client, v, authenticatedSenderPhone); err != nil {
+					slog.Error("Failed to store poll vote", "sender", authenticatedSenderPhone, "chat", v.Info.Chat.String(), "error", err)
+				}
+				return
+			}
+
 			// Store message in database with the authenticated sender's phone number
 			if err := cm.messageHandler.HandleMessageEvent(v, authenticatedSenderPhone); err != nil {
-				log.Printf("Failed to store user message: %v", err)
+				slog.Error("Failed to store user message", "sender", authenticatedSenderPhone, "chat", v.Info.Chat.String(), "error", err)
+			}
+
+		case *events.HistorySync:
+			client, exists := cm.userStoreManager.GetUserClient(authenticatedSenderPhone)
+			if !exists {
+				return
+			}
+			cm.historyImporter.HandleHistorySync(client, v, authenticatedSenderPhone)
+
+		case *events.Receipt:
+			receiptType := string(v.Type)
+			if v.Type == types.ReceiptTypeDelivered {
+				receiptType = "delivered"
+			}
+			// Receipts from the recipients of our messages feed the delivery and read rates
+			if !v.IsFromMe {
+				if err := cm.gormDB.UpdateMessageReceipts(v.MessageIDs, receiptType, v.Timestamp); err != nil {
+					slog.Error("Failed to store receipt", "sender", authenticatedSenderPhone, "chat", v.Chat.String(), "type", receiptType, "error", err)
+				}
+			}
+			cm.eventBus.Publish(models.EventReceipt, authenticatedSenderPhone, &models.ReceiptEvent{
+				Type:       receiptType,
+				MessageIDs: v.MessageIDs,
+				ChatID:     v.Chat.String(),
+				From:       v.Sender.User,
+				Timestamp:  v.Timestamp,
+			})
+
+		case *events.Connected:
+			if reconnecting {
+				metrics.ReconnectAttempts.WithLabelValues("success").Inc()
+				reconnecting = false
 			}
+			cm.eventBus.Publish(models.EventConnection, authenticatedSenderPhone, &models.ConnectionEvent{Status: "connected"})
+
+		case *events.Disconnected:
+			reconnecting = true
+			cm.eventBus.Publish(models.EventConnection, authenticatedSenderPhone, &models.ConnectionEvent{Status: "disconnected"})
+
+		case *events.LoggedOut:
+			cm.eventBus.Publish(models.EventConnection, authenticatedSenderPhone, &models.ConnectionEvent{
+				Status: "logged_out",
+				Reason: v.Reason.String(),
+			})
 		}
 	}
 }
 
 // MonitorConnections periodically checks if clients are still connected
-func (cm *ClientManager) MonitorConnections() {
+func (cm *ClientManager) MonitorConnections(ctx context.Context) {
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
 
@@ -116,96 +265,462 @@ func (cm *ClientManager) MonitorConnections() {
 		select {
 		case <-ticker.C:
 			cm.checkConnections()
-			// Periodically sync to MSSQL
-			cm.syncToMSSQL()
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
 // checkConnections checks the connection status of all user clients
 func (cm *ClientManager) checkConnections() {
-	cm.mu.RLock()
-	defer cm.mu.RUnlock()
-
+	// A snapshot, so no lock is held while the senders table is updated
 	userClients := cm.userStoreManager.GetAllUserClients()
 	for phone, client := range userClients {
 		if !client.IsConnected() {
-			log.Printf("🔴 Client %s is disconnected", phone)
+			slog.Warn("Client is disconnected", "sender", phone)
 			// Mark sender as invalidated in SQLite (which will sync to MSSQL)
 			cm.db.UpdateSenderStatus(phone, "invalidated")
 		}
 	}
 }
 
-// syncToMSSQL periodically syncs all senders from SQLite to MSSQL
-func (cm *ClientManager) syncToMSSQL() {
-	if err := cm.gormDB.ForceSyncAllSenders(cm.db); err != nil {
-		log.Printf("Warning: Failed to sync senders to MSSQL: %v", err)
+// SendTextOptions holds the optional reply and mention settings for a text message
+type SendTextOptions struct {
+	QuotedMessage *models.Message // message being replied to
+	Mentions      []string        // phone numbers to @mention (group chats), each must be an @phone token in the text
+	LinkPreview   bool            // attach a preview of the first link in the text
+}
+
+// MissingMentions returns the mentioned phone numbers that are not in the text
+// as an @phone token. WhatsApp only renders a mention when its token is in the text.
+func MissingMentions(text string, mentions []string) []string {
+	var missing []string
+	for _, phone := range mentions {
+		if !hasMentionToken(text, phone) {
+			missing = append(missing, phone)
+		}
 	}
+	return missing
 }
 
-// SendMessage sends a WhatsApp message using a registered user client
-func (cm *ClientManager) SendMessage(senderPhone, recipient, message string) error {
-	cm.mu.RLock()
+// hasMentionToken reports whether text holds @phone not followed by another digit
+func hasMentionToken(text, phone string) bool {
+	token := "@" + phone
+	for i := strings.Index(text, token); i >= 0; {
+		end := i + len(token)
+		if end == len(text) || text[end] < '0' || text[end] > '9' {
+			return true
+		}
+		next := strings.Index(text[end:], token)
+		if next < 0 {
+			return false
+		}
+		i = end + next
+	}
+	return false
+}
+
+// quotedMessage rebuilds a stored message for the quote of a reply, so a reply
+// to a media, location, contact or poll message quotes it as that kind
+func quotedMessage(quoted *models.Message) *waProto.Message {
+	payload := quoted.Payload
+	if payload == nil {
+		payload = &models.MessagePayload{}
+	}
+	optional := func(value string) *string {
+		if value == "" {
+			return nil
+		}
+		return proto.String(value)
+	}
+
+	switch quoted.MessageType {
+	case "image":
+		return &waProto.Message{ImageMessage: &waProto.ImageMessage{
+			Caption:  optional(payload.Caption),
+			Mimetype: optional(payload.MimeType),
+		}}
+	case "video":
+		return &waProto.Message{VideoMessage: &waProto.VideoMessage{
+			Caption:     optional(payload.Caption),
+			Mimetype:    optional(payload.MimeType),
+			Seconds:     proto.Uint32(payload.Seconds),
+			GifPlayback: proto.Bool(payload.Gif),
+		}}
+	case "audio":
+		return &waProto.Message{AudioMessage: &waProto.AudioMessage{
+			Mimetype: optional(payload.MimeType),
+			Seconds:  proto.Uint32(payload.Seconds),
+			PTT:      proto.Bool(payload.Voice),
+		}}
+	case "document", "file":
+		fileName := payload.FileName
+		if fileName == "" {
+			// Files sent through the API store their name as the content
+			fileName = quoted.Content
+		}
+		return &waProto.Message{DocumentMessage: &waProto.DocumentMessage{
+			FileName: optional(fileName),
+			Caption:  optional(payload.Caption),
+			Mimetype: optional(payload.MimeType),
+		}}
+	case "sticker":
+		return &waProto.Message{StickerMessage: &waProto.StickerMessage{
+			Mimetype:   optional(payload.MimeType),
+			IsAnimated: proto.Bool(payload.Animated),
+		}}
+	case "contact", "contacts":
+		var contacts []*waProto.ContactMessage
+		for _, vcard := range payload.VCards {
+			contacts = append(contacts, &waProto.ContactMessage{Vcard: proto.String(vcard)})
+		}
+		if quoted.MessageType == "contacts" {
+			return &waProto.Message{ContactsArrayMessage: &waProto.ContactsArrayMessage{
+				DisplayName: proto.String(quoted.Content),
+				Contacts:    contacts,
+			}}
+		}
+		contact := &waProto.ContactMessage{DisplayName: proto.String(quoted.Content)}
+		if len(contacts) > 0 {
+			contact.Vcard = contacts[0].Vcard
+		}
+		return &waProto.Message{ContactMessage: contact}
+	case "location":
+		return &waProto.Message{LocationMessage: &waProto.LocationMessage{
+			DegreesLatitude:  payload.Latitude,
+			DegreesLongitude: payload.Longitude,
+			Name:             optional(payload.LocationName),
+			Address:          optional(payload.Address),
+		}}
+	case "live_location":
+		return &waProto.Message{LiveLocationMessage: &waProto.LiveLocationMessage{
+			DegreesLatitude:  payload.Latitude,
+			DegreesLongitude: payload.Longitude,
+			Caption:          optional(payload.Caption),
+		}}
+	case "poll":
+		poll := &waProto.PollCreationMessage{
+			Name:                   proto.String(quoted.Content),
+			SelectableOptionsCount: proto.Uint32(payload.SelectableCount),
+		}
+		for _, option := range payload.PollOptions {
+			poll.Options = append(poll.Options, &waProto.PollCreationMessage_Option{OptionName: proto.String(option)})
+		}
+		return &waProto.Message{PollCreationMessage: poll}
+	}
+	return &waProto.Message{Conversation: proto.String(quoted.Content)}
+}
+
+// RecipientJID converts a recipient into a WhatsApp JID. Plain phone numbers map
+// to user chats, full JIDs (e.g. "1203630...@g.us") are parsed as is.
+func RecipientJID(recipient string) (types.JID, error) {
+	if strings.Contains(recipient, "@") {
+		jid, err := types.ParseJID(recipient)
+		if err != nil {
+			return types.JID{}, fmt.Errorf("invalid recipient %s: %v", recipient, err)
+		}
+		return jid, nil
+	}
+	return types.JID{
+		User:   recipient,
+		Server: types.DefaultUserServer,
+	}, nil
+}
+
+// getConnectedClient returns the client of a registered and connected sender
+func (cm *ClientManager) getConnectedClient(senderPhone string) (*whatsmeow.Client, error) {
 	client, exists := cm.userStoreManager.GetUserClient(senderPhone)
-	cm.mu.RUnlock()
 
 	if !exists {
-		return fmt.Errorf("sender %s is not registered", senderPhone)
+		metrics.SendFailures.WithLabelValues("not_registered").Inc()
+		return nil, fmt.Errorf("sender %s is not registered", senderPhone)
 	}
 
 	if !client.IsConnected() {
-		return fmt.Errorf("sender %s is not connected", senderPhone)
+		metrics.SendFailures.WithLabelValues("not_connected").Inc()
+		return nil, fmt.Errorf("sender %s is not connected", senderPhone)
+	}
+	return client, nil
+}
+
+// recipientJID converts a recipient into a JID for sending, counting invalid recipients as failed sends
+func recipientJID(recipient string) (types.JID, error) {
+	jid, err := RecipientJID(recipient)
+	if err != nil {
+		metrics.SendFailures.WithLabelValues("invalid_recipient").Inc()
+	}
+	return jid, err
+}
+
+// sendMessage sends a prepared message from a sender's client, recording the
+// outcome and latency by message type. It returns the WhatsApp ID of the sent message.
+func (cm *ClientManager) sendMessage(ctx context.Context, client *whatsmeow.Client, senderPhone, messageType string, to types.JID, msg *waProto.Message) (string, error) {
+	start := time.Now()
+	// A send that reached WhatsApp must not be abandoned because the API client went away
+	resp, err := client.SendMessage(context.WithoutCancel(ctx), to, msg)
+	if err != nil {
+		metrics.SendFailures.WithLabelValues("send_failed").Inc()
+		return "", err
+	}
+
+	metrics.SendLatency.WithLabelValues(messageType).Observe(time.Since(start).Seconds())
+	metrics.MessagesSent.WithLabelValues(messageType).Inc()
+	return resp.ID, nil
+}
+
+// SendMessage sends a WhatsApp message using a registered user client
+func (cm *ClientManager) SendMessage(senderPhone, recipient, message string) (string, error) {
+	return cm.SendTextMessage(context.Background(), senderPhone, recipient, message, nil)
+}
+
+// SendTextMessage sends a text message, optionally quoting a previous message and
+// mentioning participants. It returns the WhatsApp ID of the sent message.
+func (cm *ClientManager) SendTextMessage(ctx context.Context, senderPhone, recipient, message string, opts *SendTextOptions) (string, error) {
+	client, err := cm.getConnectedClient(senderPhone)
+	if err != nil {
+		return "", err
+	}
+
+	to, err := recipientJID(recipient)
+	if err != nil {
+		return "", err
 	}
 
 	// Create message
+	var msg *waProto.Message
+	if opts == nil || (opts.QuotedMessage == nil && len(opts.Mentions) == 0 && !opts.LinkPreview) {
+		msg = &waProto.Message{
+			Conversation: proto.String(message),
+		}
+	} else {
+		contextInfo := &waProto.ContextInfo{}
+
+		if quoted := opts.QuotedMessage; quoted != nil {
+			contextInfo.StanzaID = proto.String(quoted.MessageID)
+			contextInfo.Participant = proto.String(cm.participantJID(client, quoted).String())
+			contextInfo.QuotedMessage = quotedMessage(quoted)
+		}
+
+		// The API rejects mentions whose @phone token is not in the text, see MissingMentions
+		for _, phone := range opts.Mentions {
+			contextInfo.MentionedJID = append(contextInfo.MentionedJID, types.NewJID(phone, types.DefaultUserServer).String())
+		}
+
+		extendedText := &waProto.ExtendedTextMessage{
+			Text:        proto.String(message),
+			ContextInfo: contextInfo,
+		}
+		if opts.LinkPreview {
+			addLinkPreview(ctx, extendedText)
+		}
+
+		msg = &waProto.Message{
+			ExtendedTextMessage: extendedText,
+		}
+	}
+
+	// Send message
+	messageID, err := cm.sendMessage(ctx, client, senderPhone, "text", to, msg)
+	if err != nil {
+		return "", fmt.Errorf("failed to send message: %v", err)
+	}
+
+	slog.InfoContext(ctx, "Message sent", "sender", senderPhone, "chat", to.String(), "message_id", messageID)
+	slog.DebugContext(ctx, "Sent message details", "sender", senderPhone, "chat", to.String(), "message_id", messageID, "type", "text", "content_length", len(message))
+	return messageID, nil
+}
+
+// SendLocation sends a location pin with an optional name and address
+func (cm *ClientManager) SendLocation(ctx context.Context, senderPhone, recipient string, location *models.Location) (string, error) {
+	msg := &waProto.Message{
+		LocationMessage: &waProto.LocationMessage{
+			DegreesLatitude:  proto.Float64(location.Latitude),
+			DegreesLongitude: proto.Float64(location.Longitude),
+		},
+	}
+	if location.Name != "" {
+		msg.LocationMessage.Name = proto.String(location.Name)
+	}
+	if location.Address != "" {
+		msg.LocationMessage.Address = proto.String(location.Address)
+	}
+
+	messageID, err := cm.sendToRecipient(ctx, senderPhone, recipient, "location", msg)
+	if err != nil {
+		return "", fmt.Errorf("failed to send location: %v", err)
+	}
+
+	slog.InfoContext(ctx, "Location sent", "sender", senderPhone, "chat", recipient, "message_id", messageID)
+	return messageID, nil
+}
+
+// SendContact sends a contact card built from the given fields
+func (cm *ClientManager) SendContact(ctx context.Context, senderPhone, recipient string, contact *models.ContactCard) (string, error) {
 	msg := &waProto.Message{
+		ContactMessage: &waProto.ContactMessage{
+			DisplayName: proto.String(contact.Name),
+			Vcard:       proto.String(BuildVCard(contact)),
+		},
+	}
+
+	messageID, err := cm.sendToRecipient(ctx, senderPhone, recipient, "contact", msg)
+	if err != nil {
+		return "", fmt.Errorf("failed to send contact: %v", err)
+	}
+
+	slog.InfoContext(ctx, "Contact sent", "sender", senderPhone, "chat", recipient, "message_id", messageID)
+	return messageID, nil
+}
+
+// SendPoll sends a poll. Single-select polls allow one option, multi-select polls any number.
+func (cm *ClientManager) SendPoll(ctx context.Context, senderPhone, recipient string, poll *models.PollRequest) (string, error) {
+	client, err := cm.getConnectedClient(senderPhone)
+	if err != nil {
+		return "", err
+	}
+
+	to, err := recipientJID(recipient)
+	if err != nil {
+		return "", err
+	}
+
+	selectableCount := 1
+	if poll.MultiSelect {
+		selectableCount = 0
+	}
+
+	messageID, err := cm.sendMessage(ctx, client, senderPhone, "poll", to, client.BuildPollCreation(poll.Question, poll.Options, selectableCount))
+	if err != nil {
+		return "", fmt.Errorf("failed to send poll: %v", err)
+	}
+
+	slog.InfoContext(ctx, "Poll sent", "sender", senderPhone, "chat", recipient, "message_id", messageID)
+	return messageID, nil
+}
+
+// sendToRecipient sends a prepared message from a connected sender to a recipient
+func (cm *ClientManager) sendToRecipient(ctx context.Context, senderPhone, recipient, messageType string, msg *waProto.Message) (string, error) {
+	client, err := cm.getConnectedClient(senderPhone)
+	if err != nil {
+		return "", err
+	}
+
+	to, err := recipientJID(recipient)
+	if err != nil {
+		return "", err
+	}
+
+	return cm.sendMessage(ctx, client, senderPhone, messageType, to, msg)
+}
+
+// SendReaction reacts to a stored message with an emoji. An empty reaction removes
+// a previously sent one.
+func (cm *ClientManager) SendReaction(ctx context.Context, senderPhone string, target *models.Message, reaction string) (string, error) {
+	client, err := cm.getConnectedClient(senderPhone)
+	if err != nil {
+		return "", err
+	}
+
+	chat, err := types.ParseJID(target.ChatID)
+	if err != nil {
+		return "", fmt.Errorf("invalid chat ID %s: %v", target.ChatID, err)
+	}
+
+	msg := client.BuildReaction(chat, cm.participantJID(client, target), target.MessageID, reaction)
+	messageID, err := cm.sendMessage(ctx, client, senderPhone, "reaction", chat, msg)
+	if err != nil {
+		return "", fmt.Errorf("failed to send reaction: %v", err)
+	}
+
+	slog.InfoContext(ctx, "Reaction sent", "sender", senderPhone, "chat", target.ChatID, "target_id", target.MessageID)
+	return messageID, nil
+}
+
+// EditMessage replaces the text of a message previously sent by the sender
+func (cm *ClientManager) EditMessage(ctx context.Context, senderPhone string, target *models.Message, message string) (string, error) {
+	client, err := cm.getConnectedClient(senderPhone)
+	if err != nil {
+		return "", err
+	}
+
+	chat, err := types.ParseJID(target.ChatID)
+	if err != nil {
+		return "", fmt.Errorf("invalid chat ID %s: %v", target.ChatID, err)
+	}
+
+	msg := client.BuildEdit(chat, target.MessageID, &waProto.Message{
 		Conversation: proto.String(message),
+	})
+	messageID, err := cm.sendMessage(ctx, client, senderPhone, "edit", chat, msg)
+	if err != nil {
+		return "", fmt.Errorf("failed to edit message: %v", err)
 	}
 
-	// Send message
-	_, err := client.SendMessage(context.Background(), types.JID{
-		User:   recipient,
-		Server: types.DefaultUserServer,
-	}, msg)
+	slog.InfoContext(ctx, "Message edited", "sender", senderPhone, "chat", target.ChatID, "target_id", target.MessageID)
+	return messageID, nil
+}
+
+// RevokeMessage deletes a message previously sent by the sender for everyone
+func (cm *ClientManager) RevokeMessage(ctx context.Context, senderPhone string, target *models.Message) (string, error) {
+	client, err := cm.getConnectedClient(senderPhone)
 	if err != nil {
-		return fmt.Errorf("failed to send message: %v", err)
+		return "", err
 	}
 
-	log.Printf("Message sent from %s to %s: %s", senderPhone, recipient, message)
-	return nil
+	chat, err := types.ParseJID(target.ChatID)
+	if err != nil {
+		return "", fmt.Errorf("invalid chat ID %s: %v", target.ChatID, err)
+	}
+
+	msg := client.BuildRevoke(chat, types.EmptyJID, target.MessageID)
+	messageID, err := cm.sendMessage(ctx, client, senderPhone, "revoke", chat, msg)
+	if err != nil {
+		return "", fmt.Errorf("failed to revoke message: %v", err)
+	}
+
+	slog.InfoContext(ctx, "Message revoked", "sender", senderPhone, "chat", target.ChatID, "target_id", target.MessageID)
+	return messageID, nil
 }
 
-// SendFile sends a WhatsApp file using a registered user client
-func (cm *ClientManager) SendFile(senderPhone, recipient, filePath string) error {
-	cm.mu.RLock()
-	client, exists := cm.userStoreManager.GetUserClient(senderPhone)
-	cm.mu.RUnlock()
+// participantJID returns the JID of the author of a stored message
+func (cm *ClientManager) participantJID(client *whatsmeow.Client, message *models.Message) types.JID {
+	if message.IsFromMe && client.Store.ID != nil {
+		return client.Store.ID.ToNonAD()
+	}
+	return types.NewJID(message.SenderPhone, types.DefaultUserServer)
+}
 
-	if !exists {
-		return fmt.Errorf("sender %s is not registered", senderPhone)
+// SendFile sends a WhatsApp file using a registered user client
+func (cm *ClientManager) SendFile(ctx context.Context, senderPhone, recipient, filePath string) (string, error) {
+	client, err := cm.getConnectedClient(senderPhone)
+	if err != nil {
+		return "", err
 	}
 
-	if !client.IsConnected() {
-		return fmt.Errorf("sender %s is not connected", senderPhone)
+	to, err := recipientJID(recipient)
+	if err != nil {
+		return "", err
 	}
 
 	// Read file
 	fileData, err := os.ReadFile(filePath)
 	if err != nil {
-		return fmt.Errorf("failed to read file: %v", err)
+		metrics.SendFailures.WithLabelValues("file_error").Inc()
+		return "", fmt.Errorf("failed to read file: %v", err)
 	}
 
 	// Get file info
 	fileInfo, err := os.Stat(filePath)
 	if err != nil {
-		return fmt.Errorf("failed to get file info: %v", err)
+		metrics.SendFailures.WithLabelValues("file_error").Inc()
+		return "", fmt.Errorf("failed to get file info: %v", err)
 	}
 
 	// Upload file to WhatsApp
-	uploaded, err := client.Upload(context.Background(), fileData, whatsmeow.MediaDocument)
+	uploaded, err := client.Upload(context.WithoutCancel(ctx), fileData, whatsmeow.MediaDocument)
 	if err != nil {
-		return fmt.Errorf("failed to upload file: %v", err)
+		metrics.SendFailures.WithLabelValues("upload_failed").Inc()
+		return "", fmt.Errorf("failed to upload file: %v", err)
 	}
 
 	// Create document message
@@ -223,19 +738,16 @@ func (cm *ClientManager) SendFile(senderPhone, recipient, filePath string) error
 	}
 
 	// Send file
-	_, err = client.SendMessage(context.Background(), types.JID{
-		User:   recipient,
-		Server: types.DefaultUserServer,
-	}, msg)
+	messageID, err := cm.sendMessage(ctx, client, senderPhone, "file", to, msg)
 	if err != nil {
-		return fmt.Errorf("failed to send file: %v", err)
+		return "", fmt.Errorf("failed to send file: %v", err)
 	}
 
-	log.Printf("File sent from %s to %s: %s", senderPhone, recipient, fileInfo.Name())
-	return nil
+	slog.InfoContext(ctx, "File sent", "sender", senderPhone, "chat", to.String(), "file", fileInfo.Name(), "message_id", messageID)
+	return messageID, nil
 }
 
-// Shutdown gracefully shuts down all clients
+// Shutdown disconnects all clients and closes their session stores
 func (cm *ClientManager) Shutdown() {
 	cm.userStoreManager.CloseAll()
 }
@@ -0,0 +1,42 @@
+package whatsapp
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/jaliph/auto-dm/models"
+)
+
+func TestMissingMentions(t *testing.T) {
+	tests := []struct {
+		text     string
+		mentions []string
+		want     []string
+	}{
+		{"Noted @919876543210", []string{"919876543210"}, nil},
+		{"@919876543210, see above", []string{"919876543210"}, nil},
+		{"Noted", []string{"919876543210"}, []string{"919876543210"}},
+		{"Noted @9198765432101", []string{"919876543210"}, []string{"919876543210"}},
+		{"@9198765432101 and @919876543210", []string{"919876543210"}, nil},
+		{"Hi @919876543210", []string{"919876543210", "919123456780"}, []string{"919123456780"}},
+	}
+	for _, test := range tests {
+		if got := MissingMentions(test.text, test.mentions); !slices.Equal(got, test.want) {
+			t.Errorf("MissingMentions(%q, %v) = %v, want %v", test.text, test.mentions, got, test.want)
+		}
+	}
+}
+
+func TestQuotedMessage(t *testing.T) {
+	// Every recorded kind is quoted as the same kind it was stored as
+	for _, fixture := range []string{"ephemeral_text", "view_once_image", "document", "document_caption", "location", "contact", "contacts_array", "poll_creation"} {
+		t.Run(fixture, func(t *testing.T) {
+			decoded := DecodeMessage(loadMessageFixture(t, fixture))
+			stored := &models.Message{MessageType: decoded.Type, Content: decoded.Content, Payload: decoded.Payload}
+			quoted := DecodeMessage(quotedMessage(stored))
+			if quoted.Type != decoded.Type || quoted.Content != decoded.Content {
+				t.Errorf("quoted as %s %q, want %s %q", quoted.Type, quoted.Content, decoded.Type, decoded.Content)
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package whatsapp
+
+import (
+	"fmt"
+	"reflect"
+
+	"go.mau.fi/whatsmeow/proto/waE2E"
+
+	"github.com/jaliph/auto-dm/models"
+)
+
+// maxUnwrapDepth guards against malformed messages nesting wrappers endlessly
+const maxUnwrapDepth = 10
+
+// DecodedMessage holds everything extracted from a WhatsApp message
+type DecodedMessage struct {
+	Message         *waE2E.Message // innermost message after unwrapping
+	Type            string
+	Content         string
+	MediaURL        string
+	ParentMessageID string
+	Payload         *models.MessagePayload
+}
+
+// DecodeMessage unwraps ephemeral, view-once, edited and other wrapper messages
+// and extracts the type, text content, media URL and structured fields
+func DecodeMessage(msg *waE2E.Message) *DecodedMessage {
+	payload := &models.MessagePayload{}
+	msg = unwrapMessage(msg, payload)
+
+	decoded := &DecodedMessage{
+		Message: msg,
+		Type:    "unknown",
+		Payload: payload,
+	}
+	if msg == nil {
+		decoded.Payload = nil
+		return decoded
+	}
+
+	var contextInfo *waE2E.ContextInfo
+
+	switch {
+	case msg.ProtocolMessage != nil:
+		protocol := msg.ProtocolMessage
+		switch protocol.GetType() {
+		case waE2E.ProtocolMessage_MESSAGE_EDIT:
+			decoded.Type = "edit"
+			if edited := protocol.GetEditedMessage(); edited != nil {
+				decoded.Content = DecodeMessage(edited).Content
+			}
+		case waE2E.ProtocolMessage_REVOKE:
+			decoded.Type = "revoke"
+		default:
+			decoded.Type = "protocol"
+		}
+		decoded.ParentMessageID = protocol.GetKey().GetID()
+
+	case msg.ReactionMessage != nil:
+		decoded.Type = "reaction"
+		decoded.Content = msg.ReactionMessage.GetText()
+		decoded.ParentMessageID = msg.ReactionMessage.GetKey().GetID()
+
+	case msg.Conversation != nil:
+		decoded.Type = "text"
+		decoded.Content = msg.GetConversation()
+
+	case msg.ExtendedTextMessage != nil:
+		text := msg.ExtendedTextMessage
+		decoded.Type = "text"
+		decoded.Content = text.GetText()
+		payload.LinkURL = text.GetMatchedText()
+		payload.LinkTitle = text.GetTitle()
+		payload.LinkDescription = text.GetDescription()
+		contextInfo = text.GetContextInfo()
+
+	case msg.ImageMessage != nil:
+		image := msg.ImageMessage
+		decoded.Type = "image"
+		decoded.Content = image.GetCaption()
+		decoded.MediaURL = image.GetURL()
+		payload.Caption = image.GetCaption()
+		payload.MimeType = image.GetMimetype()
+		payload.FileLength = image.GetFileLength()
+		payload.Width = image.GetWidth()
+		payload.Height = image.GetHeight()
+		contextInfo = image.GetContextInfo()
+
+	case msg.VideoMessage != nil:
+		video := msg.VideoMessage
+		decoded.Type = "video"
+		decoded.Content = video.GetCaption()
+		decoded.MediaURL = video.GetURL()
+		payload.Caption = video.GetCaption()
+		payload.MimeType = video.GetMimetype()
+		payload.FileLength = video.GetFileLength()
+		payload.Seconds = video.GetSeconds()
+		payload.Width = video.GetWidth()
+		payload.Height = video.GetHeight()
+		payload.Gif = video.GetGifPlayback()
+		contextInfo = video.GetContextInfo()
+
+	case msg.AudioMessage != nil:
+		audio := msg.AudioMessage
+		decoded.Type = "audio"
+		decoded.MediaURL = audio.GetURL()
+		payload.MimeType = audio.GetMimetype()
+		payload.FileLength = audio.GetFileLength()
+		payload.Seconds = audio.GetSeconds()
+		payload.Voice = audio.GetPTT()
+		contextInfo = audio.GetContextInfo()
+
+	case msg.DocumentMessage != nil:
+		document := msg.DocumentMessage
+		decoded.Type = "document"
+		decoded.Content = document.GetCaption()
+		if decoded.Content == "" {
+			decoded.Content = document.GetFileName()
+		}
+		decoded.MediaURL = document.GetURL()
+		payload.Caption = document.GetCaption()
+		payload.FileName = document.GetFileName()
+		payload.MimeType = document.GetMimetype()
+		payload.FileLength = document.GetFileLength()
+		payload.PageCount = document.GetPageCount()
+		contextInfo = document.GetContextInfo()
+
+	case msg.StickerMessage != nil:
+		sticker := msg.StickerMessage
+		decoded.Type = "sticker"
+		decoded.MediaURL = sticker.GetURL()
+		payload.MimeType = sticker.GetMimetype()
+		payload.FileLength = sticker.GetFileLength()
+		payload.Animated = sticker.GetIsAnimated()
+		contextInfo = sticker.GetContextInfo()
+
+	case msg.ContactMessage != nil:
+		contact := msg.ContactMessage
+		decoded.Type = "contact"
+		decoded.Content = contact.GetDisplayName()
+		payload.ContactName = contact.GetDisplayName()
+		payload.VCards = []string{contact.GetVcard()}
+		contextInfo = contact.GetContextInfo()
+
+	case msg.ContactsArrayMessage != nil:
+		contacts := msg.ContactsArrayMessage
+		decoded.Type = "contacts"
+		decoded.Content = contacts.GetDisplayName()
+		payload.ContactName = contacts.GetDisplayName()
+		for _, contact := range contacts.GetContacts() {
+			payload.VCards = append(payload.VCards, contact.GetVcard())
+		}
+		contextInfo = contacts.GetContextInfo()
+
+	case msg.LocationMessage != nil:
+		location := msg.LocationMessage
+		decoded.Type = "location"
+		decoded.Content = formatLocation(location.GetName(), location.GetAddress(), location.GetDegreesLatitude(), location.GetDegreesLongitude())
+		payload.Latitude = location.DegreesLatitude
+		payload.Longitude = location.DegreesLongitude
+		payload.LocationName = location.GetName()
+		payload.Address = location.GetAddress()
+		payload.LocationURL = location.GetURL()
+		contextInfo = location.GetContextInfo()
+
+	case msg.LiveLocationMessage != nil:
+		location := msg.LiveLocationMessage
+		decoded.Type = "live_location"
+		decoded.Content = location.GetCaption()
+		payload.Caption = location.GetCaption()
+		payload.Latitude = location.DegreesLatitude
+		payload.Longitude = location.DegreesLongitude
+		contextInfo = location.GetContextInfo()
+
+	case msg.ButtonsResponseMessage != nil:
+		response := msg.ButtonsResponseMessage
+		decoded.Type = "button_response"
+		decoded.Content = response.GetSelectedDisplayText()
+		payload.SelectedID = response.GetSelectedButtonID()
+		payload.SelectedDisplayText = response.GetSelectedDisplayText()
+		contextInfo = response.GetContextInfo()
+
+	case msg.TemplateButtonReplyMessage != nil:
+		response := msg.TemplateButtonReplyMessage
+		decoded.Type = "button_response"
+		decoded.Content = response.GetSelectedDisplayText()
+		payload.SelectedID = response.GetSelectedID()
+		payload.SelectedDisplayText = response.GetSelectedDisplayText()
+		contextInfo = response.GetContextInfo()
+
+	case msg.ListResponseMessage != nil:
+		response := msg.ListResponseMessage
+		decoded.Type = "list_response"
+		decoded.Content = response.GetTitle()
+		payload.SelectedID = response.GetSingleSelectReply().GetSelectedRowID()
+		payload.SelectedDisplayText = response.GetTitle()
+		contextInfo = response.GetContextInfo()
+
+	case msg.InteractiveResponseMessage != nil:
+		response := msg.InteractiveResponseMessage
+		decoded.Type = "interactive_response"
+		decoded.Content = response.GetBody().GetText()
+		payload.SelectedID = response.GetNativeFlowResponseMessage().GetName()
+		payload.SelectedDisplayText = response.GetBody().GetText()
+		payload.ResponseParams = response.GetNativeFlowResponseMessage().GetParamsJSON()
+		contextInfo = response.GetContextInfo()
+
+	case getPollCreation(msg) != nil:
+		poll := getPollCreation(msg)
+		decoded.Type = "poll"
+		decoded.Content = poll.GetName()
+		payload.PollOptions = pollOptionNames(poll)
+		payload.SelectableCount = poll.GetSelectableOptionsCount()
+		contextInfo = poll.GetContextInfo()
+
+	case msg.PollUpdateMessage != nil:
+		decoded.Type = "poll_vote"
+		decoded.ParentMessageID = msg.PollUpdateMessage.GetPollCreationMessageKey().GetID()
+	}
+
+	// Replies and mentions live in the context info of the inner message
+	if contextInfo != nil {
+		decoded.ParentMessageID = contextInfo.GetStanzaID()
+		payload.Mentions = contextInfo.GetMentionedJID()
+	}
+
+	if reflect.ValueOf(*payload).IsZero() {
+		decoded.Payload = nil
+	}
+	return decoded
+}
+
+// unwrapMessage strips the wrapper messages and records which ones were present
+func unwrapMessage(msg *waE2E.Message, payload *models.MessagePayload) *waE2E.Message {
+	for depth := 0; msg != nil && depth < maxUnwrapDepth; depth++ {
+		switch {
+		case msg.GetDeviceSentMessage().GetMessage() != nil:
+			msg = msg.GetDeviceSentMessage().GetMessage()
+		case msg.GetEphemeralMessage().GetMessage() != nil:
+			msg = msg.GetEphemeralMessage().GetMessage()
+			payload.Ephemeral = true
+		case msg.GetViewOnceMessage().GetMessage() != nil:
+			msg = msg.GetViewOnceMessage().GetMessage()
+			payload.ViewOnce = true
+		case msg.GetViewOnceMessageV2().GetMessage() != nil:
+			msg = msg.GetViewOnceMessageV2().GetMessage()
+			payload.ViewOnce = true
+		case msg.GetViewOnceMessageV2Extension().GetMessage() != nil:
+			msg = msg.GetViewOnceMessageV2Extension().GetMessage()
+			payload.ViewOnce = true
+		case msg.GetDocumentWithCaptionMessage().GetMessage() != nil:
+			msg = msg.GetDocumentWithCaptionMessage().GetMessage()
+		case msg.GetEditedMessage().GetMessage() != nil:
+			msg = msg.GetEditedMessage().GetMessage()
+		case msg.GetBotInvokeMessage().GetMessage() != nil:
+			msg = msg.GetBotInvokeMessage().GetMessage()
+		case msg.GetLottieStickerMessage().GetMessage() != nil:
+			msg = msg.GetLottieStickerMessage().GetMessage()
+		case msg.GetGroupMentionedMessage().GetMessage() != nil:
+			msg = msg.GetGroupMentionedMessage().GetMessage()
+		default:
+			return msg
+		}
+	}
+	return msg
+}
+
+// formatLocation builds a readable description of a location
+func formatLocation(name, address string, latitude, longitude float64) string {
+	coordinates := fmt.Sprintf("%f,%f", latitude, longitude)
+	switch {
+	case name != "" && address != "":
+		return fmt.Sprintf("%s, %s (%s)", name, address, coordinates)
+	case name != "":
+		return fmt.Sprintf("%s (%s)", name, coordinates)
+	case address != "":
+		return fmt.Sprintf("%s (%s)", address, coordinates)
+	}
+	return coordinates
+}
+
+// getPollCreation returns the poll of a poll creation message in any of its versions
+func getPollCreation(msg *waE2E.Message) *waE2E.PollCreationMessage {
+	switch {
+	case msg.PollCreationMessage != nil:
+		return msg.PollCreationMessage
+	case msg.PollCreationMessageV2 != nil:
+		return msg.PollCreationMessageV2
+	case msg.PollCreationMessageV3 != nil:
+		return msg.PollCreationMessageV3
+	}
+	return nil
+}
+
+// pollOptionNames returns the option names of a poll in order
+func pollOptionNames(poll *waE2E.PollCreationMessage) []string {
+	options := make([]string, 0, len(poll.GetOptions()))
+	for _, option := range poll.GetOptions() {
+		options = append(options, option.GetOptionName())
+	}
+	return options
+}
@@ -0,0 +1,206 @@
+package whatsapp
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"go.mau.fi/whatsmeow/proto/waE2E"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/jaliph/auto-dm/models"
+)
+
+// loadMessageFixture reads a recorded message from testdata/messages
+func loadMessageFixture(t *testing.T, name string) *waE2E.Message {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", "messages", name+".json"))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %v", err)
+	}
+	msg := &waE2E.Message{}
+	if err := protojson.Unmarshal(data, msg); err != nil {
+		t.Fatalf("failed to decode fixture: %v", err)
+	}
+	return msg
+}
+
+func TestDecodeMessage(t *testing.T) {
+	tests := []struct {
+		fixture     string
+		wantType    string
+		wantContent string
+		wantParent  string
+		check       func(t *testing.T, payload *models.MessagePayload)
+	}{
+		{
+			fixture:     "ephemeral_text",
+			wantType:    "text",
+			wantContent: "See you at 5",
+			check: func(t *testing.T, payload *models.MessagePayload) {
+				if payload == nil || !payload.Ephemeral {
+					t.Error("expected the ephemeral wrapper to be recorded")
+				}
+			},
+		},
+		{
+			fixture:     "view_once_image",
+			wantType:    "image",
+			wantContent: "Only once",
+			check: func(t *testing.T, payload *models.MessagePayload) {
+				if payload == nil || !payload.ViewOnce {
+					t.Fatal("expected the view-once wrapper to be recorded")
+				}
+				if payload.MimeType != "image/jpeg" || payload.Width != 1080 || payload.Height != 1920 {
+					t.Errorf("unexpected image fields: %+v", payload)
+				}
+			},
+		},
+		{
+			fixture:     "edit",
+			wantType:    "edit",
+			wantContent: "Meeting moved to 6",
+			wantParent:  "3EB0C431D2A7E1F5A9B2",
+		},
+		{
+			fixture:    "revoke",
+			wantType:   "revoke",
+			wantParent: "3EB0A1B2C3D4E5F60718",
+		},
+		{
+			fixture:     "reaction",
+			wantType:    "reaction",
+			wantContent: "👍",
+			wantParent:  "3EB0F00DBABE12345678",
+		},
+		{
+			fixture:     "document_caption",
+			wantType:    "document",
+			wantContent: "Invoice for October",
+			check: func(t *testing.T, payload *models.MessagePayload) {
+				if payload == nil || payload.FileName != "invoice-42.pdf" || payload.PageCount != 3 {
+					t.Errorf("unexpected document fields: %+v", payload)
+				}
+			},
+		},
+		{
+			fixture:     "document",
+			wantType:    "document",
+			wantContent: "report.csv",
+		},
+		{
+			fixture:     "location",
+			wantType:    "location",
+			wantContent: "Head Office, MG Road, Bengaluru (12.971600,77.594600)",
+			check: func(t *testing.T, payload *models.MessagePayload) {
+				if payload == nil || payload.Latitude == nil || *payload.Latitude != 12.9716 || payload.Longitude == nil || *payload.Longitude != 77.5946 {
+					t.Errorf("unexpected coordinates: %+v", payload)
+				}
+			},
+		},
+		{
+			fixture:     "contact",
+			wantType:    "contact",
+			wantContent: "Asha Rao",
+			check: func(t *testing.T, payload *models.MessagePayload) {
+				if payload == nil || len(payload.VCards) != 1 {
+					t.Errorf("expected one vCard, got %+v", payload)
+				}
+			},
+		},
+		{
+			fixture:     "contacts_array",
+			wantType:    "contacts",
+			wantContent: "2 contacts",
+			check: func(t *testing.T, payload *models.MessagePayload) {
+				if payload == nil || len(payload.VCards) != 2 {
+					t.Errorf("expected two vCards, got %+v", payload)
+				}
+			},
+		},
+		{
+			fixture:     "buttons_response",
+			wantType:    "button_response",
+			wantContent: "Yes, confirm",
+			wantParent:  "3EB0B0770B077ABCDEF0",
+			check: func(t *testing.T, payload *models.MessagePayload) {
+				if payload == nil || payload.SelectedID != "confirm" {
+					t.Errorf("unexpected selection: %+v", payload)
+				}
+			},
+		},
+		{
+			fixture:     "template_button_reply",
+			wantType:    "button_response",
+			wantContent: "Track order",
+			check: func(t *testing.T, payload *models.MessagePayload) {
+				if payload == nil || payload.SelectedID != "track-order" {
+					t.Errorf("unexpected selection: %+v", payload)
+				}
+			},
+		},
+		{
+			fixture:     "list_response",
+			wantType:    "list_response",
+			wantContent: "Large pizza",
+			wantParent:  "3EB0115700112233AABB",
+			check: func(t *testing.T, payload *models.MessagePayload) {
+				if payload == nil || payload.SelectedID != "size-l" {
+					t.Errorf("unexpected selection: %+v", payload)
+				}
+			},
+		},
+		{
+			fixture:     "poll_creation",
+			wantType:    "poll",
+			wantContent: "Lunch?",
+			check: func(t *testing.T, payload *models.MessagePayload) {
+				if payload == nil || !slices.Equal(payload.PollOptions, []string{"Pizza", "Sushi", "Salad"}) || payload.SelectableCount != 1 {
+					t.Errorf("unexpected poll fields: %+v", payload)
+				}
+			},
+		},
+		{
+			fixture:    "poll_update",
+			wantType:   "poll_vote",
+			wantParent: "3EB0P011C0FFEE000001",
+		},
+		{
+			fixture:     "reply_with_mention",
+			wantType:    "text",
+			wantContent: "@919123456780 agreed",
+			wantParent:  "3EB0AB12CD34EF56AB78",
+			check: func(t *testing.T, payload *models.MessagePayload) {
+				if payload == nil || !slices.Equal(payload.Mentions, []string{"919123456780@s.whatsapp.net"}) {
+					t.Errorf("unexpected mentions: %+v", payload)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			decoded := DecodeMessage(loadMessageFixture(t, test.fixture))
+			if decoded.Type != test.wantType {
+				t.Errorf("type = %q, want %q", decoded.Type, test.wantType)
+			}
+			if decoded.Content != test.wantContent {
+				t.Errorf("content = %q, want %q", decoded.Content, test.wantContent)
+			}
+			if decoded.ParentMessageID != test.wantParent {
+				t.Errorf("parent message ID = %q, want %q", decoded.ParentMessageID, test.wantParent)
+			}
+			if test.check != nil {
+				test.check(t, decoded.Payload)
+			}
+		})
+	}
+}
+
+func TestDecodeMessageNil(t *testing.T) {
+	decoded := DecodeMessage(nil)
+	if decoded.Type != "unknown" || decoded.Payload != nil {
+		t.Errorf("unexpected decode of a nil message: %+v", decoded)
+	}
+}
@@ -0,0 +1,157 @@
+package whatsapp
+
+import (
+	"cmp"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waHistorySync"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+
+	"github.com/jaliph/auto-dm/database"
+	"github.com/jaliph/auto-dm/models"
+)
+
+// HistoryImporter imports the past conversations WhatsApp sends after a phone is linked
+type HistoryImporter struct {
+	gormDB         *database.GormDB
+	messageHandler *MessageHandler
+	enabled        bool
+	lookbackDays   int
+	progress       map[string]*models.HistoryImportProgress // phone -> progress
+	mu             sync.RWMutex
+}
+
+// NewHistoryImporter creates a new history importer
+func NewHistoryImporter(gormDB *database.GormDB, messageHandler *MessageHandler, enabled bool, lookbackDays int) *HistoryImporter {
+	return &HistoryImporter{
+		gormDB:         gormDB,
+		messageHandler: messageHandler,
+		enabled:        enabled,
+		lookbackDays:   lookbackDays,
+		progress:       make(map[string]*models.HistoryImportProgress),
+	}
+}
+
+// HandleHistorySync stores the messages of one history sync chunk, skipping
+// messages that are already stored or older than the lookback window. Edits and
+// revokes from an earlier chunk are applied once the message they refer to is stored.
+func (hi *HistoryImporter) HandleHistorySync(client *whatsmeow.Client, evt *events.HistorySync, authenticatedSenderPhone string) {
+	if !hi.enabled {
+		return
+	}
+
+	var cutoff time.Time
+	if hi.lookbackDays > 0 {
+		cutoff = time.Now().AddDate(0, 0, -hi.lookbackDays)
+	}
+
+	var imported, skipped, failed int
+	conversations := evt.Data.GetConversations()
+	for _, conversation := range conversations {
+		chatJID, err := types.ParseJID(conversation.GetID())
+		if err != nil {
+			slog.Warn("Skipping history conversation with invalid JID", "sender", authenticatedSenderPhone, "chat", conversation.GetID(), "error", err)
+			continue
+		}
+
+		// Chunks list the newest messages first, import oldest first so edits,
+		// revokes and reactions find the message they refer to
+		historyMsgs := slices.Clone(conversation.GetMessages())
+		slices.SortStableFunc(historyMsgs, func(a, b *waHistorySync.HistorySyncMsg) int {
+			return cmp.Compare(a.GetMessage().GetMessageTimestamp(), b.GetMessage().GetMessageTimestamp())
+		})
+
+		for _, historyMsg := range historyMsgs {
+			msgEvt, err := client.ParseWebMessage(chatJID, historyMsg.GetMessage())
+			if err != nil {
+				failed++
+				continue
+			}
+
+			if msgEvt.Info.Timestamp.Before(cutoff) || hi.gormDB.MessageExists(msgEvt.Info.ID) {
+				skipped++
+				continue
+			}
+
+			// Imported history is stored without being pushed to live subscribers
+			if _, err := hi.messageHandler.storeMessageEvent(msgEvt, authenticatedSenderPhone); err != nil {
+				slog.Error("Failed to import history message", "sender", authenticatedSenderPhone, "chat", chatJID.String(), "message_id", msgEvt.Info.ID, "error", err)
+				failed++
+				continue
+			}
+			imported++
+		}
+	}
+
+	progress := hi.updateProgress(authenticatedSenderPhone, evt, len(conversations), imported, skipped, failed)
+	slog.Info("Imported history sync chunk",
+		"sender", authenticatedSenderPhone,
+		"chunk", evt.Data.GetChunkOrder(),
+		"sync_type", progress.SyncType,
+		"progress", progress.Progress,
+		"conversations", len(conversations),
+		"imported", imported,
+		"skipped", skipped,
+		"failed", failed)
+}
+
+// updateProgress adds the results of a chunk to the sender's import progress
+func (hi *HistoryImporter) updateProgress(phone string, evt *events.HistorySync, conversations, imported, skipped, failed int) models.HistoryImportProgress {
+	hi.mu.Lock()
+	defer hi.mu.Unlock()
+
+	now := time.Now()
+	progress, exists := hi.progress[phone]
+	if !exists {
+		progress = &models.HistoryImportProgress{
+			Phone:     phone,
+			StartedAt: now,
+		}
+		hi.progress[phone] = progress
+	}
+
+	progress.SyncType = evt.Data.GetSyncType().String()
+	progress.Progress = evt.Data.GetProgress()
+	progress.Chunks++
+	progress.Conversations += conversations
+	progress.Imported += imported
+	progress.Skipped += skipped
+	progress.Failed += failed
+	progress.UpdatedAt = now
+
+	progress.Status = "importing"
+	if progress.Progress >= 100 {
+		progress.Status = "completed"
+	}
+	return *progress
+}
+
+// GetProgress returns the import progress of a sender
+func (hi *HistoryImporter) GetProgress(phone string) (*models.HistoryImportProgress, bool) {
+	hi.mu.RLock()
+	defer hi.mu.RUnlock()
+
+	progress, exists := hi.progress[phone]
+	if !exists {
+		return nil, false
+	}
+	snapshot := *progress
+	return &snapshot, true
+}
+
+// GetAllProgress returns the import progress of all senders
+func (hi *HistoryImporter) GetAllProgress() []models.HistoryImportProgress {
+	hi.mu.RLock()
+	defer hi.mu.RUnlock()
+
+	all := make([]models.HistoryImportProgress, 0, len(hi.progress))
+	for _, progress := range hi.progress {
+		all = append(all, *progress)
+	}
+	return all
+}
@@ -0,0 +1,279 @@
+package whatsapp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/proto/waE2E"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	linkPreviewTimeout      = 10 * time.Second
+	linkPreviewMaxPageSize  = 512 * 1024
+	linkPreviewMaxThumbSize = 100 * 1024
+)
+
+var (
+	linkPattern      = regexp.MustCompile(`https?://[^\s]+`)
+	titlePattern     = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	metaTagPattern   = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	metaAttrPattern  = regexp.MustCompile(`(?is)(property|name|content)\s*=\s*("[^"]*"|'[^']*')`)
+	linkPreviewAgent = "Mozilla/5.0 (compatible; auto-dm link preview)"
+)
+
+// linkPreviewMaxRedirects bounds the redirects followed for one preview resource
+const linkPreviewMaxRedirects = 5
+
+// linkPreviewHTTP fetches preview pages and thumbnails. The links come from
+// API callers and the pages they point to, and what is fetched is sent on to
+// the recipient, so only public addresses are dialed. The check runs on the
+// resolved address of every connection, redirects included, so DNS names
+// that point inward are refused too. Proxies are not used, since they would
+// dial on our behalf.
+var linkPreviewHTTP = &http.Client{
+	Timeout: linkPreviewTimeout,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: linkPreviewTimeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				return checkLinkPreviewAddress(address)
+			},
+		}).DialContext,
+		TLSHandshakeTimeout:   linkPreviewTimeout,
+		ResponseHeaderTimeout: linkPreviewTimeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= linkPreviewMaxRedirects {
+			return errors.New("too many redirects")
+		}
+		return checkLinkPreviewURL(req.Context(), req.URL)
+	},
+}
+
+// nonPublicPrefixes are ranges that net/netip does not classify as private,
+// loopback or link-local but that are not reachable on the public internet
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),      // this network
+	netip.MustParsePrefix("100.64.0.0/10"),  // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),   // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"),  // benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),    // reserved, and broadcast
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64, can embed any IPv4 address
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+	netip.MustParsePrefix("2001:db8::/32"),  // documentation
+	netip.MustParsePrefix("fec0::/10"),      // deprecated site-local
+}
+
+// publicAddress reports whether a link preview may connect to ip: not
+// loopback, private, link-local (which includes cloud metadata services),
+// multicast or otherwise reserved
+func publicAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsValid() || ip.IsUnspecified() || ip.IsLoopback() || ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkLinkPreviewAddress refuses a resolved ip:port that is not public
+func checkLinkPreviewAddress(address string) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %s: %v", address, err)
+	}
+	if !publicAddress(addrPort.Addr()) {
+		return fmt.Errorf("refusing to fetch link preview from non-public address %s", addrPort.Addr().Unmap())
+	}
+	return nil
+}
+
+// checkLinkPreviewURL refuses URLs that are not http or https, or whose host
+// resolves to a non-public address. The dialer checks the address it
+// actually connects to as well, this check fails early and with a clearer error.
+func checkLinkPreviewURL(ctx context.Context, link *url.URL) error {
+	if link.Scheme != "http" && link.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", link.Scheme)
+	}
+	host := link.Hostname()
+	if host == "" {
+		return errors.New("link has no host")
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if !publicAddress(ip) {
+			return fmt.Errorf("refusing to fetch link preview from non-public address %s", ip)
+		}
+		return nil
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if !publicAddress(ip) {
+			return fmt.Errorf("refusing to fetch link preview from %s, it resolves to non-public address %s", host, ip.Unmap())
+		}
+	}
+	return nil
+}
+
+// findLink returns the first link in text, without the punctuation that
+// usually follows a link in a sentence. A closing bracket is only kept when
+// the link opened it, as in Wikipedia links.
+func findLink(text string) string {
+	link := linkPattern.FindString(text)
+	for link != "" {
+		last := link[len(link)-1]
+		switch {
+		case strings.IndexByte(".,;:!?'\"", last) >= 0:
+		case last == ')' && strings.Count(link, "(") < strings.Count(link, ")"):
+		case last == ']' && strings.Count(link, "[") < strings.Count(link, "]"):
+		case last == '}' || last == '>':
+		default:
+			return link
+		}
+		link = link[:len(link)-1]
+	}
+	return link
+}
+
+// addLinkPreview fetches the first link in the text and fills in the preview fields.
+// The text is still sent if the page cannot be fetched, just without a title or thumbnail.
+func addLinkPreview(ctx context.Context, msg *waProto.ExtendedTextMessage) {
+	link := findLink(msg.GetText())
+	if link == "" {
+		return
+	}
+	msg.MatchedText = proto.String(link)
+	msg.PreviewType = waProto.ExtendedTextMessage_NONE.Enum()
+
+	pageURL, err := url.Parse(link)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to fetch link preview", "link", link, "error", err)
+		return
+	}
+	page, _, pageURL, err := fetchLinkPreviewResource(ctx, pageURL, linkPreviewMaxPageSize)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to fetch link preview", "link", link, "error", err)
+		return
+	}
+
+	meta := parseMetaTags(page)
+	title := meta["og:title"]
+	if title == "" {
+		if match := titlePattern.FindStringSubmatch(page); match != nil {
+			title = strings.TrimSpace(html.UnescapeString(match[1]))
+		}
+	}
+	if title != "" {
+		msg.Title = proto.String(title)
+	}
+
+	description := meta["og:description"]
+	if description == "" {
+		description = meta["description"]
+	}
+	if description != "" {
+		msg.Description = proto.String(description)
+	}
+
+	if image := meta["og:image"]; image != "" {
+		// og:image may be relative to the page it is on
+		imageURL, err := pageURL.Parse(image)
+		if err == nil {
+			var thumbnail, contentType string
+			// One byte over the limit tells a large image from one that fits,
+			// a cut off JPEG would be attached as a broken thumbnail
+			thumbnail, contentType, _, err = fetchLinkPreviewResource(ctx, imageURL, linkPreviewMaxThumbSize+1)
+			switch {
+			case err != nil || contentType != "image/jpeg":
+			case len(thumbnail) > linkPreviewMaxThumbSize:
+				slog.DebugContext(ctx, "Link preview image is too large for a thumbnail", "link", image)
+			default:
+				msg.JPEGThumbnail = []byte(thumbnail)
+			}
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "Failed to fetch link preview image", "link", image, "error", err)
+		}
+	}
+}
+
+// fetchLinkPreviewResource downloads at most maxSize bytes from a public URL.
+// It returns the body, its content type and the URL it was served from after
+// redirects.
+func fetchLinkPreviewResource(ctx context.Context, link *url.URL, maxSize int64) (string, string, *url.URL, error) {
+	if err := checkLinkPreviewURL(ctx, link); err != nil {
+		return "", "", nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link.String(), nil)
+	if err != nil {
+		return "", "", nil, err
+	}
+	req.Header.Set("User-Agent", linkPreviewAgent)
+
+	resp, err := linkPreviewHTTP.Do(req)
+	if err != nil {
+		return "", "", nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSize))
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return string(body), strings.TrimSpace(contentType), resp.Request.URL, nil
+}
+
+// parseMetaTags collects the property/name -> content pairs of the page's meta tags
+func parseMetaTags(page string) map[string]string {
+	meta := make(map[string]string)
+	for _, tag := range metaTagPattern.FindAllString(page, -1) {
+		var key, content string
+		for _, attr := range metaAttrPattern.FindAllStringSubmatch(tag, -1) {
+			value := html.UnescapeString(strings.Trim(attr[2], `"'`))
+			switch strings.ToLower(attr[1]) {
+			case "property", "name":
+				key = strings.ToLower(value)
+			case "content":
+				content = strings.TrimSpace(value)
+			}
+		}
+		if key != "" && content != "" {
+			if _, exists := meta[key]; !exists {
+				meta[key] = content
+			}
+		}
+	}
+	return meta
+}
@@ -1,31 +1,51 @@
 package whatsapp
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
-	"go.mau.fi/whatsmeow/proto/waE2E"
+	"go.mau.fi/whatsmeow"
 	"go.mau.fi/whatsmeow/types/events"
 
 	"github.com/jaliph/auto-dm/database"
+	"github.com/jaliph/auto-dm/eventbus"
+	"github.com/jaliph/auto-dm/metrics"
 	"github.com/jaliph/auto-dm/models"
 )
 
 // MessageHandler handles WhatsApp message events and stores them in the database
 type MessageHandler struct {
-	gormDB *database.GormDB
+	gormDB   *database.GormDB
+	eventBus *eventbus.Bus
 }
 
 // NewMessageHandler creates a new message handler
-func NewMessageHandler(gormDB *database.GormDB) *MessageHandler {
+func NewMessageHandler(gormDB *database.GormDB, eventBus *eventbus.Bus) *MessageHandler {
 	return &MessageHandler{
-		gormDB: gormDB,
+		gormDB:   gormDB,
+		eventBus: eventBus,
 	}
 }
 
-// HandleMessageEvent processes a WhatsApp message event
+// HandleMessageEvent processes a WhatsApp message event and pushes it to live subscribers
 func (mh *MessageHandler) HandleMessageEvent(evt *events.Message, authenticatedSenderPhone string) error {
+	message, err := mh.storeMessageEvent(evt, authenticatedSenderPhone)
+	if err != nil || message == nil {
+		return err
+	}
+
+	if !message.IsFromMe {
+		metrics.MessagesReceived.WithLabelValues(message.MessageType).Inc()
+	}
+	mh.eventBus.Publish(models.EventMessage, authenticatedSenderPhone, message)
+	return nil
+}
+
+// storeMessageEvent stores a WhatsApp message event. It returns nil if the
+// message was already stored or carries no conversation content.
+func (mh *MessageHandler) storeMessageEvent(evt *events.Message, authenticatedSenderPhone string) (*models.Message, error) {
 	// Determine the actual sender and recipient based on the message direction
 	var senderPhone, recipientPhone string
 
@@ -39,83 +59,117 @@ func (mh *MessageHandler) HandleMessageEvent(evt *events.Message, authenticatedS
 		recipientPhone = authenticatedSenderPhone
 	}
 
+	// Skip messages that were already stored (e.g. redelivered after a reconnect)
+	if mh.gormDB.MessageExists(evt.Info.ID) {
+		return nil, nil
+	}
+
+	// Unwrap and decode the message content
+	decoded := DecodeMessage(evt.Message)
+
 	// Create message model
 	message := &models.Message{
-		SenderPhone:    senderPhone,
-		RecipientPhone: recipientPhone,
-		MessageType:    mh.getMessageType(evt.Message),
-		Content:        mh.getMessageContent(evt.Message),
-		MediaURL:       mh.getMediaURL(evt.Message),
-		Timestamp:      time.Unix(evt.Info.Timestamp.Unix(), 0),
-		IsFromMe:       evt.Info.IsFromMe,
-		ChatID:         evt.Info.Chat.String(),
-		MessageID:      evt.Info.ID,
+		SenderPhone:     senderPhone,
+		RecipientPhone:  recipientPhone,
+		MessageType:     decoded.Type,
+		Content:         decoded.Content,
+		MediaURL:        decoded.MediaURL,
+		Timestamp:       time.Unix(evt.Info.Timestamp.Unix(), 0),
+		IsFromMe:        evt.Info.IsFromMe,
+		ChatID:          evt.Info.Chat.String(),
+		MessageID:       evt.Info.ID,
+		ParentMessageID: decoded.ParentMessageID,
+		Payload:         decoded.Payload,
+	}
+
+	// Edits, revokes and reactions refer to an earlier message
+	switch message.MessageType {
+	case "edit", "revoke", "reaction":
+		if err := mh.gormDB.StoreFollowUpMessage(message); err != nil {
+			return nil, fmt.Errorf("failed to store %s: %v", message.MessageType, err)
+		}
+		slog.Debug("Stored follow-up message",
+			"sender", authenticatedSenderPhone,
+			"chat", message.ChatID,
+			"type", message.MessageType,
+			"target_id", message.ParentMessageID)
+		return message, nil
+	case "protocol", "poll_vote":
+		// Poll votes go through HandlePollUpdate, other protocol messages (history sync
+		// notifications, key shares, ...) are not conversation content
+		return nil, nil
 	}
 
 	// Store message in database
 	if err := mh.gormDB.StoreMessage(message); err != nil {
-		return fmt.Errorf("failed to store message: %v", err)
+		return nil, fmt.Errorf("failed to store message: %v", err)
 	}
 
-	log.Printf("Stored message from %s to %s: %s (IsFromMe: %v)",
-		message.SenderPhone, message.RecipientPhone, message.Content, evt.Info.IsFromMe)
+	// Keep the options of incoming polls so their votes can be tallied
+	if poll := getPollCreation(decoded.Message); poll != nil {
+		if err := mh.gormDB.StorePoll(&models.Poll{
+			MessageID:       message.MessageID,
+			ChatID:          message.ChatID,
+			SenderPhone:     message.SenderPhone,
+			Question:        poll.GetName(),
+			Options:         pollOptionNames(poll),
+			SelectableCount: int(poll.GetSelectableOptionsCount()),
+		}); err != nil {
+			slog.Warn("Failed to store poll", "sender", authenticatedSenderPhone, "chat", message.ChatID, "message_id", message.MessageID, "error", err)
+		}
+	}
 
-	return nil
-}
+	slog.Debug("Stored message",
+		"sender", authenticatedSenderPhone,
+		"chat", message.ChatID,
+		"type", message.MessageType,
+		"from_me", message.IsFromMe,
+		"content_length", len(message.Content))
 
-// getMessageType determines the type of message
-func (mh *MessageHandler) getMessageType(msg *waE2E.Message) string {
-	if msg.Conversation != nil {
-		return "text"
-	}
-	if msg.ImageMessage != nil {
-		return "image"
-	}
-	if msg.VideoMessage != nil {
-		return "video"
-	}
-	if msg.AudioMessage != nil {
-		return "audio"
-	}
-	if msg.DocumentMessage != nil {
-		return "document"
-	}
-	if msg.StickerMessage != nil {
-		return "sticker"
-	}
-	if msg.ContactMessage != nil {
-		return "contact"
-	}
-	if msg.LocationMessage != nil {
-		return "location"
-	}
-	return "unknown"
+	return message, nil
 }
 
-// getMessageContent extracts the text content from a message
-func (mh *MessageHandler) getMessageContent(msg *waE2E.Message) string {
-	if msg.Conversation != nil {
-		return *msg.Conversation
+// HandlePollUpdate decrypts a poll vote and stores it as the voter's current selection
+func (mh *MessageHandler) HandlePollUpdate(client *whatsmeow.Client, evt *events.Message, authenticatedSenderPhone string) error {
+	pollMessageID := evt.Message.GetPollUpdateMessage().GetPollCreationMessageKey().GetID()
+
+	poll, err := mh.gormDB.GetPoll(pollMessageID)
+	if err != nil {
+		return fmt.Errorf("failed to get poll for vote: %v", err)
 	}
-	if msg.ExtendedTextMessage != nil && msg.ExtendedTextMessage.Text != nil {
-		return *msg.ExtendedTextMessage.Text
+
+	vote, err := client.DecryptPollVote(context.Background(), evt)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt poll vote: %v", err)
 	}
-	return ""
-}
 
-// getMediaURL extracts media URL from a message
-func (mh *MessageHandler) getMediaURL(msg *waE2E.Message) string {
-	if msg.ImageMessage != nil && msg.ImageMessage.URL != nil {
-		return *msg.ImageMessage.URL
+	// Votes only carry SHA-256 hashes of the selected option names
+	optionsByHash := make(map[string]string, len(poll.Options))
+	for i, hash := range whatsmeow.HashPollOptions(poll.Options) {
+		optionsByHash[string(hash)] = poll.Options[i]
 	}
-	if msg.VideoMessage != nil && msg.VideoMessage.URL != nil {
-		return *msg.VideoMessage.URL
+
+	selected := []string{}
+	for _, hash := range vote.GetSelectedOptions() {
+		if option, ok := optionsByHash[string(hash)]; ok {
+			selected = append(selected, option)
+		}
 	}
-	if msg.AudioMessage != nil && msg.AudioMessage.URL != nil {
-		return *msg.AudioMessage.URL
+
+	voterPhone := evt.Info.Sender.User
+	if evt.Info.IsFromMe {
+		voterPhone = authenticatedSenderPhone
 	}
-	if msg.DocumentMessage != nil && msg.DocumentMessage.URL != nil {
-		return *msg.DocumentMessage.URL
+
+	if err := mh.gormDB.StorePollVote(&models.PollVote{
+		PollMessageID:   pollMessageID,
+		VoterPhone:      voterPhone,
+		SelectedOptions: selected,
+		Timestamp:       time.Unix(evt.Info.Timestamp.Unix(), 0),
+	}); err != nil {
+		return fmt.Errorf("failed to store poll vote: %v", err)
 	}
-	return ""
+
+	slog.Debug("Stored poll vote", "sender", authenticatedSenderPhone, "chat", evt.Info.Chat.String(), "voter", voterPhone, "poll_id", pollMessageID)
+	return nil
 }
@@ -5,11 +5,13 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"sync"
 	"time"
 
+	"github.com/jaliph/auto-dm/metrics"
 	"github.com/jaliph/auto-dm/models"
 	"github.com/skip2/go-qrcode"
 	"go.mau.fi/whatsmeow"
@@ -22,7 +24,8 @@ type QRCodeSession struct {
 	QRCode    string
 	ExpiresAt time.Time
 	Client    *whatsmeow.Client
-	Status    string // "pending", "authenticated", "expired"
+	Status    string             // "pending", "authenticated", "expired"
+	cancel    context.CancelFunc // stops QR code generation
 	mu        sync.RWMutex
 }
 
@@ -32,6 +35,8 @@ type QRManager struct {
 	mu               sync.RWMutex
 	db               Database
 	userStoreManager UserStoreManager
+	registrar        ClientRegistrar
+	publisher        EventPublisher
 }
 
 // Database interface for QR manager
@@ -53,12 +58,24 @@ type UserStoreManager interface {
 	CloseAll()
 }
 
+// ClientRegistrar interface for QR manager
+type ClientRegistrar interface {
+	RegisterClient(phone string, client *whatsmeow.Client)
+}
+
+// EventPublisher interface for QR manager
+type EventPublisher interface {
+	Publish(eventType, sender string, data interface{})
+}
+
 // NewQRManager creates a new QR code manager
-func NewQRManager(db Database, userStoreManager UserStoreManager) *QRManager {
+func NewQRManager(db Database, userStoreManager UserStoreManager, registrar ClientRegistrar, publisher EventPublisher) *QRManager {
 	return &QRManager{
 		sessions:         make(map[string]*QRCodeSession),
 		db:               db,
 		userStoreManager: userStoreManager,
+		registrar:        registrar,
+		publisher:        publisher,
 	}
 }
 
@@ -98,15 +115,19 @@ func (qm *QRManager) CreateQRCodeSessionWithContext(ctx context.Context, phone s
 		if sender.Status == "authenticated" {
 			return nil, fmt.Errorf("sender %s is already authenticated", phone)
 		}
+		// A paused sender is still linked, linking a second device would orphan the first
+		if sender.Status == "paused" && sender.DeviceID != "" {
+			return nil, fmt.Errorf("sender %s is paused, resume it instead", phone)
+		}
 
 		// For failed senders, we'll reuse the existing record but update the status
-		log.Printf("Re-registering failed sender %s (previous status: %s)", phone, sender.Status)
+		slog.InfoContext(ctx, "Re-registering failed sender", "sender", phone, "previous_status", sender.Status)
 		if err := qm.db.UpdateSenderStatus(phone, "pending"); err != nil {
 			return nil, fmt.Errorf("failed to update sender status: %v", err)
 		}
 
 		// Remove any existing sessions for this phone number
-		qm.removeSessionsForPhone(phone)
+		qm.RemoveSessionsForPhone(phone)
 	} else {
 		// Create new sender record
 		if err := qm.db.CreateSender(phone); err != nil {
@@ -134,21 +155,30 @@ func (qm *QRManager) CreateQRCodeSessionWithContext(ctx context.Context, phone s
 	}
 
 	// Create session
+	expiresAt := time.Now().Add(time.Duration(expiryMinutes) * time.Minute)
+	// QR code generation outlives the request that created the session, so
+	// it is bounded by the session expiry instead
+	genCtx, cancel := context.WithDeadline(context.Background(), expiresAt)
 	session := &QRCodeSession{
 		Phone:     phone,
 		Token:     token,
-		ExpiresAt: time.Now().Add(time.Duration(expiryMinutes) * time.Minute),
+		ExpiresAt: expiresAt,
 		Client:    client,
 		Status:    "pending",
+		cancel:    cancel,
 	}
 
 	// Store session
 	qm.mu.Lock()
 	qm.sessions[token] = session
 	qm.mu.Unlock()
+	metrics.QRSessions.WithLabelValues("created").Inc()
 
-	// Start QR code generation in background with context
-	go qm.generateQRCodeWithContext(ctx, session)
+	// Start QR code generation in background
+	go func() {
+		defer cancel()
+		qm.generateQRCodeWithContext(genCtx, session)
+	}()
 
 	return session, nil
 }
@@ -160,14 +190,18 @@ func (qm *QRManager) CreateQRCodeSession(phone string, baseURL string, expiryMin
 
 // generateQRCodeWithContext generates QR code for a session with context support
 func (qm *QRManager) generateQRCodeWithContext(ctx context.Context, session *QRCodeSession) {
-	log.Printf("Starting QR code generation for %s", session.Phone)
+	slog.Info("Starting QR code generation", "sender", session.Phone)
 
 	// Get QR channel with context
 	qrChan, _ := session.Client.GetQRChannel(ctx)
 
+	// Register handlers before connecting so messages and the initial
+	// history sync sent right after linking are not missed
+	qm.registrar.RegisterClient(session.Phone, session.Client)
+
 	// Connect client
 	if err := session.Client.Connect(); err != nil {
-		log.Printf("Failed to connect client for %s: %v", session.Phone, err)
+		slog.Error("Failed to connect client", "sender", session.Phone, "error", err)
 		qm.updateSessionStatus(session, "expired")
 		return
 	}
@@ -181,40 +215,37 @@ func (qm *QRManager) generateQRCodeWithContext(ctx context.Context, session *QRC
 				return
 			}
 
-			session.mu.Lock()
 			switch evt.Event {
 			case "code":
+				session.mu.Lock()
 				session.QRCode = evt.Code
 				session.Status = "pending"
-				log.Printf("QR code generated for %s", session.Phone)
+				session.mu.Unlock()
+				slog.Info("QR code generated", "sender", session.Phone)
+				qm.publishSession(session)
 
 			case "timeout":
-				session.Status = "expired"
-				log.Printf("QR code timed out for %s", session.Phone)
+				slog.Info("QR code timed out", "sender", session.Phone)
 				qm.updateSessionStatus(session, "expired")
-				session.mu.Unlock()
 				return
 
 			case "success":
-				session.Status = "authenticated"
-				log.Printf("Authentication successful for %s", session.Phone)
+				slog.Info("Authentication successful", "sender", session.Phone)
 
 				// Update database
 				if session.Client.Store.ID != nil {
 					qm.db.UpdateSenderDeviceID(session.Phone, session.Client.Store.ID.String())
 				}
 				qm.updateSessionStatus(session, "authenticated")
-				session.mu.Unlock()
 				return
 			}
-			session.mu.Unlock()
 
 		case <-ctx.Done():
-			log.Printf("QR code generation cancelled for %s: %v", session.Phone, ctx.Err())
-			session.mu.Lock()
-			session.Status = "expired"
-			session.mu.Unlock()
-			qm.updateSessionStatus(session, "expired")
+			slog.Info("QR code generation cancelled", "sender", session.Phone, "reason", ctx.Err())
+			// A removed session leaves the sender's status to whoever removed it
+			if !errors.Is(ctx.Err(), context.Canceled) {
+				qm.updateSessionStatus(session, "expired")
+			}
 			return
 		}
 	}
@@ -225,22 +256,50 @@ func (qm *QRManager) generateQRCode(session *QRCodeSession) {
 	qm.generateQRCodeWithContext(context.Background(), session)
 }
 
-// updateSessionStatus updates the session status and database
+// updateSessionStatus updates the session status and database.
+// The caller must not hold the session lock.
 func (qm *QRManager) updateSessionStatus(session *QRCodeSession, status string) {
 	session.mu.Lock()
+	changed := session.Status != status
 	session.Status = status
 	session.mu.Unlock()
 
+	// Expiry can be noticed more than once, count each session only on its change
+	if changed && status != "pending" {
+		metrics.QRSessions.WithLabelValues(status).Inc()
+	}
+
 	// Update database
 	if err := qm.db.UpdateSenderStatus(session.Phone, status); err != nil {
-		log.Printf("Failed to update sender status for %s: %v", session.Phone, err)
+		slog.Error("Failed to update sender status", "sender", session.Phone, "status", status, "error", err)
+	}
+	qm.publishSession(session)
+}
+
+// publishSession pushes the current code and status of a session to live subscribers
+func (qm *QRManager) publishSession(session *QRCodeSession) {
+	qm.publisher.Publish(models.EventQR, session.Phone, session.State())
+}
+
+// State returns the current code and status of the session. The code is only
+// included while the session is still waiting to be scanned.
+func (session *QRCodeSession) State() *models.QREvent {
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+
+	state := &models.QREvent{
+		Token:     session.Token,
+		Status:    session.Status,
+		ExpiresAt: session.ExpiresAt,
+	}
+	if state.Status == "pending" {
+		state.QRCode = session.QRCode
 	}
+	return state
 }
 
 // GetQRCodeWithContext retrieves the QR code for a given token with context support
 func (qm *QRManager) GetQRCodeWithContext(ctx context.Context, token string) (*QRCodeSession, error) {
-	log.Printf("DEBUG: GetQRCodeWithContext called with token: %s", token)
-
 	// Check if context is cancelled
 	select {
 	case <-ctx.Done():
@@ -252,32 +311,28 @@ func (qm *QRManager) GetQRCodeWithContext(ctx context.Context, token string) (*Q
 	session, exists := qm.sessions[token]
 	qm.mu.RUnlock()
 
-	log.Printf("DEBUG: Session exists: %v", exists)
 	if !exists {
-		log.Printf("DEBUG: Session not found for token: %s", token)
 		return nil, fmt.Errorf("session not found")
 	}
 
-	log.Printf("DEBUG: Found session for phone: %s, status: %s, expires at: %v",
-		session.Phone, session.Status, session.ExpiresAt)
-
-	session.mu.RLock()
-	defer session.mu.RUnlock()
-
 	// Check if session is expired
-	now := time.Now()
-	log.Printf("DEBUG: Current time: %v, Expires at: %v", now, session.ExpiresAt)
-	if now.After(session.ExpiresAt) {
-		log.Printf("DEBUG: Session expired for token: %s", token)
-		session.Status = "expired"
+	if time.Now().After(session.ExpiresAt) {
 		qm.updateSessionStatus(session, "expired")
 		return nil, fmt.Errorf("QR code session expired")
 	}
 
-	log.Printf("DEBUG: Session is valid, returning session")
 	return session, nil
 }
 
+// GetSession returns the session for a token, including expired sessions that were not cleaned up yet
+func (qm *QRManager) GetSession(token string) (*QRCodeSession, bool) {
+	qm.mu.RLock()
+	defer qm.mu.RUnlock()
+
+	session, exists := qm.sessions[token]
+	return session, exists
+}
+
 // GetQRCode retrieves the QR code for a given token (legacy method)
 func (qm *QRManager) GetQRCode(token string) (*QRCodeSession, error) {
 	return qm.GetQRCodeWithContext(context.Background(), token)
@@ -291,19 +346,31 @@ func (qm *QRManager) CleanupExpiredSessions() {
 	now := time.Now()
 	for token, session := range qm.sessions {
 		if now.After(session.ExpiresAt) {
-			session.Status = "expired"
-			qm.updateSessionStatus(session, "expired")
+			session.mu.RLock()
+			authenticated := session.Status == "authenticated"
+			session.mu.RUnlock()
+
+			// Linked senders keep their status, only their session is dropped
+			if !authenticated {
+				qm.updateSessionStatus(session, "expired")
+			}
 			delete(qm.sessions, token)
 		}
 	}
 }
 
-// StartCleanup starts periodic cleanup of expired sessions
-func (qm *QRManager) StartCleanup() {
+// StartCleanup starts periodic cleanup of expired sessions until ctx is cancelled
+func (qm *QRManager) StartCleanup(ctx context.Context) {
 	ticker := time.NewTicker(5 * time.Minute)
 	go func() {
-		for range ticker.C {
-			qm.CleanupExpiredSessions()
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				qm.CleanupExpiredSessions()
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 }
@@ -321,15 +388,19 @@ func (qm *QRManager) GetSessionByPhone(phone string) *QRCodeSession {
 	return nil
 }
 
-// removeSessionsForPhone removes all sessions for a specific phone number
-func (qm *QRManager) removeSessionsForPhone(phone string) {
+// RemoveSessionsForPhone removes all sessions for a specific phone number and
+// stops their QR code generation
+func (qm *QRManager) RemoveSessionsForPhone(phone string) {
 	qm.mu.Lock()
 	defer qm.mu.Unlock()
 
 	for token, session := range qm.sessions {
 		if session.Phone == phone {
+			if session.cancel != nil {
+				session.cancel()
+			}
 			delete(qm.sessions, token)
-			log.Printf("Removed existing session for phone %s", phone)
+			slog.Info("Removed existing QR session", "sender", phone)
 		}
 	}
 }
@@ -0,0 +1,38 @@
+package whatsapp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jaliph/auto-dm/models"
+)
+
+// BuildVCard builds a vCard 3.0 string that WhatsApp renders as a contact card.
+// The waid parameter lets WhatsApp link the card to the contact's account.
+func BuildVCard(contact *models.ContactCard) string {
+	phone := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, contact.Phone)
+
+	var b strings.Builder
+	b.WriteString("BEGIN:VCARD\n")
+	b.WriteString("VERSION:3.0\n")
+	fmt.Fprintf(&b, "FN:%s\n", escapeVCardValue(contact.Name))
+	if contact.Organization != "" {
+		fmt.Fprintf(&b, "ORG:%s;\n", escapeVCardValue(contact.Organization))
+	}
+	fmt.Fprintf(&b, "TEL;type=CELL;type=VOICE;waid=%s:+%s\n", phone, phone)
+	if contact.Email != "" {
+		fmt.Fprintf(&b, "EMAIL:%s\n", escapeVCardValue(contact.Email))
+	}
+	b.WriteString("END:VCARD")
+	return b.String()
+}
+
+// escapeVCardValue escapes characters with a special meaning in vCard values
+func escapeVCardValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(value)
+}